@@ -0,0 +1,450 @@
+// Assembler for sectioned assembly files:
+//
+//	assembly	= format, [ architecture ], { section }-
+//	format		= "format", name, { option }, newline
+//	architecture	= "architecture", name, { option }, newline
+//	section		= "section", name, [ architecture-name ], { option }, newline,
+//			  { [ label, ":" ], [ statement ], newline }
+//	option		= key, "=", value
+//
+// The format is bin, for flat binaries, or elf.  Each section is assembled by
+// its architecture, or the default declared after the format; options of a
+// section line are those of its format, followed by those of its
+// architecture.  Statements refer to labels with label expressions: a label
+// of the statement's own section by its name, and that of another section as
+// section.label.
+package asm
+
+import (
+	debug "debug/elf"
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/lib/os/elf"
+	"github.com/vvanpo/system/lang/lib/os/flat"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// An Architecture parses the statements of its sections
+type Architecture interface {
+	Parse(statement string) (Statement, error)
+}
+
+// A Statement is encoded once the addresses of labels are known.  Its length
+// may depend on them.
+type Statement interface {
+	Encode(pc uint64, s *Scope) ([]byte, error)
+}
+
+var architectures = map[string]func(options map[string]string) (Architecture, error){
+	"data": newData,
+}
+
+// Register makes an architecture available to sections by name
+func Register(name string, create func(options map[string]string) (Architecture, error)) {
+	architectures[name] = create
+}
+
+// Format options, and those of its sections
+var formatOptions = map[string][]string{
+	"bin": {"origin", "length", "fill"},
+	"elf": {"machine", "endian", "entry", "stack"},
+}
+
+var sectionOptions = map[string][]string{
+	"bin": {"align", "start"},
+	"elf": {},
+}
+
+// The sections of an elf file are its segments
+var elfSegment = map[string]lang.Segment{
+	"code": lang.CodeSegment,
+	"data": lang.DataSegment,
+}
+
+type line struct {
+	number    int
+	statement Statement
+}
+
+type section struct {
+	name    string
+	options map[string]string
+	lines   []line
+	labels  map[string]int // Index of the line each label precedes
+	order   []string       // Labels in order of definition
+	data    []byte
+	starts  []uint64 // Offset of each line, and of the end of the section
+}
+
+// A Scope evaluates label expressions for the statements of a section
+type Scope struct {
+	section string
+	labels  map[string]uint64 // Addresses by qualified name
+	partial bool              // Labels may not all be placed yet
+}
+
+// Eval evaluates a label expression
+func (s *Scope) Eval(e *Expr) (int64, error) {
+	return e.Eval(func(name string) (int64, error) {
+		if !strings.Contains(name, ".") {
+			name = s.section + "." + name
+		}
+		a, ok := s.labels[name]
+		if !ok && !s.partial {
+			return 0, fmt.Errorf("undefined label %s", name)
+		}
+		return int64(a), nil
+	})
+}
+
+// Passes after which labels must have settled
+const maxPasses = 64
+
+// Assemble assembles a source file into an image of its format, and returns
+// a map of its sections and labels, which are named section.label.  Labels
+// are resolved in passes: the first places them assuming those not yet
+// defined are zero, and later passes encode the statements with the labels
+// of the previous pass, until the labels no longer move.  Labels of bin
+// sections are absolute addresses, while those of elf sections, which may be
+// code and data, are offsets into their segment.
+func Assemble(source string) (image []byte, m flat.Map, err error) {
+	format, fopts, sections, err := parse(source)
+	if err != nil {
+		return
+	}
+	var c flat.Config
+	if format == "bin" {
+		if c, err = binConfig(fopts); err != nil {
+			return
+		}
+	}
+	labels, bases := make(map[string]uint64), make(map[string]uint64)
+	for pass := 0; ; pass++ {
+		if pass == maxPasses {
+			return nil, nil, errors.New("asm: labels do not settle")
+		}
+		var fs []flat.Section
+		for _, s := range sections {
+			// Statements are encoded at the address the section had in
+			// the previous pass
+			s.data, s.starts = nil, nil
+			scope := &Scope{s.name, labels, pass == 0}
+			for _, l := range s.lines {
+				s.starts = append(s.starts, uint64(len(s.data)))
+				b, err := l.statement.Encode(bases[s.name]+uint64(len(s.data)), scope)
+				if err != nil {
+					return nil, nil, fmt.Errorf("asm: line %d: %v", l.number, err)
+				}
+				s.data = append(s.data, b...)
+			}
+			s.starts = append(s.starts, uint64(len(s.data)))
+			f, err := binSection(s, format)
+			if err != nil {
+				return nil, nil, err
+			}
+			fs = append(fs, f)
+		}
+		next := make(map[string]uint64)
+		nextBases := make(map[string]uint64)
+		if format == "bin" {
+			if nextBases, err = flat.Place(fs, c); err != nil {
+				return nil, nil, fmt.Errorf("asm: %v", err)
+			}
+		}
+		for _, s := range sections {
+			for _, name := range s.order {
+				next[s.name+"."+name] = nextBases[s.name] + s.starts[s.labels[name]]
+			}
+		}
+		if pass > 0 && equal(labels, next) && equal(bases, nextBases) {
+			if format == "bin" {
+				if image, m, err = flat.Link(fs, c); err != nil {
+					err = fmt.Errorf("asm: %v", err)
+				}
+				return
+			}
+			return writeELF(sections, fopts, labels)
+		}
+		labels, bases = next, nextBases
+	}
+}
+
+func equal(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// parse reads the declarations and statements of a source file
+func parse(source string) (format string, fopts map[string]string, sections []*section, err error) {
+	var arch string
+	var aopts map[string]string
+	var s *section
+	var a Architecture
+	for n, text := range strings.Split(source, "\n") {
+		number := n + 1
+		errorf := func(f string, v ...interface{}) error {
+			return fmt.Errorf("asm: line %d: %s", number, fmt.Sprintf(f, v...))
+		}
+		w := strings.Fields(text)
+		if len(w) == 0 {
+			continue
+		}
+		switch {
+		case format == "":
+			if w[0] != "format" || len(w) < 2 {
+				return "", nil, nil, errorf("missing format declaration")
+			}
+			format = w[1]
+			if _, ok := formatOptions[format]; !ok {
+				return "", nil, nil, errorf("invalid format %s", format)
+			}
+			if fopts, err = options(w[2:], formatOptions[format], false); err != nil {
+				return "", nil, nil, errorf("%v", err)
+			}
+			continue
+		case w[0] == "architecture":
+			if len(w) < 2 {
+				return "", nil, nil, errorf("missing architecture name")
+			}
+			arch = w[1]
+			if aopts, err = options(w[2:], nil, true); err != nil {
+				return "", nil, nil, errorf("%v", err)
+			}
+			continue
+		case w[0] == "section":
+			if len(w) < 2 {
+				return "", nil, nil, errorf("missing section name")
+			}
+			s = &section{name: w[1], labels: make(map[string]int)}
+			if !validName(s.name, ".-") {
+				return "", nil, nil, errorf("invalid section name %s", s.name)
+			}
+			for _, t := range sections {
+				if t.name == s.name {
+					return "", nil, nil, errorf("duplicate section %s", s.name)
+				}
+			}
+			sarch, opts, rest := arch, aopts, w[2:]
+			if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+				sarch, opts, rest = rest[0], nil, rest[1:]
+			}
+			all, err := options(rest, nil, true)
+			if err != nil {
+				return "", nil, nil, errorf("%v", err)
+			}
+			s.options = make(map[string]string)
+			for _, k := range sectionOptions[format] {
+				if v, ok := all[k]; ok {
+					s.options[k] = v
+					delete(all, k)
+				}
+			}
+			for k, v := range opts {
+				if _, ok := all[k]; !ok {
+					all[k] = v
+				}
+			}
+			if sarch == "" {
+				return "", nil, nil, errorf("section %s has no architecture", s.name)
+			}
+			create, ok := architectures[sarch]
+			if !ok {
+				return "", nil, nil, errorf("invalid architecture %q", sarch)
+			}
+			if a, err = create(all); err != nil {
+				return "", nil, nil, errorf("%v", err)
+			}
+			sections = append(sections, s)
+			continue
+		case s == nil:
+			return "", nil, nil, errorf("statement outside a section")
+		}
+		// Label
+		if i := strings.IndexRune(text, ':'); i >= 0 && validName(strings.TrimSpace(text[:i]), "-") {
+			name := strings.TrimSpace(text[:i])
+			if n, ok := integer([]rune(name)); ok && n == len([]rune(name)) {
+				return "", nil, nil, errorf("invalid label %s", name)
+			}
+			if _, ok := s.labels[name]; ok {
+				return "", nil, nil, errorf("duplicate label %s.%s", s.name, name)
+			}
+			s.labels[name] = len(s.lines)
+			s.order = append(s.order, name)
+			if text = text[i+1:]; strings.TrimSpace(text) == "" {
+				continue
+			}
+		}
+		st, err := a.Parse(strings.TrimSpace(text))
+		if err != nil {
+			return "", nil, nil, errorf("%v", err)
+		}
+		s.lines = append(s.lines, line{number, st})
+	}
+	if format == "" {
+		return "", nil, nil, errors.New("asm: missing format declaration")
+	}
+	if len(sections) == 0 {
+		return "", nil, nil, errors.New("asm: no sections")
+	}
+	return
+}
+
+// validName reports whether s is a word, of letters, digits, _ and the
+// runes of extra
+func validName(s, extra string) bool {
+	for _, r := range s {
+		if !word(r) && !strings.ContainsRune(extra, r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// options parses key=value words, of the given keys unless open
+func options(words []string, keys []string, open bool) (opts map[string]string, err error) {
+	opts = make(map[string]string)
+	for _, w := range words {
+		i := strings.Index(w, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid option %s", w)
+		}
+		k := w[:i]
+		if !open && !contains(keys, k) {
+			return nil, fmt.Errorf("invalid option %s", k)
+		}
+		if _, ok := opts[k]; ok {
+			return nil, fmt.Errorf("duplicate option %s", k)
+		}
+		opts[k] = w[i+1:]
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func number(opts map[string]string, k string) (v uint64, err error) {
+	s, ok := opts[k]
+	if !ok {
+		return
+	}
+	r := []rune(s)
+	if n, ok := integer(r); !ok || n != len(r) {
+		return 0, fmt.Errorf("asm: invalid %s %s", k, s)
+	}
+	i, err := parseInteger(s)
+	return uint64(i), err
+}
+
+func binConfig(opts map[string]string) (c flat.Config, err error) {
+	if c.Origin, err = number(opts, "origin"); err != nil {
+		return
+	}
+	if c.Length, err = number(opts, "length"); err != nil {
+		return
+	}
+	fill, err := number(opts, "fill")
+	if err != nil {
+		return
+	}
+	if fill > 0xff {
+		return c, fmt.Errorf("asm: invalid fill %d", fill)
+	}
+	c.Fill = byte(fill)
+	return
+}
+
+// binSection returns a section for placement.  elf sections must be
+// segments.
+func binSection(s *section, format string) (f flat.Section, err error) {
+	if format == "elf" {
+		if _, ok := elfSegment[s.name]; !ok {
+			return f, fmt.Errorf("asm: elf section %s is not code or data", s.name)
+		}
+	}
+	f = flat.Section{Name: s.name, Data: s.data}
+	if f.Align, err = number(s.options, "align"); err != nil {
+		return
+	}
+	if f.Start, err = number(s.options, "start"); err != nil {
+		return
+	}
+	for _, name := range s.order {
+		f.Symbols = append(f.Symbols, flat.Symbol{Name: s.name + "." + name, Value: s.starts[s.labels[name]]})
+	}
+	return
+}
+
+// writeELF writes elf sections as the segments of an executable, with its
+// labels as symbols
+func writeELF(sections []*section, opts map[string]string, labels map[string]uint64) (image []byte, m flat.Map, err error) {
+	var f lang.File
+	for _, s := range sections {
+		seg := elfSegment[s.name]
+		if seg == lang.CodeSegment {
+			f.Code = s.data
+		} else {
+			f.Data = s.data
+		}
+		m = append(m, flat.Entry{Size: uint64(len(s.data)), Section: s.name})
+		for _, name := range s.order {
+			v := labels[s.name+"."+name]
+			f.Symbols = append(f.Symbols, lang.Symbol{Name: s.name + "." + name, Segment: seg, Value: uint(v)})
+			m = append(m, flat.Entry{Address: v, Section: s.name, Name: s.name + "." + name})
+		}
+	}
+	sort.SliceStable(m, func(i, j int) bool { return m[i].Address < m[j].Address })
+	stack, err := number(opts, "stack")
+	if err != nil {
+		return
+	}
+	f.Stack = uint(stack)
+	if name, ok := opts["entry"]; ok {
+		if !strings.Contains(name, ".") {
+			name = "code." + name
+		}
+		v, ok := labels[name]
+		if !ok || !strings.HasPrefix(name, "code.") {
+			return nil, nil, fmt.Errorf("asm: entry %s is not a code label", name)
+		}
+		f.Entry = uint(v)
+	}
+	c, mach := debug.ELFCLASS64, debug.EM_X86_64
+	switch opts["machine"] {
+	case "", "x86-64":
+	case "i386":
+		c, mach = debug.ELFCLASS32, debug.EM_386
+	default:
+		return nil, nil, fmt.Errorf("asm: invalid machine %s", opts["machine"])
+	}
+	d := debug.ELFDATA2LSB
+	switch opts["endian"] {
+	case "", "little":
+	case "big":
+		d = debug.ELFDATA2MSB
+	default:
+		return nil, nil, fmt.Errorf("asm: invalid byte order %s", opts["endian"])
+	}
+	r, err := elf.Write(f, d, c, mach)
+	if err != nil {
+		return
+	}
+	image, err = ioutil.ReadAll(r)
+	return
+}
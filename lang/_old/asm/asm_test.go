@@ -0,0 +1,207 @@
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/lib/os/elf"
+	"github.com/vvanpo/system/lang/lib/os/flat"
+)
+
+// The source of translate_test, with the label a it refers to defined, and
+// its unterminated raw string closed.  The width of {a} and the text of
+// \{a} depend on where the data section ends, so its labels settle over
+// passes.
+const translate = `format bin
+architecture ir
+section code    data align=8
+    "mov {_end} _sp \{testlabel} \{data.end}"
+  testlabel:
+    "mov {_end + 1} _fp"
+    "mov {testlabel} _ip"
+  end:
+section data data align=64
+  hello: "hello,      日本語world!\n", 010203afh
+    "{2}\{code.end * 2}}\{data.hello}test", {a93dh + hello * code.testlabel}, r"\\\\n", "\n"
+    {2**8 - 1}, {a}, "\{a}", "{hello}   \{hello+1}"
+    "this is a test\\\"\\", r"a\" simple test\\"
+    0, bh,
+    "日"
+  end:
+  a:
+`
+
+func entry(address, size uint64, section, name string) flat.Entry {
+	return flat.Entry{Address: address, Size: size, Section: section, Name: name}
+}
+
+func TestTranslate(t *testing.T) {
+	image, m, err := Assemble(translate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"mov {_end} _sp 21 175",
+		"mov {_end + 1} _fp",
+		"mov {testlabel} _ip",
+		"\x00\x00\x00\x00\x00\x00", // To the 64-byte alignment of data
+		"hello,      日本語world!\n", "\xaf\x03\x02\x01",
+		// a93dh + 64*21 is 0xae7d, stored in three bytes to keep its sign
+		"{2}116}64test", "\x7d\xae\x00", `\\\\n`, "\n",
+		"\xff\x00", "\xaf\x00", "175", "{hello}   65",
+		`this is a test\"\`, `a" simple test\\`,
+		"\x00\x0b",
+		"日",
+	}, "")
+	if string(image) != want {
+		t.Errorf("image\n%q\nwant\n%q", image, want)
+	}
+	wantMap := flat.Map{
+		entry(0, 58, "code", ""),
+		entry(21, 0, "code", "code.testlabel"),
+		entry(58, 0, "code", "code.end"),
+		entry(64, 111, "data", ""),
+		entry(64, 0, "data", "data.hello"),
+		entry(175, 0, "data", "data.end"),
+		entry(175, 0, "data", "data.a"),
+	}
+	if !reflect.DeepEqual(m, wantMap) {
+		t.Errorf("map %v, want %v", m, wantMap)
+	}
+}
+
+// A jump to a label past the end of its section needs a longer encoding
+// than the first pass assumes, which moves the labels after it
+func TestSettle(t *testing.T) {
+	source := `format bin origin=1000h
+section code x86-64
+  start: jmp data.end
+    call start
+section data data
+    {code.start}, "` + strings.Repeat("x", 200) + `"
+  end:
+`
+	image, m, err := Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{
+		0xe9, 0xcf, 0, 0, 0, // jmp 0x10d4
+		0xe8, 0xf6, 0xff, 0xff, 0xff, // call 0x1000
+		0x00, 0x10,
+	}, strings.Repeat("x", 200)...)
+	if !bytes.Equal(image, want) {
+		t.Errorf("image % x", image)
+	}
+	if e := m[len(m)-1]; e.Name != "data.end" || e.Address != 0x10d4 {
+		t.Errorf("last map entry %v", e)
+	}
+}
+
+// Labels of elf sections are offsets into their segments
+func TestELF(t *testing.T) {
+	source := `format elf entry=start stack=1000h
+section code x86-64
+    nop
+  start: mov eax, data.value
+    ret
+section data data width=2
+    "ab"
+  value: 1, {-2}
+`
+	image, m, err := Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Read(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := []byte{0x90, 0xb8, 2, 0, 0, 0, 0xc3}
+	data := []byte{'a', 'b', 1, 0, 0xfe, 0xff}
+	if !bytes.Equal(f.Code, code) || !bytes.Equal(f.Data, data) || f.Entry != 1 || f.Stack != 0x1000 {
+		t.Errorf("code % x, data % x, entry %d, stack %#x", f.Code, f.Data, f.Entry, f.Stack)
+	}
+	symbols := map[string]lang.Symbol{}
+	for _, s := range f.Symbols {
+		symbols[s.Name] = s
+	}
+	if s := symbols["code.start"]; s.Segment != lang.CodeSegment || s.Value != 1 {
+		t.Errorf("code.start %+v", s)
+	}
+	if s := symbols["data.value"]; s.Segment != lang.DataSegment || s.Value != 2 {
+		t.Errorf("data.value %+v", s)
+	}
+	wantMap := flat.Map{
+		entry(0, 7, "code", ""),
+		entry(0, 6, "data", ""),
+		entry(1, 0, "code", "code.start"),
+		entry(2, 0, "data", "data.value"),
+	}
+	if !reflect.DeepEqual(m, wantMap) {
+		t.Errorf("map %v, want %v", m, wantMap)
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"1 + 2 * 3", 7},
+		{"-7 / 2", -4},
+		{"-7 % 2", 1},
+		{"2 ** 3 ** 2", 512},
+		{"3 ** 39", 4052555153018976267},
+		{"(-2) ** 63", -1 << 63},
+		{"1 ** 7fffffffffffffffh", 1},
+		{"(-1) ** 7fffffffffffffffh", -1},
+		{"0 ** 0", 1},
+		{"l.x - 1", 9},
+	}
+	for _, test := range tests {
+		e, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		v, err := e.Eval(func(string) (int64, error) { return 10, nil })
+		if v != test.want || err != nil {
+			t.Errorf("%s: got %d, %v, want %d", test.expr, v, err, test.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"section code data\n", "line 1: missing format declaration"},
+		{"format bin\n", "no sections"},
+		{"format bin\n    0\n", "line 2: statement outside a section"},
+		{"format bin\nsection code\n", "section code has no architecture"},
+		{"format bin\nsection code data\n  x: 0\n  x: 1\n", "line 4: duplicate label code.x"},
+		{"format bin\nsection code data\n    {x}\n", "line 3: undefined label code.x"},
+		{"format bin\nsection code data\n    {data.x}\n", "undefined label data.x"},
+		{"format bin\nsection code data\n    {1 / (2 - 2)}\n", "division by zero"},
+		{"format bin\nsection code data\n    {2 ** -1}\n", "negative exponent"},
+		{"format bin\nsection code data\n    {2**9223372036854775807}\n", "line 3: integer overflow"},
+		{"format bin\nsection code data\n    {2**70}\n", "integer overflow"},
+		{"format bin\nsection code data\n    {7fffffffffffffffh + 1}\n", "integer overflow"},
+		{"format bin\nsection code data\n    {8000000000000000h - 1}\n", "integer overflow"},
+		{"format bin\nsection code data\n    {100000000h * 100000000h}\n", "integer overflow"},
+		{"format bin\nsection code data\n    {8000000000000000h / -1}\n", "integer overflow"},
+		{"format bin\nsection code data\n    \"open\n", "line 3: unterminated string"},
+		{"format bin\nsection a data start=10h\n    1, 2\nsection b data start=11h\n    3\n", "overlap"},
+		{"format elf\nsection text data\n    1\n", "elf section text is not code or data"},
+		{"format elf entry=data.x\nsection data data\n  x: 1\n", "entry data.x is not a code label"},
+	}
+	for _, test := range tests {
+		if _, _, err := Assemble(test.source); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want %q", test.source, err, test.want)
+		}
+	}
+}
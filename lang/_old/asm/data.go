@@ -0,0 +1,227 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The data architecture stores strings and integers.  A statement is a list
+// of values separated by commas:
+//
+//	integer	decimal, or hexadecimal with an h suffix
+//	{expr}	integer given by a label expression
+//	"..."	string, with the escapes \\ \" \a \b \f \n \r \t \v, \xhh bytes,
+//		\uhhhh and \Uhhhhhhhh code points, and \{expr} for the decimal
+//		value of a label expression
+//	r"..."	raw string, in which only \" is an escape
+//
+// Integers are stored in the fewest multiples of width bytes that hold them
+// as two's complement, in the architecture's byte order.  Its options are
+// width=n, endian=little or endian=big, and encoding=utf-8.
+type data struct {
+	width     int
+	bigEndian bool
+}
+
+func newData(options map[string]string) (Architecture, error) {
+	d := &data{width: 1}
+	for k, v := range options {
+		switch k {
+		case "width":
+			n, err := parseInteger(v)
+			if err != nil || n < 1 || n > 8 {
+				return nil, fmt.Errorf("invalid data width %s", v)
+			}
+			d.width = int(n)
+		case "endian":
+			if v != "little" && v != "big" {
+				return nil, fmt.Errorf("invalid byte order %s", v)
+			}
+			d.bigEndian = v == "big"
+		case "encoding":
+			if v != "utf-8" {
+				return nil, fmt.Errorf("unsupported encoding %s", v)
+			}
+		default:
+			return nil, fmt.Errorf("invalid data option %s", k)
+		}
+	}
+	return d, nil
+}
+
+// A piece of a data statement is a run of bytes, an integer expression, or
+// the decimal text of an expression
+type piece struct {
+	b    []byte
+	expr *Expr
+	text bool
+}
+
+type dataStatement struct {
+	*data
+	pieces []piece
+}
+
+func (d *data) Parse(s string) (Statement, error) {
+	st := &dataStatement{data: d}
+	r := []rune(s)
+	i := 0
+	skip := func() {
+		for i < len(r) && (r[i] == ' ' || r[i] == '\t') {
+			i++
+		}
+	}
+	for skip(); i < len(r); skip() {
+		var err error
+		switch {
+		case r[i] == '{':
+			end := i + 1
+			for end < len(r) && r[end] != '}' {
+				end++
+			}
+			if end == len(r) {
+				return nil, errors.New("missing } in data statement")
+			}
+			e, err := ParseExpr(string(r[i+1 : end]))
+			if err != nil {
+				return nil, err
+			}
+			st.pieces = append(st.pieces, piece{expr: e})
+			i = end + 1
+		case r[i] == '"':
+			i, err = st.string(r, i+1, false)
+		case r[i] == 'r' && i+1 < len(r) && r[i+1] == '"':
+			i, err = st.string(r, i+2, true)
+		default:
+			n, ok := integer(r[i:])
+			if !ok {
+				return nil, fmt.Errorf("invalid data value %q", string(r[i:]))
+			}
+			v, err := parseInteger(string(r[i : i+n]))
+			if err != nil {
+				return nil, err
+			}
+			st.pieces = append(st.pieces, piece{b: d.integer(v)})
+			i += n
+		}
+		if err != nil {
+			return nil, err
+		}
+		if skip(); i < len(r) {
+			if r[i] != ',' {
+				return nil, fmt.Errorf("missing , before %q", string(r[i:]))
+			}
+			i++
+		}
+	}
+	return st, nil
+}
+
+// string parses the string starting at r[i], after its opening quote, and
+// returns the index following its closing quote
+func (st *dataStatement) string(r []rune, i int, raw bool) (int, error) {
+	var b []byte
+	add := func(c rune) {
+		var e [utf8.UTFMax]byte
+		b = append(b, e[:utf8.EncodeRune(e[:], c)]...)
+	}
+	for ; i < len(r) && r[i] != '"'; i++ {
+		if r[i] != '\\' || i+1 == len(r) {
+			add(r[i])
+			continue
+		}
+		i++
+		c := r[i]
+		switch {
+		case raw && c == '"':
+			add('"')
+		case raw:
+			add('\\')
+			add(c)
+		case c == '\\' || c == '"':
+			add(c)
+		case c == 'a' || c == 'b' || c == 'f' || c == 'n' || c == 'r' || c == 't' || c == 'v':
+			add(map[rune]rune{'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v'}[c])
+		case c == 'x' || c == 'u' || c == 'U':
+			n := map[rune]int{'x': 2, 'u': 4, 'U': 8}[c]
+			if i+n >= len(r) {
+				return 0, fmt.Errorf("short \\%c escape", c)
+			}
+			v, err := strconv.ParseUint(string(r[i+1:i+1+n]), 16, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid \\%c escape", c)
+			}
+			if c == 'x' {
+				b = append(b, byte(v))
+			} else {
+				add(rune(v))
+			}
+			i += n
+		case c == '{':
+			end := i + 1
+			for end < len(r) && r[end] != '}' {
+				end++
+			}
+			if end == len(r) {
+				return 0, errors.New("missing } in string")
+			}
+			e, err := ParseExpr(string(r[i+1 : end]))
+			if err != nil {
+				return 0, err
+			}
+			st.pieces = append(st.pieces, piece{b: b}, piece{expr: e, text: true})
+			b = nil
+			i = end
+		default:
+			return 0, fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+	if i == len(r) {
+		return 0, errors.New("unterminated string")
+	}
+	st.pieces = append(st.pieces, piece{b: b})
+	return i + 1, nil
+}
+
+// integer encodes v in the fewest multiples of width bytes
+func (d *data) integer(v int64) (b []byte) {
+	n := d.width
+	for n < 8 && (v < -1<<(uint(n)*8-1) || v >= 1<<(uint(n)*8-1)) {
+		n += d.width
+	}
+	b = make([]byte, n)
+	for i := 0; i < n; i++ {
+		shift := uint(i) * 8
+		if shift > 63 {
+			shift = 63 // Sign extension
+		}
+		c := byte(v >> shift)
+		if d.bigEndian {
+			b[n-1-i] = c
+		} else {
+			b[i] = c
+		}
+	}
+	return
+}
+
+func (st *dataStatement) Encode(pc uint64, s *Scope) (b []byte, err error) {
+	for _, p := range st.pieces {
+		if p.expr == nil {
+			b = append(b, p.b...)
+			continue
+		}
+		v, err := s.Eval(p.expr)
+		if err != nil {
+			return nil, err
+		}
+		if p.text {
+			b = append(b, strconv.FormatInt(v, 10)...)
+		} else {
+			b = append(b, st.integer(v)...)
+		}
+	}
+	return
+}
@@ -0,0 +1,252 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// An Expr is a label expression, of integers and labels combined with the
+// operators + - * / % ** and parentheses.  Integers are decimal, or
+// hexadecimal with an h suffix, and any other word is a label.  Labels may
+// contain - and ., so subtracting from a label needs spaces.
+type Expr struct {
+	op          string // Operator, or empty for leaves
+	left, right *Expr
+	value       int64
+	label       string
+}
+
+// ParseExpr parses a label expression
+func ParseExpr(s string) (e *Expr, err error) {
+	p := &exprParser{s: []rune(s)}
+	if e, err = p.sum(); err != nil {
+		return
+	}
+	if p.skip(); p.i < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", string(p.s[p.i:]), s)
+	}
+	return
+}
+
+// Labels returns the labels of the expression
+func (e *Expr) Labels() (labels []string) {
+	switch {
+	case e.op != "":
+		return append(e.left.Labels(), e.right.Labels()...)
+	case e.label != "":
+		return []string{e.label}
+	}
+	return
+}
+
+// Eval evaluates the expression, given the values of its labels.  Division
+// and modulo round toward negative infinity, and results that overflow 64
+// bits are errors.
+func (e *Expr) Eval(label func(name string) (int64, error)) (v int64, err error) {
+	if e.op == "" {
+		if e.label != "" {
+			return label(e.label)
+		}
+		return e.value, nil
+	}
+	a, err := e.left.Eval(label)
+	if err != nil {
+		return
+	}
+	b, err := e.right.Eval(label)
+	if err != nil {
+		return
+	}
+	switch e.op {
+	case "+":
+		if v = a + b; (a^v)&(b^v) < 0 {
+			return 0, errOverflow
+		}
+		return
+	case "-":
+		if v = a - b; (a^b)&(a^v) < 0 {
+			return 0, errOverflow
+		}
+		return
+	case "*":
+		return multiply(a, b)
+	case "/", "%":
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			return 0, errOverflow
+		}
+		q, r := a/b, a%b
+		if r != 0 && (r < 0) != (b < 0) {
+			q, r = q-1, r+b
+		}
+		if e.op == "/" {
+			return q, nil
+		}
+		return r, nil
+	case "**":
+		if b < 0 {
+			return 0, errors.New("negative exponent")
+		}
+		// By squaring, so that large exponents end early or overflow
+		v = 1
+		for ; b > 0; b >>= 1 {
+			if b&1 != 0 {
+				if v, err = multiply(v, a); err != nil {
+					return
+				}
+			}
+			if b > 1 {
+				if a, err = multiply(a, a); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+	return 0, fmt.Errorf("invalid operator %s", e.op)
+}
+
+var errOverflow = errors.New("integer overflow")
+
+func multiply(a, b int64) (int64, error) {
+	v := a * b
+	if a != 0 && (v/a != b || a == -1 && b == math.MinInt64) {
+		return 0, errOverflow
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	s []rune
+	i int
+}
+
+func (p *exprParser) skip() {
+	for p.i < len(p.s) && unicode.IsSpace(p.s[p.i]) {
+		p.i++
+	}
+}
+
+// operator consumes and returns the first of ops found next, if any
+func (p *exprParser) operator(ops ...string) string {
+	p.skip()
+	for _, op := range ops {
+		if p.i+len(op) <= len(p.s) && string(p.s[p.i:p.i+len(op)]) == op {
+			// ** is not two multiplications
+			if op == "*" && p.i+1 < len(p.s) && p.s[p.i+1] == '*' {
+				continue
+			}
+			p.i += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) binary(next func() (*Expr, error), ops ...string) (e *Expr, err error) {
+	if e, err = next(); err != nil {
+		return
+	}
+	for op := p.operator(ops...); op != ""; op = p.operator(ops...) {
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		e = &Expr{op: op, left: e, right: right}
+	}
+	return
+}
+
+func (p *exprParser) sum() (*Expr, error) { return p.binary(p.product, "+", "-") }
+
+func (p *exprParser) product() (*Expr, error) { return p.binary(p.power, "*", "/", "%") }
+
+// power is right-associative
+func (p *exprParser) power() (e *Expr, err error) {
+	if e, err = p.unary(); err != nil {
+		return
+	}
+	if p.operator("**") == "" {
+		return
+	}
+	right, err := p.power()
+	if err != nil {
+		return
+	}
+	return &Expr{op: "**", left: e, right: right}, nil
+}
+
+func (p *exprParser) unary() (e *Expr, err error) {
+	if p.operator("-") == "" {
+		return p.primary()
+	}
+	if e, err = p.unary(); err != nil {
+		return
+	}
+	return &Expr{op: "-", left: &Expr{}, right: e}, nil
+}
+
+func (p *exprParser) primary() (e *Expr, err error) {
+	p.skip()
+	if p.i == len(p.s) {
+		return nil, errors.New("expression ends early")
+	}
+	if p.s[p.i] == '(' {
+		p.i++
+		if e, err = p.sum(); err != nil {
+			return
+		}
+		if p.operator(")") == "" {
+			return nil, errors.New("missing ) in expression")
+		}
+		return
+	}
+	if n, ok := integer(p.s[p.i:]); ok {
+		v, err := parseInteger(string(p.s[p.i : p.i+n]))
+		p.i += n
+		return &Expr{value: v}, err
+	}
+	if !word(p.s[p.i]) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.s[p.i])
+	}
+	start := p.i
+	for p.i < len(p.s) && (word(p.s[p.i]) || p.s[p.i] == '-' || p.s[p.i] == '.') {
+		p.i++
+	}
+	return &Expr{label: string(p.s[start:p.i])}, nil
+}
+
+func word(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+func hexDigit(r rune) bool { return '0' <= r && r <= '9' || 'a' <= r && r <= 'f' }
+
+// integer returns the length of the integer at the start of s, decimal or
+// hexadecimal with an h suffix, if it is not followed by other word characters
+func integer(s []rune) (n int, ok bool) {
+	for n < len(s) && hexDigit(s[n]) {
+		n++
+	}
+	if n > 0 && n < len(s) && s[n] == 'h' && (n+1 == len(s) || !word(s[n+1])) {
+		return n + 1, true
+	}
+	for n = 0; n < len(s) && '0' <= s[n] && s[n] <= '9'; n++ {
+	}
+	return n, n > 0 && (n == len(s) || !word(s[n]))
+}
+
+func parseInteger(s string) (int64, error) {
+	base := 10
+	if s[len(s)-1] == 'h' {
+		s, base = s[:len(s)-1], 16
+	}
+	v, err := strconv.ParseUint(s, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %s", s)
+	}
+	return int64(v), nil
+}
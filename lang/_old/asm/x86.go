@@ -0,0 +1,229 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang/asm/x86"
+	"strings"
+)
+
+// The x86-64 and i386 architectures assemble instructions in Intel syntax,
+// destination first:
+//
+//	[rep] mnemonic [operand {, operand}]
+//	operand	= register | [size [ptr]] "[" address "]" | expr
+//	size	= byte | word | dword | qword
+//	address	= terms of a base register, an index register*scale and a
+//		  displacement expression, joined by + or -
+//
+// The expression of a jump or call is its target address, as is the
+// displacement of a memory operand based on rip.  Neither architecture has
+// options.
+type x86Arch struct {
+	mode x86.Mode
+}
+
+func init() {
+	Register("x86-64", newX86(x86.Mode64))
+	Register("i386", newX86(x86.Mode32))
+}
+
+func newX86(m x86.Mode) func(map[string]string) (Architecture, error) {
+	return func(options map[string]string) (Architecture, error) {
+		for k := range options {
+			return nil, fmt.Errorf("invalid x86 option %s", k)
+		}
+		return &x86Arch{m}, nil
+	}
+}
+
+// An operand whose value is given by a label expression
+type x86Operand struct {
+	op   x86.Operand
+	expr *Expr // Immediate, target, or displacement
+}
+
+type x86Statement struct {
+	mode     x86.Mode
+	mnemonic string
+	operands []x86Operand
+}
+
+var x86Sizes = map[string]int{"byte": 1, "word": 2, "dword": 4, "qword": 8}
+
+func (a *x86Arch) Parse(s string) (Statement, error) {
+	st := &x86Statement{mode: a.mode}
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		i = len(s)
+	}
+	st.mnemonic, s = strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+	if st.mnemonic == "rep" {
+		i = strings.IndexAny(s+" ", " \t")
+		st.mnemonic, s = "rep "+strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+	}
+	relative := st.mnemonic == "jmp" || st.mnemonic == "call" || st.mnemonic[0] == 'j'
+	if s == "" {
+		return st, nil
+	}
+	for _, o := range strings.Split(s, ",") {
+		op, err := parseX86Operand(strings.TrimSpace(o), relative)
+		if err != nil {
+			return nil, err
+		}
+		st.operands = append(st.operands, op)
+	}
+	return st, nil
+}
+
+func parseX86Operand(s string, relative bool) (op x86Operand, err error) {
+	if r, ok := x86.Register(s); ok {
+		return x86Operand{op: r}, nil
+	}
+	w := strings.Fields(s)
+	var m x86.Mem
+	if len(w) > 0 {
+		if size, ok := x86Sizes[strings.ToLower(w[0])]; ok {
+			m.Size = size
+			s = strings.TrimSpace(s[len(w[0]):])
+			if len(w) > 1 && strings.HasPrefix(strings.ToLower(s), "ptr") {
+				s = strings.TrimSpace(s[3:])
+			}
+			if !strings.HasPrefix(s, "[") {
+				return op, fmt.Errorf("missing memory operand after %s", w[0])
+			}
+		}
+	}
+	if !strings.HasPrefix(s, "[") {
+		e, err := ParseExpr(s)
+		if err != nil {
+			return op, err
+		}
+		if relative {
+			return x86Operand{x86.Rel(0), e}, nil
+		}
+		return x86Operand{x86.Imm(0), e}, nil
+	}
+	if !strings.HasSuffix(s, "]") {
+		return op, fmt.Errorf("missing ] in %q", s)
+	}
+	disp := ""
+	for _, t := range addressTerms(s[1 : len(s)-1]) {
+		sign, t := t[0], strings.TrimSpace(t[1:])
+		reg, scale := t, ""
+		if i := strings.Index(t, "*"); i >= 0 {
+			reg, scale = strings.TrimSpace(t[:i]), strings.TrimSpace(t[i+1:])
+			if _, ok := x86.Register(reg); !ok {
+				reg, scale = scale, reg
+			}
+		}
+		r, ok := x86.Register(reg)
+		switch {
+		case !ok:
+			disp += " " + string(sign) + " " + t
+			continue
+		case sign == '-':
+			return op, fmt.Errorf("negative register %s", reg)
+		case scale == "" && m.Base.Size == 0:
+			m.Base = r
+			continue
+		case m.Index.Size != 0:
+			return op, fmt.Errorf("too many registers in %q", s)
+		}
+		m.Index, m.Scale = r, 1
+		if scale != "" {
+			n, err := parseInteger(scale)
+			if err != nil {
+				return op, err
+			}
+			m.Scale = int(n)
+		}
+	}
+	op.op = m
+	if disp == "" {
+		return
+	}
+	op.expr, err = ParseExpr("0" + disp)
+	return
+}
+
+// addressTerms splits an address into terms, each led by its sign.  As
+// labels may contain -, a - only separates terms if it follows a space, an
+// operator or the start.
+func addressTerms(s string) (terms []string) {
+	depth, start := 0, 0
+	prev := ' '
+	for i, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == '+' || c == '-' && strings.ContainsRune(" \t+-*", prev)):
+			if strings.TrimSpace(s[start:i]) != "" || start > 0 {
+				terms = append(terms, s[start:i])
+			}
+			start = i
+		}
+		prev = c
+	}
+	terms = append(terms, s[start:])
+	for i, t := range terms {
+		if t[0] != '+' && t[0] != '-' {
+			terms[i] = "+" + t
+		}
+	}
+	return
+}
+
+func (st *x86Statement) Encode(pc uint64, s *Scope) ([]byte, error) {
+	var ops []x86.Operand
+	for _, o := range st.operands {
+		op := o.op
+		if o.expr != nil {
+			v, err := s.Eval(o.expr)
+			if err != nil {
+				return nil, err
+			}
+			switch op := op.(type) {
+			case x86.Imm:
+				ops = append(ops, x86.Imm(v))
+				continue
+			case x86.Rel:
+				// Targets not yet placed are assumed near
+				if !s.known(o.expr) {
+					v = int64(pc)
+				}
+				ops = append(ops, x86.Rel(v))
+				continue
+			case x86.Mem:
+				if op.Base == x86.RIP && !s.known(o.expr) {
+					v = int64(pc)
+				}
+				op.Disp = v
+				ops = append(ops, op)
+				continue
+			}
+		}
+		ops = append(ops, op)
+	}
+	b, err := x86.Encode(st.mode, pc, st.mnemonic, ops...)
+	if err != nil {
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "x86: "))
+	}
+	return b, nil
+}
+
+// known reports whether the labels of an expression are placed
+func (s *Scope) known(e *Expr) bool {
+	for _, name := range e.Labels() {
+		if !strings.Contains(name, ".") {
+			name = s.section + "." + name
+		}
+		if _, ok := s.labels[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
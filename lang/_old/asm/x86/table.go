@@ -0,0 +1,164 @@
+package x86
+
+import (
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//go:embed instructions.txt
+var instructions string
+
+// A form is one encoding of an instruction, from an opcode line of
+// instructions.txt
+type form struct {
+	opcode   []byte // Including any mandatory prefixes
+	rex      bool   // REX prefix required
+	rexW     bool
+	plusReg  bool // The last opcode byte holds a register
+	modrm    int  // Digit of the reg field, modrmReg for /r, or -1 without ModRM
+	imm      int  // Immediate length
+	rel      int  // Relative displacement length
+	operands []string
+	roles    []role
+	compat   bool // Valid in 32-bit mode
+	long     bool // Valid in 64-bit mode
+}
+
+const modrmReg = 8
+
+// Role of an operand in an encoding
+type role int
+
+const (
+	roleImplicit role = iota
+	roleReg           // ModRM:reg
+	roleRM            // ModRM:r/m
+	roleOpcode        // Added to the opcode
+	roleImm
+	roleSignedImm // Sign-extended to the operand size
+	roleRel
+)
+
+var forms map[string][]*form
+
+func init() {
+	var err error
+	if forms, err = parseTable(instructions); err != nil {
+		panic(err)
+	}
+}
+
+// parseTable parses the fixed-column format of instructions.txt
+func parseTable(s string) (table map[string][]*form, err error) {
+	table = make(map[string][]*form)
+	var mnemonic string
+	var encodings map[string][]role
+	opcodes := false
+	for n, line := range strings.Split(s, "\n") {
+		errorf := func(f string, v ...interface{}) error {
+			return fmt.Errorf("x86: instructions.txt:%d: %s", n+1, fmt.Sprintf(f, v...))
+		}
+		switch {
+		case line == "" || line[0] == '#':
+		case !strings.HasPrefix(line, "  "):
+			mnemonic = strings.TrimSpace(line)
+			encodings = make(map[string][]role)
+			opcodes = false
+		case strings.HasPrefix(line, "  ---"):
+			opcodes = true
+		case !opcodes:
+			w := strings.Fields(line)
+			var roles []role
+			for _, r := range w[1:] {
+				roles = append(roles, parseRole(r))
+			}
+			encodings[w[0]] = roles
+		default:
+			column := func(from, to int) string {
+				if from >= len(line) {
+					return ""
+				}
+				if to > len(line) {
+					to = len(line)
+				}
+				return strings.TrimSpace(line[from:to])
+			}
+			f, err := parseOpcode(column(2, 28))
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			if ops := column(28, 48); ops != "" {
+				f.operands = strings.Split(ops, ",")
+			}
+			roles, ok := encodings[column(48, 52)]
+			if !ok {
+				return nil, errorf("undefined encoding %s", column(48, 52))
+			}
+			if len(f.operands) > 0 && len(roles) != len(f.operands) {
+				return nil, errorf("operands do not match encoding %s", column(48, 52))
+			}
+			if len(f.operands) > 0 {
+				f.roles = roles
+			}
+			f.compat, f.long = column(52, 56) == "V", column(56, 60) == "V"
+			table[mnemonic] = append(table[mnemonic], f)
+		}
+	}
+	return
+}
+
+func parseRole(s string) role {
+	switch {
+	case strings.HasPrefix(s, "ModRM:reg"):
+		return roleReg
+	case strings.HasPrefix(s, "ModRM:r/m"):
+		return roleRM
+	case strings.HasPrefix(s, "opcode+"):
+		return roleOpcode
+	case strings.HasPrefix(s, "imm8/"):
+		return roleSignedImm
+	case strings.HasPrefix(s, "imm"):
+		return roleImm
+	case s == "Offset":
+		return roleRel
+	}
+	return roleImplicit
+}
+
+// parseOpcode parses Intel opcode notation, such as REX.W + 0F AF /r
+func parseOpcode(s string) (f *form, err error) {
+	f = &form{modrm: -1}
+	for _, t := range strings.Fields(s) {
+		switch {
+		case t == "+":
+		case t == "REX":
+			f.rex = true
+		case t == "REX.W":
+			f.rexW = true
+		case t == "/r":
+			f.modrm = modrmReg
+		case len(t) == 2 && t[0] == '/' && '0' <= t[1] && t[1] <= '7':
+			f.modrm = int(t[1] - '0')
+		case t == "ib" || t == "iw" || t == "id" || t == "io":
+			f.imm = map[string]int{"ib": 1, "iw": 2, "id": 4, "io": 8}[t]
+		case t == "cb" || t == "cd":
+			f.rel = map[string]int{"cb": 1, "cd": 4}[t]
+		default:
+			if i := strings.Index(t, "+r"); i > 0 {
+				f.plusReg = true
+				t = t[:i]
+			}
+			b, err := strconv.ParseUint(t, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid opcode %s", t)
+			}
+			f.opcode = append(f.opcode, byte(b))
+		}
+	}
+	if len(f.opcode) == 0 {
+		return nil, fmt.Errorf("missing opcode in %q", s)
+	}
+	return
+}
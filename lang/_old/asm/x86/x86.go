@@ -0,0 +1,452 @@
+// Encoder for x86 and x86-64 instructions, driven by the opcode listing of
+// instructions.txt
+package x86
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The width of addresses and default operands
+type Mode int
+
+const (
+	Mode32 Mode = 32
+	Mode64 Mode = 64
+)
+
+// An Operand is a Reg, Mem, Imm or Rel
+type Operand interface {
+	operand()
+}
+
+// A Reg is a general-purpose register
+type Reg struct {
+	Num  int  // Register number, with bit 3 in a REX prefix
+	Size int  // Width in bytes, or zero for no register
+	High bool // AH, CH, DH or BH
+	rip  bool
+}
+
+// A Mem is a memory operand of [base + index*scale + disp].  Based on RIP,
+// its displacement is instead the target address.
+type Mem struct {
+	Base  Reg // No base if Size is zero
+	Index Reg
+	Scale int // 1, 2, 4 or 8
+	Disp  int64
+	Size  int // Width of the access in bytes, or zero if given by another operand
+}
+
+// An Imm is an immediate value
+type Imm int64
+
+// A Rel is the target address of a relative jump or call
+type Rel uint64
+
+func (Reg) operand() {}
+func (Mem) operand() {}
+func (Imm) operand() {}
+func (Rel) operand() {}
+
+var (
+	AL, CL, DL, BL     = Reg{Num: 0, Size: 1}, Reg{Num: 1, Size: 1}, Reg{Num: 2, Size: 1}, Reg{Num: 3, Size: 1}
+	AH, CH, DH, BH     = Reg{Num: 4, Size: 1, High: true}, Reg{Num: 5, Size: 1, High: true}, Reg{Num: 6, Size: 1, High: true}, Reg{Num: 7, Size: 1, High: true}
+	AX, CX, DX, BX     = Reg{Num: 0, Size: 2}, Reg{Num: 1, Size: 2}, Reg{Num: 2, Size: 2}, Reg{Num: 3, Size: 2}
+	SP, BP, SI, DI     = Reg{Num: 4, Size: 2}, Reg{Num: 5, Size: 2}, Reg{Num: 6, Size: 2}, Reg{Num: 7, Size: 2}
+	EAX, ECX, EDX, EBX = Reg{Num: 0, Size: 4}, Reg{Num: 1, Size: 4}, Reg{Num: 2, Size: 4}, Reg{Num: 3, Size: 4}
+	ESP, EBP, ESI, EDI = Reg{Num: 4, Size: 4}, Reg{Num: 5, Size: 4}, Reg{Num: 6, Size: 4}, Reg{Num: 7, Size: 4}
+	RAX, RCX, RDX, RBX = Reg{Num: 0, Size: 8}, Reg{Num: 1, Size: 8}, Reg{Num: 2, Size: 8}, Reg{Num: 3, Size: 8}
+	RSP, RBP, RSI, RDI = Reg{Num: 4, Size: 8}, Reg{Num: 5, Size: 8}, Reg{Num: 6, Size: 8}, Reg{Num: 7, Size: 8}
+	// The instruction pointer, as the base of RIP-relative memory operands
+	RIP = Reg{Size: 8, rip: true}
+)
+
+var registers = make(map[string]Reg)
+
+func init() {
+	names := [][]string{
+		{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil"},
+		{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"},
+		{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi"},
+		{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi"},
+	}
+	suffix := []string{"b", "w", "d", ""}
+	for i, size := range []int{1, 2, 4, 8} {
+		for n := 0; n < 16; n++ {
+			name := fmt.Sprintf("r%d%s", n, suffix[i])
+			if n < 8 {
+				name = names[i][n]
+			}
+			registers[name] = Reg{Num: n, Size: size}
+		}
+	}
+	for n, name := range []string{"ah", "ch", "dh", "bh"} {
+		registers[name] = Reg{Num: 4 + n, Size: 1, High: true}
+	}
+	registers["rip"] = RIP
+}
+
+// Register returns the register of a name, such as eax or r8d
+func Register(name string) (r Reg, ok bool) {
+	r, ok = registers[strings.ToLower(name)]
+	return
+}
+
+// Alternative mnemonics
+var aliases = map[string]string{
+	"JC": "JB", "JNAE": "JB", "JNC": "JAE", "JNB": "JAE", "JZ": "JE", "JNZ": "JNE",
+	"JNA": "JBE", "JNBE": "JA", "JPE": "JP", "JPO": "JNP", "JNGE": "JL", "JNL": "JGE",
+	"JNG": "JLE", "JNLE": "JG", "SAL": "SHL",
+}
+
+// Encode an instruction at address pc, choosing the shortest of the forms
+// that accept the operands.  Operands are in Intel order, destination first.
+func Encode(m Mode, pc uint64, mnemonic string, operands ...Operand) (code []byte, err error) {
+	mnemonic = strings.ToUpper(strings.Join(strings.Fields(mnemonic), " "))
+	if a, ok := aliases[mnemonic]; ok {
+		mnemonic = a
+	}
+	fs, ok := forms[mnemonic]
+	if !ok {
+		return nil, fmt.Errorf("x86: unknown instruction %s", mnemonic)
+	}
+	if err = check(m, operands); err != nil {
+		return
+	}
+	err = fmt.Errorf("x86: invalid operands for %s", mnemonic)
+	var chosen *form
+	sizes := make(map[string]bool) // Accesses of memory operands without size
+	for _, f := range fs {
+		if m == Mode32 && !f.compat || m == Mode64 && !f.long {
+			continue
+		}
+		b, ferr := f.encode(m, pc, operands)
+		switch {
+		case ferr == nil:
+			for i, op := range operands {
+				if a, ok := op.(Mem); ok && a.Size == 0 {
+					sizes[f.operands[i]] = true
+				}
+			}
+			// Of equal lengths, shorter immediates are preferred
+			if chosen == nil || len(b) < len(code) || len(b) == len(code) && f.imm < chosen.imm {
+				code, chosen, err = b, f, nil
+			}
+		case ferr != errMismatch && chosen == nil:
+			err = ferr
+		}
+	}
+	if len(sizes) > 1 {
+		return nil, errors.New("x86: memory operand of unknown size")
+	}
+	return
+}
+
+var errMismatch = errors.New("x86: operand mismatch")
+
+// check validates the registers and sizes of operands for the mode
+func check(m Mode, operands []Operand) error {
+	for _, op := range operands {
+		switch op := op.(type) {
+		case Reg:
+			if err := checkReg(m, op); err != nil {
+				return err
+			}
+			if op.rip {
+				return errors.New("x86: rip is only a memory operand base")
+			}
+		case Mem:
+			if op.Disp < -1<<31 || op.Disp >= 1<<31 {
+				return errors.New("x86: displacement out of range")
+			}
+			for _, r := range []Reg{op.Base, op.Index} {
+				if r.Size == 0 {
+					continue
+				}
+				if err := checkReg(m, r); err != nil {
+					return err
+				}
+				if r.Size != int(m)/8 {
+					return fmt.Errorf("x86: %d-bit address register in %d-bit mode", r.Size*8, m)
+				}
+			}
+			switch {
+			case op.Index.Size != 0 && op.Index.Num == 4 && !op.Index.rip:
+				return errors.New("x86: the stack pointer cannot be an index")
+			case op.Index.rip, op.Base.rip && op.Index.Size != 0:
+				return errors.New("x86: rip cannot be indexed")
+			case op.Index.Size != 0 && op.Scale != 1 && op.Scale != 2 && op.Scale != 4 && op.Scale != 8:
+				return fmt.Errorf("x86: invalid scale %d", op.Scale)
+			}
+		}
+	}
+	return nil
+}
+
+func checkReg(m Mode, r Reg) error {
+	if m == Mode32 && (r.Num >= 8 || r.Size == 8 || r.Size == 1 && r.Num >= 4 && !r.High) {
+		return errors.New("x86: register unavailable in 32-bit mode")
+	}
+	return nil
+}
+
+// size returns the operand size of a form, in bytes, from its first sized
+// operand
+func (f *form) size() int {
+	for _, o := range f.operands {
+		switch {
+		case strings.HasPrefix(o, "r/m"):
+			return atoi(o[3:]) / 8
+		case o[0] == 'r' && o != "rel8" && o != "rel32":
+			return atoi(o[1:]) / 8
+		case o == "AL":
+			return 1
+		case o == "AX":
+			return 2
+		case o == "EAX":
+			return 4
+		case o == "RAX":
+			return 8
+		}
+	}
+	return 0
+}
+
+func atoi(s string) (n int) {
+	for _, c := range s {
+		n = n*10 + int(c-'0')
+	}
+	return
+}
+
+// match reports whether an operand is accepted by an operand of a form, of
+// the given operand size
+func match(op Operand, spec string, r role, size int) bool {
+	switch op := op.(type) {
+	case Reg:
+		switch {
+		case strings.HasPrefix(spec, "r/m"):
+			return op.Size*8 == atoi(spec[3:])
+		case spec == "r8" || spec == "r16" || spec == "r32" || spec == "r64":
+			return op.Size*8 == atoi(spec[1:])
+		}
+		fixed, ok := registers[strings.ToLower(spec)]
+		return ok && fixed == op
+	case Mem:
+		switch {
+		case spec == "m":
+			return true
+		case strings.HasPrefix(spec, "r/m"):
+			return op.Size == 0 || op.Size*8 == atoi(spec[3:])
+		}
+	case Imm:
+		switch {
+		case spec == "1":
+			return op == 1
+		case strings.HasPrefix(spec, "imm"):
+			// Values are signed or unsigned in the operand size
+			v := int64(op)
+			if size < 8 {
+				n := uint(size) * 8
+				if v < -1<<(n-1) || v >= 1<<n {
+					return false
+				}
+				v = v << (64 - n) >> (64 - n)
+			}
+			bits := uint(atoi(spec[3:]))
+			switch {
+			case bits == 64:
+				return true
+			case r == roleSignedImm && int(bits) < size*8:
+				return v >= -1<<(bits-1) && v < 1<<(bits-1)
+			}
+			return v >= -1<<(bits-1) && v < 1<<bits
+		}
+	case Rel:
+		return strings.HasPrefix(spec, "rel")
+	}
+	return false
+}
+
+// encode an instruction in a form, or return errMismatch
+func (f *form) encode(m Mode, pc uint64, operands []Operand) (b []byte, err error) {
+	if len(operands) != len(f.operands) {
+		return nil, errMismatch
+	}
+	size := f.size()
+	// Sign-extended immediates of forms without sized operands, such as
+	// push, extend to the stack width
+	opsize := size
+	if opsize == 0 {
+		opsize = int(m) / 8
+	}
+	for i, op := range operands {
+		if !match(op, f.operands[i], f.roles[i], opsize) {
+			return nil, errMismatch
+		}
+	}
+	var reg, rm Operand
+	var opreg Reg
+	var imm Imm
+	var target Rel
+	for i, op := range operands {
+		switch f.roles[i] {
+		case roleReg:
+			reg = op
+		case roleRM:
+			rm = op
+		case roleOpcode:
+			opreg = op.(Reg)
+		case roleImm, roleSignedImm:
+			imm = op.(Imm)
+		case roleRel:
+			target = op.(Rel)
+		}
+	}
+
+	// REX prefix
+	rex := byte(0)
+	if f.rexW {
+		rex |= 8
+	}
+	high, low := false, false // Operands of AH-BH, or SPL-DIL
+	for _, op := range operands {
+		if r, ok := op.(Reg); ok && r.Size == 1 && r.Num >= 4 {
+			high, low = high || r.High, low || !r.High
+		}
+	}
+	if r, ok := reg.(Reg); ok && r.Num >= 8 {
+		rex |= 4
+	}
+	switch r := rm.(type) {
+	case Reg:
+		if r.Num >= 8 {
+			rex |= 1
+		}
+	case Mem:
+		if r.Index.Size != 0 && r.Index.Num >= 8 {
+			rex |= 2
+		}
+		if r.Base.Size != 0 && !r.Base.rip && r.Base.Num >= 8 {
+			rex |= 1
+		}
+	}
+	if opreg.Num >= 8 {
+		rex |= 1
+	}
+	needRex := rex != 0 || f.rex || low
+	if needRex && high {
+		return nil, errors.New("x86: ah, ch, dh and bh cannot be used with a REX prefix")
+	}
+	if needRex && m == Mode32 {
+		return nil, errMismatch
+	}
+
+	// Prefixes, REX and opcode
+	opcode := f.opcode
+	for len(opcode) > 1 && (opcode[0] == 0x66 || opcode[0] == 0xf2 || opcode[0] == 0xf3) {
+		b = append(b, opcode[0])
+		opcode = opcode[1:]
+	}
+	if size == 2 {
+		b = append(b, 0x66)
+	}
+	if needRex {
+		b = append(b, 0x40|rex)
+	}
+	b = append(b, opcode...)
+	if f.plusReg {
+		b[len(b)-1] += byte(opreg.Num & 7)
+	}
+
+	// ModRM, SIB and displacement
+	ripDisp := -1 // Position of a RIP-relative displacement
+	if f.modrm >= 0 {
+		field := byte(f.modrm)
+		if f.modrm == modrmReg {
+			field = byte(reg.(Reg).Num & 7)
+		}
+		switch r := rm.(type) {
+		case Reg:
+			b = append(b, 0xc0|field<<3|byte(r.Num&7))
+		case Mem:
+			if r.Base.rip {
+				ripDisp = len(b) + 1
+			}
+			b = append(b, address(m, field, r)...)
+		}
+	}
+	switch f.imm {
+	case 1, 2, 4, 8:
+		for i := 0; i < f.imm; i++ {
+			b = append(b, byte(int64(imm)>>(8*uint(i))))
+		}
+	}
+	if f.rel != 0 {
+		disp := int64(target) - int64(pc) - int64(len(b)+f.rel)
+		if f.rel == 1 && (disp < -128 || disp > 127) || disp < -1<<31 || disp >= 1<<31 {
+			return nil, errMismatch
+		}
+		for i := 0; i < f.rel; i++ {
+			b = append(b, byte(disp>>(8*uint(i))))
+		}
+	}
+	if ripDisp >= 0 {
+		// The displacement is relative to the end of the instruction,
+		// and Disp is the target address
+		disp := int64(rm.(Mem).Disp) - int64(pc) - int64(len(b))
+		if disp < -1<<31 || disp >= 1<<31 {
+			return nil, errors.New("x86: rip-relative target out of range")
+		}
+		for i := 0; i < 4; i++ {
+			b[ripDisp+i] = byte(disp >> (8 * uint(i)))
+		}
+	}
+	return
+}
+
+// address encodes the ModRM, SIB and displacement of a memory operand
+func address(m Mode, field byte, a Mem) (b []byte) {
+	disp := func(n int) {
+		for i := 0; i < n; i++ {
+			b = append(b, byte(a.Disp>>(8*uint(i))))
+		}
+	}
+	dispSize, mod := 4, byte(2)
+	switch {
+	case a.Disp == 0 && a.Base.Size != 0 && a.Base.Num&7 != 5:
+		dispSize, mod = 0, 0
+	case a.Disp >= -128 && a.Disp < 128 && a.Base.Size != 0 && !a.Base.rip:
+		dispSize, mod = 1, 1
+	}
+	scale := map[int]byte{0: 0, 1: 0, 2: 1, 4: 2, 8: 3}[a.Scale]
+	switch {
+	case a.Base.rip:
+		b = append(b, field<<3|5)
+		disp(4)
+	case a.Base.Size == 0 && a.Index.Size == 0 && m == Mode32:
+		b = append(b, field<<3|5)
+		disp(4)
+	case a.Base.Size == 0:
+		// SIB with no base; 64-bit mode has no plain absolute form
+		index := byte(4)
+		if a.Index.Size != 0 {
+			index = byte(a.Index.Num & 7)
+		}
+		b = append(b, field<<3|4, scale<<6|index<<3|5)
+		disp(4)
+	case a.Index.Size != 0 || a.Base.Num&7 == 4:
+		index := byte(4)
+		if a.Index.Size != 0 {
+			index = byte(a.Index.Num & 7)
+		}
+		b = append(b, mod<<6|field<<3|4, scale<<6|index<<3|byte(a.Base.Num&7))
+		disp(dispSize)
+	default:
+		b = append(b, mod<<6|field<<3|byte(a.Base.Num&7))
+		disp(dispSize)
+	}
+	return
+}
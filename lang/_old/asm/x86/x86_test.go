@@ -0,0 +1,143 @@
+package x86
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The expected bytes are those GNU as assembles the instruction in the
+// comment to, with one exception: as prefers the moffs form of a 32-bit
+// load from an absolute address, while Encode accepts only ModRM memory
+// operands and uses a disp32 address, one byte longer.
+var encodings = []struct {
+	mode     Mode
+	pc       uint64
+	mnemonic string
+	operands []Operand
+	want     []byte
+}{
+	// mov rax, rbx
+	{Mode64, 0, "mov", []Operand{RAX, RBX}, []byte{0x48, 0x89, 0xd8}},
+	// mov r8d, 1
+	{Mode64, 0, "mov", []Operand{Reg{Num: 8, Size: 4}, Imm(1)}, []byte{0x41, 0xb8, 1, 0, 0, 0}},
+	// mov rax, -1
+	{Mode64, 0, "mov", []Operand{RAX, Imm(-1)}, []byte{0x48, 0xc7, 0xc0, 0xff, 0xff, 0xff, 0xff}},
+	// movabs rax, 0x123456789
+	{Mode64, 0, "mov", []Operand{RAX, Imm(0x123456789)}, []byte{0x48, 0xb8, 0x89, 0x67, 0x45, 0x23, 1, 0, 0, 0}},
+	// mov al, [rsp]
+	{Mode64, 0, "mov", []Operand{AL, Mem{Base: RSP}}, []byte{0x8a, 0x04, 0x24}},
+	// mov [rbp], ecx
+	{Mode64, 0, "mov", []Operand{Mem{Base: RBP}, ECX}, []byte{0x89, 0x4d, 0x00}},
+	// mov [r13+8], r12
+	{Mode64, 0, "mov", []Operand{Mem{Base: Reg{Num: 13, Size: 8}, Disp: 8}, Reg{Num: 12, Size: 8}}, []byte{0x4d, 0x89, 0x65, 0x08}},
+	// mov rax, [rsp+rcx*8-8]
+	{Mode64, 0, "mov", []Operand{RAX, Mem{Base: RSP, Index: RCX, Scale: 8, Disp: -8}}, []byte{0x48, 0x8b, 0x44, 0xcc, 0xf8}},
+	// mov eax, [r12+r9*4+0x1000]
+	{Mode64, 0, "mov", []Operand{EAX, Mem{Base: Reg{Num: 12, Size: 8}, Index: Reg{Num: 9, Size: 8}, Scale: 4, Disp: 0x1000}}, []byte{0x43, 0x8b, 0x84, 0x8c, 0, 0x10, 0, 0}},
+	// mov qword ptr [rax], 5
+	{Mode64, 0, "mov", []Operand{Mem{Base: RAX, Size: 8}, Imm(5)}, []byte{0x48, 0xc7, 0x00, 5, 0, 0, 0}},
+	// mov byte ptr [rbx+1], 0x7f
+	{Mode64, 0, "mov", []Operand{Mem{Base: RBX, Disp: 1, Size: 1}, Imm(0x7f)}, []byte{0xc6, 0x43, 0x01, 0x7f}},
+	// mov sil, dl
+	{Mode64, 0, "mov", []Operand{Reg{Num: 6, Size: 1}, DL}, []byte{0x40, 0x88, 0xd6}},
+	// mov ah, bl
+	{Mode64, 0, "mov", []Operand{AH, BL}, []byte{0x88, 0xdc}},
+	// mov eax, ds:0x1000
+	{Mode64, 0, "mov", []Operand{EAX, Mem{Disp: 0x1000}}, []byte{0x8b, 0x04, 0x25, 0, 0x10, 0, 0}},
+	// lea rdx, [rip+0xff9], at 0x1000
+	{Mode64, 0x1000, "lea", []Operand{RDX, Mem{Base: RIP, Disp: 0x2000}}, []byte{0x48, 0x8d, 0x15, 0xf9, 0x0f, 0, 0}},
+	// add rsp, 8
+	{Mode64, 0, "add", []Operand{RSP, Imm(8)}, []byte{0x48, 0x83, 0xc4, 0x08}},
+	// add eax, 0x1000
+	{Mode64, 0, "add", []Operand{EAX, Imm(0x1000)}, []byte{0x05, 0, 0x10, 0, 0}},
+	// sub rsp, 0x200
+	{Mode64, 0, "sub", []Operand{RSP, Imm(0x200)}, []byte{0x48, 0x81, 0xec, 0, 2, 0, 0}},
+	// cmp r10, rcx
+	{Mode64, 0, "cmp", []Operand{Reg{Num: 10, Size: 8}, RCX}, []byte{0x49, 0x39, 0xca}},
+	// and ax, 0xff
+	{Mode64, 0, "and", []Operand{AX, Imm(0xff)}, []byte{0x66, 0x25, 0xff, 0}},
+	// xor ecx, ecx
+	{Mode64, 0, "xor", []Operand{ECX, ECX}, []byte{0x31, 0xc9}},
+	// test al, 1
+	{Mode64, 0, "test", []Operand{AL, Imm(1)}, []byte{0xa8, 0x01}},
+	// imul rsi, rax
+	{Mode64, 0, "imul", []Operand{RSI, RAX}, []byte{0x48, 0x0f, 0xaf, 0xf0}},
+	// imul eax, ecx, 10
+	{Mode64, 0, "imul", []Operand{EAX, ECX, Imm(10)}, []byte{0x6b, 0xc1, 0x0a}},
+	// not qword ptr [rsp+16]
+	{Mode64, 0, "not", []Operand{Mem{Base: RSP, Disp: 16, Size: 8}}, []byte{0x48, 0xf7, 0x54, 0x24, 0x10}},
+	// div rcx
+	{Mode64, 0, "div", []Operand{RCX}, []byte{0x48, 0xf7, 0xf1}},
+	// shl rax, cl
+	{Mode64, 0, "shl", []Operand{RAX, CL}, []byte{0x48, 0xd3, 0xe0}},
+	// sar edx, 31
+	{Mode64, 0, "sar", []Operand{EDX, Imm(31)}, []byte{0xc1, 0xfa, 0x1f}},
+	// shr rcx, 1
+	{Mode64, 0, "shr", []Operand{RCX, Imm(1)}, []byte{0x48, 0xd1, 0xe9}},
+	// movzx eax, byte ptr [rsp+rcx-1]
+	{Mode64, 0, "movzx", []Operand{EAX, Mem{Base: RSP, Index: RCX, Scale: 1, Disp: -1, Size: 1}}, []byte{0x0f, 0xb6, 0x44, 0x0c, 0xff}},
+	// movsxd rax, dword ptr [rdx+rax*4]
+	{Mode64, 0, "movsxd", []Operand{RAX, Mem{Base: RDX, Index: RAX, Scale: 4, Size: 4}}, []byte{0x48, 0x63, 0x04, 0x82}},
+	// bswap r9
+	{Mode64, 0, "bswap", []Operand{Reg{Num: 9, Size: 8}}, []byte{0x49, 0x0f, 0xc9}},
+	// push r12
+	{Mode64, 0, "push", []Operand{Reg{Num: 12, Size: 8}}, []byte{0x41, 0x54}},
+	// pop rbp
+	{Mode64, 0, "pop", []Operand{RBP}, []byte{0x5d}},
+	// jmp 0x10, at 0
+	{Mode64, 0, "jmp", []Operand{Rel(0x10)}, []byte{0xeb, 0x0e}},
+	// jne 0x1010, at 0x10
+	{Mode64, 0x10, "jnz", []Operand{Rel(0x1010)}, []byte{0x0f, 0x85, 0xfa, 0x0f, 0, 0}},
+	// call 0, at 0x100
+	{Mode64, 0x100, "call", []Operand{Rel(0)}, []byte{0xe8, 0xfb, 0xfe, 0xff, 0xff}},
+	// jmp rax
+	{Mode64, 0, "jmp", []Operand{RAX}, []byte{0xff, 0xe0}},
+	// rep stosb
+	{Mode64, 0, "rep  stosb", nil, []byte{0xf3, 0xaa}},
+	// loop 0, at 0x10
+	{Mode64, 0x10, "loop", []Operand{Rel(0)}, []byte{0xe2, 0xee}},
+	// mov eax, [esp+4]
+	{Mode32, 0, "mov", []Operand{EAX, Mem{Base: ESP, Disp: 4}}, []byte{0x8b, 0x44, 0x24, 0x04}},
+	// inc esi
+	{Mode32, 0, "inc", []Operand{ESI}, []byte{0x46}},
+	// mov eax, ds:0x1000, which as encodes as a1 00 10 00 00
+	{Mode32, 0, "mov", []Operand{EAX, Mem{Disp: 0x1000}}, []byte{0x8b, 0x05, 0, 0x10, 0, 0}},
+	// shld edx, eax, cl
+	{Mode32, 0, "shld", []Operand{EDX, EAX, CL}, []byte{0x0f, 0xa5, 0xc2}},
+	// lea edi, [ebp-8]
+	{Mode32, 0, "lea", []Operand{EDI, Mem{Base: EBP, Disp: -8}}, []byte{0x8d, 0x7d, 0xf8}},
+}
+
+func TestEncode(t *testing.T) {
+	for _, e := range encodings {
+		got, err := Encode(e.mode, e.pc, e.mnemonic, e.operands...)
+		if err != nil || !bytes.Equal(got, e.want) {
+			t.Errorf("%s %v in %d-bit mode: got % x, %v; want % x", e.mnemonic, e.operands, e.mode, got, err, e.want)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		mode     Mode
+		mnemonic string
+		operands []Operand
+		want     string
+	}{
+		{Mode64, "mov", []Operand{AH, Reg{Num: 6, Size: 1}}, "cannot be used with a REX prefix"},
+		{Mode32, "mov", []Operand{RAX, RBX}, "unavailable in 32-bit mode"},
+		{Mode64, "mov", []Operand{Mem{Base: RAX}, Imm(1)}, "memory operand of unknown size"},
+		{Mode64, "mov", []Operand{RAX, Mem{Base: RAX, Index: RSP, Scale: 1}}, "stack pointer cannot be an index"},
+		{Mode64, "mov", []Operand{RAX, Mem{Base: RAX, Index: RCX, Scale: 3}}, "invalid scale 3"},
+		{Mode64, "mov", []Operand{RAX, Mem{Base: EAX}}, "32-bit address register"},
+		{Mode64, "add", []Operand{AL, Imm(0x100)}, "invalid operands"},
+		{Mode64, "frob", nil, "unknown instruction FROB"},
+	}
+	for _, test := range tests {
+		_, err := Encode(test.mode, 0, test.mnemonic, test.operands...)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s %v: got %v, want %q", test.mnemonic, test.operands, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Textual assembly of bytelang, for writing and inspecting programs by hand,
+// in the asmlang grammar of spec.txt.  Each line holds one statement,
+// optionally preceded by a label, and # begins a comment:
+//
+//	statement	= "function" | "end" | "allocate" number | "deallocate" number
+//			| "store" [length] address expression | "thread" number
+//			| "if" expression | "return" | "pragma" quoted-string
+//	expression	= "call" number | "open" number
+//			| "process" number number { number } | "reference" number
+//			| "load" [length] address | "literal" { number } | op [length]
+//	op		= "not" | "and" | "or" | "xor" | "shiftl" | "lshiftr"
+//			| "ashiftr" | "add" | "sub" | "mult" | "floordiv" | "exp"
+//			| "mod"
+//	length		= "bytes" number
+//	address		= "rel" ( "sp" | "fp" ) number | "val" "ip"
+//			| "segment" number number
+//	number		= decimal | "0x" hex | label
+//
+// Statements outside any function belong to the global function, and the
+// bodies of function and if statements close with end.  Stores, loads and
+// ops are a word long unless given a length in bytes, and segment addresses
+// give the segment id and the offset into it.  Open is a system call opening
+// a file by id.  A label, declared as name: before a statement, stands for
+// the bytecode offset of that statement, so that call and thread can name
+// functions.
+package asmlang
+
+import (
+	"fmt"
+	"github.com/vvanpo/system/lang/bytelang"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Mnemonics of the operations, indexed from bytelang.MarkerNot
+var ops = []string{"not", "and", "or", "xor", "shiftl", "lshiftr", "ashiftr", "add", "sub", "mult", "floordiv", "exp", "mod"}
+
+const (
+	segmentShift = 48
+	wordLength   = 8
+)
+
+type line struct {
+	number int
+	tokens []string
+}
+
+type fixup struct {
+	label string
+	line  int
+}
+
+type assembler struct {
+	lines  []line
+	i      int
+	b      []byte
+	labels map[string]uint
+	fixups map[int]fixup // Words that hold the offset of a label
+	line   *line
+	tokens []string // Remaining tokens of the current line
+	err    error
+}
+
+// Assemble text into bytelang
+func Assemble(text string) (b *bytelang.Bytelang, err error) {
+	a := &assembler{labels: make(map[string]uint), fixups: make(map[int]fixup)}
+	if err = a.split(text); err != nil {
+		return
+	}
+	a.function(false)
+	if a.err != nil {
+		return nil, a.err
+	}
+	for pos, f := range a.fixups {
+		off, ok := a.labels[f.label]
+		if !ok {
+			return nil, fmt.Errorf("asmlang: line %d: undefined label %s", f.line, f.label)
+		}
+		putWord(a.b[pos:], off)
+	}
+	return bytelang.Decode(string(a.b))
+}
+
+// split divides text into lines of tokens, without comments or blank lines
+func (a *assembler) split(text string) error {
+	for n, s := range strings.Split(text, "\n") {
+		var tokens []string
+		r := []rune(s)
+		for i := 0; i < len(r); {
+			switch {
+			case unicode.IsSpace(r[i]):
+				i++
+				continue
+			case r[i] == '#':
+				i = len(r)
+				continue
+			}
+			start := i
+			if r[i] == '"' {
+				for i++; i < len(r) && r[i] != '"'; i++ {
+					if r[i] == '\\' {
+						i++
+					}
+				}
+				if i >= len(r) {
+					return fmt.Errorf("asmlang: line %d: unterminated string", n+1)
+				}
+				i++
+			} else {
+				for i < len(r) && !unicode.IsSpace(r[i]) && r[i] != '#' {
+					i++
+				}
+			}
+			tokens = append(tokens, string(r[start:i]))
+		}
+		if len(tokens) > 0 {
+			a.lines = append(a.lines, line{n + 1, tokens})
+		}
+	}
+	return nil
+}
+
+func (a *assembler) fail(format string, v ...interface{}) {
+	if a.err == nil {
+		n := 0
+		if a.line != nil {
+			n = a.line.number
+		}
+		a.err = fmt.Errorf("asmlang: line %d: %s", n, fmt.Sprintf(format, v...))
+	}
+}
+
+// next returns the next token of the current line
+func (a *assembler) next() (t string) {
+	if len(a.tokens) == 0 {
+		a.fail("missing operand")
+		return
+	}
+	t, a.tokens = a.tokens[0], a.tokens[1:]
+	return
+}
+
+func (a *assembler) byte(c byte) { a.b = append(a.b, c) }
+
+func (a *assembler) word(w uint) {
+	var b [8]byte
+	putWord(b[:], w)
+	a.b = append(a.b, b[:]...)
+}
+
+func putWord(b []byte, w uint) {
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(w)
+		w >>= 8
+	}
+}
+
+// number writes a number operand, or the offset of a label
+func (a *assembler) number() {
+	t := a.next()
+	if validLabel(t) {
+		a.fixups[len(a.b)] = fixup{t, a.line.number}
+		a.word(0)
+		return
+	}
+	a.word(a.parseNumber(t))
+}
+
+func (a *assembler) parseNumber(t string) uint {
+	var n uint64
+	var err error
+	if strings.HasPrefix(t, "0x") {
+		n, err = strconv.ParseUint(t[2:], 16, 64)
+	} else {
+		n, err = strconv.ParseUint(t, 10, 64)
+	}
+	if err != nil {
+		a.fail("invalid number %s", t)
+	}
+	return uint(n)
+}
+
+func validLabel(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// function writes the statements of a body preceded by their count, up to
+// the end of a nested body or of the text
+func (a *assembler) function(nested bool) {
+	count := len(a.b)
+	a.word(0)
+	n := uint(0)
+	for a.err == nil {
+		if a.i == len(a.lines) {
+			if nested {
+				a.fail("missing end")
+			}
+			break
+		}
+		a.line = &a.lines[a.i]
+		a.tokens = a.line.tokens
+		a.i++
+		for len(a.tokens) > 0 && strings.HasSuffix(a.tokens[0], ":") {
+			label := strings.TrimSuffix(a.tokens[0], ":")
+			if !validLabel(label) {
+				a.fail("invalid label %s", label)
+			}
+			if _, ok := a.labels[label]; ok {
+				a.fail("duplicate label %s", label)
+			}
+			a.labels[label] = uint(len(a.b))
+			a.tokens = a.tokens[1:]
+			if len(a.tokens) == 0 {
+				if a.i == len(a.lines) || a.lines[a.i].tokens[0] == "end" {
+					a.fail("label %s without a statement", label)
+					return
+				}
+				a.line = &a.lines[a.i]
+				a.tokens = a.line.tokens
+				a.i++
+			}
+		}
+		if a.tokens[0] == "end" {
+			if !nested {
+				a.fail("end outside a body")
+			}
+			if len(a.tokens) > 1 {
+				a.fail("unexpected %s", a.tokens[1])
+			}
+			a.tokens = nil
+			break
+		}
+		a.statement()
+		if len(a.tokens) > 0 {
+			a.fail("unexpected %s", a.tokens[0])
+		}
+		n++
+	}
+	putWord(a.b[count:], n)
+}
+
+func (a *assembler) statement() {
+	switch t := a.next(); t {
+	case "function":
+		a.byte(bytelang.MarkerFunction)
+		a.endOfLine()
+		a.function(true)
+	case "allocate":
+		a.byte(bytelang.MarkerAllocate)
+		a.number()
+	case "deallocate":
+		a.byte(bytelang.MarkerDeallocate)
+		a.number()
+	case "store":
+		a.byte(bytelang.MarkerAssignment)
+		length := a.length()
+		a.address()
+		a.expression()
+		a.putLength(length)
+	case "thread":
+		a.byte(bytelang.MarkerThread)
+		a.number()
+	case "if":
+		a.byte(bytelang.MarkerIf)
+		a.expression()
+		a.endOfLine()
+		a.function(true)
+	case "return":
+		a.byte(bytelang.MarkerReturn)
+	case "pragma":
+		a.byte(bytelang.MarkerPragma)
+		s, err := strconv.Unquote(a.next())
+		if err != nil {
+			a.fail("invalid pragma string")
+		}
+		a.word(uint(len(s)))
+		a.b = append(a.b, s...)
+	default:
+		a.fail("invalid statement %s", t)
+	}
+}
+
+// length returns the tokens of an optional length, which follows bytes
+func (a *assembler) length() []string {
+	if len(a.tokens) == 0 || a.tokens[0] != "bytes" {
+		return nil
+	}
+	a.next()
+	return []string{a.next()}
+}
+
+// putLength writes a length parsed by length, or a word length if there is
+// none
+func (a *assembler) putLength(length []string) {
+	if length == nil {
+		a.word(wordLength)
+		return
+	}
+	rest := a.tokens
+	a.tokens = length
+	a.number()
+	a.tokens = rest
+}
+
+func (a *assembler) endOfLine() {
+	if len(a.tokens) > 0 {
+		a.fail("unexpected %s", a.tokens[0])
+	}
+}
+
+func (a *assembler) expression() {
+	switch t := a.next(); t {
+	case "call":
+		a.byte(bytelang.MarkerFunctionCall)
+		a.number()
+	case "process":
+		a.byte(bytelang.MarkerProcessCall)
+		a.number()
+		a.number()
+		a.word(uint(len(a.tokens)))
+		for len(a.tokens) > 0 {
+			a.number()
+		}
+	case "reference":
+		a.byte(bytelang.MarkerReference)
+		a.number()
+	case "open":
+		a.byte(bytelang.MarkerProcessCall)
+		a.word(bytelang.SystemModule)
+		a.number()
+		a.word(0)
+	case "load":
+		a.byte(bytelang.MarkerDereference)
+		length := a.length()
+		a.address()
+		a.putLength(length)
+	case "literal":
+		a.byte(bytelang.MarkerLiteral)
+		a.word(uint(len(a.tokens)))
+		for len(a.tokens) > 0 {
+			a.number()
+		}
+	default:
+		for i, op := range ops {
+			if t == op {
+				a.byte(bytelang.MarkerNot + byte(i))
+				a.putLength(a.length())
+				return
+			}
+		}
+		a.fail("invalid expression %s", t)
+	}
+}
+
+func (a *assembler) address() {
+	switch t := a.next(); t {
+	case "rel":
+		switch r := a.next(); r {
+		case "sp":
+			a.byte(bytelang.MarkerStackPointer)
+		case "fp":
+			a.byte(bytelang.MarkerFramePointer)
+		default:
+			a.fail("invalid register %s", r)
+		}
+		a.number()
+	case "val":
+		if r := a.next(); r != "ip" {
+			a.fail("invalid register %s", r)
+		}
+		a.byte(bytelang.MarkerInstructionPointer)
+	case "segment":
+		a.byte(bytelang.MarkerAddress)
+		id, off := a.parseNumber(a.next()), a.parseNumber(a.next())
+		if id >= 1<<16 || off >= 1<<segmentShift {
+			a.fail("segment address out of range")
+		}
+		a.word(id<<segmentShift | off)
+	default:
+		a.fail("invalid address %s", t)
+	}
+}
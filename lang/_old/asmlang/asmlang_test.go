@@ -0,0 +1,141 @@
+package asmlang
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// double calls a function doubling its parameter, exiting with the result
+const double = `
+# main frame's status word is at fp+8
+allocate 8
+store rel sp 0 literal 6
+store bytes 0 rel sp 0 call double
+store rel fp 8 load rel sp 0
+deallocate 8
+double:
+function
+	allocate 8
+	store rel sp 0 literal 2
+	allocate 8
+	store rel sp 0 load rel fp 8
+	store rel fp 8 mult
+	return
+end
+`
+
+func TestAssemble(t *testing.T) {
+	b, err := Assemble(double)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := b.Run(); status != 12 || err != nil {
+		t.Errorf("ran to %d, %v", status, err)
+	}
+}
+
+// every uses each form of the grammar
+const every = `
+pragma "fold"
+allocate 32
+store rel sp 0 literal 1 0xff f
+store bytes 16 rel sp 8 add bytes 16
+store bytes 3 segment 2 0x10 load bytes 3 rel fp 16
+store val ip load val ip
+store rel sp 0 open 3
+store rel sp 0 process 3 4 5 6
+store rel sp 0 reference 3
+if not
+	thread f
+	return
+end
+f:
+function
+	store rel fp 8 exp
+end
+`
+
+func TestRoundTrip(t *testing.T) {
+	b, err := Assemble(every)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := Disassemble(b)
+	c, err := Assemble(text)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, text)
+	}
+	if c.Compile() != b.Compile() {
+		t.Fatalf("disassembly assembles to different bytecode:\n%s", text)
+	}
+	for _, want := range []string{
+		"store rel sp 0 literal 1 255 ",
+		"store bytes 16 rel sp 8 add bytes 16\n",
+		"store bytes 3 segment 2 16 load bytes 3 rel fp 16\n",
+		"store val ip load val ip\n",
+		"store rel sp 0 open 3\n",
+		"store rel sp 0 process 3 4 5 6\n",
+		"if not\n",
+		"store rel fp 8 exp\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("disassembly lacks %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestRoundTripRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		buf := make([]byte, 8+r.Intn(120))
+		buf[7] = byte(r.Intn(4))
+		for j := 8; j < len(buf); j++ {
+			switch r.Intn(4) {
+			case 0:
+				buf[j] = byte(r.Intn(int(bytelang.MarkerPragma) + 1))
+			case 1:
+				buf[j] = byte(r.Intn(256))
+			}
+		}
+		b, err := bytelang.Decode(string(buf))
+		if err != nil {
+			continue
+		}
+		text := Disassemble(b)
+		c, err := Assemble(text)
+		if err != nil {
+			t.Fatalf("%v in\n%s", err, text)
+		}
+		if c.Compile() != b.Compile() {
+			t.Fatalf("disassembly assembles to different bytecode:\n%s", text)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct{ text, want string }{
+		{"end", "line 1: end outside a body"},
+		{"function", "line 1: missing end"},
+		{"jump", "line 1: invalid statement jump"},
+		{"allocate", "line 1: missing operand"},
+		{"allocate 1 2", "line 1: unexpected 2"},
+		{"store rel xp 0 literal", "line 1: invalid register xp"},
+		{"store bytes rel sp 0 literal", "line 1: invalid address sp"},
+		{"store segment 70000 0 literal", "line 1: segment address out of range"},
+		{"store rel sp 0 call g", "line 1: undefined label g"},
+		{"l:\nl: return", "line 2: duplicate label l"},
+		{"pragma \"a", "line 1: unterminated string"},
+	}
+	for _, test := range tests {
+		_, err := Assemble(test.text)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want %q", test.text, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package asmlang
+
+import (
+	"fmt"
+	"github.com/vvanpo/system/lang/bytelang"
+	"strconv"
+	"strings"
+)
+
+type disassembler struct {
+	b         []byte
+	pos       int
+	functions map[uint]bool // Offsets of function statements
+	targets   map[uint]bool // Offsets called or started as threads
+	labelled  map[uint]bool
+	s         string
+	depth     int
+}
+
+// Disassemble bytelang into text that assembles back into the same bytecode.
+// Functions that are called or started as threads are labelled by their
+// offset.
+func Disassemble(b *bytelang.Bytelang) string {
+	d := &disassembler{b: []byte(b.Compile()), functions: make(map[uint]bool), targets: make(map[uint]bool)}
+	// The first pass finds the functions to label
+	d.function()
+	d.labelled = make(map[uint]bool)
+	for off := range d.targets {
+		d.labelled[off] = d.functions[off]
+	}
+	d.pos, d.s = 0, ""
+	d.function()
+	return d.s
+}
+
+func (d *disassembler) word() (w uint) {
+	for i := 0; i < 8; i++ {
+		w = w<<8 | uint(d.b[d.pos+i])
+	}
+	d.pos += 8
+	return
+}
+
+func (d *disassembler) line(s string) {
+	if d.labelled == nil {
+		return
+	}
+	d.s += strings.Repeat("\t", d.depth) + s + "\n"
+}
+
+// target returns the operand of a call or thread
+func (d *disassembler) target() string {
+	off := d.word()
+	d.targets[off] = true
+	if d.labelled != nil && d.labelled[off] {
+		return fmt.Sprintf("f%d", off)
+	}
+	return fmt.Sprint(off)
+}
+
+func (d *disassembler) function() {
+	n := d.word()
+	for i := uint(0); i < n; i++ {
+		d.statement()
+	}
+}
+
+func (d *disassembler) body(s string) {
+	d.line(s)
+	d.depth++
+	d.function()
+	d.depth--
+	d.line("end")
+}
+
+func (d *disassembler) statement() {
+	off := uint(d.pos)
+	if d.labelled[off] {
+		d.line(fmt.Sprintf("f%d:", off))
+	}
+	m := d.b[d.pos]
+	d.pos++
+	switch m {
+	case bytelang.MarkerFunction:
+		d.functions[off] = true
+		d.body("function")
+	case bytelang.MarkerAllocate:
+		d.line(fmt.Sprint("allocate ", d.word()))
+	case bytelang.MarkerDeallocate:
+		d.line(fmt.Sprint("deallocate ", d.word()))
+	case bytelang.MarkerAssignment:
+		a := d.address()
+		e := d.expression()
+		d.line(fmt.Sprintf("store %s%s %s", length(d.word()), a, e))
+	case bytelang.MarkerThread:
+		d.line("thread " + d.target())
+	case bytelang.MarkerIf:
+		d.body("if " + d.expression())
+	case bytelang.MarkerReturn:
+		d.line("return")
+	case bytelang.MarkerPragma:
+		n := int(d.word())
+		d.line("pragma " + strconv.Quote(string(d.b[d.pos:d.pos+n])))
+		d.pos += n
+	}
+}
+
+func (d *disassembler) expression() string {
+	m := d.b[d.pos]
+	d.pos++
+	switch m {
+	case bytelang.MarkerFunctionCall:
+		return "call " + d.target()
+	case bytelang.MarkerProcessCall:
+		module, function, n := d.word(), d.word(), d.word()
+		if module == bytelang.SystemModule && n == 0 {
+			return fmt.Sprint("open ", function)
+		}
+		s := fmt.Sprint("process ", module, " ", function)
+		for ; n > 0; n-- {
+			s += fmt.Sprint(" ", d.word())
+		}
+		return s
+	case bytelang.MarkerReference:
+		return fmt.Sprint("reference ", d.word())
+	case bytelang.MarkerDereference:
+		a := d.address()
+		return fmt.Sprintf("load %s%s", length(d.word()), a)
+	case bytelang.MarkerLiteral:
+		s := "literal"
+		for n := d.word(); n > 0; n-- {
+			s += fmt.Sprint(" ", d.word())
+		}
+		return s
+	}
+	return strings.TrimSpace(ops[m-bytelang.MarkerNot] + " " + length(d.word()))
+}
+
+// length returns the optional length of a store, load or op, followed by a
+// space
+func length(n uint) string {
+	if n == wordLength {
+		return ""
+	}
+	return fmt.Sprintf("bytes %d ", n)
+}
+
+func (d *disassembler) address() string {
+	m := d.b[d.pos]
+	d.pos++
+	switch m {
+	case bytelang.MarkerStackPointer:
+		return fmt.Sprint("rel sp ", d.word())
+	case bytelang.MarkerFramePointer:
+		return fmt.Sprint("rel fp ", d.word())
+	case bytelang.MarkerInstructionPointer:
+		return "val ip"
+	}
+	a := d.word()
+	return fmt.Sprintf("segment %d %d", a>>segmentShift, a&(1<<segmentShift-1))
+}
@@ -1,38 +1,42 @@
 package bytelang
 
-// Bytecode markers
+// Bytecode markers, which begin each statement, expression and address
 const (
-	bAddress byte = iota
+	MarkerAddress byte = iota
 	// Globals:
-	bStackPointer
-	bFramePointer
-	bInstructionPointer
+	MarkerStackPointer
+	MarkerFramePointer
+	MarkerInstructionPointer
 	// Statements:
-	bFunction
-	bAllocate
-	bDeallocate
-	bAssignment
-	bThread
-	bIf
-	bReturn
+	MarkerFunction
+	MarkerAllocate
+	MarkerDeallocate
+	MarkerAssignment
+	MarkerThread
+	MarkerIf
+	MarkerReturn
 	// Expressions:
-	bFunctionCall
-	bReference
-	bDereference
-	bLiteral
-	bNot
-	bAnd
-	bOr
-	bXor
-	bShiftL
-	bLShiftR
-	bAShiftR
-	bAdd
-	bSubtract
-	bMultiply
-	bDivideFloor
-	bExponent
-	bModulo
+	MarkerFunctionCall
+	MarkerReference
+	MarkerDereference
+	MarkerLiteral
+	MarkerNot
+	MarkerAnd
+	MarkerOr
+	MarkerXor
+	MarkerShiftL
+	MarkerLShiftR
+	MarkerAShiftR
+	MarkerAdd
+	MarkerSubtract
+	MarkerMultiply
+	MarkerDivideFloor
+	MarkerExponent
+	MarkerModulo
+	// Markers added after the original set, kept last so that existing
+	// bytecode keeps its encoding:
+	MarkerProcessCall
+	MarkerPragma
 )
 
 // Representation of a bytelang file
@@ -65,12 +69,32 @@ type ifStmt struct {
 
 type returnStmt struct{}
 
+// Pragmas are compiler options, which apply to the statements following them
+// in the same function body
+type pragma string
+
+const (
+	// Pass absolute addresses through native compilation as real addresses
+	pragmaRealAddress = "real address"
+	// Optimization passes
+	pragmaFold  = "fold constants"
+	pragmaDead  = "remove dead code"
+	pragmaMerge = "merge allocations"
+)
+
 type expression interface {
 	compile() string
 }
 
 type functionCall uint
 
+// A call to a function in another code segment, which runs in a new process
+type processCall struct {
+	module   uint
+	function uint
+	segments []uint // Segments shared with the new process
+}
+
 type reference uint
 
 type dereference struct {
@@ -89,6 +113,8 @@ type address interface {
 	compile() string
 }
 
+type absolute uint
+
 type stackPointer struct {
 	offset uint
 }
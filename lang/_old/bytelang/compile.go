@@ -16,7 +16,7 @@ func (b *Bytelang) Compile() (s string) {
 }
 
 func (f function) compile() (s string) {
-	s = string(bFunction)
+	s = string(MarkerFunction)
 	s += putWord(uint(len(f)))
 	for _, stmt := range f {
 		s += stmt.compile()
@@ -25,19 +25,19 @@ func (f function) compile() (s string) {
 }
 
 func (a allocate) compile() (s string) {
-	s = string(bAllocate)
+	s = string(MarkerAllocate)
 	s += putWord(uint(a))
 	return
 }
 
 func (d deallocate) compile() (s string) {
-	s = string(bDeallocate)
+	s = string(MarkerDeallocate)
 	s += putWord(uint(d))
 	return
 }
 
 func (a assignment) compile() (s string) {
-	s = string(bAssignment)
+	s = string(MarkerAssignment)
 	s += a.address.compile()
 	s += a.value.compile()
 	s += putWord(a.length)
@@ -45,14 +45,15 @@ func (a assignment) compile() (s string) {
 }
 
 func (t thread) compile() (s string) {
-	s = string(bThread)
+	s = string(MarkerThread)
 	s += putWord(uint(t))
 	return
 }
 
 func (i ifStmt) compile() (s string) {
-	s = string(bIf)
+	s = string(MarkerIf)
 	s += i.condition.compile()
+	s += putWord(uint(len(i.statement)))
 	for _, stmt := range i.statement {
 		s += stmt.compile()
 	}
@@ -60,31 +61,50 @@ func (i ifStmt) compile() (s string) {
 }
 
 func (r returnStmt) compile() (s string) {
-	s = string(bReturn)
+	s = string(MarkerReturn)
+	return
+}
+
+func (p pragma) compile() (s string) {
+	s = string(MarkerPragma)
+	s += putWord(uint(len(p)))
+	s += string(p)
 	return
 }
 
 func (f functionCall) compile() (s string) {
-	s = string(bFunctionCall)
+	s = string(MarkerFunctionCall)
 	s += putWord(uint(f))
 	return
 }
 
+func (p processCall) compile() (s string) {
+	s = string(MarkerProcessCall)
+	s += putWord(p.module)
+	s += putWord(p.function)
+	s += putWord(uint(len(p.segments)))
+	for _, id := range p.segments {
+		s += putWord(id)
+	}
+	return
+}
+
 func (r reference) compile() (s string) {
-	s = string(bReference)
+	s = string(MarkerReference)
 	s += putWord(uint(r))
 	return
 }
 
 func (d dereference) compile() (s string) {
-	s = string(bDereference)
+	s = string(MarkerDereference)
 	s += d.address.compile()
 	s += putWord(d.length)
 	return
 }
 
 func (l literal) compile() (s string) {
-	s = string(bLiteral)
+	s = string(MarkerLiteral)
+	s += putWord(uint(len(l)))
 	for _, w := range l {
 		s += putWord(w)
 	}
@@ -97,19 +117,25 @@ func (o operation) compile() (s string) {
 	return
 }
 
+func (a absolute) compile() (s string) {
+	s = string(MarkerAddress)
+	s += putWord(uint(a))
+	return
+}
+
 func (sp stackPointer) compile() (s string) {
-	s = string(bStackPointer)
+	s = string(MarkerStackPointer)
 	s += putWord(sp.offset)
 	return
 }
 
 func (f framePointer) compile() (s string) {
-	s = string(bFramePointer)
+	s = string(MarkerFramePointer)
 	s += putWord(f.offset)
 	return
 }
 
 func (i instructionPointer) compile() (s string) {
-	s = string(bInstructionPointer)
+	s = string(MarkerInstructionPointer)
 	return
 }
@@ -0,0 +1,227 @@
+package bytelang
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// A step is a decoded statement together with its location in the bytecode
+type step struct {
+	statement
+	body uint // Offset of the first statement of a function or if body
+	next uint // Offset of the statement following this one
+}
+
+// Bytecode that has been decoded for execution
+type code struct {
+	bytes []byte
+	steps map[uint]*step // Indexed by statement offset
+}
+
+type decoder struct {
+	b     []byte
+	pos   uint
+	steps map[uint]*step
+	err   error
+}
+
+func getWord(b []byte) (word uint) {
+	for i := 0; i < 8; i++ {
+		word <<= 8
+		word |= uint(b[i])
+	}
+	return
+}
+
+func (d *decoder) fail(s string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bytelang: offset %d: %s", d.pos, s)
+	}
+}
+
+func (d *decoder) byte() (c byte) {
+	if d.err != nil {
+		return
+	}
+	if d.pos >= uint(len(d.b)) {
+		d.fail("unexpected end of bytecode")
+		return
+	}
+	c = d.b[d.pos]
+	d.pos++
+	return
+}
+
+func (d *decoder) word() (word uint) {
+	if d.err != nil {
+		return
+	}
+	if d.pos+8 > uint(len(d.b)) {
+		d.fail("unexpected end of bytecode")
+		return
+	}
+	word = getWord(d.b[d.pos:])
+	d.pos += 8
+	return
+}
+
+// count reads a number of items that each take at least min bytes, guarding
+// against lengths that could not possibly fit in the remaining bytecode
+func (d *decoder) count(min uint) (n uint) {
+	n = d.word()
+	if d.err == nil && n > (uint(len(d.b))-d.pos)/min {
+		d.fail("count exceeds length of bytecode")
+		n = 0
+	}
+	return
+}
+
+// function decodes a statement list preceded by its length, and returns the
+// offset of the first statement
+func (d *decoder) function() (f function, body uint) {
+	n := d.count(1)
+	body = d.pos
+	f = make(function, 0, n)
+	for i := uint(0); i < n && d.err == nil; i++ {
+		f = append(f, d.statement())
+	}
+	return
+}
+
+func (d *decoder) statement() (s statement) {
+	off := d.pos
+	st := &step{}
+	switch m := d.byte(); m {
+	case MarkerFunction:
+		s, st.body = d.function()
+	case MarkerAllocate:
+		s = allocate(d.word())
+	case MarkerDeallocate:
+		s = deallocate(d.word())
+	case MarkerAssignment:
+		a := assignment{address: d.address()}
+		a.value = d.expression()
+		a.length = d.word()
+		s = a
+	case MarkerThread:
+		s = thread(d.word())
+	case MarkerIf:
+		i := ifStmt{condition: d.expression()}
+		i.statement, st.body = d.function()
+		s = i
+	case MarkerReturn:
+		s = returnStmt{}
+	case MarkerPragma:
+		n := d.count(1)
+		s = pragma(d.b[d.pos : d.pos+n])
+		d.pos += n
+	default:
+		d.pos = off
+		d.fail(fmt.Sprintf("invalid statement marker %d", m))
+	}
+	st.statement = s
+	st.next = d.pos
+	d.steps[off] = st
+	return
+}
+
+func (d *decoder) expression() (e expression) {
+	switch m := d.byte(); m {
+	case MarkerFunctionCall:
+		e = functionCall(d.word())
+	case MarkerProcessCall:
+		p := processCall{module: d.word(), function: d.word()}
+		n := d.count(8)
+		for i := uint(0); i < n; i++ {
+			p.segments = append(p.segments, d.word())
+		}
+		e = p
+	case MarkerReference:
+		e = reference(d.word())
+	case MarkerDereference:
+		r := dereference{address: d.address()}
+		r.length = d.word()
+		e = r
+	case MarkerLiteral:
+		n := d.count(8)
+		l := make(literal, n)
+		for i := range l {
+			l[i] = d.word()
+		}
+		e = l
+	default:
+		if m < MarkerNot || m > MarkerModulo {
+			d.pos--
+			d.fail(fmt.Sprintf("invalid expression marker %d", m))
+			return
+		}
+		e = operation{marker: m, length: d.word()}
+	}
+	return
+}
+
+func (d *decoder) address() (a address) {
+	switch m := d.byte(); m {
+	case MarkerAddress:
+		a = absolute(d.word())
+	case MarkerStackPointer:
+		a = stackPointer{d.word()}
+	case MarkerFramePointer:
+		a = framePointer{d.word()}
+	case MarkerInstructionPointer:
+		a = instructionPointer{}
+	default:
+		d.pos--
+		d.fail(fmt.Sprintf("invalid address marker %d", m))
+	}
+	return
+}
+
+// decode parses compiled bytecode, recording the offset of every statement
+func decode(b []byte) (*Bytelang, *code, error) {
+	d := &decoder{b: b, steps: make(map[uint]*step)}
+	f, body := d.function()
+	if d.err == nil && d.pos != uint(len(b)) {
+		d.fail("trailing bytes after global function")
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	d.steps[0] = &step{statement: f, body: body, next: d.pos}
+	return &Bytelang{f}, &code{bytes: b, steps: d.steps}, nil
+}
+
+// Decode bytecode produced by Compile back into a Bytelang structure
+func Decode(s string) (b *Bytelang, err error) {
+	b, _, err = decode([]byte(s))
+	return
+}
+
+// Read a gzipped .bytelang file
+func Read(r io.Reader) (b *Bytelang, err error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+	s, err := ioutil.ReadAll(z)
+	if err != nil {
+		return
+	}
+	if len(s) == 0 {
+		return nil, errors.New("bytelang: empty file")
+	}
+	return Decode(string(s))
+}
+
+// Write the compiled bytecode as a gzipped .bytelang file
+func (b *Bytelang) Write(w io.Writer) error {
+	z := gzip.NewWriter(w)
+	if _, err := io.WriteString(z, b.Compile()); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,68 @@
+package bytelang
+
+import "math/rand"
+
+var Widths = []uint{1, 2, 3, 4, 5, 7, 8, 9, 12, 16, 24, 32}
+
+// RandomOperation returns a program applying a random operation to random
+// operands of a random width from Widths.  Its exit status is the low word
+// of the result.
+func RandomOperation(r *rand.Rand) *Bytelang {
+	n := Widths[r.Intn(len(Widths))]
+	// Both operands in one allocation, rounded up to words
+	length := (2*n + wordLength - 1) &^ (wordLength - 1)
+	b := make([]byte, length)
+	r.Read(b)
+	// Keep the second operand small at times, to shift and divide by
+	if r.Intn(2) == 0 {
+		for i := uint(0); i < n-1; i++ {
+			b[i] = 0
+		}
+		b[n-1] %= byte(8*n + 8)
+	}
+	l := make(literal, length/wordLength)
+	for i := range l {
+		l[i] = getWord(b[i*wordLength:])
+	}
+	op := MarkerNot + byte(r.Intn(int(MarkerModulo-MarkerNot+1)))
+	m := n
+	if m > wordLength {
+		m = wordLength
+	}
+	return &Bytelang{function{
+		allocate(length),
+		assignment{stackPointer{0}, l, length},
+		assignment{stackPointer{0}, operation{op, n}, n},
+		assignment{framePointer{2*wordLength - m}, dereference{stackPointer{n - m}, m}, m},
+		deallocate(length - n),
+	}}
+}
+
+// VGA text memory, at a real address
+const VGAText = 0xb8000
+
+// KernelEntry returns the kernel entry of ckernel/boot.c, which writes "my
+// first kernel" to VGA text memory, and the bytes it writes
+func KernelEntry() (b *Bytelang, text []byte) {
+	for _, c := range "my first kernel" {
+		text = append(text, byte(c), 0x07)
+	}
+	n := uint(len(text))
+	length := (n + wordLength - 1) &^ (wordLength - 1)
+	padded := append(append([]byte{}, text...), make([]byte, length-n)...)
+	l := make(literal, length/wordLength)
+	for i := range l {
+		l[i] = getWord(padded[i*wordLength:])
+	}
+	return &Bytelang{function{
+		pragma(pragmaRealAddress),
+		allocate(length),
+		assignment{stackPointer{0}, l, length},
+		assignment{absolute(VGAText), dereference{stackPointer{0}, n}, n},
+		deallocate(length),
+	}}, text
+}
+
+// RandomProgram returns a program of random expressions, calls and if
+// statements
+var RandomProgram = randomProgram
@@ -0,0 +1,155 @@
+package bytelang
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+)
+
+const (
+	i386Base = 0x8048000 // Load address of the test executables
+	vgaPage  = 0x1000
+)
+
+// i386Executable links an i386 object into a static Linux executable, whose
+// start routine calls the entry point and writes its edx, eax and ecx to
+// standard output, followed by the page of VGA text memory
+func i386Executable(t *testing.T, o *Object) []byte {
+	const headers = 0x80 // The ELF header and program headers
+	align := func(n int) int { return (n + 15) &^ 15 }
+	stub := []byte{
+		0xe8, 0, 0, 0, 0, // call entry
+		0x89, 0x15, 0, 0, 0, 0, // mov [status], edx
+		0xa3, 0, 0, 0, 0, // mov [status+4], eax
+		0x89, 0x0d, 0, 0, 0, 0, // mov [status+8], ecx
+		0xb8, 4, 0, 0, 0, // mov eax, write
+		0xbb, 1, 0, 0, 0, // mov ebx, 1
+		0xb9, 0, 0, 0, 0, // mov ecx, status
+		0xba, 12, 0, 0, 0, // mov edx, 12
+		0xcd, 0x80, // int 0x80
+		0xb8, 4, 0, 0, 0, // mov eax, write
+		0xb9, 0, 0x80, 0x0b, 0, // mov ecx, VGAText
+		0xba, 0, 0x10, 0, 0, // mov edx, vgaPage
+		0xcd, 0x80, // int 0x80
+		0xb8, 1, 0, 0, 0, // mov eax, exit
+		0x31, 0xdb, // xor ebx, ebx
+		0xcd, 0x80, // int 0x80
+	}
+	text := align(headers + len(stub))
+	data := align(text + len(o.Text))
+	status := align(data + len(o.Data) + int(o.Bss))
+	image := make([]byte, status+12)
+	le := binary.LittleEndian
+	base := map[Section]int{Text: text, Data: data, Bss: data + len(o.Data)}
+	var entry int
+	for _, s := range o.Symbols {
+		if s.Name == o.Entry {
+			entry = base[s.Section] + int(s.Value)
+		}
+	}
+	copy(image[headers:], stub)
+	le.PutUint32(image[headers+1:], uint32(entry-(headers+5)))
+	for _, off := range []int{7, 12, 18, 33} {
+		le.PutUint32(image[headers+off:], uint32(i386Base+status))
+	}
+	le.PutUint32(image[headers+12:], uint32(i386Base+status+4))
+	le.PutUint32(image[headers+18:], uint32(i386Base+status+8))
+	copy(image[text:], o.Text)
+	copy(image[data:], o.Data)
+	for _, r := range o.Relocations {
+		if r.Type != lang.RelAbs32 || r.Symbol != "" {
+			t.Fatalf("unexpected relocation %+v", r)
+		}
+		le.PutUint32(image[text+int(r.Offset):], uint32(i386Base+base[r.Section]+int(r.Addend)))
+	}
+	// ELF header, and program headers for the image and the VGA text page
+	copy(image, "\x7fELF\x01\x01\x01")
+	le.PutUint16(image[16:], 2) // ET_EXEC
+	le.PutUint16(image[18:], 3) // EM_386
+	le.PutUint32(image[20:], 1)
+	le.PutUint32(image[24:], i386Base+headers)
+	le.PutUint32(image[28:], 52)
+	le.PutUint16(image[40:], 52)
+	le.PutUint16(image[42:], 32)
+	le.PutUint16(image[44:], 2)
+	for i, p := range [][8]uint32{
+		{1, 0, i386Base, i386Base, uint32(len(image)), uint32(len(image)), 7, 0x1000},
+		{1, 0, VGAText, VGAText, 0, vgaPage, 6, 0x1000},
+	} {
+		for j, v := range p {
+			le.PutUint32(image[52+32*i+4*j:], v)
+		}
+	}
+	return image
+}
+
+// runI386 runs a program compiled for i386 natively, returning its exit
+// status, its fault reason and the VGA text page
+func runI386(t *testing.T, b *Bytelang) (status uint, reason uint32, vga []byte) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+		t.Skip("i386 code runs on linux/386 and linux/amd64 hosts")
+	}
+	o, err := b.CompileI386()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(t.TempDir(), "i386")
+	if err := os.WriteFile(exe, i386Executable(t, o), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(exe).Output()
+	if err != nil {
+		t.Skipf("running i386 executable: %v", err)
+	}
+	if len(out) != 12+vgaPage {
+		t.Fatalf("i386 executable wrote %d bytes", len(out))
+	}
+	le := binary.LittleEndian
+	status = uint(le.Uint32(out))<<32 | uint(le.Uint32(out[4:]))
+	return status, le.Uint32(out[8:]), out[12:]
+}
+
+func TestI386(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		b := RandomOperation(r)
+		status, err := b.Run()
+		want := uint32(FaultNone)
+		if err != nil {
+			status, want = faultStatus, FaultDivision
+		}
+		nstatus, reason, _ := runI386(t, b)
+		if nstatus != status || reason != want {
+			t.Errorf("%v: VM returns %#x, %v; i386 code %#x, fault %d", b, status, err, nstatus, reason)
+		}
+	}
+}
+
+func TestI386RealAddress(t *testing.T) {
+	b, text := KernelEntry()
+	o, err := b.CompileI386()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mov edi, 0xb8000, as the destination of the copy
+	if !bytes.Contains(o.Text, []byte{0xbf, 0x00, 0x80, 0x0b, 0x00}) {
+		t.Error("real address not passed through to the machine code")
+	}
+	if _, err := b.Run(); err == nil {
+		t.Error("VM ran a real address")
+	}
+	status, reason, vga := runI386(t, b)
+	if status != 0 || reason != FaultNone {
+		t.Errorf("exits with %#x, fault %d", status, reason)
+	}
+	if !bytes.Equal(vga[:len(text)], text) {
+		t.Errorf("VGA text memory holds %q", vga[:len(text)])
+	}
+}
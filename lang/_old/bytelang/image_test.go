@@ -0,0 +1,80 @@
+package bytelang_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/bytelang"
+	"github.com/vvanpo/system/lang/lib/os/multiboot"
+)
+
+// TestKernelImage checks the bytes of the multiboot image of the kernel
+// entry of ckernel/boot.c
+func TestKernelImage(t *testing.T) {
+	b, _ := bytelang.KernelEntry()
+	o, err := b.CompileI386()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := multiboot.Compile(b, multiboot.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	word := func(off uint) uint { return uint(binary.LittleEndian.Uint32(image[off:])) }
+	const load, stub, text = 0x100000, 32, 48
+	header := []uint{0x1badb002, 1 << 16, 0, load, load, 0, 0, load + stub}
+	header[2] = -(header[0] + header[1]) & 0xffffffff
+	for i, want := range header {
+		if i == 5 || i == 6 {
+			continue // The end of the image and of its stack
+		}
+		if got := word(uint(4 * i)); got != want {
+			t.Errorf("header field %d is %#x, want %#x", i, got, want)
+		}
+	}
+	if end := word(20); end != load+uint(len(image)) {
+		t.Errorf("load end address %#x, want %#x", end, load+len(image))
+	}
+	// mov esp, stack; call entry
+	if image[stub] != 0xbc || word(stub+1) != word(24) || image[stub+5] != 0xe8 {
+		t.Errorf("boot stub % x", image[stub:text])
+	}
+	var entry uint
+	for _, s := range o.Symbols {
+		if s.Name == o.Entry {
+			entry = s.Value
+		}
+	}
+	if target := uint(int32(word(stub+6))) + stub + 10; target&0xffffffff != text+entry {
+		t.Errorf("boot stub calls %#x, want the entry point at %#x", target, text+entry)
+	}
+	// The text, as relocated against the sections placed at 1MiB
+	relocated := make(map[uint]bool)
+	data := uint((text + len(o.Text) + 15) &^ 15)
+	for _, r := range o.Relocations {
+		base := uint(load + text)
+		if r.Section == bytelang.Data {
+			base = load + data
+		}
+		if got, want := word(text+r.Offset), base+uint(r.Addend); r.Type != lang.RelAbs32 || got != want {
+			t.Errorf("relocation at %#x is %#x, want %#x", r.Offset, got, want)
+		}
+		for i := uint(0); i < 4; i++ {
+			relocated[r.Offset+i] = true
+		}
+	}
+	for i, c := range o.Text {
+		if !relocated[uint(i)] && image[text+i] != c {
+			t.Fatalf("text differs at %#x", i)
+		}
+	}
+	if !bytes.Equal(image[data:data+uint(len(o.Data))], o.Data) {
+		t.Error("data differs")
+	}
+	// mov edi, 0xb8000, as the destination of the copy
+	if !bytes.Contains(image[text:data], []byte{0xbf, 0x00, 0x80, 0x0b, 0x00}) {
+		t.Error("real address not passed through to the image")
+	}
+}
@@ -0,0 +1,114 @@
+package bytelang
+
+import (
+	"fmt"
+	"github.com/vvanpo/system/lang"
+)
+
+// NativeStack is the length of machine stack the entry point of native code
+// needs, for its stack segment and the frame that calls it
+const NativeStack = stackLength + 1<<12
+
+// Machine code produced by a native backend.  The text section references
+// the data section only through relocations, so the object can be placed at
+// any address by a linker or loader.
+type Object struct {
+	Arch        string // GOARCH name of the target
+	Text        []byte
+	Data        []byte
+	Bss         uint   // Length of the zeroed bss section
+	Entry       string // Symbol of the entry point
+	Symbols     []Symbol
+	Relocations []Relocation
+	Lines       []Line
+}
+
+// File returns the binary of native code, for the process loader.  The bss
+// section follows the data section in the data segment, and the stack
+// segment is the stack the entry point runs on.  The object may not refer to
+// symbols it does not define.
+func (o *Object) File() (f *lang.File, err error) {
+	f = &lang.File{
+		Code:  o.Text,
+		Data:  append(append([]byte(nil), o.Data...), make([]byte, o.Bss)...),
+		Stack: NativeStack,
+	}
+	segment := func(s Section, value uint) (lang.Segment, uint) {
+		switch s {
+		case Text:
+			return lang.CodeSegment, value
+		case Data:
+			return lang.DataSegment, value
+		}
+		return lang.DataSegment, uint(len(o.Data)) + value
+	}
+	symbols := make(map[string]Symbol)
+	entry := false
+	for _, s := range o.Symbols {
+		seg, value := segment(s.Section, s.Value)
+		f.Symbols = append(f.Symbols, lang.Symbol{Name: s.Name, Segment: seg, Value: value, Size: s.Size, Function: s.Function, Global: s.Global})
+		symbols[s.Name] = s
+		if s.Name == o.Entry && seg == lang.CodeSegment {
+			f.Entry, entry = value, true
+		}
+	}
+	if !entry {
+		return nil, fmt.Errorf("bytelang: undefined entry point %s", o.Entry)
+	}
+	for _, r := range o.Relocations {
+		section, addend := r.Section, r.Addend
+		if r.Symbol != "" {
+			s, ok := symbols[r.Symbol]
+			if !ok {
+				return nil, fmt.Errorf("bytelang: undefined symbol %s", r.Symbol)
+			}
+			section, addend = s.Section, addend+int64(s.Value)
+		}
+		seg, base := segment(section, 0)
+		f.Relocations = append(f.Relocations, lang.Relocation{Offset: r.Offset, Type: r.Type, Segment: seg, Addend: addend + int64(base)})
+	}
+	return
+}
+
+type Section int
+
+const (
+	Text Section = iota
+	Data
+	Bss
+)
+
+type Symbol struct {
+	Name     string
+	Section  Section
+	Value    uint // Offset into the section
+	Size     uint
+	Function bool
+	Global   bool
+}
+
+// A relocation patches the text section at Offset with the address of a
+// section, or of a symbol if one is named, plus Addend
+type Relocation struct {
+	Offset  uint
+	Type    lang.RelocationType
+	Section Section
+	Symbol  string
+	Addend  int64
+}
+
+// A line maps an address in the text section to the bytecode offset of the
+// statement that generated it
+type Line struct {
+	Address uint
+	Offset  uint
+}
+
+// An Export makes a function callable from other languages, through a global
+// trampoline that runs it on a fresh stack segment, with its parameters
+// pushed as words so that the first is just above the status word
+type Export struct {
+	Name     string // Symbol of the trampoline
+	Function uint   // Bytecode offset of the function
+	Params   int
+}
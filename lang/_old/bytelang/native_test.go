@@ -0,0 +1,46 @@
+package bytelang_test
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/vvanpo/system/lang/bytelang"
+	"github.com/vvanpo/system/lang/lib/os/loader"
+)
+
+// TestAMD64 runs random operations of random widths in the VM and natively,
+// each in a child process placed at random bases, and compares their results
+func TestAMD64(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("native code runs on linux/amd64 hosts")
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := bytelang.RandomOperation(r)
+		status, err := b.Run()
+		o, cerr := b.CompileAMD64()
+		if cerr != nil {
+			t.Fatal(cerr)
+		}
+		f, lerr := o.File()
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		img, lerr := loader.Load(f, loader.Randomize(f, r))
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		nstatus, reason, nerr := img.RunNative()
+		if nerr != nil {
+			t.Fatal(nerr)
+		}
+		want := uint(bytelang.FaultNone)
+		if err != nil {
+			status, want = ^uint(0), bytelang.FaultDivision
+		}
+		if nstatus != status || reason != want {
+			t.Errorf("%v: VM returns %#x, %v; native code %#x, fault %d", b, status, err, nstatus, reason)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package bytelang
+
+import "fmt"
+
+// A Mapping relates the statement offsets of optimized bytecode to the
+// offsets of the source statements they were derived from.  Statements
+// replaced by several others map to the same source statement.
+type Mapping map[uint]uint
+
+// A node is an optimized statement, along with the offset of its source
+type node struct {
+	statement
+	origin uint
+	body   []node // Function and if bodies
+}
+
+type optimizer struct {
+	*code
+	fold, dead, merge bool
+	enabled           bool // Some pass is enabled by a pragma
+}
+
+// Optimize applies the optimization passes enabled by pragmas, each of which
+// covers the statements following it in the same function body, including
+// nested bodies:
+//
+//	"fold constants" evaluates operations on literal operands, as pushed by
+//	allocating a word-aligned length and assigning the literal to it
+//	"remove dead code" replaces if statements that have a literal zero
+//	condition with an assignment of the condition
+//	"merge allocations" combines adjacent allocate and deallocate statements
+//
+// Optimized programs behave identically, except that memory below the stack
+// pointer is not preserved, and merged allocations only fault on their net
+// length.  Statement offsets change, so function calls and threads are
+// relocated, and programs using the instruction pointer or reading the code
+// segment cannot be optimized.  The returned mapping relates the optimized
+// bytecode back to the source.
+func (b *Bytelang) Optimize() (o *Bytelang, m Mapping, err error) {
+	_, c, err := decode([]byte(b.Compile()))
+	if err != nil {
+		return
+	}
+	opt := &optimizer{code: c}
+	root := c.steps[0]
+	nodes := opt.statements(root.body, root.next)
+	m = make(Mapping)
+	if !opt.enabled {
+		for off := range c.steps {
+			m[off] = off
+		}
+		return b, m, nil
+	}
+	for off, s := range c.steps {
+		if layoutDependent(s.statement) {
+			return nil, nil, fmt.Errorf("bytelang: offset %d: statement depends on the code layout", off)
+		}
+	}
+	m[0] = 0
+	fns := map[uint]uint{0: 0}
+	layout(nodes, wordLength, m, fns)
+	f, err := build(nodes, fns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Bytelang{f}, m, nil
+}
+
+func (o *optimizer) statements(off, end uint) (nodes []node) {
+	fold, dead, merge := o.fold, o.dead, o.merge
+	for off < end {
+		s := o.steps[off]
+		n := node{statement: s.statement, origin: off}
+		switch stmt := s.statement.(type) {
+		case pragma:
+			o.pragma(stmt)
+		case function:
+			n.body = o.statements(s.body, s.next)
+		case ifStmt:
+			if o.dead && zero(stmt.condition) && !o.defines(s.body, s.next) {
+				n.statement = assignment{stackPointer{0}, stmt.condition, length(stmt.condition)}
+			} else {
+				n.body = o.statements(s.body, s.next)
+			}
+		}
+		nodes = o.reduce(append(nodes, n))
+		off = s.next
+	}
+	o.fold, o.dead, o.merge = fold, dead, merge
+	return
+}
+
+func (o *optimizer) pragma(p pragma) {
+	switch p {
+	case pragmaFold:
+		o.fold = true
+	case pragmaDead:
+		o.dead = true
+	case pragmaMerge:
+		o.merge = true
+	default:
+		return
+	}
+	o.enabled = true
+}
+
+// defines reports whether a function is defined between two offsets, which
+// keeps a dead body alive, as the function can still be called
+func (o *optimizer) defines(off, end uint) bool {
+	for i, s := range o.steps {
+		if _, ok := s.statement.(function); ok && i >= off && i < end {
+			return true
+		}
+	}
+	return false
+}
+
+func zero(e expression) bool {
+	l, ok := e.(literal)
+	if !ok {
+		return false
+	}
+	for _, w := range l {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reduce rewrites the statements at the end of a body, as each is appended,
+// so that the result of one rewrite can take part in the next
+func (o *optimizer) reduce(nodes []node) []node {
+	for changed := true; changed; {
+		changed = false
+		if o.merge {
+			nodes, changed = mergeTail(nodes)
+		}
+		if o.fold && !changed {
+			nodes, changed = foldTail(nodes)
+		}
+	}
+	return nodes
+}
+
+func mergeTail(nodes []node) ([]node, bool) {
+	k := len(nodes)
+	if k < 2 {
+		return nodes, false
+	}
+	n := nodes[k-2]
+	switch a := n.statement.(type) {
+	case allocate:
+		switch b := nodes[k-1].statement.(type) {
+		case allocate:
+			if a+b < a {
+				return nodes, false
+			}
+			n.statement = a + b
+		case deallocate:
+			switch {
+			case uint(a) > uint(b):
+				n.statement = a - allocate(b)
+			case uint(b) > uint(a):
+				n.statement = b - deallocate(a)
+			default:
+				return nodes[:k-2], true
+			}
+		default:
+			return nodes, false
+		}
+	case deallocate:
+		// An allocation following a deallocation zeroes the popped memory
+		b, ok := nodes[k-1].statement.(deallocate)
+		if !ok || a+b < a {
+			return nodes, false
+		}
+		n.statement = a + b
+	default:
+		return nodes, false
+	}
+	return append(nodes[:k-2], n), true
+}
+
+// pushed returns the literal of a pair of statements pushing one onto the stack
+func pushed(nodes []node) (l literal, ok bool) {
+	a, ok := nodes[0].statement.(allocate)
+	if !ok {
+		return
+	}
+	s, ok := nodes[1].statement.(assignment)
+	if !ok || s.address != (stackPointer{0}) {
+		return
+	}
+	l, ok = s.value.(literal)
+	if !ok || uint(len(l))*wordLength != uint(a) || s.length != uint(a) || a == 0 {
+		return nil, false
+	}
+	return
+}
+
+func foldTail(nodes []node) ([]node, bool) {
+	k := len(nodes)
+	if k < 3 {
+		return nodes, false
+	}
+	last := nodes[k-1]
+	s, ok := last.statement.(assignment)
+	if !ok {
+		return nodes, false
+	}
+	op, ok := s.value.(operation)
+	if !ok {
+		return nodes, false
+	}
+	var a, b []byte
+	start := k - 3
+	if op.marker == MarkerNot {
+		l, ok := pushed(nodes[k-3:])
+		if !ok || uint(len(l))*wordLength != op.length {
+			return nodes, false
+		}
+		a = []byte(l.bytes())
+		for i := range a {
+			a[i] = ^a[i]
+		}
+	} else {
+		if k < 5 {
+			return nodes, false
+		}
+		start = k - 5
+		x, ok := pushed(nodes[k-5:])
+		if !ok || uint(len(x))*wordLength != op.length {
+			return nodes, false
+		}
+		y, ok := pushed(nodes[k-3:])
+		if !ok || len(y) != len(x) {
+			return nodes, false
+		}
+		a, b = []byte(x.bytes()), []byte(y.bytes())
+		if compute(op.marker, a, b) != nil {
+			return nodes, false
+		}
+	}
+	result := make(literal, len(a)/wordLength)
+	for i := range result {
+		result[i] = getWord(a[i*wordLength:])
+	}
+	nodes = append(nodes[:start+1], node{
+		statement: assignment{stackPointer{0}, result, op.length},
+		origin:    last.origin,
+	})
+	if s.address != (stackPointer{0}) {
+		last.statement = assignment{s.address, dereference{stackPointer{0}, s.length}, s.length}
+		nodes = append(nodes, last)
+	}
+	return nodes, true
+}
+
+func (l literal) bytes() (s string) {
+	for _, w := range l {
+		s += putWord(w)
+	}
+	return
+}
+
+// layoutDependent reports whether a statement uses the instruction pointer or
+// the code segment
+func layoutDependent(s statement) bool {
+	addresses := []address{}
+	var value expression
+	switch s := s.(type) {
+	case assignment:
+		addresses = append(addresses, s.address)
+		value = s.value
+	case ifStmt:
+		value = s.condition
+	}
+	if d, ok := value.(dereference); ok {
+		addresses = append(addresses, d.address)
+	}
+	for _, a := range addresses {
+		switch a := a.(type) {
+		case instructionPointer:
+			return true
+		case absolute:
+			if uint(a)>>segmentShift == codeSegment {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// layout assigns offsets to statements from off, recording the source of each
+// in m, and the new offset of each function in fns
+func layout(nodes []node, off uint, m Mapping, fns map[uint]uint) uint {
+	for _, n := range nodes {
+		m[off] = n.origin
+		switch s := n.statement.(type) {
+		case function:
+			fns[n.origin] = off
+			off = layout(n.body, off+1+wordLength, m, fns)
+		case ifStmt:
+			off = layout(n.body, off+uint(1+len(s.condition.compile()))+wordLength, m, fns)
+		default:
+			off += uint(len(s.compile()))
+		}
+	}
+	return off
+}
+
+// build assembles optimized statements, relocating function calls
+func build(nodes []node, fns map[uint]uint) (f function, err error) {
+	relocate := func(fn uint) (uint, error) {
+		off, ok := fns[fn]
+		if !ok {
+			return 0, fmt.Errorf("bytelang: call to offset %d, which is not a function", fn)
+		}
+		return off, nil
+	}
+	expression := func(e expression) (expression, error) {
+		switch e := e.(type) {
+		case functionCall:
+			fn, err := relocate(uint(e))
+			return functionCall(fn), err
+		case processCall:
+			if e.module == 0 {
+				fn, err := relocate(e.function)
+				e.function = fn
+				return e, err
+			}
+		}
+		return e, nil
+	}
+	for _, n := range nodes {
+		s := n.statement
+		switch stmt := s.(type) {
+		case function:
+			s, err = build(n.body, fns)
+		case ifStmt:
+			stmt.condition, err = expression(stmt.condition)
+			if err == nil {
+				stmt.statement, err = build(n.body, fns)
+			}
+			s = stmt
+		case assignment:
+			stmt.value, err = expression(stmt.value)
+			s = stmt
+		case thread:
+			var fn uint
+			fn, err = relocate(uint(stmt))
+			s = thread(fn)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, s)
+	}
+	return
+}
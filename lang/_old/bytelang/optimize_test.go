@@ -0,0 +1,162 @@
+package bytelang
+
+import (
+	"math/rand"
+	"testing"
+)
+
+var passes = []pragma{pragmaFold, pragmaDead, pragmaMerge}
+
+// push allocates a word and assigns it a literal
+func push(w uint) []statement {
+	return []statement{allocate(8), assignment{stackPointer{0}, literal{w}, 8}}
+}
+
+// randomExpression returns statements pushing the result of a random word
+// expression
+func randomExpression(r *rand.Rand, depth int) (s []statement) {
+	if depth == 0 || r.Intn(3) == 0 {
+		return push(uint(r.Intn(20)))
+	}
+	if r.Intn(6) == 0 {
+		s = randomExpression(r, depth-1)
+		return append(s, assignment{stackPointer{0}, operation{MarkerNot, 8}, 8})
+	}
+	s = append(randomExpression(r, depth-1), randomExpression(r, depth-1)...)
+	op := MarkerAnd + byte(r.Intn(int(MarkerModulo-MarkerAnd+1)))
+	return append(s, assignment{stackPointer{0}, operation{op, 8}, 8})
+}
+
+// randomProgram returns a program of random expressions in a function and
+// in the global function, the exit status combining their results, and if
+// statements of constant conditions.  The function is defined first, at
+// offset 8.
+func randomProgram(r *rand.Rand) *Bytelang {
+	var p function
+	for _, pass := range passes {
+		if r.Intn(3) != 0 {
+			p = append(p, pass)
+		}
+	}
+	fn := append(append(function{}, p...), allocate(8), allocate(8), deallocate(16))
+	fn = append(fn, randomExpression(r, 3)...)
+	fn = append(fn, assignment{framePointer{8}, dereference{stackPointer{0}, 8}, 8}, deallocate(8))
+	f := append(function{fn}, p...)
+	f = append(f,
+		allocate(8),
+		ifStmt{literal{0}, []statement{allocate(8), assignment{framePointer{8}, literal{99}, 8}, deallocate(8)}},
+		ifStmt{literal{uint(r.Intn(2))}, []statement{allocate(8), deallocate(8), allocate(8), deallocate(8)}},
+		deallocate(8),
+	)
+	f = append(f, randomExpression(r, 3)...)
+	return &Bytelang{append(f,
+		allocate(8),
+		assignment{stackPointer{0}, functionCall(8), 0},
+		assignment{framePointer{8}, operation{MarkerXor, 8}, 8},
+		deallocate(8),
+	)}
+}
+
+// optimized checks that an optimized program verifies, maps back to the
+// statements of its source and runs to the same result
+func optimized(t *testing.T, b *Bytelang) *Bytelang {
+	if err := b.Verify(); err != nil {
+		t.Fatalf("source: %v", err)
+	}
+	status, err := b.Run()
+	o, m, oerr := b.Optimize()
+	if oerr != nil {
+		t.Fatal(oerr)
+	}
+	if verr := o.Verify(); verr != nil {
+		t.Fatalf("optimized: %v", verr)
+	}
+	ostatus, oerr := o.Run()
+	if ostatus != status || (err == nil) != (oerr == nil) {
+		t.Fatalf("source runs to %d, %v, optimized to %d, %v", status, err, ostatus, oerr)
+	}
+	_, src, _ := decode([]byte(b.Compile()))
+	_, c, _ := decode([]byte(o.Compile()))
+	for off := range c.steps {
+		if origin, ok := m[off]; !ok || src.steps[origin] == nil {
+			t.Fatalf("offset %d maps to no source statement", off)
+		}
+	}
+	return o
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name  string
+		f     function
+		lines int // Statements of the optimized global function
+	}{
+		{"fold", append(append(append(function{pragma(pragmaFold)}, push(5)...), push(7)...),
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+			deallocate(8),
+		), 5},
+		{"fold a wide not", function{
+			pragma(pragmaFold),
+			allocate(16),
+			assignment{stackPointer{0}, literal{^uint(0), ^uint(12)}, 16},
+			assignment{stackPointer{0}, operation{MarkerNot, 16}, 16},
+			assignment{framePointer{8}, dereference{stackPointer{8}, 8}, 8},
+			deallocate(16),
+		}, 5},
+		{"remove dead code", function{
+			pragma(pragmaDead),
+			allocate(8),
+			ifStmt{literal{0}, []statement{returnStmt{}}},
+			assignment{framePointer{8}, literal{12}, 8},
+			deallocate(8),
+		}, 5},
+		{"merge allocations", function{
+			pragma(pragmaMerge),
+			allocate(8), allocate(8),
+			assignment{stackPointer{8}, literal{5}, 8},
+			assignment{stackPointer{0}, literal{7}, 8},
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+			allocate(8), deallocate(16),
+		}, 6},
+		{"merge operands pushed separately", append(append(append(function{pragma(pragmaMerge)}, push(5)...), push(7)...),
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+			deallocate(8),
+		), 7},
+		{"all passes", append(append(append(function{pragma(pragmaFold), pragma(pragmaDead), pragma(pragmaMerge)}, push(5)...), push(7)...),
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+			ifStmt{literal{0}, []statement{allocate(8), deallocate(8)}},
+			deallocate(8),
+		), 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &Bytelang{test.f}
+			if status, err := b.Run(); status != 12 || err != nil {
+				t.Fatalf("source runs to %d, %v", status, err)
+			}
+			o := optimized(t, b)
+			if len(o.function) != test.lines {
+				t.Errorf("optimized to %d statements, want %d", len(o.function), test.lines)
+			}
+		})
+	}
+}
+
+func TestOptimizeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		optimized(t, randomProgram(r))
+	}
+}
+
+func TestOptimizeLayoutDependent(t *testing.T) {
+	b := &Bytelang{function{
+		pragma(pragmaMerge),
+		allocate(8),
+		assignment{stackPointer{0}, dereference{instructionPointer{}, 8}, 8},
+		deallocate(8),
+	}}
+	if _, _, err := b.Optimize(); err == nil {
+		t.Error("optimized a program reading the instruction pointer")
+	}
+}
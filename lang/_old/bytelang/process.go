@@ -0,0 +1,245 @@
+package bytelang
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang/lib/os/namespace"
+)
+
+// A process owns a code segment, and a segment table holding the stacks of
+// its threads and any segments passed to it by its caller.  Calling a
+// function in another code segment creates a new process, and the calling
+// thread blocks until that process exits.
+//
+// A process exits once its main thread has returned from its first frame and
+// all other threads have returned.  Its exit status is the word above that
+// frame, at fp+8, which the VM allocates and zeroes beforehand.  The status
+// is placed at the bottom of the caller's stack, as the value of the process
+// call expression.
+//
+// A fault terminates the faulting process, its threads, and any processes
+// they are blocked on.  The caller receives the exit status faultStatus, so
+// faults never cross address spaces; the fault of the initial process is
+// returned by Run.
+//
+// A process running a driver module is a driver process, whose segment
+// firstSegment maps its devices: an offset into the segment is a physical
+// address, and each access of it is seen by the device there.  The segments
+// passed to a driver follow its device segment, which cannot itself be
+// passed to another process.
+type process struct {
+	id         uint
+	vm         *virtual
+	code       *code
+	segments   map[uint]*segment
+	next       uint // Next free segment id
+	tasks      []*task
+	children   []*process
+	caller     *task
+	namespace  *namespace.Namespace
+	files      []string // Paths of the namespace files, from firstFile
+	spawner    *spawner // Of a process spawned through a spawn file
+	statusAddr uint
+	status     uint
+	fault      error
+	exited     bool
+}
+
+// A task is a thread of execution within a process
+type task struct {
+	proc       *process
+	ip, sp, fp uint
+	ends       []uint   // End offsets of the functions in each frame
+	resume     bool     // Complete the statement at ip, after a call returned
+	waiting    bool     // Blocked on a process call
+	blocked    *blocked // Blocked on the length of a file
+	done       bool
+}
+
+// spawn creates a process running function fn of a module.  Passed segments
+// are shared with the caller, and numbered from firstSegment, or following
+// the device segment of a driver.
+func (vm *virtual) spawn(module, fn uint, segments []*segment, caller *task) (p *process, err error) {
+	if module >= uint(len(vm.modules)) {
+		return nil, fmt.Errorf("invalid module %d", module)
+	}
+	c := vm.modules[module]
+	vm.pids++
+	p = &process{
+		id:        vm.pids,
+		vm:        vm,
+		code:      c,
+		segments:  map[uint]*segment{codeSegment: {data: c.bytes, code: true}},
+		next:      firstSegment,
+		caller:    caller,
+		namespace: vm.namespace,
+	}
+	// Processes inherit the namespace of their caller
+	if caller != nil {
+		p.namespace = caller.proc.namespace
+	}
+	if d, ok := vm.drivers[module]; ok {
+		p.segments[p.next] = &segment{device: d}
+		p.next++
+	}
+	for _, s := range segments {
+		p.segments[p.next] = s
+		p.next++
+	}
+	t, err := p.newTask(fn, true)
+	if err != nil {
+		return nil, err
+	}
+	p.statusAddr = t.fp + wordLength
+	if caller != nil {
+		caller.proc.children = append(caller.proc.children, p)
+	}
+	return
+}
+
+// newTask starts a thread at function fn with a fresh stack segment.  The
+// main thread of a process also gets a word for the exit status.
+func (p *process) newTask(fn uint, main bool) (t *task, err error) {
+	t = &task{proc: p}
+	id := stackSegment
+	if !main {
+		id = p.next
+		p.next++
+	}
+	p.segments[id] = &segment{data: make([]byte, stackLength), owner: t}
+	t.sp = id<<segmentShift | stackLength
+	if main {
+		if err = t.push(0); err != nil {
+			return nil, err
+		}
+	}
+	if err = t.enter(fn, exitAddress); err != nil {
+		return nil, err
+	}
+	p.tasks = append(p.tasks, t)
+	p.vm.tasks = append(p.vm.tasks, t)
+	return
+}
+
+// enter pushes a frame for function fn
+func (t *task) enter(fn, ret uint) error {
+	s, ok := t.proc.code.steps[fn]
+	if ok {
+		_, ok = s.statement.(function)
+	}
+	if !ok {
+		return fmt.Errorf("no function at offset %d", fn)
+	}
+	if err := t.push(t.fp); err != nil {
+		return err
+	}
+	t.fp = t.sp
+	if err := t.push(ret); err != nil {
+		return err
+	}
+	t.ip = codeSegment<<segmentShift | s.body
+	t.ends = append(t.ends, codeSegment<<segmentShift|s.next)
+	return nil
+}
+
+// call a function, returning to the current statement to complete it
+func (t *task) call(fn uint) error {
+	return t.enter(fn, t.ip)
+}
+
+func (t *task) ret() error {
+	ret, err := t.readWord(t.fp - wordLength)
+	if err != nil {
+		return err
+	}
+	fp, err := t.readWord(t.fp)
+	if err != nil {
+		return err
+	}
+	t.sp, t.fp = t.fp+wordLength, fp
+	t.ends = t.ends[:len(t.ends)-1]
+	if ret != exitAddress {
+		t.ip, t.resume = ret, true
+		return nil
+	}
+	p := t.proc
+	if t == p.tasks[0] {
+		if p.status, err = t.readWord(p.statusAddr); err != nil {
+			return err
+		}
+	}
+	t.done = true
+	p.join()
+	return nil
+}
+
+// join exits the process once all of its threads are done
+func (p *process) join() {
+	for _, t := range p.tasks {
+		if !t.done {
+			return
+		}
+	}
+	p.exit()
+}
+
+func (t *task) callProcess(c processCall) error {
+	if c.module == SystemModule {
+		return t.system(c)
+	}
+	var segments []*segment
+	for _, id := range c.segments {
+		s, ok := t.proc.segments[id]
+		if !ok {
+			return fmt.Errorf("invalid segment %d", id)
+		}
+		if s.owner != nil {
+			return errors.New("stack segments cannot be passed to a process")
+		}
+		if s.device != nil {
+			return errors.New("device segments cannot be passed to a process")
+		}
+		segments = append(segments, s)
+	}
+	if _, err := t.proc.vm.spawn(c.module, c.function, segments, t); err != nil {
+		return err
+	}
+	t.waiting = true
+	return nil
+}
+
+// exit wakes the caller with the exit status at the bottom of its stack
+func (p *process) exit() {
+	p.exited = true
+	for _, t := range p.tasks {
+		t.done = true
+	}
+	if p.spawner != nil {
+		p.spawner.exited(p.status)
+	}
+	c := p.caller
+	if c == nil || c.done {
+		return
+	}
+	c.waiting = false
+	if err := c.writeWord(c.sp, p.status); err != nil {
+		p.vm.fault(c, err)
+		return
+	}
+	c.resume = true
+}
+
+// terminate a faulting process and everything it is blocked on
+func (vm *virtual) terminate(p *process, fault error) {
+	if p.exited {
+		return
+	}
+	for _, c := range p.children {
+		if !c.exited {
+			c.caller = nil
+			vm.terminate(c, fault)
+		}
+	}
+	p.status, p.fault = faultStatus, fault
+	p.exit()
+}
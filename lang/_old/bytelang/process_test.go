@@ -0,0 +1,154 @@
+package bytelang_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// spin is a module whose main thread loops forever
+const spin = `
+	allocate 8
+	loop:
+	deallocate 8
+	allocate 16
+	store rel sp 8 literal 0x1000000000000
+	store rel sp 0 literal loop
+	store val ip add
+`
+
+// divide faults by dividing by zero, once its main thread has run a few
+// statements
+const divide = `
+	allocate 8
+	deallocate 8
+	allocate 8
+	deallocate 8
+	allocate 16
+	store rel fp 8 floordiv
+	deallocate 8
+`
+
+// run runs a program in the VM, checking the process of any fault
+func run(t *testing.T, process uint, program ...string) (status uint, err error) {
+	b := assemble(t, program...)
+	status, err = b[0].Run(b[1:]...)
+	if err == nil {
+		return
+	}
+	if f, ok := err.(*bytelang.Fault); !ok || f.Process != process {
+		t.Errorf("fault %#v, want of process %d", err, process)
+	}
+	return
+}
+
+func TestProcessStatus(t *testing.T) {
+	// The status is the word above the first frame, when the main thread
+	// returns
+	if status, err := run(t, 0, `
+		allocate 8
+		store rel sp 0 literal 7
+		store rel fp 8 load rel sp 0
+		deallocate 8
+	`); status != 7 || err != nil {
+		t.Errorf("runs to %d, %v", status, err)
+	}
+	// A process call evaluates to the status of the process
+	if status, err := run(t, 0, `
+		allocate 16
+		store rel sp 8 process 1 0
+		store rel sp 0 literal 2
+		store rel fp 8 mult
+		deallocate 8
+	`, `
+		allocate 8
+		store rel sp 0 literal 21
+		store rel fp 8 load rel sp 0
+		deallocate 8
+	`); status != 42 || err != nil {
+		t.Errorf("runs to %d, %v", status, err)
+	}
+}
+
+// A faulting child returns the fault status to its caller, which runs on;
+// the fault does not reach Run
+func TestChildFault(t *testing.T) {
+	status, err := run(t, 0, `
+		allocate 16
+		store rel sp 8 process 1 0
+		store rel sp 0 literal 1
+		store rel fp 8 add
+		deallocate 8
+	`, divide)
+	if status != 0 || err != nil {
+		t.Errorf("runs to %#x, %v", status, err)
+	}
+}
+
+// A fault of the initial process is returned by Run with the fault status
+func TestFault(t *testing.T) {
+	status, err := run(t, 1, divide)
+	if status != ^uint(0) || err == nil || !strings.HasSuffix(err.Error(), "division by zero") {
+		t.Errorf("runs to %#x, %v", status, err)
+	}
+}
+
+// A process runs until all of its threads return, so a thread faulting after
+// the main thread returned faults the process
+func TestThreadOutlivesMain(t *testing.T) {
+	main := `
+		thread worker
+		allocate 8
+		store rel sp 0 literal 5
+		store rel fp 8 load rel sp 0
+		deallocate 8
+		worker:
+		function
+			allocate 8
+			deallocate 8
+			allocate 8
+			deallocate 8
+			allocate 8
+			deallocate 8
+			%s
+		end
+	`
+	if status, err := run(t, 1, fmt.Sprintf(main, "")); status != 5 || err != nil {
+		t.Errorf("runs to %d, %v", status, err)
+	}
+	status, err := run(t, 1, fmt.Sprintf(main, "allocate 16\n\t\t\tstore rel fp 8 floordiv"))
+	if status != ^uint(0) || err == nil || !strings.HasSuffix(err.Error(), "division by zero") {
+		t.Errorf("runs to %#x, %v, once the thread faults", status, err)
+	}
+}
+
+// A fault terminates the other threads of the process, and the processes
+// they are blocked on, which would otherwise spin forever
+func TestTeardown(t *testing.T) {
+	threads := `
+		thread spinner
+		` + divide + `
+		spinner:
+		function
+			` + spin + `
+		end
+	`
+	if status, err := run(t, 1, threads); status != ^uint(0) || err == nil {
+		t.Errorf("threads: runs to %#x, %v", status, err)
+	}
+	children := `
+		thread caller
+		` + divide + `
+		caller:
+		function
+			allocate 8
+			store rel sp 0 process 1 0
+			deallocate 8
+		end
+	`
+	if status, err := run(t, 1, children, spin); status != ^uint(0) || err == nil {
+		t.Errorf("children: runs to %#x, %v", status, err)
+	}
+}
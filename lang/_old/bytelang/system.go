@@ -0,0 +1,283 @@
+package bytelang
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang/lib/os/cache"
+	"github.com/vvanpo/system/lang/lib/os/device"
+	"github.com/vvanpo/system/lang/lib/os/file"
+	"github.com/vvanpo/system/lang/lib/os/namespace"
+	"strings"
+	"time"
+)
+
+// A process call to SystemModule is a system call.  The only call is open,
+// whose function word is the id of a file, and whose value is the id of a
+// new segment holding the file, or openFailed if it could not be opened.
+//
+// File id 0 is the metadata file of the process, listing the ids of the
+// other files it can open, one per line, as a decimal id and a name
+// separated by a space.  The system services come first, named without a
+// leading slash, followed by the files of the process namespace, named by
+// their paths.  The namespace files are listed when the process first opens
+// the metadata file or one of their ids, and keep those ids.
+//
+// The segment of an open file holds a mutable list of bytes.  Assignments to
+// it overwrite the file, and extend it when they reach past its end, and a
+// read past its end blocks until the file is long enough, so that a file
+// passed to another process can serve as a pipe between them.  Namespace
+// files of a FileServer that is not a StoreServer have no way back to their
+// server, so an assignment to one faults.
+const (
+	SystemModule = ^uint(0)
+	openFailed   = ^uint(0)
+)
+
+// File ids
+const (
+	metadataFile uint = iota
+	consoleFile       // Shared by all processes and the host
+	clockFile         // A word of the nanoseconds since the Unix epoch, at open
+	spawnFile         // Spawns processes, as described by spawner
+	firstFile         // Namespace files are numbered from here
+)
+
+var services = []string{
+	consoleFile: "console",
+	clockFile:   "clock",
+	spawnFile:   "spawn",
+}
+
+// A FileServer serves the files bound to it by process namespaces
+type FileServer interface {
+	namespace.Server
+	Read(path string) ([]byte, error)
+}
+
+// A StoreServer is a FileServer whose files can be read and written in
+// place, through the cache of a System if it has one
+type StoreServer interface {
+	FileServer
+	Store(path string) (cache.Store, error)
+}
+
+// A System is the environment the system calls of a program's processes are
+// served from
+type System struct {
+	// The namespace of the initial process, which the processes it calls
+	// inherit
+	Namespace *namespace.Namespace
+	// Servers are named as in the namespace, and that of namespace.Root
+	// serves unbound paths
+	Servers map[string]FileServer
+	// The console file, read and written by the host.  Without one, the
+	// console is an empty file that is never appended to by the host.
+	Console *file.File
+	// Every process opening a file of a StoreServer shares its segment,
+	// whose writes pass to the store.  They pass through the cache if there
+	// is one, and its dirty pages are flushed once the program exits.
+	Cache *cache.Cache
+	// Drivers maps the modules run as driver processes to their devices,
+	// usually a device.Bus.  Devices that are tickers advance once per
+	// scheduling round.
+	Drivers map[uint]device.Device
+}
+
+// RunSystem runs the program like Run, serving its system calls from sys
+func (b *Bytelang) RunSystem(sys System, modules ...*Bytelang) (status uint, err error) {
+	if sys.Namespace != nil {
+		if err = sys.Namespace.Validate(); err != nil {
+			return
+		}
+	}
+	vm, err := newVirtual(b, modules...)
+	if err != nil {
+		return
+	}
+	vm.namespace, vm.servers = sys.Namespace, make(map[string]namespace.Server)
+	vm.cache, vm.stores = sys.Cache, make(map[namespace.Binding]*segment)
+	vm.drivers = sys.Drivers
+	if sys.Console != nil {
+		vm.console = sys.Console
+	}
+	for name, s := range sys.Servers {
+		vm.servers[name] = s
+	}
+	status, err = vm.run()
+	if vm.cache != nil {
+		if ferr := vm.cache.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	return
+}
+
+func (t *task) system(c processCall) error {
+	if len(c.segments) > 0 {
+		return errors.New("segments passed to a system call")
+	}
+	s, err := t.proc.open(c.function)
+	id := openFailed
+	if err == nil {
+		id = t.proc.next
+		t.proc.next++
+		t.proc.segments[id] = s
+	}
+	if err := t.writeWord(t.sp, id); err != nil {
+		return err
+	}
+	t.resume = true
+	return nil
+}
+
+// open returns the segment of a file
+func (p *process) open(id uint) (s *segment, err error) {
+	var data []byte
+	switch id {
+	case metadataFile:
+		data, err = p.metadata()
+	case consoleFile:
+		return &segment{file: p.vm.console}, nil
+	case clockFile:
+		data = []byte(putWord(uint(time.Now().UnixNano())))
+	case spawnFile:
+		sp := &spawner{file: file.New(nil)}
+		return &segment{file: sp.file, written: sp.request}, nil
+	default:
+		return p.openFile(id)
+	}
+	if err != nil {
+		return
+	}
+	return &segment{file: file.New(data)}, nil
+}
+
+func (p *process) metadata() ([]byte, error) {
+	if err := p.listFiles(); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for id, name := range services {
+		if name != "" {
+			fmt.Fprintf(&b, "%d %s\n", id, name)
+		}
+	}
+	for i, name := range p.files {
+		fmt.Fprintf(&b, "%d %s\n", firstFile+uint(i), name)
+	}
+	return []byte(b.String()), nil
+}
+
+// listFiles numbers the files of the namespace, once
+func (p *process) listFiles() (err error) {
+	if p.files != nil || p.namespace == nil {
+		return
+	}
+	files, err := p.namespace.Files(p.vm.servers)
+	if err != nil {
+		return
+	}
+	p.files = append([]string{}, files...)
+	return
+}
+
+// openFile returns the segment of a namespace file
+func (p *process) openFile(id uint) (s *segment, err error) {
+	if err = p.listFiles(); err != nil {
+		return
+	}
+	if id < firstFile || id-firstFile >= uint(len(p.files)) {
+		return nil, fmt.Errorf("invalid file id %d", id)
+	}
+	b, err := p.namespace.Open(p.files[id-firstFile], p.vm.servers)
+	if err != nil {
+		return
+	}
+	server := p.vm.servers[b.Server]
+	if ss, ok := server.(StoreServer); ok {
+		return p.vm.openStore(ss, b)
+	}
+	data, err := server.(FileServer).Read(b.Remote)
+	if err != nil {
+		return
+	}
+	path := p.files[id-firstFile]
+	return &segment{
+		file: file.New(data),
+		written: func(t *task, offset uint64, data []byte) error {
+			return fmt.Errorf("file %s is read-only, as server %q has no store", path, b.Server)
+		},
+	}, nil
+}
+
+// openStore returns the shared segment of a file of a StoreServer, written
+// through the cache if there is one
+func (vm *virtual) openStore(server StoreServer, b namespace.Binding) (s *segment, err error) {
+	b.Write = false
+	if s, ok := vm.stores[b]; ok {
+		return s, nil
+	}
+	store, err := server.Store(b.Remote)
+	if err != nil {
+		return
+	}
+	_, fixed := store.(cache.FixedStore)
+	if vm.cache != nil {
+		v := vm.cache.Bind(store)
+		store, fixed = v, v.Fixed()
+	}
+	f := file.Open(store, uint64(store.Size()))
+	if fixed {
+		f.Fix()
+	}
+	s = &segment{
+		file: f,
+		written: func(t *task, offset uint64, data []byte) error {
+			_, err := store.WriteAt(data, int64(offset))
+			return err
+		},
+	}
+	vm.stores[b] = s
+	return
+}
+
+// A spawner serves the segment of an open spawn file, which holds a record
+// of three words for each process spawned through it: the module and
+// function the process runs, written by the opener, and its exit status,
+// written once it exits.  The process is spawned once the function word is
+// written, and runs alongside the opener with its namespace, so the opener
+// blocks only when it reads the status.  The next record may be written
+// once the status is.
+type spawner struct {
+	file    *file.File
+	next    uint64 // Offset of the current record
+	running bool
+}
+
+// request spawns the process of a record that has been written
+func (s *spawner) request(t *task, offset uint64, data []byte) error {
+	n := s.file.Length()
+	switch {
+	case s.running && n > s.next+2*wordLength:
+		return errors.New("spawn file written while its process runs")
+	case s.running || n < s.next+2*wordLength:
+		return nil
+	}
+	b, err := s.file.Read(s.next, 2*wordLength)
+	if err != nil {
+		return err
+	}
+	p, err := t.proc.vm.spawn(getWord(b), getWord(b[wordLength:]), nil, nil)
+	if err != nil {
+		return err
+	}
+	p.namespace, p.spawner, s.running = t.proc.namespace, s, true
+	return nil
+}
+
+// exited records the exit status of the spawned process
+func (s *spawner) exited(status uint) {
+	s.file.Write(s.next+2*wordLength, []byte(putWord(status)))
+	s.next += 3 * wordLength
+	s.running = false
+}
@@ -0,0 +1,188 @@
+package bytelang_test
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/bytelang"
+	"github.com/vvanpo/system/lang/lib/os/cache"
+	"github.com/vvanpo/system/lang/lib/os/device"
+	"github.com/vvanpo/system/lang/lib/os/driver"
+	"github.com/vvanpo/system/lang/lib/os/fileserver"
+	"github.com/vvanpo/system/lang/lib/os/namespace"
+)
+
+// A readServer is a FileServer without a store, serving files from a map
+type readServer map[string]string
+
+func (s readServer) Walk(p string) (bool, error) {
+	_, ok := s[p]
+	return ok, nil
+}
+
+func (s readServer) List(dir string) (names []string, err error) {
+	for p := range s {
+		if path.Dir(p) == dir {
+			names = append(names, path.Base(p))
+		}
+	}
+	return
+}
+
+func (s readServer) Create(p string) error {
+	s[p] = ""
+	return nil
+}
+
+func (s readServer) Read(p string) ([]byte, error) {
+	return []byte(s[p]), nil
+}
+
+// overwrite opens /p/f, file id 4, as segments 3 and 4, writes through
+// segment 4 and exits with the first word of segment 3
+const overwrite = `
+	allocate 8
+	store rel sp 0 open 4
+	store rel sp 0 open 4
+	store rel sp 0 literal 0x5a5a5a5a5a5a5a5a
+	store segment 4 2 load rel sp 0
+	store rel fp 8 load segment 3 0
+	deallocate 8
+`
+
+func system(t *testing.T, server bytelang.FileServer, c *cache.Cache) (uint, error) {
+	ns, err := namespace.Read(strings.NewReader("/p --> m:/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := assemble(t, overwrite)[0]
+	return b.RunSystem(bytelang.System{
+		Namespace: ns,
+		Servers:   map[string]bytelang.FileServer{"m": server},
+		Cache:     c,
+	})
+}
+
+// Writes to the file of a StoreServer reach the server, with or without a
+// cache
+func TestStoreWrite(t *testing.T) {
+	for _, c := range []*cache.Cache{nil, cache.New(4, 2, cache.NewLRU())} {
+		m := fileserver.NewMemory()
+		m.Add("/f", []byte("0123456789abcdef"))
+		status, err := system(t, fileserver.Connect(m), c)
+		if want := uint(0x30315a5a5a5a5a5a); status != want || err != nil {
+			t.Errorf("cache %v: runs to %#x, %v; want %#x", c != nil, status, err, want)
+		}
+		f, err := m.Open("/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := f.Read(0, f.Length())
+		if want := "01ZZZZZZZZabcdef"; string(b) != want || err != nil {
+			t.Errorf("cache %v: server holds %q, %v; want %q", c != nil, b, err, want)
+		}
+	}
+}
+
+// flushes counts the flushes of a block device
+type flushes struct {
+	driver.BlockDevice
+	n int
+}
+
+func (f *flushes) Flush() error {
+	f.n++
+	return f.BlockDevice.Flush()
+}
+
+// The cache of the VM is flushed through to the block devices written
+func TestDeviceFlush(t *testing.T) {
+	r, err := driver.NewRAMDisk(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.WriteAt([]byte("0123456789abcdef"), 0)
+	d := &flushes{BlockDevice: r}
+	status, err := system(t, driver.NewServer(map[string]driver.BlockDevice{"f": d}), cache.New(4, 2, nil))
+	if want := uint(0x30315a5a5a5a5a5a); status != want || err != nil {
+		t.Errorf("runs to %#x, %v; want %#x", status, err, want)
+	}
+	b := make([]byte, 16)
+	r.ReadAt(b, 0)
+	if want := "01ZZZZZZZZabcdef"; string(b) != want || d.n != 1 {
+		t.Errorf("device holds %q, flushed %d times; want %q, once", b, d.n, want)
+	}
+}
+
+// Writes to the file of a FileServer without a store fault, rather than
+// being lost
+func TestReadOnlyWrite(t *testing.T) {
+	status, err := system(t, readServer{"/f": "0123456789abcdef"}, nil)
+	if status != ^uint(0) || err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("runs to %#x, %v", status, err)
+	}
+}
+
+// Driver processes see the devices of a PC in segment 3, and the segments
+// passed to them from segment 4
+func TestDriver(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		status uint
+		text   string // Of the VGA buffer
+		sent   string // Through the serial port
+	}{
+		{"devices", `
+			allocate 8
+			store segment 3 0xb8000 literal 0x4f076b0700000000
+			store segment 3 0x3f8 literal 0x2a00000000000000
+			store segment 3 0x48 load segment 4 0
+			store rel fp 8 load segment 3 0x3f8
+			deallocate 8
+		`, 0x5a00000000200000, "Ok", "*"},
+		{"unmapped address", `
+			allocate 8
+			store rel fp 8 load segment 3 0x1000
+			deallocate 8
+		`, ^uint(0), "", ""},
+		{"device segment passed on", `
+			allocate 8
+			store rel sp 0 process 1 0 3
+			store rel fp 8 load rel sp 0
+			deallocate 8
+		`, ^uint(0), "", ""},
+	}
+	for _, test := range tests {
+		b := assemble(t, `
+			allocate 8
+			store rel sp 0 open 1
+			store rel sp 0 literal 1000
+			store segment 3 0 load rel sp 0
+			store rel sp 0 process 1 0 3
+			store rel fp 8 load rel sp 0
+			deallocate 8
+		`, test.driver)
+		bus, vga, serial, timer := device.PC()
+		serial.Receive([]byte("Z"))
+		status, err := b[0].RunSystem(bytelang.System{Drivers: map[uint]device.Device{1: bus}}, b[1])
+		if status != test.status || err != nil {
+			t.Errorf("%s: runs to %#x, %v; want %#x", test.name, status, err, test.status)
+		}
+		if text := vga.Text(); text != test.text {
+			t.Errorf("%s: screen reads %q, want %q", test.name, text, test.text)
+		}
+		if sent := serial.Snapshot(); string(sent) != test.sent {
+			t.Errorf("%s: sent %q, want %q", test.name, sent, test.sent)
+		}
+		// The alarm set from the passed segment, and the clock advanced
+		if test.name == "devices" {
+			registers := timer.Snapshot()
+			if alarm := binary.BigEndian.Uint64(registers[device.TimerAlarm:]); alarm != 1000 || registers[device.TimerCount+7] == 0 {
+				t.Errorf("%s: timer registers % x", test.name, registers)
+			}
+		}
+	}
+}
@@ -1,11 +1,1079 @@
 package bytelang
 
-// Transpile a bytelang structure into C89 source code
-func (b *Bytelang) Transpile() (s string) {
-	s = b.function.transpile()
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The C program models the processes of the VM: each thread is a task with
+// its own stack segment, and the tasks take turns executing a statement at
+// a time, in the same rounds as the VM's scheduler.  Segments are byte
+// arrays, and words in memory keep the VM's big-endian layout.  Each module
+// has a step function that dispatches on the offset of the instruction
+// pointer, rather than threading its statements by goto: a task must yield
+// after every statement to keep the VM's interleaving of threads, and
+// assignments to _ip jump to computed addresses, which C89 can only reach
+// through a switch.  A fault longjmps back to the scheduler, which terminates the
+// faulting process.  System calls are served as by a VM without a System,
+// and the console is written to standard error once the program exits.
+const cRuntime = `#include <setjmp.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#define _STACK 65536UL
+
+/* Kinds of segment */
+enum { _KCODE, _KSTACK, _KFILE, _KSPAWN };
+
+struct _task;
+
+struct _seg {
+	unsigned char *data;
+	unsigned long len, cap;
+	int kind;
+	struct _task *owner;	/* Of a stack, the only task that accesses it */
+	unsigned long next;	/* Offset of the current record of a spawn file */
+	int running;
+};
+
+struct _module {
+	const unsigned char *code;
+	unsigned long len;
+	const unsigned long *functions;	/* Offset, body and end of each */
+	unsigned long nfunctions;
+	void (*step)(int resume);
+};
+
+struct _proc {
+	unsigned long id;
+	const struct _module *module;
+	struct _seg **segs;	/* Indexed by segment id */
+	unsigned long nsegs, next;
+	struct _task **tasks;
+	unsigned long ntasks;
+	struct _proc **children;
+	unsigned long nchildren;
+	struct _task *caller;
+	struct _seg *spawner;
+	unsigned long statusoff;	/* In the main thread's stack */
+	unsigned char status[8];
+	int exited, faulted;
+};
+
+struct _task {
+	struct _proc *proc;
+	unsigned ipseg, spseg, fpseg;
+	unsigned long ip, sp, fp;
+	unsigned long *ends;	/* End offsets of the functions in each frame */
+	unsigned long nends;
+	int resume, waiting, done;
+	struct _seg *blocked;	/* A file read past its end */
+	unsigned long blocklen;
+};
+
+static struct _task **_tasks, *_cur;
+static unsigned long _ntasks, _pids;
+static struct _seg *_console;
+static jmp_buf _env;
+
+#define _ip (_cur->ip)
+#define _sp (_cur->sp)
+#define _fp (_cur->fp)
+#define _ss (_cur->spseg)
+#define _fs (_cur->fpseg)
+
+static void _request(struct _seg *s);
+
+static void *_grow(void *p, unsigned long n, unsigned long size)
+{
+	p = realloc(p, (n ? n : 1) * size);
+	if (!p) {
+		fputs("out of memory\n", stderr);
+		exit(EXIT_FAILURE);
+	}
+	return p;
+}
+
+static void *_new(unsigned long size)
+{
+	return memset(_grow(0, 1, size), 0, size);
+}
+
+static void _report(struct _task *t, const char *msg)
+{
+	fprintf(stderr, "process %lu: fault at %u:%#lx: %s\n", t->proc->id,
+		t->ipseg, t->ip, msg);
+}
+
+static void _fault(const char *msg)
+{
+	_report(_cur, msg);
+	longjmp(_env, 1);
+}
+
+/* Block the current task until the file reaches a length */
+static void _block(struct _seg *s, unsigned long length)
+{
+	_cur->blocked = s;
+	_cur->blocklen = length;
+	longjmp(_env, 2);
+}
+
+static struct _seg *_segment(unsigned long seg, int write)
+{
+	struct _seg *s = seg < _cur->proc->nsegs ? _cur->proc->segs[seg] : 0;
+	if (!s)
+		_fault("invalid segment");
+	if (s->owner && s->owner != _cur)
+		_fault("segment is the stack of another thread");
+	if (write && s->kind == _KCODE)
+		_fault("segment is read-only");
+	return s;
+}
+
+static unsigned char *_ptr(unsigned long seg, unsigned long off, unsigned long n, int write)
+{
+	struct _seg *s = _segment(seg, write);
+	int file = s->kind == _KFILE || s->kind == _KSPAWN;
+	if (off + n < off)
+		_fault("address out of bounds");
+	if (file && write)
+		_fault("segment is a file, written only by assignment");
+	if (off > s->len || n > s->len - off) {
+		if (file)
+			_block(s, off + n);
+		_fault("address out of bounds");
+	}
+	return s->data + off;
+}
+
+/* Overwrite the bytes of a file, extending it if they pass its end */
+static void _write(struct _seg *s, unsigned long off, const unsigned char *p, unsigned long n)
+{
+	if (!s->data || off + n > s->cap) {
+		s->cap = 2 * (off + n) + 16;
+		s->data = _grow(s->data, s->cap, 1);
+	}
+	if (n)
+		memmove(s->data + off, p, n);
+	if (off + n > s->len)
+		s->len = off + n;
+}
+
+static struct _seg *_file(int kind, const unsigned char *p, unsigned long n)
+{
+	struct _seg *s = _new(sizeof *s);
+	s->kind = kind;
+	_write(s, 0, p, n);
+	return s;
+}
+
+/* Store bytes at an address, passing writes to a file through to it */
+static void _store(unsigned long seg, unsigned long off, const unsigned char *p, unsigned long n)
+{
+	struct _seg *s = _segment(seg, 1);
+	if (s->kind != _KFILE && s->kind != _KSPAWN) {
+		memmove(_ptr(seg, off, n, 1), p, n);
+		return;
+	}
+	if (off > s->len)
+		_fault("address out of bounds");
+	_write(s, off, p, n);
+	if (s->kind == _KSPAWN)
+		_request(s);
+}
+
+static void _putw(unsigned char *p, unsigned seg, unsigned long off)
+{
+	int i;
+	p[0] = (seg >> 8) & 0xff;
+	p[1] = seg & 0xff;
+	for (i = 7; i >= 2; i--) {
+		p[i] = off & 0xff;
+		off >>= 8;
+	}
+}
+
+static unsigned long _getw(const unsigned char *p, unsigned *seg)
+{
+	unsigned long off = 0;
+	int i;
+	*seg = (unsigned)p[0] << 8 | p[1];
+	for (i = 2; i < 8; i++) {
+		if (off > (~0UL >> 8))
+			_fault("address out of range");
+		off = off << 8 | p[i];
+	}
+	return off;
+}
+
+/* A word as an index, or ~0UL if it does not fit */
+static unsigned long _index(const unsigned char *p)
+{
+	unsigned long n = 0;
+	int i;
+	for (i = 0; i < 8; i++) {
+		if (n > (~0UL >> 8))
+			return ~0UL;
+		n = n << 8 | p[i];
+	}
+	return n;
+}
+
+static int _zero(const unsigned char *p, unsigned long n)
+{
+	while (n--)
+		if (*p++)
+			return 0;
+	return 1;
+}
+
+static void _alloc(unsigned long n)
+{
+	if (_sp < n)
+		_fault("stack overflow");
+	_sp -= n;
+	memset(_ptr(_ss, _sp, n, 1), 0, n);
+}
+
+static void _dealloc(unsigned long n)
+{
+	if (_sp + n < _sp || _sp + n > _segment(_ss, 0)->len)
+		_fault("stack underflow");
+	_sp += n;
+}
+
+static void _push(unsigned seg, unsigned long off)
+{
+	_alloc(8);
+	_putw(_ptr(_ss, _sp, 8, 1), seg, off);
+}
+
+static void _load(unsigned long seg, unsigned long off, unsigned long n)
+{
+	unsigned char *p = _ptr(seg, off, n, 0);
+	memmove(_ptr(_ss, _sp, n, 1), p, n);
+}
+
+static void _jump(const unsigned char *p)
+{
+	_ip = _getw(p, &_cur->ipseg);
+}
+
+static unsigned char *_operand(unsigned long n)
+{
+	if (n == 0)
+		_fault("zero-length operation");
+	_ptr(_ss, _sp, n, 0);
+	return _ptr(_ss, _sp + n, n, 1);
+}
+
+static void _not(unsigned long n)
+{
+	unsigned char *a = _ptr(_ss, _sp, n, 1);
+	if (n == 0)
+		_fault("zero-length operation");
+	while (n--)
+		a[n] = ~a[n] & 0xff;
+}
+
+static void _and(unsigned long n)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0);
+	unsigned long i;
+	for (i = 0; i < n; i++)
+		a[i] &= b[i];
+	_sp += n;
+}
+
+static void _or(unsigned long n)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0);
+	unsigned long i;
+	for (i = 0; i < n; i++)
+		a[i] |= b[i];
+	_sp += n;
+}
+
+static void _xor(unsigned long n)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0);
+	unsigned long i;
+	for (i = 0; i < n; i++)
+		a[i] ^= b[i];
+	_sp += n;
+}
+
+static void _add(unsigned long n)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0);
+	unsigned long i, c = 0;
+	for (i = n; i-- > 0;) {
+		c += a[i] + b[i];
+		a[i] = c & 0xff;
+		c >>= 8;
+	}
+	_sp += n;
+}
+
+static void _sub(unsigned char *a, const unsigned char *b, unsigned long n)
+{
+	unsigned long i, c = 0;
+	for (i = n; i-- > 0;) {
+		unsigned long d = b[i] + c;
+		c = a[i] < d;
+		a[i] = (a[i] + 256 - d) & 0xff;
+	}
+}
+
+static void _subtract(unsigned long n)
+{
+	unsigned char *a = _operand(n);
+	_sub(a, _ptr(_ss, _sp, n, 0), n);
+	_sp += n;
+}
+
+/* Shift amount of the second operand, saturating at the operand width */
+static unsigned long _count(const unsigned char *b, unsigned long n)
+{
+	unsigned long i, s = 0;
+	for (i = 0; i < n; i++) {
+		if (s > (8 * n) >> 8)
+			return 8 * n;
+		s = s << 8 | b[i];
+	}
+	return s < 8 * n ? s : 8 * n;
+}
+
+static void _shiftl(unsigned long n)
+{
+	unsigned char *a = _operand(n);
+	unsigned long s = _count(_ptr(_ss, _sp, n, 0), n), k = s / 8, i;
+	unsigned bits = s % 8;
+	for (i = 0; i < n; i++) {
+		unsigned hi = i + k < n ? a[i + k] : 0;
+		unsigned lo = i + k + 1 < n ? a[i + k + 1] : 0;
+		a[i] = (hi << bits | lo >> (8 - bits)) & 0xff;
+	}
+	_sp += n;
+}
+
+static void _shiftr(unsigned long n, unsigned fill)
+{
+	unsigned char *a = _operand(n);
+	unsigned long s = _count(_ptr(_ss, _sp, n, 0), n), k = s / 8, i;
+	unsigned bits = s % 8;
+	for (i = n; i-- > 0;) {
+		unsigned lo = i >= k ? a[i - k] : fill;
+		unsigned hi = i >= k + 1 ? a[i - k - 1] : fill;
+		a[i] = (lo >> bits | hi << (8 - bits)) & 0xff;
+	}
+	_sp += n;
+}
+
+static void _lshiftr(unsigned long n)
+{
+	_shiftr(n, 0);
+}
+
+static void _ashiftr(unsigned long n)
+{
+	_shiftr(n, _operand(n)[0] & 0x80 ? 0xff : 0);
+}
+
+static unsigned char *_scratch(unsigned long n)
+{
+	unsigned char *p = calloc(n ? n : 1, 1);
+	if (!p)
+		_fault("out of memory");
+	return p;
+}
+
+/* r = x * y modulo 2^(8n); r may alias x or y */
+static void _mul(unsigned char *r, const unsigned char *x, const unsigned char *y, unsigned long n)
+{
+	unsigned char *t = _scratch(n);
+	unsigned long i, j, c;
+	for (i = 0; i < n; i++) {
+		if (!y[n - 1 - i])
+			continue;
+		c = 0;
+		for (j = 0; i + j < n; j++) {
+			c += t[n - 1 - i - j] + (unsigned long)x[n - 1 - j] * y[n - 1 - i];
+			t[n - 1 - i - j] = c & 0xff;
+			c >>= 8;
+		}
+	}
+	memcpy(r, t, n);
+	free(t);
+}
+
+static void _multiply(unsigned long n)
+{
+	unsigned char *a = _operand(n);
+	_mul(a, a, _ptr(_ss, _sp, n, 0), n);
+	_sp += n;
+}
+
+/* Long division of the operands, leaving either quotient or remainder */
+static void _divide(unsigned long n, int remainder)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0), *q, *r, *d;
+	unsigned long i;
+	if (_zero(b, n))
+		_fault("division by zero");
+	q = _scratch(n);
+	r = _scratch(n + 1);
+	d = _scratch(n + 1);
+	memcpy(d + 1, b, n);
+	for (i = 0; i < 8 * n; i++) {
+		unsigned long j;
+		unsigned bit = a[i / 8] >> (7 - i % 8) & 1;
+		for (j = 0; j < n; j++)
+			r[j] = (r[j] << 1 | r[j + 1] >> 7) & 0xff;
+		r[n] = (r[n] << 1 | bit) & 0xff;
+		if (memcmp(r, d, n + 1) >= 0) {
+			_sub(r, d, n + 1);
+			q[i / 8] |= 0x80 >> (i % 8);
+		}
+	}
+	memcpy(a, remainder ? r + 1 : q, n);
+	free(q);
+	free(r);
+	free(d);
+	_sp += n;
+}
+
+static void _dividefloor(unsigned long n)
+{
+	_divide(n, 0);
+}
+
+static void _modulo(unsigned long n)
+{
+	_divide(n, 1);
+}
+
+static void _exponent(unsigned long n)
+{
+	unsigned char *a = _operand(n), *b = _ptr(_ss, _sp, n, 0), *r = _scratch(n);
+	unsigned long i;
+	if (n)
+		r[n - 1] = 1;
+	for (i = 0; i < 8 * n; i++) {
+		_mul(r, r, r, n);
+		if (b[i / 8] >> (7 - i % 8) & 1)
+			_mul(r, r, a, n);
+	}
+	memcpy(a, r, n);
+	free(r);
+	_sp += n;
+}
+static int _function(const struct _module *m, unsigned long off, unsigned long *body, unsigned long *end)
+{
+	unsigned long i;
+	for (i = 0; i < m->nfunctions; i++)
+		if (m->functions[3 * i] == off) {
+			*body = m->functions[3 * i + 1];
+			*end = m->functions[3 * i + 2];
+			return 1;
+		}
+	return 0;
+}
+
+/* Push a frame for the function at offset fn, returning to the statement at
+   offset ret, or exiting the thread */
+static void _enter(unsigned long fn, unsigned long ret, int exit)
+{
+	unsigned long body, end;
+	if (!_function(_cur->proc->module, fn, &body, &end))
+		_fault("no function at offset");
+	_push(_fs, _fp);
+	_fs = _ss;
+	_fp = _sp;
+	_alloc(8);
+	if (exit)
+		memset(_ptr(_ss, _sp, 8, 1), 0xff, 8);
+	else
+		_putw(_ptr(_ss, _sp, 8, 1), 1, ret);
+	_cur->ipseg = 1;
+	_ip = body;
+	_cur->ends = _grow(_cur->ends, _cur->nends + 1, sizeof *_cur->ends);
+	_cur->ends[_cur->nends++] = end;
+}
+
+static void _terminate(struct _proc *p);
+
+/* Record the exit status of the process of a spawn file */
+static void _exited(struct _seg *s, const unsigned char *status)
+{
+	_write(s, s->next + 16, status, 8);
+	s->next += 24;
+	s->running = 0;
+}
+
+/* Exit a process, waking its caller with the exit status */
+static void _exitp(struct _proc *p)
+{
+	struct _task *c = p->caller;
+	struct _seg *s;
+	unsigned long i;
+	p->exited = 1;
+	for (i = 0; i < p->ntasks; i++)
+		p->tasks[i]->done = 1;
+	if (p->spawner)
+		_exited(p->spawner, p->status);
+	if (!c || c->done)
+		return;
+	c->waiting = 0;
+	s = c->spseg < c->proc->nsegs ? c->proc->segs[c->spseg] : 0;
+	if (!s || s->kind != _KSTACK || c->sp > s->len || 8 > s->len - c->sp) {
+		_report(c, "address out of bounds");
+		_terminate(c->proc);
+		return;
+	}
+	memcpy(s->data + c->sp, p->status, 8);
+	c->resume = 1;
+}
+
+/* Terminate a faulting process and everything it is blocked on */
+static void _terminate(struct _proc *p)
+{
+	unsigned long i;
+	if (p->exited)
+		return;
+	for (i = 0; i < p->nchildren; i++)
+		if (!p->children[i]->exited) {
+			p->children[i]->caller = 0;
+			_terminate(p->children[i]);
+		}
+	memset(p->status, 0xff, 8);
+	p->faulted = 1;
+	_exitp(p);
+}
+
+static void _join(struct _proc *p)
+{
+	unsigned long i;
+	for (i = 0; i < p->ntasks; i++)
+		if (!p->tasks[i]->done)
+			return;
+	_exitp(p);
+}
+
+static void _ret(void)
+{
+	unsigned char *p = _ptr(_fs, _fp - 8, 16, 0), ret[8];
+	struct _proc *proc = _cur->proc;
+	unsigned seg;
+	memcpy(ret, p, 8);
+	_sp = _fp + 8;
+	_ss = _fs;
+	_fp = _getw(p + 8, &seg);
+	_fs = seg;
+	_cur->nends--;
+	if (memcmp(ret, "\377\377\377\377\377\377\377\377", 8)) {
+		_jump(ret);
+		_cur->resume = 1;
+		return;
+	}
+	if (_cur == proc->tasks[0])
+		memcpy(proc->status, _ptr(2, proc->statusoff, 8, 0), 8);
+	_cur->done = 1;
+	_join(proc);
+}
+
+/* Execute the statement at the instruction pointer */
+static void _step(void)
+{
+	int resume = _cur->resume;
+	if (_cur->ipseg == 1 && _cur->nends && _ip == _cur->ends[_cur->nends - 1]) {
+		_ret();
+		return;
+	}
+	if (_cur->ipseg != 1)
+		_fault("instruction pointer outside code segment");
+	_cur->resume = 0;
+	_cur->proc->module->step(resume);
+}
+`
+
+// cSystem follows the module table
+const cSystem = `
+static void _attach(struct _proc *p, unsigned long id, struct _seg *s)
+{
+	if (id >= p->nsegs) {
+		p->segs = _grow(p->segs, id + 1, sizeof *p->segs);
+		while (p->nsegs <= id)
+			p->segs[p->nsegs++] = 0;
+	}
+	p->segs[id] = s;
+}
+
+/* Start a thread at function fn with a fresh stack segment.  The main thread
+   of a process also gets a word for the exit status. */
+static struct _task *_newtask(struct _proc *p, unsigned long fn, int main)
+{
+	struct _task *t, *cur = _cur;
+	struct _seg *s;
+	unsigned long id = 2, body, end;
+	if (!main)
+		id = p->next++;
+	if (!_function(p->module, fn, &body, &end))
+		_fault("no function at offset");
+	t = _new(sizeof *t);
+	t->proc = p;
+	s = _new(sizeof *s);
+	s->kind = _KSTACK;
+	s->data = _new(_STACK);
+	s->len = _STACK;
+	s->owner = t;
+	_attach(p, id, s);
+	t->spseg = id;
+	t->sp = _STACK;
+	_cur = t;
+	if (main)
+		_push(0, 0);
+	_enter(fn, 0, 1);
+	_cur = cur;
+	p->tasks = _grow(p->tasks, p->ntasks + 1, sizeof *p->tasks);
+	p->tasks[p->ntasks++] = t;
+	_tasks = _grow(_tasks, _ntasks + 1, sizeof *_tasks);
+	_tasks[_ntasks++] = t;
+	return t;
+}
+
+/* Create a process running function fn of a module, sharing segments with
+   the caller */
+static struct _proc *_spawn(unsigned long module, unsigned long fn, struct _seg **segs, unsigned long n, struct _task *caller)
+{
+	struct _proc *p;
+	struct _seg *code;
+	unsigned long i;
+	if (module >= sizeof _modules / sizeof *_modules)
+		_fault("invalid module");
+	p = _new(sizeof *p);
+	p->id = ++_pids;
+	p->module = &_modules[module];
+	code = _new(sizeof *code);
+	code->kind = _KCODE;
+	code->data = (unsigned char *)p->module->code;
+	code->len = p->module->len;
+	_attach(p, 1, code);
+	p->next = 3;
+	for (i = 0; i < n; i++)
+		_attach(p, p->next++, segs[i]);
+	p->caller = caller;
+	p->statusoff = _newtask(p, fn, 1)->fp + 8;
+	if (caller) {
+		struct _proc *c = caller->proc;
+		c->children = _grow(c->children, c->nchildren + 1, sizeof *c->children);
+		c->children[c->nchildren++] = p;
+	}
+	return p;
+}
+
+static void _thread(unsigned long fn)
+{
+	_newtask(_cur->proc, fn, 0);
+}
+
+/* Call a function of another module, blocking until its process exits */
+static void _process(unsigned long module, unsigned long fn, unsigned long n, const unsigned long *ids)
+{
+	struct _seg **segs = _grow(0, n, sizeof *segs);
+	unsigned long i;
+	for (i = 0; i < n; i++) {
+		struct _seg *s = ids[i] < _cur->proc->nsegs ? _cur->proc->segs[ids[i]] : 0;
+		if (!s)
+			_fault("invalid segment");
+		if (s->kind == _KSTACK)
+			_fault("stack segments cannot be passed to a process");
+		segs[i] = s;
+	}
+	_spawn(module, fn, segs, n, _cur);
+	free(segs);
+	_cur->waiting = 1;
+}
+
+/* The system call, opening the file with an id as a new segment */
+static void _open(unsigned long id)
+{
+	static const char metadata[] = "1 console\n2 clock\n3 spawn\n";
+	unsigned char w[8], ns[8];
+	struct _seg *s = 0;
+	unsigned long seg;
+	switch (id) {
+	case 0:
+		s = _file(_KFILE, (const unsigned char *)metadata, sizeof metadata - 1);
+		break;
+	case 1:
+		if (!_console)
+			_console = _file(_KFILE, 0, 0);
+		s = _console;
+		break;
+	case 2:
+		_putw(w, 0, (unsigned long)time(0));
+		_putw(ns, 0, 1000000000UL);
+		_mul(w, w, ns, 8);
+		s = _file(_KFILE, w, 8);
+		break;
+	case 3:
+		s = _file(_KSPAWN, 0, 0);
+		break;
+	}
+	if (s) {
+		seg = _cur->proc->next++;
+		_attach(_cur->proc, seg, s);
+		_putw(_ptr(_ss, _sp, 8, 1), 0, seg);
+	} else {
+		memset(_ptr(_ss, _sp, 8, 1), 0xff, 8);
+	}
+	_cur->resume = 1;
+}
+
+/* Spawn the process of a record written to a spawn file */
+static void _request(struct _seg *s)
+{
+	struct _proc *p;
+	if (s->running && s->len > s->next + 16)
+		_fault("spawn file written while its process runs");
+	if (s->running || s->len < s->next + 16)
+		return;
+	p = _spawn(_index(s->data + s->next), _index(s->data + s->next + 8), 0, 0, 0);
+	p->spawner = s;
+	s->running = 1;
+}
+
+/* Step each task in turn, until every process has exited */
+static void _schedule(void)
+{
+	static unsigned long i, n, live;
+	static int progress;
+	while (_ntasks) {
+		progress = 0;
+		n = _ntasks;
+		for (i = 0; i < n; i++) {
+			_cur = _tasks[i];
+			if (_cur->done || _cur->waiting)
+				continue;
+			if (_cur->blocked) {
+				if (_cur->blocked->len < _cur->blocklen)
+					continue;
+				_cur->blocked = 0;
+			}
+			progress = 1;
+			switch (setjmp(_env)) {
+			case 0:
+				_step();
+				break;
+			case 1:
+				_terminate(_cur->proc);
+				break;
+			}
+		}
+		for (i = live = 0; i < _ntasks; i++)
+			if (!_tasks[i]->done)
+				_tasks[live++] = _tasks[i];
+		_ntasks = live;
+		if (!progress && live) {
+			_report(_tasks[0], "deadlock");
+			_terminate(_tasks[0]->proc);
+		}
+	}
+}
+
+int main(void)
+{
+	struct _proc *root = _spawn(0, 0, 0, 0, 0);
+	unsigned char *s = root->status;
+	_schedule();
+	if (_console)
+		fwrite(_console->data, 1, _console->len, stderr);
+	printf("%02x%02x%02x%02x%02x%02x%02x%02x\n", s[0], s[1], s[2], s[3],
+		s[4], s[5], s[6], s[7]);
+	return root->faulted ? EXIT_FAILURE : EXIT_SUCCESS;
+}
+`
+
+var cOperations = map[byte]string{
+	MarkerNot:         "_not",
+	MarkerAnd:         "_and",
+	MarkerOr:          "_or",
+	MarkerXor:         "_xor",
+	MarkerShiftL:      "_shiftl",
+	MarkerLShiftR:     "_lshiftr",
+	MarkerAShiftR:     "_ashiftr",
+	MarkerAdd:         "_add",
+	MarkerSubtract:    "_subtract",
+	MarkerMultiply:    "_multiply",
+	MarkerDivideFloor: "_dividefloor",
+	MarkerExponent:    "_exponent",
+	MarkerModulo:      "_modulo",
+}
+
+type transpiler struct {
+	*code
+}
+
+// Transpile a bytelang structure into a C89 program that runs it as Run
+// does, with the additional modules as the code segments it can call into.
+// The program prints the exit status of the initial process as a hex word.
+func (b *Bytelang) Transpile(modules ...*Bytelang) (s string, err error) {
+	var steps []string
+	s = cRuntime
+	for i, m := range append([]*Bytelang{b}, modules...) {
+		_, c, err := decode([]byte(m.Compile()))
+		if err != nil {
+			return "", err
+		}
+		t := &transpiler{c}
+		s += cBytes(fmt.Sprint("_code", i), c.bytes)
+		s += t.functions(i)
+		s += fmt.Sprintf("static void _step%d(int resume);\n\n", i)
+		steps = append(steps, t.step(i))
+	}
+	s += "static const struct _module _modules[] = {\n"
+	for i := range steps {
+		s += fmt.Sprintf("\t{_code%d, sizeof _code%d, _functions%d,\n", i, i, i)
+		s += fmt.Sprintf("\t\tsizeof _functions%d / sizeof *_functions%d / 3, _step%d},\n", i, i, i)
+	}
+	s += "};\n"
+	s += cSystem
+	s += strings.Join(steps, "")
+	return
+}
+
+func cBytes(name string, b []byte) (s string) {
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	s = fmt.Sprintf("static const unsigned char %s[] = {", name)
+	for i, c := range b {
+		if i%12 == 0 {
+			s += "\n\t"
+		} else {
+			s += " "
+		}
+		s += fmt.Sprintf("0x%02x,", c)
+	}
+	s += "\n};\n"
 	return
 }
 
-func (f function) transpile() (s string) {
+// constant returns a C unsigned long constant, if it fits in 32 bits
+func constant(n uint) (string, bool) {
+	if n > 0xffffffff {
+		return "", false
+	}
+	return fmt.Sprintf("%dUL", n), true
+}
+
+// index returns a C constant for a segment id, module or function offset,
+// where those that do not fit in 32 bits are invalid
+func index(n uint) string {
+	if c, ok := constant(n); ok {
+		return c
+	}
+	return "~0UL"
+}
+
+func fault(msg string) string {
+	return fmt.Sprintf("\t\t_fault(%q);\n", msg)
+}
+
+// offsets returns the statement offsets in order
+func (t *transpiler) offsets() (offsets []uint) {
+	for off := range t.steps {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
 	return
 }
+
+// functions emits the table of the functions of module i
+func (t *transpiler) functions(i int) (s string) {
+	s = fmt.Sprintf("static const unsigned long _functions%d[] = {\n", i)
+	for _, off := range t.offsets() {
+		st := t.steps[off]
+		if _, ok := st.statement.(function); ok {
+			s += fmt.Sprintf("\t%dUL, %dUL, %dUL,\n", off, st.body, st.next)
+		}
+	}
+	s += "};\n"
+	return
+}
+
+// step emits the step function of module i, with a case for each statement.
+// Each case returns to the scheduler with _ip at the next statement, as the
+// VM executes one statement of each task in a round.
+func (t *transpiler) step(i int) (s string) {
+	s = fmt.Sprintf("\nstatic void _step%d(int resume)\n{\n\tswitch (_ip) {\n", i)
+	for _, off := range t.offsets() {
+		s += t.statement(off, t.steps[off])
+	}
+	s += "\t}\n\t_fault(\"no statement at address\");\n}\n"
+	return
+}
+
+// statement emits a case executing the statement at offset off, or
+// completing it when resuming after a call
+func (t *transpiler) statement(off uint, st *step) (s string) {
+	s = fmt.Sprintf("\tcase %dUL:\n", off)
+	next := fmt.Sprintf("\t\t_ip = %dUL;\n\t\treturn;\n", st.next)
+	switch stmt := st.statement.(type) {
+	case allocate:
+		s += "\t\tif (!resume)\n"
+		if n, ok := constant(uint(stmt)); ok {
+			s += fmt.Sprintf("\t\t\t_alloc(%s);\n", n)
+		} else {
+			s += "\t" + fault("stack overflow")
+		}
+	case deallocate:
+		s += "\t\tif (!resume)\n"
+		if n, ok := constant(uint(stmt)); ok {
+			s += fmt.Sprintf("\t\t\t_dealloc(%s);\n", n)
+		} else {
+			s += "\t" + fault("stack underflow")
+		}
+	case assignment:
+		s += "\t\tif (!resume) {\n"
+		s += indent(t.expression(off, stmt.value))
+		s += "\t\t}\n"
+		s += t.assign(stmt)
+		if _, ok := stmt.address.(instructionPointer); ok {
+			return
+		}
+	case thread:
+		s += fmt.Sprintf("\t\tif (!resume)\n\t\t\t_thread(%s);\n", index(uint(stmt)))
+	case ifStmt:
+		s += "\t\tif (!resume) {\n"
+		s += indent(t.expression(off, stmt.condition))
+		s += "\t\t}\n"
+		if n, ok := constant(length(stmt.condition)); ok {
+			s += fmt.Sprintf("\t\tif (!_zero(_ptr(_ss, _sp, %s, 0), %s)) {\n", n, n)
+			s += fmt.Sprintf("\t\t\t_ip = %dUL;\n\t\t\treturn;\n\t\t}\n", st.body)
+		} else {
+			s += fault("address out of bounds")
+		}
+	case returnStmt:
+		s += "\t\tif (!resume) {\n\t\t\t_ret();\n\t\t\treturn;\n\t\t}\n"
+	}
+	return s + next
+}
+
+// indent the code of an expression by a level
+func indent(s string) string {
+	return strings.Replace("\t"+s, "\n\t", "\n\t\t", -1)
+}
+
+// address returns C expressions for the segment and offset of an address
+func (t *transpiler) address(a address) (seg, off string, ok bool) {
+	register := func(seg, r string, offset uint) (string, string, bool) {
+		d := int64(offset)
+		if d < 0 {
+			n, ok := constant(uint(-d))
+			return seg, r + " - " + n, ok
+		}
+		n, ok := constant(uint(d))
+		return seg, r + " + " + n, ok
+	}
+	switch a := a.(type) {
+	case absolute:
+		off, ok = constant(uint(a) & offsetMask)
+		return fmt.Sprint(uint(a) >> segmentShift), off, ok
+	case stackPointer:
+		return register("_ss", "_sp", a.offset)
+	case framePointer:
+		return register("_fs", "_fp", a.offset)
+	}
+	return
+}
+
+// expression emits code placing the value of e at the bottom of the stack.
+// Calls return from the step, to complete the statement once they return.
+func (t *transpiler) expression(off uint, e expression) (s string) {
+	switch e := e.(type) {
+	case functionCall:
+		s = fmt.Sprintf("\t\t_enter(%s, %dUL, 0);\n\t\treturn;\n", index(uint(e)), off)
+	case processCall:
+		switch {
+		case e.module == SystemModule && len(e.segments) > 0:
+			return fault("segments passed to a system call")
+		case e.module == SystemModule:
+			return fmt.Sprintf("\t\t_open(%s);\n\t\treturn;\n", index(e.function))
+		case len(e.segments) == 0:
+			s = fmt.Sprintf("\t\t_process(%s, %s, 0, 0);\n", index(e.module), index(e.function))
+		default:
+			var ids []string
+			for _, id := range e.segments {
+				ids = append(ids, index(id))
+			}
+			s = "\t\t{\n"
+			s += fmt.Sprintf("\t\t\tstatic const unsigned long s[] = {%s};\n", strings.Join(ids, ", "))
+			s += fmt.Sprintf("\t\t\t_process(%s, %s, %d, s);\n\t\t}\n", index(e.module), index(e.function), len(ids))
+		}
+		s += "\t\treturn;\n"
+	case literal:
+		var b []byte
+		for _, w := range e {
+			b = append(b, putWord(w)...)
+		}
+		s = t.store(b)
+	case reference:
+		s = t.store([]byte(putWord(uint(e))))
+	case dereference:
+		if _, ok := e.address.(instructionPointer); ok {
+			if e.length != wordLength {
+				return fault("instruction pointer must be read at word length")
+			}
+			return fmt.Sprintf("\t\t_putw(_ptr(_ss, _sp, 8, 1), 1, %dUL);\n", off)
+		}
+		seg, addr, ok := t.address(e.address)
+		n, nok := constant(e.length)
+		if !ok || !nok {
+			return fault("address out of bounds")
+		}
+		s = fmt.Sprintf("\t\t_load(%s, %s, %s);\n", seg, addr, n)
+	case operation:
+		if n, ok := constant(e.length); ok {
+			s = fmt.Sprintf("\t\t%s(%s);\n", cOperations[e.marker], n)
+		} else {
+			s = fault("address out of bounds")
+		}
+	}
+	return
+}
+
+func (t *transpiler) store(b []byte) (s string) {
+	if len(b) == 0 {
+		return "\t\t_ptr(_ss, _sp, 0, 1);\n"
+	}
+	s = "\t\t{\n"
+	for _, line := range strings.Split(cBytes("v", b), "\n") {
+		if line != "" {
+			s += "\t\t\t" + line + "\n"
+		}
+	}
+	s += fmt.Sprintf("\t\t\tmemcpy(_ptr(_ss, _sp, %d, 1), v, %d);\n\t\t}\n", len(b), len(b))
+	return
+}
+
+// assign emits the completion of an assignment, after its value is evaluated
+func (t *transpiler) assign(a assignment) (s string) {
+	if _, ok := a.address.(instructionPointer); ok {
+		if a.length != wordLength {
+			return fault("instruction pointer must be assigned at word length")
+		}
+		return "\t\t_jump(_ptr(_ss, _sp, 8, 0));\n\t\treturn;\n"
+	}
+	seg, addr, ok := t.address(a.address)
+	n, nok := constant(a.length)
+	if !ok || !nok {
+		return fault("address out of bounds")
+	}
+	return fmt.Sprintf("\t\t_store(%s, %s, _ptr(_ss, _sp, %s, 0), %s);\n", seg, addr, n, n)
+}
@@ -0,0 +1,187 @@
+package bytelang_test
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/asmlang"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// transpiled compiles the C89 source of a program with gcc, and returns the
+// exit status it prints and whether it faulted
+func transpiled(t *testing.T, b *bytelang.Bytelang, modules ...*bytelang.Bytelang) (status uint, faulted bool) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	src, err := b.Transpile(modules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c, exe := filepath.Join(dir, "prog.c"), filepath.Join(dir, "prog")
+	if err := os.WriteFile(c, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("gcc", "-std=c89", "-pedantic-errors", "-Wall", "-Werror",
+		"-Wno-unused-function", "-o", exe, c).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	out, err = exec.Command(exe).Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	s, perr := strconv.ParseUint(lines[len(lines)-1], 16, 64)
+	if perr != nil {
+		t.Fatalf("%v in output %q", perr, out)
+	}
+	return uint(s), err != nil
+}
+
+// same checks that a program runs to the same result in the VM and in C
+func same(t *testing.T, b *bytelang.Bytelang, modules ...*bytelang.Bytelang) (status uint) {
+	status, err := b.Run(modules...)
+	cstatus, faulted := transpiled(t, b, modules...)
+	if cstatus != status || faulted != (err != nil) {
+		t.Errorf("VM runs to %#x, %v; C to %#x, faulted %v", status, err, cstatus, faulted)
+	}
+	return status
+}
+
+func assemble(t *testing.T, text ...string) (b []*bytelang.Bytelang) {
+	for _, s := range text {
+		m, err := asmlang.Assemble(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, m)
+	}
+	return
+}
+
+func TestTranspile(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []string // Followed by the modules it calls
+		status  uint
+	}{
+		{"loop through the instruction pointer", []string{`
+			allocate 8
+			store rel sp 0 literal 5	# counter at fp-16
+			loop:
+			allocate 16
+			store rel sp 8 load rel fp 8
+			store rel sp 0 literal 3
+			store rel fp 8 add
+			deallocate 8
+			allocate 16
+			store rel sp 8 load rel fp 0xfffffffffffffff0
+			store rel sp 0 literal 1
+			store rel fp 0xfffffffffffffff0 sub
+			deallocate 8
+			if load rel fp 0xfffffffffffffff0
+				allocate 16
+				store rel sp 8 literal 0x1000000000000
+				store rel sp 0 literal loop
+				store val ip add
+			end
+			deallocate 8
+		`}, 15},
+		{"thread writing a file the main thread reads", []string{`
+			allocate 8
+			store rel sp 0 open 1	# the console, as segment 3
+			deallocate 8
+			thread writer
+			allocate 8
+			store rel fp 8 load segment 3 0	# blocks until written
+			deallocate 8
+			writer:
+			function
+				allocate 8
+				store rel sp 0 literal 42
+				store segment 3 0 load rel sp 0
+				deallocate 8
+			end
+		`}, 42},
+		{"process call passing a segment", []string{`
+			allocate 8
+			store rel sp 0 open 1
+			store rel sp 0 literal 21
+			store segment 3 0 load rel sp 0
+			store rel sp 0 process 1 0 3
+			store rel fp 8 load rel sp 0
+			deallocate 8
+		`, `
+			allocate 16
+			store rel sp 8 literal 2
+			store rel sp 0 load segment 3 0
+			store rel fp 8 mult
+			deallocate 8
+		`}, 42},
+		{"process call of a faulting process", []string{`
+			allocate 8
+			store rel sp 0 process 1 0
+			store rel fp 8 load rel sp 0
+			deallocate 8
+		`, `
+			allocate 16
+			store rel fp 8 floordiv
+			deallocate 8
+		`}, ^uint(0)},
+		{"spawn file", []string{`
+			allocate 16
+			store rel sp 0 open 3
+			store rel sp 0 literal 1 0
+			store bytes 16 segment 3 0 load bytes 16 rel sp 0
+			store rel fp 8 load segment 3 16	# blocks until it exits
+			deallocate 16
+		`, `
+			allocate 8
+			store rel sp 0 literal 7
+			store rel fp 8 load rel sp 0
+			deallocate 8
+		`}, 7},
+		{"metadata and failed open", []string{`
+			allocate 16
+			store rel sp 0 open 0
+			store rel sp 8 load segment 3 0
+			store rel sp 0 open 9
+			store rel fp 8 xor
+			deallocate 8
+		`}, 0x3120636f6e736f6c ^ ^uint(0)},
+		{"deadlock", []string{`
+			allocate 8
+			store rel sp 0 open 1
+			store rel fp 8 load segment 3 0
+			deallocate 8
+		`}, ^uint(0)},
+		{"fault", []string{`
+			allocate 16
+			store rel fp 8 floordiv
+			deallocate 8
+		`}, ^uint(0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := assemble(t, test.program...)
+			if status := same(t, b[0], b[1:]...); status != test.status {
+				t.Errorf("runs to %#x, want %#x", status, test.status)
+			}
+		})
+	}
+}
+
+func TestTranspileRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		same(t, bytelang.RandomOperation(r))
+		same(t, bytelang.RandomProgram(r))
+	}
+}
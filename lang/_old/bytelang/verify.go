@@ -0,0 +1,268 @@
+package bytelang
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Diagnostic is a rule broken by the statement at a bytecode offset
+type Diagnostic struct {
+	Offset  uint
+	Message string
+}
+
+// Diagnostics is the error returned by Verify
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i, diag := range d {
+		lines[i] = fmt.Sprintf("bytelang: offset %d: %s", diag.Offset, diag.Message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The stack of a frame, as simulated by the verifier
+type stack struct {
+	known bool // False once control has jumped or returned
+	depth uint // Bytes allocated in the frame
+}
+
+type verifier struct {
+	*code
+	threads map[uint]bool // Functions started as threads
+	thread  bool          // The current function is started as a thread
+	real    bool          // Absolute addresses are real addresses
+	diags   Diagnostics
+}
+
+// Verify checks the rules of the bytecode semantics that can be decided
+// without running a program, by simulating the stack of each function along
+// every path through its if statements:
+//
+//	allocations are deallocated only once, and if bodies leave the stack
+//	depth unchanged
+//	expressions and assignments only use allocated stack
+//	operations have both of their operands allocated at the bottom of the
+//	stack
+//	the instruction pointer is read and assigned at word length
+//	stack addresses stay within the allocated frame and the caller's
+//	variables, without overwriting the saved frame pointer or return address
+//	absolute addresses name a valid segment, and threads do not use the stack
+//	segment of the main thread
+//	calls and threads start functions
+//
+// Statements following a return or jump are checked without a stack depth,
+// as they can only be reached through the instruction pointer.  All broken
+// rules are returned as Diagnostics.
+func (b *Bytelang) Verify() error {
+	_, c, err := decode([]byte(b.Compile()))
+	if err != nil {
+		return err
+	}
+	return verify(c)
+}
+
+func verify(c *code) error {
+	v := &verifier{code: c, threads: make(map[uint]bool)}
+	for _, s := range c.steps {
+		if t, ok := s.statement.(thread); ok {
+			v.threads[uint(t)] = true
+		}
+	}
+	v.function(0)
+	if len(v.diags) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.diags, func(i, j int) bool { return v.diags[i].Offset < v.diags[j].Offset })
+	return v.diags
+}
+
+func (v *verifier) fail(off uint, format string, a ...interface{}) {
+	v.diags = append(v.diags, Diagnostic{off, fmt.Sprintf(format, a...)})
+}
+
+func (v *verifier) function(off uint) {
+	f := v.steps[off]
+	thread := v.thread
+	v.thread = v.threads[off]
+	v.statements(f.body, f.next, &stack{known: true})
+	v.thread = thread
+}
+
+func (v *verifier) statements(off, end uint, s *stack) {
+	real := v.real
+	for off < end {
+		st := v.steps[off]
+		v.statement(off, st, s)
+		off = st.next
+	}
+	v.real = real
+}
+
+func (v *verifier) statement(off uint, st *step, s *stack) {
+	switch stmt := st.statement.(type) {
+	case function:
+		v.function(off)
+	case allocate:
+		s.depth += uint(stmt)
+	case deallocate:
+		v.pop(off, s, uint(stmt))
+	case assignment:
+		v.expression(off, stmt.value, s)
+		if _, ok := stmt.value.(functionCall); !ok {
+			v.need(off, s, stmt.length, "assignment reads")
+		}
+		v.address(off, stmt.address, stmt.length, true, s)
+		if _, ok := stmt.address.(instructionPointer); ok {
+			s.known = false
+		}
+	case thread:
+		v.call(off, uint(stmt))
+	case ifStmt:
+		v.expression(off, stmt.condition, s)
+		v.need(off, s, length(stmt.condition), "condition reads")
+		body := *s
+		v.statements(st.body, st.next, &body)
+		switch {
+		case !s.known:
+			*s = body
+		case body.known && body.depth != s.depth:
+			v.fail(off, "if body changes the stack depth from %d to %d bytes", s.depth, body.depth)
+		}
+	case returnStmt:
+		s.known = false
+	case pragma:
+		if stmt == pragmaRealAddress {
+			v.real = true
+		}
+	}
+}
+
+// need checks that n bytes are allocated at the bottom of the stack
+func (v *verifier) need(off uint, s *stack, n uint, what string) {
+	if s.known && s.depth < n {
+		v.fail(off, "%s %d bytes, but only %d are allocated", what, n, s.depth)
+	}
+}
+
+// pop deallocates n bytes
+func (v *verifier) pop(off uint, s *stack, n uint) {
+	if !s.known {
+		return
+	}
+	if s.depth < n {
+		v.fail(off, "deallocates %d bytes, but only %d are allocated", n, s.depth)
+		s.depth = 0
+		return
+	}
+	s.depth -= n
+}
+
+func (v *verifier) call(off, fn uint) {
+	if s, ok := v.steps[fn]; ok {
+		if _, ok := s.statement.(function); ok {
+			return
+		}
+	}
+	v.fail(off, "no function at offset %d", fn)
+}
+
+func (v *verifier) expression(off uint, e expression, s *stack) {
+	switch e := e.(type) {
+	case functionCall:
+		v.call(off, uint(e))
+	case processCall:
+		if e.module == 0 {
+			v.call(off, e.function)
+		}
+		for _, id := range e.segments {
+			switch id {
+			case 0:
+				v.fail(off, "invalid segment 0 passed to a process")
+			case stackSegment:
+				v.fail(off, "stack segment passed to a process")
+			}
+		}
+		v.need(off, s, wordLength, "process call writes")
+	case reference:
+		v.need(off, s, wordLength, "reference writes")
+	case literal:
+		v.need(off, s, length(e), "literal writes")
+	case dereference:
+		v.address(off, e.address, e.length, false, s)
+		v.need(off, s, e.length, "dereference writes")
+	case operation:
+		v.operation(off, e, s)
+	}
+}
+
+func (v *verifier) operation(off uint, o operation, s *stack) {
+	if o.length == 0 {
+		v.fail(off, "zero-length operation")
+		return
+	}
+	if !s.known {
+		return
+	}
+	// The operands lie at the bottom of the stack, and the result replaces
+	// the second
+	n := 2 * o.length
+	if o.marker == MarkerNot {
+		n = o.length
+	}
+	if s.depth < n {
+		v.fail(off, "operation reads %d bytes of operands, but only %d are allocated", n, s.depth)
+		return
+	}
+	s.depth -= n - o.length
+}
+
+// address checks an access of n bytes
+func (v *verifier) address(off uint, a address, n uint, write bool, s *stack) {
+	access := "read"
+	if write {
+		access = "assigned"
+	}
+	// Frame-relative bounds of the access, and of the frame's locals and
+	// linkage, where the frame pointer is at 0
+	var lo int64
+	switch a := a.(type) {
+	case instructionPointer:
+		if n != wordLength {
+			v.fail(off, "instruction pointer %s at length %d, not word length", access, n)
+		}
+		return
+	case absolute:
+		if v.real {
+			return
+		}
+		switch uint(a) >> segmentShift {
+		case 0:
+			v.fail(off, "invalid segment 0")
+		case codeSegment:
+			if write {
+				v.fail(off, "code segment is read-only")
+			}
+		case stackSegment:
+			if v.thread {
+				v.fail(off, "thread references the stack segment of the main thread")
+			}
+		}
+		return
+	case stackPointer:
+		lo = int64(a.offset) - wordLength - int64(s.depth)
+	case framePointer:
+		lo = int64(a.offset)
+	}
+	if !s.known || n == 0 {
+		return
+	}
+	hi := lo + int64(n)
+	if lo < -wordLength-int64(s.depth) {
+		v.fail(off, "address is below the stack pointer")
+	} else if write && lo < wordLength && hi > -wordLength {
+		v.fail(off, "assignment overwrites the frame pointer or return address")
+	}
+}
@@ -0,0 +1,161 @@
+package bytelang
+
+import (
+	"strings"
+	"testing"
+)
+
+// sum adds two words held in a single allocation, returning them as the exit
+// status
+var sum = function{
+	allocate(16),
+	assignment{stackPointer{8}, literal{5}, 8},
+	assignment{stackPointer{0}, literal{7}, 8},
+	assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+	deallocate(8),
+}
+
+func TestVerifyAccepts(t *testing.T) {
+	double := function{
+		allocate(8),
+		assignment{stackPointer{0}, literal{2}, 8},
+		allocate(8),
+		assignment{stackPointer{0}, dereference{framePointer{8}, 8}, 8},
+		assignment{framePointer{8}, operation{MarkerMultiply, 8}, 8},
+		returnStmt{},
+	}
+	tests := []struct {
+		name   string
+		f      function
+		status uint
+	}{
+		{"operands in one allocation", sum, 12},
+		{"operands in separate allocations", function{
+			allocate(8), assignment{stackPointer{0}, literal{5}, 8},
+			allocate(8), assignment{stackPointer{0}, literal{7}, 8},
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+			deallocate(8),
+		}, 12},
+		{"operation narrower than its allocation", function{
+			allocate(32),
+			assignment{stackPointer{0}, literal{0, 3, 0, 4}, 32},
+			assignment{stackPointer{0}, dereference{stackPointer{24}, 8}, 8},
+			assignment{framePointer{8}, operation{MarkerMultiply, 8}, 8},
+			deallocate(24),
+		}, 12},
+		{"not of a wide operand", function{
+			allocate(16),
+			assignment{stackPointer{0}, literal{^uint(0), ^uint(12)}, 16},
+			assignment{stackPointer{0}, operation{MarkerNot, 16}, 16},
+			assignment{framePointer{8}, dereference{stackPointer{8}, 8}, 8},
+			deallocate(16),
+		}, 12},
+		{"call", function{
+			double,
+			allocate(8),
+			assignment{stackPointer{0}, literal{6}, 8},
+			assignment{stackPointer{0}, functionCall(8), 0},
+			assignment{framePointer{8}, dereference{stackPointer{0}, 8}, 8},
+			deallocate(8),
+		}, 12},
+		{"balanced if", function{
+			allocate(8),
+			assignment{stackPointer{0}, literal{1}, 8},
+			ifStmt{dereference{stackPointer{0}, 8}, []statement{
+				allocate(8),
+				assignment{stackPointer{0}, literal{12}, 8},
+				assignment{framePointer{8}, dereference{stackPointer{0}, 8}, 8},
+				deallocate(8),
+			}},
+			deallocate(8),
+		}, 12},
+		{"returning if", function{
+			allocate(8),
+			assignment{stackPointer{0}, literal{12}, 8},
+			assignment{framePointer{8}, dereference{stackPointer{0}, 8}, 8},
+			ifStmt{dereference{stackPointer{0}, 8}, []statement{
+				deallocate(8),
+				returnStmt{},
+			}},
+			deallocate(8),
+		}, 12},
+	}
+	for _, test := range tests {
+		b := &Bytelang{test.f}
+		if err := b.Verify(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		status, err := b.Run()
+		if err != nil || status != test.status {
+			t.Errorf("%s: ran to %d, %v; want %d", test.name, status, err, test.status)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		f    function
+		want []string // A diagnostic for each, in order
+	}{
+		{"deallocation of unallocated stack", function{
+			allocate(8), deallocate(16),
+		}, []string{"deallocates 16 bytes, but only 8 are allocated"}},
+		{"missing operand", function{
+			allocate(8),
+			assignment{stackPointer{0}, literal{5}, 8},
+			assignment{framePointer{8}, operation{MarkerAdd, 8}, 8},
+		}, []string{"operation reads 16 bytes of operands, but only 8 are allocated"}},
+		{"zero-length operation", function{
+			allocate(16),
+			assignment{framePointer{8}, operation{MarkerAdd, 0}, 0},
+		}, []string{"zero-length operation"}},
+		{"unallocated literal", function{
+			assignment{framePointer{8}, literal{1, 2}, 16},
+		}, []string{"literal writes 16 bytes, but only 0 are allocated", "assignment reads 16 bytes"}},
+		{"unbalanced if", function{
+			allocate(8),
+			assignment{stackPointer{0}, literal{1}, 8},
+			ifStmt{dereference{stackPointer{0}, 8}, []statement{allocate(8)}},
+		}, []string{"if body changes the stack depth from 8 to 16 bytes"}},
+		{"narrow jump", function{
+			allocate(8),
+			assignment{instructionPointer{}, literal{0}, 4},
+		}, []string{"instruction pointer assigned at length 4"}},
+		{"frame pointer overwritten", function{
+			allocate(8),
+			assignment{stackPointer{0}, literal{0}, 8},
+			assignment{framePointer{0}, dereference{stackPointer{0}, 8}, 8},
+		}, []string{"overwrites the frame pointer"}},
+		{"read below the stack pointer", function{
+			allocate(8),
+			assignment{stackPointer{0}, dereference{stackPointer{^uint(7)}, 8}, 8},
+		}, []string{"below the stack pointer"}},
+		{"code segment written", function{
+			allocate(8),
+			assignment{absolute(codeSegment << segmentShift), literal{0}, 8},
+		}, []string{"code segment is read-only"}},
+		{"call of a statement", function{
+			allocate(8),
+			assignment{stackPointer{0}, functionCall(9), 0},
+		}, []string{"no function at offset 9"}},
+	}
+	for _, test := range tests {
+		err := (&Bytelang{test.f}).Verify()
+		diags, ok := err.(Diagnostics)
+		if !ok {
+			t.Errorf("%s: got %v, want diagnostics", test.name, err)
+			continue
+		}
+		if len(diags) != len(test.want) {
+			t.Errorf("%s: got %v, want %d diagnostics", test.name, err, len(test.want))
+			continue
+		}
+		for i, d := range diags {
+			if !strings.Contains(d.Message, test.want[i]) {
+				t.Errorf("%s: got %q, want %q", test.name, d.Message, test.want[i])
+			}
+		}
+	}
+}
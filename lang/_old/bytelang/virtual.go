@@ -1,8 +1,523 @@
 package bytelang
 
+import (
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang/lib/os/cache"
+	"github.com/vvanpo/system/lang/lib/os/device"
+	"github.com/vvanpo/system/lang/lib/os/file"
+	"github.com/vvanpo/system/lang/lib/os/namespace"
+	"math/big"
+)
+
+const (
+	wordLength   = 8
+	segmentShift = 48 // Addresses hold a segment id above an offset
+	offsetMask   = 1<<segmentShift - 1
+	stackLength  = 1 << 16
+	exitAddress  = ^uint(0) // Return address of a thread's first frame
+	faultStatus  = ^uint(0) // Exit status of a process that faulted
+)
+
+// Automatic segments of every process
+const (
+	codeSegment uint = 1 + iota
+	stackSegment
+	firstSegment // Segments passed by the caller are numbered from here
+)
+
+// A Fault is a run-time error that terminates a process
+type Fault struct {
+	Process uint
+	Address uint // Instruction address of the faulting statement
+	Err     error
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("process %d: fault at %#x: %v", f.Process, f.Address, f.Err)
+}
+
+type segment struct {
+	data  []byte
+	code  bool       // Code segments are read-only
+	owner *task      // Stack segments are only accessible by their thread
+	file  *file.File // Holds the data of the segment of an open file
+	// Maps the devices of a driver process, which see each access
+	device device.Device
+	// Called after the segment is written, with the writing task
+	written func(t *task, offset uint64, data []byte) error
+}
+
+// A blocked read of a file segment past its end, which waits until the file
+// is long enough
+type blocked struct {
+	file   *file.File
+	length uint64
+}
+
+func (b *blocked) Error() string {
+	return fmt.Sprintf("read past the end of a file of length %d", b.file.Length())
+}
+
 type virtual struct {
-	Bytelang
+	modules   []*code
+	tasks     []*task
+	pids      uint
+	namespace *namespace.Namespace        // Of the initial process
+	servers   map[string]namespace.Server // Each a FileServer
+	console   *file.File
+	cache     *cache.Cache
+	stores    map[namespace.Binding]*segment // Shared segments of store files
+	drivers   map[uint]device.Device         // Device segments of driver modules
+}
+
+func newVirtual(b *Bytelang, modules ...*Bytelang) (vm *virtual, err error) {
+	vm = &virtual{console: file.New(nil)}
+	// Nothing but the processes can extend the console of a VM without a host
+	vm.console.Close()
+	for _, m := range append([]*Bytelang{b}, modules...) {
+		_, c, err := decode([]byte(m.Compile()))
+		if err == nil {
+			err = verify(c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vm.modules = append(vm.modules, c)
+	}
+	return
+}
+
+// Run the program in a new virtual machine.  Additional modules are loaded
+// as separate code segments, numbered from 1, that the program can call into
+// as new processes.  The exit status of the initial process is returned,
+// along with its fault if it did not exit normally.
+func (b *Bytelang) Run(modules ...*Bytelang) (status uint, err error) {
+	vm, err := newVirtual(b, modules...)
+	if err != nil {
+		return
+	}
+	return vm.run()
+}
+
+func (vm *virtual) run() (status uint, err error) {
+	root, err := vm.spawn(0, 0, nil, nil)
+	if err != nil {
+		return
+	}
+	for len(vm.tasks) > 0 {
+		progress := false
+		for _, t := range vm.tasks {
+			if t.done || t.waiting {
+				continue
+			}
+			if t.blocked != nil {
+				if t.blocked.file.Length() < t.blocked.length {
+					continue
+				}
+				t.blocked = nil
+			}
+			progress = true
+			if err := t.step(); err != nil {
+				if b, ok := err.(*blocked); ok {
+					t.blocked = b
+					continue
+				}
+				vm.fault(t, err)
+			}
+		}
+		live := vm.tasks[:0]
+		for _, t := range vm.tasks {
+			if !t.done {
+				live = append(live, t)
+			}
+		}
+		vm.tasks = live
+		vm.tick()
+		if !progress && len(live) > 0 && !vm.waitConsole() {
+			vm.fault(live[0], errors.New("deadlock"))
+		}
+	}
+	if root.fault != nil {
+		err = root.fault
+	}
+	return root.status, err
+}
+
+// tick advances the clock of the devices by a scheduling round, once for
+// devices shared between drivers
+func (vm *virtual) tick() {
+	ticked := make(map[device.Device]bool)
+	for _, d := range vm.drivers {
+		if t, ok := d.(device.Ticker); ok && !ticked[d] {
+			ticked[d] = true
+			t.Tick()
+		}
+	}
+}
+
+// waitConsole waits for the host to extend the console, if a task is
+// blocked on it, and reports whether it did
+func (vm *virtual) waitConsole() bool {
+	length := ^uint64(0)
+	for _, t := range vm.tasks {
+		if b := t.blocked; b != nil && b.file == vm.console && b.length < length {
+			length = b.length
+		}
+	}
+	if length == ^uint64(0) {
+		return false
+	}
+	_, err := vm.console.Wait(length, nil)
+	return err == nil
+}
+
+func (vm *virtual) fault(t *task, err error) {
+	f := &Fault{Process: t.proc.id, Address: t.ip, Err: err}
+	vm.terminate(t.proc, f)
+}
+
+func (t *task) segment(addr uint, write bool) (s *segment, off uint, err error) {
+	id, off := addr>>segmentShift, addr&offsetMask
+	s, ok := t.proc.segments[id]
+	switch {
+	case !ok:
+		return nil, 0, fmt.Errorf("invalid segment %d", id)
+	case s.owner != nil && s.owner != t:
+		return nil, 0, fmt.Errorf("segment %d is the stack of another thread", id)
+	case write && s.code:
+		return nil, 0, fmt.Errorf("segment %d is read-only", id)
+	}
+	return
+}
+
+// access returns the bytes at an address.  Those of a file or device segment
+// are a copy, which cannot be written; a read past the end of the file blocks
+// the task until the file is long enough.
+func (t *task) access(addr, length uint, write bool) ([]byte, error) {
+	s, off, err := t.segment(addr, write)
+	switch {
+	case err != nil:
+		return nil, err
+	case off+length < off:
+		return nil, fmt.Errorf("address %#x out of bounds", addr)
+	case (s.file != nil || s.device != nil) && write:
+		return nil, fmt.Errorf("segment %d is a file, written only by assignment", addr>>segmentShift)
+	case s.device != nil:
+		b := make([]byte, length)
+		if _, err := s.device.ReadAt(b, int64(off)); err != nil {
+			return nil, fmt.Errorf("address %#x: %v", addr, err)
+		}
+		return b, nil
+	case s.file != nil:
+		b, err := s.file.Read(uint64(off), uint64(length))
+		if err != nil {
+			return nil, &blocked{s.file, uint64(off + length)}
+		}
+		return b, nil
+	case off+length > uint(len(s.data)):
+		return nil, fmt.Errorf("address %#x out of bounds", addr)
+	}
+	return s.data[off : off+length], nil
+}
+
+// store writes bytes at an address.  Writes to a file segment pass through
+// to the file, and those reaching past its end extend it; writes to a device
+// segment pass to the device.
+func (t *task) store(addr uint, data []byte) error {
+	s, off, err := t.segment(addr, true)
+	if err != nil {
+		return err
+	}
+	if s.device != nil {
+		if _, err := s.device.WriteAt(data, int64(off)); err != nil {
+			return fmt.Errorf("address %#x: %v", addr, err)
+		}
+		return nil
+	}
+	if s.file == nil {
+		b, err := t.access(addr, uint(len(data)), true)
+		if err != nil {
+			return err
+		}
+		copy(b, data)
+		return nil
+	}
+	if err := s.file.Write(uint64(off), data); err != nil {
+		return fmt.Errorf("address %#x out of bounds", addr)
+	}
+	if s.written != nil {
+		return s.written(t, uint64(off), data)
+	}
+	return nil
+}
+
+func (t *task) readWord(addr uint) (uint, error) {
+	b, err := t.access(addr, wordLength, false)
+	if err != nil {
+		return 0, err
+	}
+	return getWord(b), nil
+}
+
+func (t *task) writeWord(addr, word uint) error {
+	return t.store(addr, []byte(putWord(word)))
+}
+
+func (t *task) push(word uint) error {
+	if err := t.allocate(wordLength); err != nil {
+		return err
+	}
+	return t.writeWord(t.sp, word)
+}
+
+func (t *task) allocate(n uint) error {
+	if t.sp&offsetMask < n {
+		return errors.New("stack overflow")
+	}
+	t.sp -= n
+	b, err := t.access(t.sp, n, true)
+	for i := range b {
+		b[i] = 0
+	}
+	return err
+}
+
+func (t *task) deallocate(n uint) error {
+	if _, err := t.access(t.sp, n, false); err != nil {
+		return errors.New("stack underflow")
+	}
+	t.sp += n
+	return nil
+}
+
+// step executes the statement at the instruction pointer
+func (t *task) step() error {
+	if t.ip == t.ends[len(t.ends)-1] {
+		return t.ret()
+	}
+	if t.ip>>segmentShift != codeSegment {
+		return fmt.Errorf("instruction pointer %#x outside code segment", t.ip)
+	}
+	s, ok := t.proc.code.steps[t.ip&offsetMask]
+	if !ok {
+		return fmt.Errorf("no statement at %#x", t.ip)
+	}
+	if t.resume {
+		t.resume = false
+		return t.complete(s)
+	}
+	switch stmt := s.statement.(type) {
+	case function, pragma:
+		t.ip = codeSegment<<segmentShift | s.next
+	case allocate:
+		if err := t.allocate(uint(stmt)); err != nil {
+			return err
+		}
+		t.ip = codeSegment<<segmentShift | s.next
+	case deallocate:
+		if err := t.deallocate(uint(stmt)); err != nil {
+			return err
+		}
+		t.ip = codeSegment<<segmentShift | s.next
+	case assignment:
+		return t.evaluate(stmt.value, s)
+	case thread:
+		if _, err := t.proc.newTask(uint(stmt), false); err != nil {
+			return err
+		}
+		t.ip = codeSegment<<segmentShift | s.next
+	case ifStmt:
+		return t.evaluate(stmt.condition, s)
+	case returnStmt:
+		return t.ret()
+	}
+	return nil
+}
+
+// evaluate the expression of a statement, completing the statement once the
+// value is at the bottom of the stack
+func (t *task) evaluate(e expression, s *step) error {
+	switch e := e.(type) {
+	case functionCall:
+		return t.call(uint(e))
+	case processCall:
+		return t.callProcess(e)
+	case literal:
+		b, err := t.access(t.sp, uint(len(e))*wordLength, true)
+		if err != nil {
+			return err
+		}
+		for i, w := range e {
+			copy(b[i*wordLength:], putWord(w))
+		}
+	case reference:
+		if err := t.writeWord(t.sp, uint(e)); err != nil {
+			return err
+		}
+	case dereference:
+		if _, ok := e.address.(instructionPointer); ok {
+			if e.length != wordLength {
+				return errors.New("instruction pointer must be read at word length")
+			}
+			if err := t.writeWord(t.sp, t.ip); err != nil {
+				return err
+			}
+			break
+		}
+		src, err := t.access(t.resolve(e.address), e.length, false)
+		if err != nil {
+			return err
+		}
+		dst, err := t.access(t.sp, e.length, true)
+		if err != nil {
+			return err
+		}
+		copy(dst, src)
+	case operation:
+		if err := t.operate(e); err != nil {
+			return err
+		}
+	}
+	return t.complete(s)
+}
+
+// complete a statement whose expression has been evaluated
+func (t *task) complete(s *step) error {
+	switch stmt := s.statement.(type) {
+	case assignment:
+		if _, ok := stmt.address.(instructionPointer); ok {
+			if stmt.length != wordLength {
+				return errors.New("instruction pointer must be assigned at word length")
+			}
+			ip, err := t.readWord(t.sp)
+			if err != nil {
+				return err
+			}
+			t.ip = ip
+			return nil
+		}
+		src, err := t.access(t.sp, stmt.length, false)
+		if err != nil {
+			return err
+		}
+		if err := t.store(t.resolve(stmt.address), src); err != nil {
+			return err
+		}
+	case ifStmt:
+		b, err := t.access(t.sp, length(stmt.condition), false)
+		if err != nil {
+			return err
+		}
+		for _, c := range b {
+			if c != 0 {
+				t.ip = codeSegment<<segmentShift | s.body
+				return nil
+			}
+		}
+	}
+	t.ip = codeSegment<<segmentShift | s.next
+	return nil
+}
+
+func (t *task) resolve(a address) uint {
+	switch a := a.(type) {
+	case absolute:
+		return uint(a)
+	case stackPointer:
+		return t.sp + a.offset
+	case framePointer:
+		return t.fp + a.offset
+	}
+	return t.ip
+}
+
+// length returns the number of bytes an expression places on the stack
+func length(e expression) uint {
+	switch e := e.(type) {
+	case literal:
+		return uint(len(e)) * wordLength
+	case dereference:
+		return e.length
+	case operation:
+		return e.length
+	}
+	return wordLength
+}
+
+// operate applies an operation to the operands at the bottom of the stack.
+// Operands are unsigned big-endian integers of the operation's length.
+func (t *task) operate(o operation) error {
+	n := o.length
+	if n == 0 {
+		return errors.New("zero-length operation")
+	}
+	if o.marker == MarkerNot {
+		b, err := t.access(t.sp, n, true)
+		for i := range b {
+			b[i] = ^b[i]
+		}
+		return err
+	}
+	b, err := t.access(t.sp, n, false)
+	if err != nil {
+		return err
+	}
+	a, err := t.access(t.sp+n, n, true)
+	if err != nil {
+		return err
+	}
+	if err := compute(o.marker, a, b); err != nil {
+		return err
+	}
+	t.sp += n
+	return nil
 }
 
-func (vm *virtual) run() {
+// compute applies a binary operation to operands of equal length, leaving the
+// result in a
+func compute(marker byte, a, b []byte) error {
+	n := uint(len(a))
+	mod := new(big.Int).Lsh(big.NewInt(1), 8*n)
+	x, y := new(big.Int).SetBytes(a), new(big.Int).SetBytes(b)
+	shift := uint(8 * n)
+	if y.IsUint64() && y.Uint64() < uint64(shift) {
+		shift = uint(y.Uint64())
+	}
+	switch marker {
+	case MarkerAnd:
+		x.And(x, y)
+	case MarkerOr:
+		x.Or(x, y)
+	case MarkerXor:
+		x.Xor(x, y)
+	case MarkerShiftL:
+		x.Lsh(x, shift)
+	case MarkerLShiftR:
+		x.Rsh(x, shift)
+	case MarkerAShiftR:
+		if a[0]&0x80 != 0 {
+			x.Sub(x, mod)
+		}
+		x.Rsh(x, shift)
+	case MarkerAdd:
+		x.Add(x, y)
+	case MarkerSubtract:
+		x.Sub(x, y)
+	case MarkerMultiply:
+		x.Mul(x, y)
+	case MarkerDivideFloor, MarkerModulo:
+		if y.Sign() == 0 {
+			return errors.New("division by zero")
+		}
+		if marker == MarkerModulo {
+			x.Mod(x, y)
+		} else {
+			x.Div(x, y)
+		}
+	case MarkerExponent:
+		x.Exp(x, y, mod)
+	}
+	x.Mod(x, mod).FillBytes(a)
+	return nil
 }
@@ -0,0 +1,1193 @@
+package bytelang
+
+import (
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	isa "github.com/vvanpo/system/lang/asm/x86"
+)
+
+// Native code keeps the bytelang stack on the machine stack, with the stack
+// pointer as _sp and the base pointer as _fp, and words in memory keep their
+// big-endian layout.  The stack segment is the stackLength bytes below the
+// entry point's stack, with its base held in the b register; the machine
+// stack pointer of the caller is saved just above it.
+//
+// The saved frame pointer and return address are native values, and reading
+// them from the stack is not portable.  Values of _ip remain bytecode
+// addresses in the code segment, and assignments to _ip are translated
+// through a jump table in the data section, which also holds a copy of the
+// bytecode for reads of the code segment.
+//
+// A fault unwinds to the caller of the entry point, which returns the exit
+// status faultStatus with the fault reason in the c register.
+
+// Fault reasons of native code
+const (
+	FaultNone = iota
+	FaultStackOverflow
+	FaultStackUnderflow
+	FaultDivision
+	FaultJump
+	FaultAddress
+	FaultUnsupported
+)
+
+const (
+	rAX = iota
+	rCX
+	rDX
+	rBX
+	rSP
+	rBP
+	rSI
+	rDI
+)
+
+// Condition codes
+const (
+	ccB  = 0x2
+	ccAE = 0x3
+	ccE  = 0x4
+	ccNE = 0x5
+	ccBE = 0x6
+)
+
+// Instructions are encoded by the asm/x86 encoder, except for jumps and
+// calls to labels, which may be defined later and so keep rel32 fields that
+// are resolved once all labels are.
+type fixup struct {
+	pos   int // Position of a rel32 field
+	label string
+}
+
+type x86 struct {
+	*code
+	word   int // Register width in bytes
+	text   []byte
+	labels map[string]int
+	fixups []fixup
+	obj    *Object
+	ends   []uint // Offsets at which a function body ends
+	unique int
+	table  uint // Offset of the jump table in the data section
+	real   bool // Absolute addresses are real addresses
+	err    error
+}
+
+func newX86(b *Bytelang, word int) (x *x86, err error) {
+	_, c, err := decode([]byte(b.Compile()))
+	if err == nil {
+		err = verify(c)
+	}
+	if err != nil {
+		return
+	}
+	x = &x86{code: c, word: word, labels: make(map[string]int), obj: new(Object)}
+	x.obj.Data = append([]byte{}, c.bytes...)
+	for len(x.obj.Data)%4 != 0 {
+		x.obj.Data = append(x.obj.Data, 0)
+	}
+	x.table = uint(len(x.obj.Data))
+	return
+}
+
+func (x *x86) emit(b ...byte) {
+	x.text = append(x.text, b...)
+}
+
+func (x *x86) imm32(v int32) {
+	x.emit(byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (x *x86) label(l string) {
+	x.labels[l] = len(x.text)
+}
+
+func (x *x86) newLabel() string {
+	x.unique++
+	return fmt.Sprintf(".%d", x.unique)
+}
+
+func (x *x86) rel32(l string) {
+	x.fixups = append(x.fixups, fixup{len(x.text), l})
+	x.imm32(0)
+}
+
+func (x *x86) jmp(l string) {
+	x.emit(0xe9)
+	x.rel32(l)
+}
+
+func (x *x86) jcc(cc byte, l string) {
+	x.emit(0x0f, 0x80|cc)
+	x.rel32(l)
+}
+
+func (x *x86) call(l string) {
+	x.emit(0xe8)
+	x.rel32(l)
+}
+
+// fault jumps to the fault handler when condition cc holds
+func (x *x86) fault(cc byte, reason int) {
+	x.jcc(cc, fmt.Sprintf("fault%d", reason))
+}
+
+// asm emits an instruction, keeping the first encoding error for finish
+func (x *x86) asm(mnemonic string, operands ...isa.Operand) {
+	mode := isa.Mode64
+	if x.word == 4 {
+		mode = isa.Mode32
+	}
+	b, err := isa.Encode(mode, uint64(len(x.text)), mnemonic, operands...)
+	if err != nil && x.err == nil {
+		x.err = fmt.Errorf("bytelang: %s %v: %v", mnemonic, operands, err)
+	}
+	x.emit(b...)
+}
+
+// reg returns a register of register width
+func (x *x86) reg(r int) isa.Reg {
+	return isa.Reg{Num: r, Size: x.word}
+}
+
+// sized returns a register of n bytes
+func sized(r, n int) isa.Reg {
+	return isa.Reg{Num: r, Size: n}
+}
+
+// mem returns the n bytes at [base + disp]
+func (x *x86) mem(n, base int, disp int32) isa.Mem {
+	return isa.Mem{Base: x.reg(base), Disp: int64(disp), Size: n}
+}
+
+// index returns the n bytes at [base + index*scale + disp]
+func (x *x86) index(n, base, index int, scale, disp int32) isa.Mem {
+	return isa.Mem{Base: x.reg(base), Index: x.reg(index), Scale: int(scale), Disp: int64(disp), Size: n}
+}
+
+func (x *x86) load(reg, base int, disp int32) {
+	x.asm("mov", x.reg(reg), x.mem(x.word, base, disp))
+}
+
+func (x *x86) store(base int, disp int32, reg int) {
+	x.asm("mov", x.mem(x.word, base, disp), x.reg(reg))
+}
+
+func (x *x86) lea(reg, base int, disp int32) {
+	x.asm("lea", x.reg(reg), x.mem(0, base, disp))
+}
+
+// alu emits a register to register instruction, such as add dst, src
+func (x *x86) alu(mnemonic string, dst, src int) {
+	x.asm(mnemonic, x.reg(dst), x.reg(src))
+}
+
+// aluImm emits a register and immediate instruction, such as cmp reg, imm
+func (x *x86) aluImm(mnemonic string, reg int, imm int32) {
+	x.asm(mnemonic, x.reg(reg), isa.Imm(imm))
+}
+
+// unary emits an instruction of one register operand, such as not reg
+func (x *x86) unary(mnemonic string, reg int) {
+	x.asm(mnemonic, x.reg(reg))
+}
+
+// shift emits a shift of a register by cl
+func (x *x86) shift(mnemonic string, reg int) {
+	x.asm(mnemonic, x.reg(reg), isa.CL)
+}
+
+func (x *x86) shiftImm(mnemonic string, reg int, n byte) {
+	x.asm(mnemonic, x.reg(reg), isa.Imm(n))
+}
+
+// movImm loads v, zero-extending a 32-bit value on 64-bit targets
+func (x *x86) movImm(reg int, v uint64) {
+	if x.word == 8 && v > 0xffffffff {
+		x.asm("mov", x.reg(reg), isa.Imm(v))
+		return
+	}
+	x.asm("mov", sized(reg, 4), isa.Imm(uint32(v)))
+}
+
+// zeroReg clears the 32-bit register, and on 64-bit targets its upper half
+func (x *x86) zeroReg(reg int) {
+	x.asm("xor", sized(reg, 4), sized(reg, 4))
+}
+
+func (x *x86) push(reg int) {
+	x.unary("push", reg)
+}
+
+func (x *x86) pop(reg int) {
+	x.unary("pop", reg)
+}
+
+// relocate zeroes the disp32 field ending the last instruction, and
+// relocates it to an offset into a section
+func (x *x86) relocate(t lang.RelocationType, section Section, addend int64) {
+	n := len(x.text) - 4
+	copy(x.text[n:], []byte{0, 0, 0, 0})
+	x.obj.Relocations = append(x.obj.Relocations, Relocation{
+		Offset:  uint(n),
+		Type:    t,
+		Section: section,
+		Addend:  addend,
+	})
+}
+
+// dataAddr loads the address of an offset into the data section
+func (x *x86) dataAddr(reg int, off uint) {
+	if x.word == 8 {
+		x.asm("lea", x.reg(reg), isa.Mem{Base: isa.RIP})
+		x.relocate(lang.RelPC32, Data, int64(off)-4)
+	} else {
+		x.asm("lea", x.reg(reg), isa.Mem{})
+		x.relocate(lang.RelAbs32, Data, int64(off))
+	}
+}
+
+// loadBE loads a big-endian value of n bytes, zero-extended
+func (x *x86) loadBE(reg, base int, disp int32, n uint) {
+	switch n {
+	case 1:
+		x.asm("movzx", sized(reg, 4), x.mem(1, base, disp))
+	case 2:
+		x.asm("movzx", sized(reg, 4), x.mem(2, base, disp))
+		x.asm("rol", sized(reg, 2), isa.Imm(8))
+	case 4:
+		x.asm("mov", sized(reg, 4), x.mem(4, base, disp))
+		x.asm("bswap", sized(reg, 4))
+	default:
+		x.load(reg, base, disp)
+		x.bswap(reg)
+	}
+}
+
+// storeBE stores the low n bytes of reg in big-endian order, clobbering it
+func (x *x86) storeBE(base int, disp int32, reg int, n uint) {
+	switch n {
+	case 1:
+		x.asm("mov", x.mem(1, base, disp), sized(reg, 1))
+	case 2:
+		x.asm("rol", sized(reg, 2), isa.Imm(8))
+		x.asm("mov", x.mem(2, base, disp), sized(reg, 2))
+	case 4:
+		x.asm("bswap", sized(reg, 4))
+		x.asm("mov", x.mem(4, base, disp), sized(reg, 4))
+	default:
+		x.bswap(reg)
+		x.store(base, disp, reg)
+	}
+}
+
+// storeBytes writes constant bytes to memory
+func (x *x86) storeBytes(base int, disp int32, b []byte) {
+	for len(b)%x.word != 0 {
+		b = append(b, 0)
+	}
+	for i := 0; i < len(b); i += x.word {
+		var v uint64
+		for j := x.word - 1; j >= 0; j-- {
+			v = v<<8 | uint64(b[i+j])
+		}
+		if x.word == 8 {
+			x.movImm(rAX, v)
+			x.store(base, disp+int32(i), rAX)
+		} else {
+			x.asm("mov", x.mem(4, base, disp+int32(i)), isa.Imm(uint32(v)))
+		}
+	}
+}
+
+// size returns n as an immediate, faulting at run time when it is too large
+func (x *x86) size(n uint) (int32, bool) {
+	if n > 0x7fffffff {
+		x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+		return 0, false
+	}
+	return int32(n), true
+}
+
+// move copies n bytes from rsi to rdi, allowing the regions to overlap
+func (x *x86) move(n int32) {
+	fwd, done := x.newLabel(), x.newLabel()
+	x.movImm(rCX, uint64(n))
+	x.alu("cmp", rDI, rSI)
+	x.jcc(ccBE, fwd)
+	x.asm("lea", x.reg(rSI), x.index(0, rSI, rCX, 1, -1))
+	x.asm("lea", x.reg(rDI), x.index(0, rDI, rCX, 1, -1))
+	x.asm("std")
+	x.asm("rep movsb")
+	x.asm("cld")
+	x.jmp(done)
+	x.label(fwd)
+	x.asm("rep movsb")
+	x.label(done)
+}
+
+// address loads the effective address of a into reg
+func (x *x86) address(reg int, a address) bool {
+	register := func(base int, offset uint) bool {
+		d := int64(offset)
+		if d != int64(int32(d)) {
+			x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+			return false
+		}
+		x.lea(reg, base, int32(d))
+		return true
+	}
+	switch a := a.(type) {
+	case stackPointer:
+		return register(rSP, a.offset)
+	case framePointer:
+		return register(rBP, a.offset)
+	case absolute:
+		if x.real {
+			if x.word == 4 && uint(a) > 0xffffffff {
+				break
+			}
+			x.movImm(reg, uint64(a))
+			return true
+		}
+		off := uint(a) & offsetMask
+		switch uint(a) >> segmentShift {
+		case codeSegment:
+			x.dataAddr(reg, off)
+			return true
+		case stackSegment:
+			return register(rBX, off)
+		}
+	}
+	x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+	return false
+}
+
+// entry emits the entry point, which runs the global function on a fresh
+// stack segment and returns its exit status by the calling convention
+func (x *x86) entry() {
+	x.trampoline("entry", 0, 0)
+	x.label("exit")
+	x.load(rSP, rBX, stackLength)
+	for _, r := range []int{rDI, rSI, rBX, rBP} {
+		x.pop(r)
+	}
+	x.asm("ret")
+	for reason := FaultStackOverflow; reason <= FaultUnsupported; reason++ {
+		x.label(fmt.Sprintf("fault%d", reason))
+		x.movImm(rCX, uint64(reason))
+		x.aluImm("or", rAX, -1)
+		x.alu("mov", rDX, rAX)
+		x.jmp("exit")
+	}
+	x.label("return")
+	x.lea(rSP, rBP, -int32(x.word))
+	x.asm("ret")
+}
+
+// trampoline runs the function at offset fn on a fresh stack segment, with
+// params words taken by the calling convention pushed in reverse order, and
+// returns the function's status word
+func (x *x86) trampoline(label string, fn uint, params int) {
+	x.label(label)
+	for _, r := range []int{rBP, rBX, rSI, rDI} {
+		x.push(r)
+	}
+	x.alu("mov", rAX, rSP)
+	x.aluImm("and", rSP, -16)
+	x.push(rAX)
+	x.lea(rBX, rSP, -stackLength)
+	for i := params - 1; i >= 0; i-- {
+		x.aluImm("sub", rSP, wordLength)
+		if x.word == 4 {
+			// Arguments follow the saved registers and return address
+			disp := int32(20 + 8*i)
+			x.load(rDX, rAX, disp+4)
+			x.storeBE(rSP, 0, rDX, 4)
+			x.load(rDX, rAX, disp)
+			x.storeBE(rSP, 4, rDX, 4)
+			continue
+		}
+		reg := []int{rDI, rSI, rDX, rCX, rAX, rAX}[i]
+		if i >= 4 {
+			x.asm("mov", isa.RAX, sized(8+i-4, 8))
+		}
+		x.storeBE(rSP, 0, reg, 8)
+	}
+	x.allocate(wordLength, false)
+	x.allocate(wordLength, false)
+	x.alu("mov", rBP, rSP)
+	x.call(fmt.Sprintf("F%d", fn))
+	x.popFrame()
+	if x.word == 8 {
+		x.loadBE(rAX, rSP, 0, 8)
+	} else {
+		x.loadBE(rDX, rSP, 0, 4)
+		x.loadBE(rAX, rSP, 4, 4)
+	}
+	x.zeroReg(rCX)
+}
+
+// export emits trampolines for exported functions, after the entry point
+func (x *x86) export(exports []Export) error {
+	names := map[string]bool{"bytelang_main": true}
+	for _, e := range exports {
+		if e.Name == "" || names[e.Name] {
+			return fmt.Errorf("bytelang: invalid or duplicate export name %q", e.Name)
+		}
+		names[e.Name] = true
+		if s, ok := x.steps[e.Function]; !ok {
+			return fmt.Errorf("bytelang: export %s: no function at offset %d", e.Name, e.Function)
+		} else if _, ok := s.statement.(function); !ok {
+			return fmt.Errorf("bytelang: export %s: no function at offset %d", e.Name, e.Function)
+		}
+		if e.Params < 0 || x.word == 8 && e.Params > 6 {
+			return fmt.Errorf("bytelang: export %s: unsupported parameter count %d", e.Name, e.Params)
+		}
+		start := len(x.text)
+		x.trampoline("export."+e.Name, e.Function, e.Params)
+		x.jmp("exit")
+		x.obj.Symbols = append(x.obj.Symbols, Symbol{
+			Name:     e.Name,
+			Value:    uint(start),
+			Size:     uint(len(x.text) - start),
+			Function: true,
+			Global:   true,
+		})
+	}
+	return nil
+}
+
+// pushFrame saves _fp in a word above the new frame
+func (x *x86) pushFrame() {
+	if x.word == 4 {
+		x.aluImm("sub", rSP, 4)
+	}
+	x.push(rBP)
+	x.alu("mov", rBP, rSP)
+}
+
+func (x *x86) popFrame() {
+	x.pop(rBP)
+	if x.word == 4 {
+		x.aluImm("add", rSP, 4)
+	}
+}
+
+func (x *x86) allocate(n uint, check bool) {
+	m, ok := x.size(n)
+	if !ok {
+		return
+	}
+	if check {
+		x.alu("mov", rAX, rSP)
+		x.alu("sub", rAX, rBX)
+		x.aluImm("cmp", rAX, m)
+		x.fault(ccB, FaultStackOverflow)
+	}
+	x.aluImm("sub", rSP, m)
+	x.alu("mov", rDI, rSP)
+	x.movImm(rCX, uint64(m))
+	x.zeroReg(rAX)
+	x.asm("rep stosb")
+}
+
+func (x *x86) deallocate(n uint) {
+	m, ok := x.size(n)
+	if !ok {
+		return
+	}
+	x.lea(rAX, rBX, stackLength)
+	x.alu("sub", rAX, rSP)
+	x.aluImm("cmp", rAX, m)
+	x.fault(ccB, FaultStackUnderflow)
+	x.aluImm("add", rSP, m)
+}
+
+// function emits the body of the function at offset off
+func (x *x86) function(off uint) {
+	f := x.steps[off]
+	x.label(fmt.Sprintf("F%d", off))
+	x.obj.Symbols = append(x.obj.Symbols, Symbol{
+		Name:     fmt.Sprintf("function.%d", off),
+		Value:    uint(len(x.text)),
+		Function: true,
+	})
+	sym := len(x.obj.Symbols) - 1
+	if x.word == 4 {
+		x.aluImm("sub", rSP, 4)
+	}
+	x.statements(f.body, f.next)
+	x.jmp("return")
+	x.obj.Symbols[sym].Size = uint(len(x.text)) - x.obj.Symbols[sym].Value
+	x.ends = append(x.ends, f.next)
+}
+
+// statements emits a statement list, scoping any pragmas within it
+func (x *x86) statements(off, end uint) {
+	real := x.real
+	for off < end {
+		s := x.steps[off]
+		x.statement(off, s)
+		off = s.next
+	}
+	x.real = real
+}
+
+// next returns the label control passes to at offset off
+func (x *x86) next(off uint) string {
+	if _, ok := x.steps[off]; ok && off != 0 {
+		return fmt.Sprintf("L%d", off)
+	}
+	return "return"
+}
+
+func (x *x86) statement(off uint, s *step) {
+	x.label(fmt.Sprintf("L%d", off))
+	x.obj.Lines = append(x.obj.Lines, Line{uint(len(x.text)), off})
+	switch stmt := s.statement.(type) {
+	case function:
+		x.jmp(x.next(s.next))
+		x.function(off)
+	case allocate:
+		x.allocate(uint(stmt), true)
+	case deallocate:
+		x.deallocate(uint(stmt))
+	case assignment:
+		if x.expression(off, stmt.value) {
+			x.assign(stmt)
+		}
+	case thread:
+		x.jmp(fmt.Sprintf("fault%d", FaultUnsupported))
+	case ifStmt:
+		if x.expression(off, stmt.condition) {
+			x.condition(length(stmt.condition), x.next(s.next))
+		}
+		x.statements(s.body, s.next)
+	case returnStmt:
+		x.jmp("return")
+	case pragma:
+		if stmt == pragmaRealAddress {
+			x.real = true
+		}
+	}
+}
+
+// condition jumps to l if the n bytes at the bottom of the stack are zero
+func (x *x86) condition(n uint, l string) {
+	m, ok := x.size(n)
+	if !ok {
+		return
+	}
+	if n == uint(x.word) {
+		x.load(rAX, rSP, 0)
+		x.alu("test", rAX, rAX)
+		x.jcc(ccE, l)
+		return
+	} else if n == 0 {
+		x.jmp(l)
+		return
+	}
+	x.test(0, m)
+	x.jcc(ccE, l)
+}
+
+// test sets the zero flag if the n bytes at sp+disp are zero
+func (x *x86) test(disp, n int32) {
+	loop := x.newLabel()
+	x.movImm(rCX, uint64(n))
+	x.zeroReg(rAX)
+	x.label(loop)
+	x.asm("or", isa.AL, x.index(1, rSP, rCX, 1, disp-1))
+	x.unary("dec", rCX)
+	x.jcc(ccNE, loop)
+	x.asm("test", isa.AL, isa.AL)
+}
+
+// expression places the value of e at the bottom of the stack, and reports
+// whether control reaches the end of it
+func (x *x86) expression(off uint, e expression) bool {
+	switch e := e.(type) {
+	case functionCall:
+		target, ok := x.steps[uint(e)]
+		if ok {
+			_, ok = target.statement.(function)
+		}
+		if !ok {
+			x.jmp(fmt.Sprintf("fault%d", FaultJump))
+			return false
+		}
+		x.pushFrame()
+		x.call(fmt.Sprintf("F%d", uint(e)))
+		x.popFrame()
+	case processCall:
+		x.jmp(fmt.Sprintf("fault%d", FaultUnsupported))
+		return false
+	case literal:
+		var b []byte
+		for _, w := range e {
+			b = append(b, putWord(w)...)
+		}
+		x.storeBytes(rSP, 0, b)
+	case reference:
+		x.storeBytes(rSP, 0, []byte(putWord(uint(e))))
+	case dereference:
+		if _, ok := e.address.(instructionPointer); ok {
+			if e.length != wordLength {
+				x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+				return false
+			}
+			x.storeBytes(rSP, 0, []byte(putWord(codeSegment<<segmentShift|off)))
+			break
+		}
+		n, ok := x.size(e.length)
+		if !ok || !x.address(rSI, e.address) {
+			return false
+		}
+		x.lea(rDI, rSP, 0)
+		x.move(n)
+	case operation:
+		return x.operate(e.marker, e.length)
+	}
+	return true
+}
+
+// assign completes an assignment, copying the value at the bottom of the
+// stack
+func (x *x86) assign(a assignment) {
+	if _, ok := a.address.(instructionPointer); ok {
+		if a.length != wordLength {
+			x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+			return
+		}
+		x.jump()
+		return
+	}
+	n, ok := x.size(a.length)
+	if !ok || !x.address(rDI, a.address) {
+		return
+	}
+	x.lea(rSI, rSP, 0)
+	x.move(n)
+}
+
+// jump translates the code address at the bottom of the stack through the
+// jump table
+func (x *x86) jump() {
+	n := int32(len(x.bytes))
+	if x.word == 8 {
+		x.loadBE(rAX, rSP, 0, 8)
+		x.alu("mov", rDX, rAX)
+		x.shiftImm("shr", rDX, segmentShift)
+		x.aluImm("cmp", rDX, int32(codeSegment))
+		x.fault(ccNE, FaultJump)
+		x.movImm(rDX, offsetMask)
+		x.alu("and", rAX, rDX)
+	} else {
+		x.loadBE(rDX, rSP, 0, 4)
+		x.aluImm("cmp", rDX, int32(codeSegment<<(segmentShift-32)))
+		x.fault(ccNE, FaultJump)
+		x.loadBE(rAX, rSP, 4, 4)
+	}
+	x.aluImm("cmp", rAX, n)
+	x.fault(ccAE, FaultJump)
+	x.dataAddr(rDX, x.table)
+	if x.word == 8 {
+		x.asm("movsxd", isa.RAX, x.index(4, rDX, rAX, 4, 0))
+	} else {
+		x.asm("mov", isa.EAX, x.index(4, rDX, rAX, 4, 0))
+	}
+	x.aluImm("cmp", rAX, -1)
+	x.fault(ccE, FaultJump)
+	// The start of the text section
+	if x.word == 8 {
+		x.asm("lea", isa.RDX, isa.Mem{Base: isa.RIP})
+	} else {
+		x.asm("lea", isa.EDX, isa.Mem{})
+		x.relocate(lang.RelAbs32, Text, 0)
+	}
+	x.alu("add", rAX, rDX)
+	x.unary("jmp", rAX)
+}
+
+// operate emits an operation on the operands at the bottom of the stack
+func (x *x86) operate(marker byte, length uint) bool {
+	n, ok := x.size(length)
+	if !ok {
+		return false
+	}
+	if n == 0 {
+		x.jmp(fmt.Sprintf("fault%d", FaultAddress))
+		return false
+	}
+	if n == 1 || n == 2 || n == 4 || n == int32(x.word) {
+		return x.operateRegister(marker, n)
+	}
+	if n == 8 && x.operatePair(marker) {
+		return true
+	}
+	unit := int32(1)
+	if n%int32(x.word) == 0 {
+		unit = int32(x.word)
+	}
+	// The units of the operands, counted down by the c register
+	a := func(disp int32) isa.Mem {
+		return x.index(int(unit), rSP, rCX, unit, disp)
+	}
+	ax := sized(rAX, int(unit))
+	loop := x.newLabel()
+	switch marker {
+	case MarkerNot:
+		x.movImm(rCX, uint64(n/unit))
+		x.label(loop)
+		x.asm("not", a(-unit))
+	case MarkerAnd, MarkerOr, MarkerXor:
+		mnemonic := map[byte]string{MarkerAnd: "and", MarkerOr: "or", MarkerXor: "xor"}[marker]
+		x.movImm(rCX, uint64(n/unit))
+		x.label(loop)
+		x.asm("mov", ax, a(-unit))
+		x.asm(mnemonic, a(n-unit), ax)
+	case MarkerAdd, MarkerSubtract:
+		mnemonic := map[byte]string{MarkerAdd: "adc", MarkerSubtract: "sbb"}[marker]
+		x.movImm(rCX, uint64(n/unit))
+		x.asm("clc")
+		x.label(loop)
+		x.asm("mov", ax, a(n-unit))
+		if unit != 1 {
+			x.asm("mov", x.reg(rDX), a(-unit))
+			x.bswap(rAX)
+			x.bswap(rDX)
+			x.alu(mnemonic, rAX, rDX)
+			x.bswap(rAX)
+		} else {
+			x.asm(mnemonic, isa.AL, a(-1))
+		}
+		x.asm("mov", a(n-unit), ax)
+	default:
+		return x.operateWide(marker, n)
+	}
+	x.unary("dec", rCX)
+	x.jcc(ccNE, loop)
+	if marker != MarkerNot {
+		x.aluImm("add", rSP, n)
+	}
+	return true
+}
+
+func (x *x86) bswap(reg int) {
+	x.unary("bswap", reg)
+}
+
+// operateRegister emits an operation on operands that fit in a register
+func (x *x86) operateRegister(marker byte, n int32) bool {
+	bits := 8 * n
+	if marker == MarkerNot {
+		x.loadBE(rAX, rSP, 0, uint(n))
+		x.unary("not", rAX)
+		x.storeBE(rSP, 0, rAX, uint(n))
+		return true
+	}
+	x.loadBE(rAX, rSP, n, uint(n))
+	x.loadBE(rCX, rSP, 0, uint(n))
+	switch marker {
+	case MarkerAnd:
+		x.alu("and", rAX, rCX)
+	case MarkerOr:
+		x.alu("or", rAX, rCX)
+	case MarkerXor:
+		x.alu("xor", rAX, rCX)
+	case MarkerAdd:
+		x.alu("add", rAX, rCX)
+	case MarkerSubtract:
+		x.alu("sub", rAX, rCX)
+	case MarkerMultiply:
+		x.alu("imul", rAX, rCX)
+	case MarkerDivideFloor, MarkerModulo:
+		x.alu("test", rCX, rCX)
+		x.fault(ccE, FaultDivision)
+		x.zeroReg(rDX)
+		x.unary("div", rCX)
+		if marker == MarkerModulo {
+			x.alu("mov", rAX, rDX)
+		}
+	case MarkerShiftL, MarkerLShiftR, MarkerAShiftR:
+		mnemonic := map[byte]string{MarkerShiftL: "shl", MarkerLShiftR: "shr", MarkerAShiftR: "sar"}[marker]
+		ok, done := x.newLabel(), x.newLabel()
+		if marker == MarkerAShiftR && bits < int32(8*x.word) {
+			x.shiftImm("shl", rAX, byte(8*int32(x.word)-bits))
+			x.shiftImm("sar", rAX, byte(8*int32(x.word)-bits))
+		}
+		x.aluImm("cmp", rCX, bits)
+		x.jcc(ccB, ok)
+		if marker == MarkerAShiftR {
+			x.movImm(rCX, uint64(bits-1))
+		} else {
+			x.zeroReg(rAX)
+			x.jmp(done)
+		}
+		x.label(ok)
+		x.shift(mnemonic, rAX)
+		x.label(done)
+	case MarkerExponent:
+		loop, skip, done := x.newLabel(), x.newLabel(), x.newLabel()
+		x.movImm(rSI, 1)
+		x.label(loop)
+		x.alu("test", rCX, rCX)
+		x.jcc(ccE, done)
+		x.asm("test", isa.CL, isa.Imm(1))
+		x.jcc(ccE, skip)
+		x.alu("imul", rSI, rAX)
+		x.label(skip)
+		x.alu("imul", rAX, rAX)
+		x.shiftImm("shr", rCX, 1)
+		x.jmp(loop)
+		x.label(done)
+		x.alu("mov", rAX, rSI)
+	}
+	x.storeBE(rSP, n, rAX, uint(n))
+	x.aluImm("add", rSP, n)
+	return true
+}
+
+// Multiplication, division, exponentiation and shifts of operands of other
+// lengths work a bit at a time on big-endian byte strings, addressed by their
+// displacement from the stack pointer.  The loops over the bytes of a string
+// keep the carry flag, so one bit can be carried from a string into the next.
+
+// loop emits a loop instruction back to label l, which must be near
+func (x *x86) loop(l string) {
+	x.asm("loop", isa.Rel(x.labels[l]))
+}
+
+// zero clears n bytes at sp+disp
+func (x *x86) zero(disp, n int32) {
+	x.lea(rDI, rSP, disp)
+	x.movImm(rCX, uint64(n))
+	x.zeroReg(rAX)
+	x.asm("rep stosb")
+}
+
+// copy n bytes from sp+src to sp+dst, which do not overlap
+func (x *x86) copy(dst, src, n int32) {
+	x.lea(rDI, rSP, dst)
+	x.lea(rSI, rSP, src)
+	x.movImm(rCX, uint64(n))
+	x.asm("rep movsb")
+}
+
+// rotate shifts n bytes at sp+disp by a bit through the carry flag, leaving
+// the bit shifted out in it
+func (x *x86) rotate(left bool, disp, n int32) {
+	rotate, step := "rcr", "inc"
+	if left {
+		rotate, step = "rcl", "dec"
+		disp += n - 1
+	}
+	x.lea(rSI, rSP, disp)
+	x.movImm(rCX, uint64(n))
+	loop := x.newLabel()
+	x.label(loop)
+	x.asm(rotate, x.mem(1, rSI, 0), isa.Imm(1))
+	x.unary(step, rSI)
+	x.loop(loop)
+}
+
+// carry adds or subtracts n bytes at sp+src to or from those at sp+dst, with
+// adc or sbb, leaving the carry or borrow out in the carry flag
+func (x *x86) carry(mnemonic string, dst, src, n int32) {
+	x.lea(rSI, rSP, src+n-1)
+	x.lea(rDI, rSP, dst+n-1)
+	x.movImm(rCX, uint64(n))
+	x.asm("clc")
+	loop := x.newLabel()
+	x.label(loop)
+	x.asm("mov", isa.AL, x.mem(1, rSI, 0))
+	x.asm(mnemonic, x.mem(1, rDI, 0), isa.AL)
+	x.unary("dec", rSI)
+	x.unary("dec", rDI)
+	x.loop(loop)
+}
+
+// decrement subtracts one from n bytes at sp+disp
+func (x *x86) decrement(disp, n int32) {
+	x.lea(rSI, rSP, disp+n-1)
+	x.movImm(rCX, uint64(n))
+	x.asm("stc")
+	loop := x.newLabel()
+	x.label(loop)
+	x.asm("sbb", x.mem(1, rSI, 0), isa.Imm(0))
+	x.unary("dec", rSI)
+	x.loop(loop)
+}
+
+// multiply sets the n bytes at sp+p to their product with those at sp+q,
+// by shifting and adding into n bytes of scratch at sp+t, with the count of
+// bits in the d register
+func (x *x86) multiply(p, q, t, n int32) {
+	loop, skip := x.newLabel(), x.newLabel()
+	x.zero(t, n)
+	x.movImm(rDX, uint64(8*n))
+	x.label(loop)
+	x.asm("clc")
+	x.rotate(true, t, n)
+	x.asm("clc")
+	x.rotate(true, p, n)
+	x.jcc(ccAE, skip)
+	x.carry("adc", t, q, n)
+	x.label(skip)
+	x.asm("dec", isa.EDX)
+	x.jcc(ccNE, loop)
+	x.copy(p, t, n)
+}
+
+// operateWide emits a multiplication, division, exponentiation or shift of
+// operands of any length, using scratch space below the stack segment's
+// stack pointer
+func (x *x86) operateWide(marker byte, n int32) bool {
+	if n > stackLength {
+		// The operands cannot have been allocated
+		x.jmp(fmt.Sprintf("fault%d", FaultStackUnderflow))
+		return false
+	}
+	var scratch int32
+	switch marker {
+	case MarkerMultiply:
+		scratch = n
+	case MarkerDivideFloor, MarkerModulo:
+		scratch = n + 1 // The remainder, with a bit above it
+	case MarkerExponent:
+		scratch = 3*n + 4 // The result, a product, a square and a count
+	}
+	if scratch != 0 {
+		x.alu("mov", rAX, rSP)
+		x.alu("sub", rAX, rBX)
+		x.aluImm("cmp", rAX, scratch)
+		x.fault(ccB, FaultStackOverflow)
+		x.aluImm("sub", rSP, scratch)
+	}
+	b, a := scratch, scratch+n
+	loop, skip, done := x.newLabel(), x.newLabel(), x.newLabel()
+	switch marker {
+	case MarkerShiftL, MarkerLShiftR, MarkerAShiftR:
+		// Shift by a bit at a time, as many times as the second operand
+		// counts down, until the first is shifted out
+		x.movImm(rDX, uint64(8*n))
+		x.label(loop)
+		x.test(b, n)
+		x.jcc(ccE, done)
+		x.decrement(b, n)
+		if marker == MarkerAShiftR {
+			// The sign bit
+			x.asm("mov", isa.AL, x.mem(1, rSP, a))
+			x.asm("shl", isa.AL, isa.Imm(1))
+		} else {
+			x.asm("clc")
+		}
+		x.rotate(marker == MarkerShiftL, a, n)
+		x.asm("dec", isa.EDX)
+		x.jcc(ccNE, loop)
+		x.label(done)
+	case MarkerMultiply:
+		x.multiply(a, b, 0, n)
+	case MarkerDivideFloor, MarkerModulo:
+		// Long division, shifting the bits of the dividend into the
+		// remainder, and the bits of the quotient into the dividend
+		x.test(b, n)
+		x.fault(ccE, FaultDivision)
+		x.zero(0, n+1)
+		x.movImm(rDX, uint64(8*n))
+		x.label(loop)
+		x.asm("clc")
+		x.rotate(true, a, n)
+		x.rotate(true, 0, n+1)
+		x.carry("sbb", 1, b, n)
+		x.asm("sbb", x.mem(1, rSP, 0), isa.Imm(0))
+		x.jcc(ccB, skip)
+		x.asm("or", x.mem(1, rSP, a+n-1), isa.Imm(1))
+		x.jmp(done)
+		x.label(skip)
+		x.carry("adc", 1, b, n)
+		x.asm("adc", x.mem(1, rSP, 0), isa.Imm(0))
+		x.label(done)
+		x.asm("dec", isa.EDX)
+		x.jcc(ccNE, loop)
+		if marker == MarkerModulo {
+			x.copy(a, 1, n)
+		}
+	case MarkerExponent:
+		// Square and multiply, for each bit of the exponent from the top
+		r, t, c, count := int32(0), n, 2*n, 3*n
+		x.zero(r, n)
+		x.asm("mov", x.mem(1, rSP, r+n-1), isa.Imm(1))
+		x.asm("mov", x.mem(4, rSP, count), isa.Imm(8*n))
+		x.label(loop)
+		x.copy(c, r, n)
+		x.multiply(r, c, t, n)
+		x.asm("clc")
+		x.rotate(true, b, n)
+		x.jcc(ccAE, skip)
+		x.multiply(r, a, t, n)
+		x.label(skip)
+		x.asm("dec", x.mem(4, rSP, count))
+		x.jcc(ccNE, loop)
+		x.copy(a, r, n)
+	default:
+		x.jmp(fmt.Sprintf("fault%d", FaultUnsupported))
+		return false
+	}
+	x.aluImm("add", rSP, scratch+n)
+	return true
+}
+
+// operatePair emits a multiplication or shift of words on 32-bit targets, with
+// the operands held in register pairs
+func (x *x86) operatePair(marker byte) bool {
+	switch marker {
+	case MarkerMultiply, MarkerShiftL, MarkerLShiftR, MarkerAShiftR:
+	default:
+		return false
+	}
+	x.loadBE(rDX, rSP, 8, 4)
+	x.loadBE(rAX, rSP, 12, 4)
+	x.loadBE(rSI, rSP, 0, 4)
+	x.loadBE(rCX, rSP, 4, 4)
+	if marker == MarkerMultiply {
+		x.alu("imul", rSI, rAX)
+		x.alu("imul", rDX, rCX)
+		x.alu("add", rSI, rDX)
+		x.unary("mul", rCX)
+		x.alu("add", rDX, rSI)
+	} else {
+		saturate, done := x.newLabel(), x.newLabel()
+		x.alu("test", rSI, rSI)
+		x.jcc(ccNE, saturate)
+		x.aluImm("cmp", rCX, 64)
+		x.jcc(ccAE, saturate)
+		if marker == MarkerShiftL {
+			x.asm("shld", isa.EDX, isa.EAX, isa.CL)
+			x.shift("shl", rAX)
+		} else {
+			x.asm("shrd", isa.EAX, isa.EDX, isa.CL)
+			x.shift(map[byte]string{MarkerLShiftR: "shr", MarkerAShiftR: "sar"}[marker], rDX)
+		}
+		x.asm("test", isa.CL, isa.Imm(32))
+		x.jcc(ccE, done)
+		switch marker {
+		case MarkerShiftL:
+			x.alu("mov", rDX, rAX)
+			x.zeroReg(rAX)
+		case MarkerLShiftR:
+			x.alu("mov", rAX, rDX)
+			x.zeroReg(rDX)
+		case MarkerAShiftR:
+			x.alu("mov", rAX, rDX)
+			x.shiftImm("sar", rDX, 31)
+		}
+		x.jmp(done)
+		x.label(saturate)
+		if marker == MarkerAShiftR {
+			x.shiftImm("sar", rDX, 31)
+			x.alu("mov", rAX, rDX)
+		} else {
+			x.zeroReg(rAX)
+			x.zeroReg(rDX)
+		}
+		x.label(done)
+	}
+	x.storeBE(rSP, 8, rDX, 4)
+	x.storeBE(rSP, 12, rAX, 4)
+	x.aluImm("add", rSP, 8)
+	return true
+}
+
+// finish resolves labels, and builds the jump table and symbols
+func (x *x86) finish(entry string) (*Object, error) {
+	if x.err != nil {
+		return nil, x.err
+	}
+	for _, f := range x.fixups {
+		target, ok := x.labels[f.label]
+		if !ok {
+			return nil, fmt.Errorf("bytelang: undefined label %s", f.label)
+		}
+		d := int32(target - (f.pos + 4))
+		x.text[f.pos] = byte(d)
+		x.text[f.pos+1] = byte(d >> 8)
+		x.text[f.pos+2] = byte(d >> 16)
+		x.text[f.pos+3] = byte(d >> 24)
+	}
+	table := make([]byte, 4*len(x.bytes))
+	for i := range table {
+		table[i] = 0xff
+	}
+	set := func(off uint, l string) {
+		p := uint32(x.labels[l])
+		table[4*off] = byte(p)
+		table[4*off+1] = byte(p >> 8)
+		table[4*off+2] = byte(p >> 16)
+		table[4*off+3] = byte(p >> 24)
+	}
+	for off := range x.steps {
+		if off != 0 {
+			set(off, fmt.Sprintf("L%d", off))
+		}
+	}
+	for _, off := range x.ends {
+		if _, ok := x.steps[off]; (!ok || off == 0) && off < uint(len(x.bytes)) {
+			set(off, "return")
+		}
+	}
+	o := x.obj
+	o.Text = x.text
+	o.Data = append(o.Data, table...)
+	o.Entry = entry
+	o.Symbols = append(o.Symbols,
+		Symbol{Name: entry, Value: uint(x.labels["entry"]), Size: uint(x.labels["fault1"] - x.labels["entry"]), Function: true, Global: true},
+		Symbol{Name: "bytecode", Section: Data, Size: uint(len(x.bytes))},
+		Symbol{Name: "jumptable", Section: Data, Value: x.table, Size: uint(len(table))},
+	)
+	return o, nil
+}
+
+// CompileAMD64 compiles a Bytelang structure into x86-64 machine code.  The
+// entry point follows the System V calling convention, taking no arguments
+// and returning the exit status in rax.  The trampolines of exports follow it
+// too, taking up to six parameters as 64-bit integers.
+func (b *Bytelang) CompileAMD64(exports ...Export) (*Object, error) {
+	x, err := newX86(b, 8)
+	if err != nil {
+		return nil, err
+	}
+	x.entry()
+	if err := x.export(exports); err != nil {
+		return nil, err
+	}
+	x.function(0)
+	o, err := x.finish("bytelang_main")
+	if o != nil {
+		o.Arch = "amd64"
+	}
+	return o, err
+}
+
+// CompileI386 compiles a Bytelang structure into 32-bit x86 machine code.  The
+// entry point and the trampolines of exports follow the cdecl calling
+// convention, taking 64-bit integer parameters and returning the exit status
+// in edx:eax.  Words remain 8 bytes wide in memory.
+func (b *Bytelang) CompileI386(exports ...Export) (*Object, error) {
+	x, err := newX86(b, 4)
+	if err != nil {
+		return nil, err
+	}
+	x.entry()
+	if err := x.export(exports); err != nil {
+		return nil, err
+	}
+	x.function(0)
+	o, err := x.finish("bytelang_main")
+	if o != nil {
+		o.Arch = "386"
+	}
+	return o, err
+}
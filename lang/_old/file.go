@@ -1,9 +1,52 @@
-
 package lang
 
-import (
+type Program struct {
+}
+
+// A File is a compiled program, in the segment-relative binary format of the
+// process loader: the code, data and stack segments are each addressed from
+// zero, and the loader chooses their base addresses
+type File struct {
+	Code        []byte
+	Data        []byte
+	Stack       uint // Length of the stack segment
+	Entry       uint // Offset of the entry point into the code segment
+	Symbols     []Symbol
+	Relocations []Relocation
+	Bytelang    []byte            // Bytecode the program was compiled from, if kept
+	Metadata    map[string]string // Toolchain information, such as the source name
+}
+
+type Segment int
+
+const (
+	CodeSegment Segment = iota
+	DataSegment
+	StackSegment
 )
 
-type Program struct {
+type Symbol struct {
+	Name     string
+	Segment  Segment
+	Value    uint // Offset into the segment
+	Size     uint
+	Function bool
+	Global   bool
+}
+
+type RelocationType int
+
+const (
+	RelPC32  RelocationType = iota // 32-bit S + A - P
+	RelAbs32                       // 32-bit S + A
+	RelAbs64                       // 64-bit S + A
+)
 
+// A relocation patches the code segment at Offset with the base address of a
+// segment plus Addend, once the loader has placed the segments
+type Relocation struct {
+	Offset  uint
+	Type    RelocationType
+	Segment Segment
+	Addend  int64
 }
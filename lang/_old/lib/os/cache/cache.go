@@ -0,0 +1,271 @@
+// A write-back cache of the pages of backing stores.  Reads and writes
+// through a view of a store are served from pages held by the cache, which
+// reads a page from the store on a miss, and writes a dirty page back to it
+// only when the page is evicted or flushed.  The cache holds a fixed number
+// of pages across all stores, and its policy chooses the page to evict when
+// it is full.
+package cache
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A Store is a backing store of bytes, such as a block device or a file
+type Store interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+}
+
+// A FixedStore is a store whose size cannot change, such as a block device
+type FixedStore interface {
+	Store
+	Fixed()
+}
+
+// A FlushStore is a store that may hold writes until it is flushed, such as
+// a block device.  Flushing a cache flushes the FlushStores it wrote to.
+type FlushStore interface {
+	Store
+	Flush() error
+}
+
+// Counters of a cache's activity
+type Stats struct {
+	Hits       uint64 // Page accesses found in the cache
+	Misses     uint64 // Page accesses read from the store
+	Writebacks uint64 // Dirty pages written to the store
+	Evictions  uint64
+}
+
+type Cache struct {
+	mu       sync.Mutex
+	pageSize int64
+	capacity int
+	policy   Policy
+	pages    map[pageKey]*Page
+	written  map[*View]bool // Views written back to since they were flushed
+	stats    Stats
+}
+
+// A View is a store read and written through a cache
+type View struct {
+	c     *Cache
+	store Store
+	size  int64 // Grows with writes before they reach the store
+}
+
+// A Page is a page of a store held by a cache
+type Page struct {
+	key    pageKey
+	data   []byte
+	length int64 // Bytes to write back, up to the end of the store
+	dirty  bool
+}
+
+type pageKey struct {
+	view  *View
+	index int64
+}
+
+var (
+	ErrOffset = errors.New("cache: negative offset")
+	ErrFixed  = errors.New("cache: write past the end of a fixed store")
+)
+
+// New returns a cache of capacity pages of pageSize bytes, evicted by a
+// policy, or least recently used if it is nil
+func New(pageSize, capacity int, policy Policy) *Cache {
+	if policy == nil {
+		policy = NewLRU()
+	}
+	if pageSize < 1 {
+		pageSize = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Cache{
+		pageSize: int64(pageSize),
+		capacity: capacity,
+		policy:   policy,
+		pages:    make(map[pageKey]*Page),
+		written:  make(map[*View]bool),
+	}
+}
+
+// Bind returns a view of a store
+func (c *Cache) Bind(s Store) *View {
+	return &View{c: c, store: s, size: s.Size()}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Flush writes every dirty page back to its store, and flushes the stores
+// written to
+func (c *Cache) Flush() error {
+	return c.flush(nil)
+}
+
+func (v *View) Size() int64 {
+	v.c.mu.Lock()
+	defer v.c.mu.Unlock()
+	return v.size
+}
+
+// Fixed reports whether the view is of a FixedStore, which writes cannot
+// extend
+func (v *View) Fixed() bool {
+	_, ok := v.store.(FixedStore)
+	return ok
+}
+
+// Flush writes the dirty pages of the view back to its store, and flushes
+// the store if it was written to
+func (v *View) Flush() error {
+	return v.c.flush(v)
+}
+
+func (v *View) ReadAt(b []byte, off int64) (n int, err error) {
+	c := v.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if off < 0 {
+		return 0, ErrOffset
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	if rest := v.size - off; int64(len(b)) > rest {
+		b, err = b[:rest], io.EOF
+	}
+	for n < len(b) {
+		p, err := c.page(v, (off+int64(n))/c.pageSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], p.data[(off+int64(n))%c.pageSize:])
+	}
+	return
+}
+
+// WriteAt writes to the pages of the view, extending it if the bytes pass
+// its end
+func (v *View) WriteAt(b []byte, off int64) (n int, err error) {
+	c := v.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if off < 0 {
+		return 0, ErrOffset
+	}
+	if _, ok := v.store.(FixedStore); ok && off+int64(len(b)) > v.size {
+		return 0, ErrFixed
+	}
+	for n < len(b) {
+		at := off + int64(n)
+		p, err := c.page(v, at/c.pageSize)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p.data[at%c.pageSize:], b[n:])
+		n += k
+		p.dirty = true
+		if end := at%c.pageSize + int64(k); end > p.length {
+			p.length = end
+		}
+	}
+	if end := off + int64(n); end > v.size {
+		v.size = end
+	}
+	return
+}
+
+// page returns a page of a view, reading it from the store on a miss
+func (c *Cache) page(v *View, index int64) (p *Page, err error) {
+	key := pageKey{v, index}
+	if p, ok := c.pages[key]; ok {
+		c.stats.Hits++
+		c.policy.Access(p)
+		return p, nil
+	}
+	c.stats.Misses++
+	for len(c.pages) >= c.capacity {
+		if err = c.evict(); err != nil {
+			return
+		}
+	}
+	p = &Page{key: key, data: make([]byte, c.pageSize)}
+	n, err := v.store.ReadAt(p.data, index*c.pageSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	p.length = int64(n)
+	c.pages[key] = p
+	c.policy.Insert(p)
+	return p, nil
+}
+
+func (c *Cache) evict() error {
+	p := c.policy.Victim()
+	if p == nil {
+		return errors.New("cache: no page to evict")
+	}
+	if err := c.writeback(p); err != nil {
+		return err
+	}
+	c.policy.Remove(p)
+	delete(c.pages, p.key)
+	c.stats.Evictions++
+	return nil
+}
+
+func (c *Cache) writeback(p *Page) error {
+	if !p.dirty {
+		return nil
+	}
+	if _, err := p.key.view.store.WriteAt(p.data[:p.length], p.key.index*c.pageSize); err != nil {
+		return err
+	}
+	p.dirty = false
+	c.written[p.key.view] = true
+	c.stats.Writebacks++
+	return nil
+}
+
+// flush writes back the dirty pages of a view, or of all views if it is nil,
+// in order of their offsets, then flushes the FlushStores written to
+func (c *Cache) flush(v *View) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dirty []*Page
+	for key, p := range c.pages {
+		if p.dirty && (v == nil || key.view == v) {
+			dirty = append(dirty, p)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].key.index < dirty[j].key.index })
+	for _, p := range dirty {
+		if err := c.writeback(p); err != nil {
+			return err
+		}
+	}
+	for w := range c.written {
+		if v != nil && w != v {
+			continue
+		}
+		if s, ok := w.store.(FlushStore); ok {
+			if err := s.Flush(); err != nil {
+				return err
+			}
+		}
+		delete(c.written, w)
+	}
+	return nil
+}
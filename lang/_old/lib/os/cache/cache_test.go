@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// recorder is a memory store that records the offsets of its writes, and
+// counts its flushes
+type recorder struct {
+	*Memory
+	writes  []int64
+	flushes int
+}
+
+func (r *recorder) WriteAt(b []byte, off int64) (int, error) {
+	r.writes = append(r.writes, off)
+	return r.Memory.WriteAt(b, off)
+}
+
+func (r *recorder) Flush() error {
+	r.flushes++
+	return nil
+}
+
+// resident returns the indices of the pages of a view held by the cache
+func resident(v *View) (pages []int64) {
+	for key := range v.c.pages {
+		if key.view == v {
+			pages = append(pages, key.index)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return
+}
+
+func read(t *testing.T, v *View, page int64) {
+	b := make([]byte, v.c.pageSize)
+	if _, err := v.ReadAt(b, page*v.c.pageSize); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+// Pages 0 to 2 are read in order, then again in reverse, and page 3 evicts
+// one.  Page 1 is read again, and page 4 evicts another.
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		held   [][]int64 // Pages held after reading pages 3 and 4
+	}{
+		{"lru", NewLRU(), [][]int64{{0, 1, 3}, {1, 3, 4}}},
+		{"fifo", NewFIFO(), [][]int64{{1, 2, 3}, {2, 3, 4}}},
+		// Every page is referenced, so the hand clears them all and
+		// evicts page 0; then it gives page 1 a second chance
+		{"clock", NewClock(), [][]int64{{1, 2, 3}, {1, 3, 4}}},
+	}
+	for _, test := range tests {
+		c := New(4, 3, test.policy)
+		v := c.Bind(NewMemory(make([]byte, 32)))
+		for _, page := range []int64{0, 1, 2, 2, 1, 0, 3} {
+			read(t, v, page)
+		}
+		if pages := resident(v); !reflect.DeepEqual(pages, test.held[0]) {
+			t.Errorf("%s: holds pages %v after page 3, want %v", test.name, pages, test.held[0])
+		}
+		read(t, v, 1)
+		read(t, v, 4)
+		if pages := resident(v); !reflect.DeepEqual(pages, test.held[1]) {
+			t.Errorf("%s: holds pages %v after page 4, want %v", test.name, pages, test.held[1])
+		}
+		if s, want := c.Stats(), (Stats{Hits: 4, Misses: 5, Evictions: 2}); s != want {
+			t.Errorf("%s: stats %+v, want %+v", test.name, s, want)
+		}
+	}
+}
+
+// Dirty pages are written back when evicted, and clean pages are not
+func TestWriteback(t *testing.T) {
+	s := &recorder{Memory: NewMemory([]byte("0123456789"))}
+	c := New(4, 1, nil)
+	v := c.Bind(s)
+	if _, err := v.WriteAt([]byte("ab"), 1); err != nil {
+		t.Fatal(err)
+	}
+	// An access spanning pages reads them in turn
+	b := make([]byte, 6)
+	if n, err := v.ReadAt(b, 0); n != 6 || err != nil || string(b) != "0ab345" {
+		t.Errorf("read %q, %d, %v", b, n, err)
+	}
+	if got := string(s.Bytes()); got != "0ab3456789" || !reflect.DeepEqual(s.writes, []int64{0}) {
+		t.Errorf("store holds %q, written at %v", got, s.writes)
+	}
+	read(t, v, 2)
+	if want := (Stats{Hits: 1, Misses: 3, Writebacks: 1, Evictions: 2}); c.Stats() != want {
+		t.Errorf("stats %+v, want %+v", c.Stats(), want)
+	}
+
+	// Writes past the end of the store grow the view, and write back only
+	// the bytes written
+	if _, err := v.WriteAt([]byte("xyz"), 9); err != nil {
+		t.Fatal(err)
+	}
+	if v.Size() != 12 || s.Size() != 10 {
+		t.Errorf("view of %d bytes, store of %d", v.Size(), s.Size())
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Bytes()); got != "0ab345678xyz" {
+		t.Errorf("store holds %q", got)
+	}
+	if _, err := v.ReadAt(make([]byte, 1), 12); err != io.EOF {
+		t.Errorf("read past the end: got %v", err)
+	}
+	if _, err := v.WriteAt([]byte("x"), -1); err != ErrOffset {
+		t.Errorf("write at -1: got %v", err)
+	}
+}
+
+type fixed struct{ *recorder }
+
+func (fixed) Fixed() {}
+
+func TestFixed(t *testing.T) {
+	v := New(4, 2, nil).Bind(fixed{&recorder{Memory: NewMemory(make([]byte, 6))}})
+	if !v.Fixed() {
+		t.Error("view of a fixed store is not fixed")
+	}
+	if _, err := v.WriteAt([]byte("ab"), 5); err != ErrFixed {
+		t.Errorf("write past the end: got %v", err)
+	}
+	if n, err := v.WriteAt([]byte("a"), 5); n != 1 || err != nil {
+		t.Errorf("write of the last byte: got %d, %v", n, err)
+	}
+}
+
+// Flushing a view writes back its dirty pages alone, in order of offset,
+// and flushes its store once it was written to
+func TestFlush(t *testing.T) {
+	c := New(4, 8, NewClock())
+	s, r := &recorder{Memory: NewMemory(make([]byte, 16))}, &recorder{Memory: NewMemory(make([]byte, 16))}
+	v, w := c.Bind(s), c.Bind(r)
+	for _, page := range []int64{3, 0, 2} {
+		v.WriteAt([]byte("v"), page*4)
+	}
+	w.WriteAt([]byte("w"), 4)
+	if err := v.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.writes, []int64{0, 8, 12}) || s.flushes != 1 {
+		t.Errorf("store written at %v, flushed %d times", s.writes, s.flushes)
+	}
+	if len(r.writes) != 0 || r.flushes != 0 {
+		t.Errorf("other store written at %v, flushed %d times", r.writes, r.flushes)
+	}
+	// Pages stay cached once written back, and are not written again
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.writes) != 3 || s.flushes != 1 || !reflect.DeepEqual(r.writes, []int64{4}) || r.flushes != 1 {
+		t.Errorf("stores written at %v and %v, flushed %d and %d times", s.writes, r.writes, s.flushes, r.flushes)
+	}
+	if !bytes.Equal(s.Bytes(), []byte("v\x00\x00\x00\x00\x00\x00\x00v\x00\x00\x00v\x00\x00\x00")) {
+		t.Errorf("store holds %q", s.Bytes())
+	}
+	if st := c.Stats(); st.Writebacks != 4 || st.Evictions != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
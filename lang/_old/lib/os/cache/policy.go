@@ -0,0 +1,107 @@
+package cache
+
+import "container/list"
+
+// A Policy orders the pages of a cache for eviction.  The cache calls it
+// with its lock held.
+type Policy interface {
+	Insert(p *Page)
+	Access(p *Page)
+	Remove(p *Page)
+	// Victim returns the page to evict next, or nil if there are none
+	Victim() *Page
+}
+
+// A queue evicts its oldest page, where pages are reordered on access if
+// recent is set
+type queue struct {
+	recent   bool
+	order    *list.List
+	elements map[*Page]*list.Element
+}
+
+// NewLRU returns a policy evicting the least recently used page
+func NewLRU() Policy {
+	return &queue{recent: true, order: list.New(), elements: make(map[*Page]*list.Element)}
+}
+
+// NewFIFO returns a policy evicting the page read earliest
+func NewFIFO() Policy {
+	return &queue{order: list.New(), elements: make(map[*Page]*list.Element)}
+}
+
+func (q *queue) Insert(p *Page) {
+	q.elements[p] = q.order.PushBack(p)
+}
+
+func (q *queue) Access(p *Page) {
+	if e, ok := q.elements[p]; ok && q.recent {
+		q.order.MoveToBack(e)
+	}
+}
+
+func (q *queue) Remove(p *Page) {
+	if e, ok := q.elements[p]; ok {
+		q.order.Remove(e)
+		delete(q.elements, p)
+	}
+}
+
+func (q *queue) Victim() *Page {
+	if e := q.order.Front(); e != nil {
+		return e.Value.(*Page)
+	}
+	return nil
+}
+
+// A clock approximates LRU: pages sit on a ring with a reference bit set on
+// access, and the hand clears bits until it finds a page without one
+type clock struct {
+	ring       []*Page
+	referenced map[*Page]bool
+	hand       int
+}
+
+// NewClock returns a policy evicting by the clock algorithm
+func NewClock() Policy {
+	return &clock{referenced: make(map[*Page]bool)}
+}
+
+func (c *clock) Insert(p *Page) {
+	c.ring = append(c.ring, p)
+	c.referenced[p] = false
+}
+
+func (c *clock) Access(p *Page) {
+	if _, ok := c.referenced[p]; ok {
+		c.referenced[p] = true
+	}
+}
+
+func (c *clock) Remove(p *Page) {
+	for i, q := range c.ring {
+		if q == p {
+			c.ring = append(c.ring[:i], c.ring[i+1:]...)
+			if c.hand > i {
+				c.hand--
+			}
+			break
+		}
+	}
+	delete(c.referenced, p)
+}
+
+func (c *clock) Victim() *Page {
+	if len(c.ring) == 0 {
+		return nil
+	}
+	for {
+		c.hand %= len(c.ring)
+		p := c.ring[c.hand]
+		if !c.referenced[p] {
+			return p
+		}
+		c.referenced[p] = false
+		c.hand++
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// A Memory store holds its bytes in memory, and grows with writes past its
+// end
+type Memory struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemory returns a memory store holding a copy of data
+func NewMemory(data []byte) *Memory {
+	return &Memory{data: append([]byte(nil), data...)}
+}
+
+func (m *Memory) ReadAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off < 0 {
+		return 0, ErrOffset
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(b, m.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (m *Memory) WriteAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off < 0 {
+		return 0, ErrOffset
+	}
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], b), nil
+}
+
+func (m *Memory) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data))
+}
+
+// Bytes returns a copy of the contents of the store
+func (m *Memory) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.data...)
+}
+
+// A HostFile store is a file of the host
+type HostFile struct {
+	*os.File
+}
+
+// OpenHostFile opens a file of the host as a store, creating it if it does
+// not exist
+func OpenHostFile(name string) (*HostFile, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &HostFile{f}, nil
+}
+
+// Size returns the size of the file, or zero if it cannot be found
+func (h *HostFile) Size() int64 {
+	fi, err := h.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
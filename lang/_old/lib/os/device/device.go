@@ -0,0 +1,158 @@
+// Emulated devices, mapped into the address space of driver processes.  A
+// device occupies a range of physical addresses, and is read and written
+// there as memory: the device model sees each access, as a device on a
+// memory bus would.  Registers holding words are big-endian, like the words
+// of bytelang.
+package device
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Device is read and written at offsets into its range of addresses.
+// Reads and writes may have effects, such as transmitting or receiving a
+// byte, so they must not be cached.
+type Device interface {
+	Size() int64
+	ReadAt(b []byte, off int64) (n int, err error)
+	WriteAt(b []byte, off int64) (n int, err error)
+	// Snapshot returns a copy of the state of the device
+	Snapshot() []byte
+}
+
+// A Ticker advances with the clock of the machine
+type Ticker interface {
+	Tick()
+}
+
+// A Bus maps devices at physical addresses.  It is itself a device, whose
+// offsets are the addresses, so that a driver addresses a device as it
+// would on the hardware.
+type Bus struct {
+	mu       sync.Mutex
+	mappings []mapping // Ordered by base
+}
+
+type mapping struct {
+	base   int64
+	device Device
+}
+
+var ErrUnmapped = errors.New("device: address not mapped to a device")
+
+// Map a device at a base address
+func (b *Bus) Map(base int64, d Device) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	end := base + d.Size()
+	for _, m := range b.mappings {
+		if base < m.base+m.device.Size() && m.base < end {
+			return fmt.Errorf("device: mapping at %#x overlaps that at %#x", base, m.base)
+		}
+	}
+	b.mappings = append(b.mappings, mapping{base, d})
+	sort.Slice(b.mappings, func(i, j int) bool { return b.mappings[i].base < b.mappings[j].base })
+	return nil
+}
+
+// Devices returns the devices of the bus by their base addresses
+func (b *Bus) Devices() map[int64]Device {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	devices := make(map[int64]Device)
+	for _, m := range b.mappings {
+		devices[m.base] = m.device
+	}
+	return devices
+}
+
+// device returns the device of an access, which may not span devices
+func (b *Bus) device(length int, addr int64) (Device, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := sort.Search(len(b.mappings), func(i int) bool { return b.mappings[i].base > addr }) - 1
+	if i < 0 {
+		return nil, 0, ErrUnmapped
+	}
+	m := b.mappings[i]
+	if addr+int64(length) > m.base+m.device.Size() {
+		return nil, 0, ErrUnmapped
+	}
+	return m.device, addr - m.base, nil
+}
+
+// Size returns the size of the address space, up to the end of the last
+// device
+func (b *Bus) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.mappings) == 0 {
+		return 0
+	}
+	m := b.mappings[len(b.mappings)-1]
+	return m.base + m.device.Size()
+}
+
+func (b *Bus) ReadAt(p []byte, addr int64) (int, error) {
+	d, off, err := b.device(len(p), addr)
+	if err != nil {
+		return 0, err
+	}
+	return d.ReadAt(p, off)
+}
+
+func (b *Bus) WriteAt(p []byte, addr int64) (int, error) {
+	d, off, err := b.device(len(p), addr)
+	if err != nil {
+		return 0, err
+	}
+	return d.WriteAt(p, off)
+}
+
+// Snapshot returns the snapshots of the devices, in order of their
+// addresses
+func (b *Bus) Snapshot() (s []byte) {
+	for _, m := range b.mappings {
+		s = append(s, m.device.Snapshot()...)
+	}
+	return
+}
+
+// Tick advances the devices that are tickers
+func (b *Bus) Tick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.mappings {
+		if t, ok := m.device.(Ticker); ok {
+			t.Tick()
+		}
+	}
+}
+
+// Addresses of the devices of a PC
+const (
+	VGABase    = 0xb8000
+	SerialBase = 0x3f8
+	TimerBase  = 0x40
+)
+
+// PC returns a bus with the devices of a PC: a VGA text buffer, a serial
+// port and a timer
+func PC() (b *Bus, vga *VGA, serial *Serial, timer *Timer) {
+	b, vga, serial, timer = new(Bus), NewVGA(), NewSerial(), new(Timer)
+	b.Map(VGABase, vga)
+	b.Map(SerialBase, serial)
+	b.Map(TimerBase, timer)
+	return
+}
+
+// check that an access is within a device
+func check(d Device, length int, off int64) error {
+	if off < 0 || off+int64(length) > d.Size() {
+		return fmt.Errorf("device: access at %#x out of range", off)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	b, vga, serial, timer := PC()
+	if err := b.Map(VGABase+Columns, NewVGA()); err == nil {
+		t.Error("overlapping mapping")
+	}
+	if err := b.Map(SerialBase+serialSize, new(Timer)); err != nil {
+		t.Error(err)
+	}
+	devices := b.Devices()
+	if len(devices) != 4 || devices[VGABase] != vga || devices[SerialBase] != serial || devices[TimerBase] != timer {
+		t.Errorf("devices %v", devices)
+	}
+	if n := b.Size(); n != VGABase+Rows*Columns*2 {
+		t.Errorf("size %#x", n)
+	}
+	tests := []struct {
+		addr   int64
+		length int
+		err    error
+	}{
+		{VGABase, 8, nil},
+		{VGABase + Rows*Columns*2 - 1, 1, nil},
+		{VGABase + Rows*Columns*2 - 1, 2, ErrUnmapped},
+		{VGABase - 1, 2, ErrUnmapped},
+		{0, 1, ErrUnmapped},
+		// Across the serial port and the timer mapped after it
+		{SerialBase + serialSize - 4, 8, ErrUnmapped},
+		{TimerBase + timerSize, 1, ErrUnmapped},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.length)
+		if _, err := b.ReadAt(p, test.addr); err != test.err {
+			t.Errorf("read of %d at %#x: got %v, want %v", test.length, test.addr, err, test.err)
+		}
+		if _, err := b.WriteAt(p, test.addr); err != test.err {
+			t.Errorf("write of %d at %#x: got %v, want %v", test.length, test.addr, err, test.err)
+		}
+	}
+}
+
+func TestVGA(t *testing.T) {
+	b, vga, _, _ := PC()
+	// Two cells of the second row, from the third column
+	cells := []byte{'h', 0x07, 'i', 0x1f}
+	if _, err := b.WriteAt(cells, VGABase+(Columns+2)*2); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, Rows*Columns*2)
+	copy(want[(Columns+2)*2:], cells)
+	if s := vga.Snapshot(); !bytes.Equal(s, want) {
+		t.Error("snapshot differs from the cells written")
+	}
+	if text := vga.Text(); text != "\n  hi" {
+		t.Errorf("text %q", text)
+	}
+	// A snapshot is a copy
+	vga.Snapshot()[0] = 'x'
+	if vga.Snapshot()[0] != 0 {
+		t.Error("snapshot shares the buffer")
+	}
+}
+
+func TestSerial(t *testing.T) {
+	b, _, serial, _ := PC()
+	status := func() byte {
+		var p [1]byte
+		b.ReadAt(p[:], SerialBase+SerialLineStatus)
+		return p[0]
+	}
+	if s := status(); s != TransmitterEmpty {
+		t.Errorf("idle line status %#x", s)
+	}
+	serial.Receive([]byte("ok"))
+	if s := status(); s != TransmitterEmpty|DataReady {
+		t.Errorf("line status %#x with data received", s)
+	}
+	var received []byte
+	for status()&DataReady != 0 {
+		var p [1]byte
+		b.ReadAt(p[:], SerialBase+SerialData)
+		received = append(received, p[0])
+	}
+	if string(received) != "ok" {
+		t.Errorf("received %q", received)
+	}
+
+	// Only bytes written to the data register are transmitted
+	b.WriteAt([]byte("hi"), SerialBase+SerialData+serialSize-2)
+	for _, c := range []byte("sent") {
+		b.WriteAt([]byte{c}, SerialBase+SerialData)
+	}
+	if s := serial.Snapshot(); string(s) != "sent" {
+		t.Errorf("transmitted %q", s)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	b, _, _, timer := PC()
+	word := func(w uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, w)
+	}
+	registers := func(count, alarm, status uint64) []byte {
+		return append(append(word(count), word(alarm)...), word(status)...)
+	}
+	b.WriteAt(word(3), TimerBase+TimerAlarm)
+	for i := 1; i <= 4; i++ {
+		b.Tick()
+		var status uint64
+		if i >= 3 {
+			status = 1
+		}
+		if s := timer.Snapshot(); !bytes.Equal(s, registers(uint64(i), 3, status)) {
+			t.Errorf("tick %d: registers % x", i, s)
+		}
+	}
+	// Writes clear the status, and setting the count restarts it
+	b.WriteAt(word(0), TimerBase+TimerCount)
+	b.WriteAt(word(7), TimerBase+TimerStatus)
+	b.Tick()
+	if s := timer.Snapshot(); !bytes.Equal(s, registers(1, 3, 0)) {
+		t.Errorf("registers % x after a reset", s)
+	}
+}
+
+// The snapshot of a bus is those of its devices, in address order
+func TestBusSnapshot(t *testing.T) {
+	b, vga, serial, timer := PC()
+	serial.Receive([]byte("x"))
+	b.WriteAt([]byte("out"), SerialBase+SerialData)
+	b.WriteAt([]byte{'A', 0x07}, VGABase)
+	b.Tick()
+	want := append(append(timer.Snapshot(), serial.Snapshot()...), vga.Snapshot()...)
+	if s := b.Snapshot(); !bytes.Equal(s, want) {
+		t.Errorf("snapshot of %d bytes, want %d", len(s), len(want))
+	}
+}
@@ -0,0 +1,219 @@
+package device
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+)
+
+// The geometry of a VGA text buffer
+const (
+	Columns = 80
+	Rows    = 25
+)
+
+// A VGA text buffer holds a character and an attribute byte for each cell
+// of the screen, row by row
+type VGA struct {
+	mu     sync.Mutex
+	buffer [Rows * Columns * 2]byte
+}
+
+func NewVGA() *VGA {
+	return new(VGA)
+}
+
+func (v *VGA) Size() int64 {
+	return int64(len(v.buffer))
+}
+
+func (v *VGA) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(v, len(b), off); err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return copy(b, v.buffer[off:]), nil
+}
+
+func (v *VGA) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(v, len(b), off); err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return copy(v.buffer[off:], b), nil
+}
+
+func (v *VGA) Snapshot() []byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]byte(nil), v.buffer[:]...)
+}
+
+// Text returns the characters of the screen, a line per row without
+// trailing blanks.  Unwritten cells are blank.
+func (v *VGA) Text() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lines := make([]string, Rows)
+	for r := range lines {
+		row := make([]byte, Columns)
+		for c := range row {
+			row[c] = v.buffer[(r*Columns+c)*2]
+			if row[c] == 0 {
+				row[c] = ' '
+			}
+		}
+		lines[r] = strings.TrimRight(string(row), " ")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// Registers of a serial port, after those of a 16550 UART
+const (
+	SerialData       = 0 // Writes transmit a byte, and reads receive one
+	SerialLineStatus = 5
+	serialSize       = 8
+)
+
+// Bits of the line status register
+const (
+	DataReady        = 1 << 0
+	TransmitterEmpty = 1 << 5
+)
+
+// A Serial port transmits the bytes written to its data register, and
+// receives the bytes given it by the host, one per read of the register
+type Serial struct {
+	mu       sync.Mutex
+	received []byte // Not yet read
+	sent     []byte
+}
+
+func NewSerial() *Serial {
+	return new(Serial)
+}
+
+func (s *Serial) Size() int64 {
+	return serialSize
+}
+
+func (s *Serial) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(s, len(b), off); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range b {
+		switch off + int64(i) {
+		case SerialData:
+			b[i] = 0
+			if len(s.received) > 0 {
+				b[i], s.received = s.received[0], s.received[1:]
+			}
+		case SerialLineStatus:
+			b[i] = TransmitterEmpty
+			if len(s.received) > 0 {
+				b[i] |= DataReady
+			}
+		default:
+			b[i] = 0
+		}
+	}
+	return len(b), nil
+}
+
+func (s *Serial) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(s, len(b), off); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range b {
+		if off+int64(i) == SerialData {
+			s.sent = append(s.sent, c)
+		}
+	}
+	return len(b), nil
+}
+
+// Receive queues bytes for the port to receive
+func (s *Serial) Receive(data []byte) {
+	s.mu.Lock()
+	s.received = append(s.received, data...)
+	s.mu.Unlock()
+}
+
+// Snapshot returns the bytes transmitted so far
+func (s *Serial) Snapshot() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.sent...)
+}
+
+// Registers of a timer, each a word
+const (
+	TimerCount  = 0  // Ticks since the timer was last set
+	TimerAlarm  = 8  // Count at which the alarm goes off, or zero for none
+	TimerStatus = 16 // One once the alarm has gone off; writes clear it
+	timerSize   = 24
+)
+
+// A Timer counts the ticks of the machine's clock, and raises its status
+// once the count reaches its alarm
+type Timer struct {
+	mu        sync.Mutex
+	registers [timerSize]byte
+}
+
+func (t *Timer) Size() int64 {
+	return timerSize
+}
+
+func (t *Timer) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(t, len(b), off); err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return copy(b, t.registers[off:]), nil
+}
+
+func (t *Timer) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(t, len(b), off); err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := copy(t.registers[off:], b)
+	if off < TimerStatus+8 && off+int64(n) > TimerStatus {
+		t.set(TimerStatus, 0)
+	}
+	return n, nil
+}
+
+func (t *Timer) word(reg int) uint64 {
+	return binary.BigEndian.Uint64(t.registers[reg:])
+}
+
+func (t *Timer) set(reg int, w uint64) {
+	binary.BigEndian.PutUint64(t.registers[reg:], w)
+}
+
+func (t *Timer) Tick() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := t.word(TimerCount) + 1
+	t.set(TimerCount, count)
+	if alarm := t.word(TimerAlarm); alarm != 0 && count == alarm {
+		t.set(TimerStatus, 1)
+	}
+}
+
+// Snapshot returns the registers of the timer
+func (t *Timer) Snapshot() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.registers[:]...)
+}
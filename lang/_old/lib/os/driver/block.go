@@ -0,0 +1,172 @@
+// Block drivers, which expose a file of fixed length that can be read and
+// written, and the server that binds them into process namespaces.
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A BlockDevice is read and written a sector at a time: the offsets and
+// lengths of its reads and writes are multiples of its sector size.  Writes
+// may be held by the device until it is flushed.
+type BlockDevice interface {
+	SectorSize() int
+	Length() int64
+	ReadAt(b []byte, off int64) (n int, err error)
+	WriteAt(b []byte, off int64) (n int, err error)
+	Flush() error
+}
+
+var (
+	ErrAlignment = errors.New("driver: access not aligned to sectors")
+	ErrRange     = errors.New("driver: access past the end of the device")
+)
+
+// check that an access is aligned to sectors and within the device
+func check(d BlockDevice, b []byte, off int64) error {
+	size := int64(d.SectorSize())
+	switch {
+	case off < 0 || off%size != 0 || int64(len(b))%size != 0:
+		return ErrAlignment
+	case off+int64(len(b)) > d.Length():
+		return ErrRange
+	}
+	return nil
+}
+
+// A RAMDisk is a block device in memory
+type RAMDisk struct {
+	mu         sync.Mutex
+	sectorSize int
+	data       []byte
+}
+
+// checkGeometry checks that a device has positive sectors, and a whole
+// number of them
+func checkGeometry(sectorSize int, sectors int64) error {
+	if sectorSize <= 0 {
+		return fmt.Errorf("driver: invalid sector size %d", sectorSize)
+	}
+	if sectors < 0 {
+		return fmt.Errorf("driver: invalid sector count %d", sectors)
+	}
+	return nil
+}
+
+func NewRAMDisk(sectorSize int, sectors int64) (*RAMDisk, error) {
+	if err := checkGeometry(sectorSize, sectors); err != nil {
+		return nil, err
+	}
+	return &RAMDisk{sectorSize: sectorSize, data: make([]byte, int64(sectorSize)*sectors)}, nil
+}
+
+func (r *RAMDisk) SectorSize() int {
+	return r.sectorSize
+}
+
+func (r *RAMDisk) Length() int64 {
+	return int64(len(r.data))
+}
+
+func (r *RAMDisk) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(r, b, off); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copy(b, r.data[off:]), nil
+}
+
+func (r *RAMDisk) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(r, b, off); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copy(r.data[off:], b), nil
+}
+
+func (r *RAMDisk) Flush() error {
+	return nil
+}
+
+// An Image is a block device backed by an image file of the host
+type Image struct {
+	f          *os.File
+	sectorSize int
+	length     int64
+}
+
+// OpenImage opens an image file, whose length must be a whole number of
+// sectors
+func OpenImage(name string, sectorSize int) (*Image, error) {
+	if err := checkGeometry(sectorSize, 0); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size()%int64(sectorSize) != 0 {
+		f.Close()
+		return nil, fmt.Errorf("driver: %s is not a whole number of %d-byte sectors", name, sectorSize)
+	}
+	return &Image{f, sectorSize, fi.Size()}, nil
+}
+
+// CreateImage creates an image file of zeroed sectors, replacing any
+// existing file
+func CreateImage(name string, sectorSize int, sectors int64) (*Image, error) {
+	if err := checkGeometry(sectorSize, sectors); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	length := int64(sectorSize) * sectors
+	if err := f.Truncate(length); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Image{f, sectorSize, length}, nil
+}
+
+func (i *Image) SectorSize() int {
+	return i.sectorSize
+}
+
+func (i *Image) Length() int64 {
+	return i.length
+}
+
+func (i *Image) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(i, b, off); err != nil {
+		return 0, err
+	}
+	return i.f.ReadAt(b, off)
+}
+
+func (i *Image) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(i, b, off); err != nil {
+		return 0, err
+	}
+	return i.f.WriteAt(b, off)
+}
+
+// Flush syncs the image file to the host's storage
+func (i *Image) Flush() error {
+	return i.f.Sync()
+}
+
+func (i *Image) Close() error {
+	return i.f.Close()
+}
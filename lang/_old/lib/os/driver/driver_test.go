@@ -0,0 +1,275 @@
+package driver
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/lib/os/cache"
+)
+
+// flushes counts the flushes of a device
+type flushes struct {
+	BlockDevice
+	n int
+}
+
+func (f *flushes) Flush() error {
+	f.n++
+	return f.BlockDevice.Flush()
+}
+
+func ramDisk(t *testing.T, sectorSize int, sectors int64) *RAMDisk {
+	r, err := NewRAMDisk(sectorSize, sectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// exercise reads and writes a device of four 4-byte sectors
+func exercise(t *testing.T, d BlockDevice) {
+	if d.SectorSize() != 4 || d.Length() != 16 {
+		t.Fatalf("%d-byte sectors, %d bytes", d.SectorSize(), d.Length())
+	}
+	if n, err := d.WriteAt([]byte("abcdefgh"), 4); n != 8 || err != nil {
+		t.Fatalf("write: got %d, %v", n, err)
+	}
+	b := make([]byte, 16)
+	if n, err := d.ReadAt(b, 0); n != 16 || err != nil || string(b) != "\x00\x00\x00\x00abcdefgh\x00\x00\x00\x00" {
+		t.Errorf("read: got %q, %d, %v", b, n, err)
+	}
+	tests := []struct {
+		length int
+		off    int64
+		err    error
+	}{
+		{4, 2, ErrAlignment},
+		{3, 0, ErrAlignment},
+		{4, -4, ErrAlignment},
+		{8, 12, ErrRange},
+		{4, 16, ErrRange},
+	}
+	for _, test := range tests {
+		b := make([]byte, test.length)
+		if _, err := d.ReadAt(b, test.off); err != test.err {
+			t.Errorf("read of %d at %d: got %v, want %v", test.length, test.off, err, test.err)
+		}
+		if _, err := d.WriteAt(b, test.off); err != test.err {
+			t.Errorf("write of %d at %d: got %v, want %v", test.length, test.off, err, test.err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRAMDisk(t *testing.T) {
+	exercise(t, ramDisk(t, 4, 4))
+}
+
+func TestImage(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "image")
+	i, err := CreateImage(name, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exercise(t, i)
+	i.Close()
+	if b, err := os.ReadFile(name); string(b) != "\x00\x00\x00\x00abcdefgh\x00\x00\x00\x00" || err != nil {
+		t.Errorf("image file holds %q, %v", b, err)
+	}
+	if i, err = OpenImage(name, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	b := make([]byte, 8)
+	if _, err := i.ReadAt(b, 8); string(b) != "efgh\x00\x00\x00\x00" || err != nil {
+		t.Errorf("reopened image reads %q, %v", b, err)
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(name, make([]byte, 10), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		open func() error
+		want string
+	}{
+		{func() error { _, err := NewRAMDisk(0, 4); return err }, "invalid sector size 0"},
+		{func() error { _, err := NewRAMDisk(-512, 4); return err }, "invalid sector size -512"},
+		{func() error { _, err := NewRAMDisk(512, -1); return err }, "invalid sector count -1"},
+		{func() error { _, err := OpenImage(name, 0); return err }, "invalid sector size 0"},
+		{func() error { _, err := OpenImage(name, 4); return err }, "not a whole number of 4-byte sectors"},
+		{func() error { _, err := CreateImage(name, -1, 1); return err }, "invalid sector size -1"},
+	}
+	for i, test := range tests {
+		if err := test.open(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%d: got %v, want %q", i, err, test.want)
+		}
+	}
+}
+
+// Bad sectors fail every access, and writes stop before them
+func TestBadSectors(t *testing.T) {
+	r := ramDisk(t, 4, 4)
+	f := Inject(r, Faults{BadSectors: []int64{2}}, 1)
+	if n, err := f.WriteAt([]byte("abcdefghijklmnop"), 0); n != 8 || err != ErrIO {
+		t.Errorf("write across the bad sector: got %d, %v", n, err)
+	}
+	if n, err := f.WriteAt([]byte("MNOP"), 12); n != 4 || err != nil {
+		t.Errorf("write after the bad sector: got %d, %v", n, err)
+	}
+	b := make([]byte, 16)
+	if n, err := f.ReadAt(b, 0); n != 8 || err != ErrIO || string(b[:8]) != "abcdefgh" {
+		t.Errorf("read across the bad sector: got %q, %d, %v", b, n, err)
+	}
+	r.ReadAt(b, 0)
+	if string(b) != "abcdefgh\x00\x00\x00\x00MNOP" {
+		t.Errorf("device holds %q", b)
+	}
+	if n := f.Injected(); n != 2 {
+		t.Errorf("%d faults injected", n)
+	}
+}
+
+// A torn write writes some whole sectors, reporting how many bytes
+func TestTornWrite(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		r := ramDisk(t, 4, 4)
+		f := Inject(r, Faults{TornWrite: 1}, seed)
+		data := []byte("abcdefghijklmnop")
+		n, err := f.WriteAt(data, 0)
+		if err != ErrIO || n%4 != 0 || n >= len(data) {
+			t.Fatalf("seed %d: torn write of %d bytes, %v", seed, n, err)
+		}
+		b := make([]byte, 16)
+		r.ReadAt(b, 0)
+		if want := append(data[:n:n], make([]byte, 16-n)...); !bytes.Equal(b, want) {
+			t.Errorf("seed %d: device holds %q after writing %d bytes", seed, b, n)
+		}
+		// The same seed tears the same write
+		g := Inject(ramDisk(t, 4, 4), Faults{TornWrite: 1}, seed)
+		if m, _ := g.WriteAt(data, 0); m != n {
+			t.Errorf("seed %d: tore at %d, then at %d", seed, n, m)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	f := Inject(ramDisk(t, 4, 4), Faults{ReadError: 1, WriteError: 1, FlushError: 1}, 1)
+	b := make([]byte, 4)
+	if n, err := f.ReadAt(b, 0); n != 0 || err != ErrIO {
+		t.Errorf("read: got %d, %v", n, err)
+	}
+	if n, err := f.WriteAt(b, 0); n != 0 || err != ErrIO {
+		t.Errorf("write: got %d, %v", n, err)
+	}
+	if err := f.Flush(); err != ErrIO {
+		t.Errorf("flush: got %v", err)
+	}
+	// Accesses the device would refuse are not faults
+	if _, err := f.ReadAt(b, 2); err != ErrAlignment {
+		t.Errorf("misaligned read: got %v", err)
+	}
+	if n := f.Injected(); n != 3 {
+		t.Errorf("%d faults injected", n)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	r := ramDisk(t, 4, 4)
+	r.WriteAt([]byte("0123456789abcdef"), 0)
+	b := Bytes{r}
+	if n, err := b.WriteAt([]byte("xyz"), 3); n != 3 || err != nil {
+		t.Fatalf("write across sectors: got %d, %v", n, err)
+	}
+	if n, err := b.WriteAt([]byte("Z"), 15); n != 1 || err != nil {
+		t.Fatalf("write of the last byte: got %d, %v", n, err)
+	}
+	all := make([]byte, 16)
+	r.ReadAt(all, 0)
+	if string(all) != "012xyz6789abcdeZ" {
+		t.Errorf("device holds %q", all)
+	}
+	tests := []struct {
+		length int
+		off    int64
+		want   string
+		err    error
+	}{
+		{5, 1, "12xyz", nil},
+		{4, 14, "eZ", io.EOF},
+		{1, 16, "", io.EOF},
+		{1, -1, "", ErrAlignment},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.length)
+		n, err := b.ReadAt(p, test.off)
+		if string(p[:n]) != test.want || err != test.err {
+			t.Errorf("read of %d at %d: got %q, %v, want %q, %v", test.length, test.off, p[:n], err, test.want, test.err)
+		}
+	}
+	if _, err := b.WriteAt([]byte("xy"), 15); err != ErrRange {
+		t.Errorf("write past the end: got %v", err)
+	}
+	if b.Size() != 16 {
+		t.Errorf("size %d", b.Size())
+	}
+}
+
+func TestServer(t *testing.T) {
+	a, c := &flushes{BlockDevice: ramDisk(t, 4, 4)}, ramDisk(t, 8, 1)
+	s := NewServer(map[string]BlockDevice{"disks/a": a, "/c": c})
+	for _, p := range []string{"/", "/disks", "disks/a", "/c"} {
+		if exists, err := s.Walk(p); !exists || err != nil {
+			t.Errorf("walk %s: got %v, %v", p, exists, err)
+		}
+	}
+	if exists, _ := s.Walk("/disks/b"); exists {
+		t.Error("walk /disks/b")
+	}
+	for dir, want := range map[string]string{"/": "c disks", "/disks": "a", "/c": ""} {
+		if names, err := s.List(dir); strings.Join(names, " ") != want || err != nil {
+			t.Errorf("list %s: got %q, %v", dir, names, err)
+		}
+	}
+	if err := s.Create("/disks/b"); err == nil {
+		t.Error("created a device")
+	}
+	if _, err := s.Read("/disks/b"); err != errNotExist {
+		t.Errorf("read /disks/b: got %v", err)
+	}
+
+	// Writes through a cache reach the device, and are flushed, when the
+	// cache is flushed
+	st, err := s.Store("/disks/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.(cache.FixedStore); !ok {
+		t.Error("store of a device is not fixed")
+	}
+	v := cache.New(8, 4, nil).Bind(st)
+	if _, err := v.WriteAt([]byte("hello"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.Read("/disks/a"); !bytes.Equal(b, make([]byte, 16)) || a.n != 0 {
+		t.Errorf("device holds %q, flushed %d times, before the cache is flushed", b, a.n)
+	}
+	if err := v.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.Read("/disks/a"); string(b) != "\x00\x00\x00\x00\x00\x00hello\x00\x00\x00\x00\x00" || a.n != 1 {
+		t.Errorf("device holds %q, flushed %d times", b, a.n)
+	}
+	// Flushing again has nothing to write, and does not flush the device
+	if v.Flush(); a.n != 1 {
+		t.Errorf("flushed %d times", a.n)
+	}
+}
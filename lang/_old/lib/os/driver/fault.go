@@ -0,0 +1,118 @@
+package driver
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// Faults are the failures a Faulty device injects, each with a probability
+// per access
+type Faults struct {
+	ReadError  float64
+	WriteError float64 // Fails before writing anything
+	TornWrite  float64 // Writes only some of the sectors before failing
+	FlushError float64
+	// Sectors whose every access fails
+	BadSectors []int64
+}
+
+var ErrIO = errors.New("driver: I/O error")
+
+// A Faulty device injects faults into the accesses of another, to test how
+// its users handle failing hardware
+type Faulty struct {
+	BlockDevice
+	mu       sync.Mutex
+	faults   Faults
+	bad      map[int64]bool
+	rand     *rand.Rand
+	injected int
+}
+
+// Inject returns a device injecting faults into d, chosen by a random
+// source seeded with seed so that the faults can be reproduced
+func Inject(d BlockDevice, f Faults, seed int64) *Faulty {
+	bad := make(map[int64]bool)
+	for _, s := range f.BadSectors {
+		bad[s] = true
+	}
+	return &Faulty{BlockDevice: d, faults: f, bad: bad, rand: rand.New(rand.NewSource(seed))}
+}
+
+// Injected returns the number of faults injected
+func (f *Faulty) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+// fail reports whether to inject a fault of probability p
+func (f *Faulty) fail(p float64) bool {
+	if p > 0 && f.rand.Float64() < p {
+		f.injected++
+		return true
+	}
+	return false
+}
+
+// badSector returns the number of sectors of an access before its first bad
+// one, or -1 if there is none
+func (f *Faulty) badSector(b []byte, off int64) int {
+	size := int64(f.SectorSize())
+	for i := int64(0); i < int64(len(b))/size; i++ {
+		if f.bad[off/size+i] {
+			return int(i)
+		}
+	}
+	return -1
+}
+
+func (f *Faulty) ReadAt(b []byte, off int64) (int, error) {
+	if err := check(f, b, off); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail(f.faults.ReadError) {
+		return 0, ErrIO
+	}
+	if i := f.badSector(b, off); i >= 0 {
+		f.injected++
+		n, _ := f.BlockDevice.ReadAt(b[:i*f.SectorSize()], off)
+		return n, ErrIO
+	}
+	return f.BlockDevice.ReadAt(b, off)
+}
+
+func (f *Faulty) WriteAt(b []byte, off int64) (int, error) {
+	if err := check(f, b, off); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail(f.faults.WriteError) {
+		return 0, ErrIO
+	}
+	sectors := len(b) / f.SectorSize()
+	if i := f.badSector(b, off); i >= 0 {
+		f.injected++
+		sectors = i
+	} else if sectors > 0 && f.fail(f.faults.TornWrite) {
+		sectors = f.rand.Intn(sectors)
+	} else {
+		return f.BlockDevice.WriteAt(b, off)
+	}
+	n, _ := f.BlockDevice.WriteAt(b[:sectors*f.SectorSize()], off)
+	return n, ErrIO
+}
+
+func (f *Faulty) Flush() error {
+	f.mu.Lock()
+	fail := f.fail(f.faults.FlushError)
+	f.mu.Unlock()
+	if fail {
+		return ErrIO
+	}
+	return f.BlockDevice.Flush()
+}
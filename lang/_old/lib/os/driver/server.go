@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"errors"
+	"github.com/vvanpo/system/lang/lib/os/cache"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A Server serves block devices as files, named by path, so that processes
+// can bind them into their namespaces.  It is a bytelang.StoreServer, whose
+// files are read and written through the cache of the VM.
+type Server struct {
+	devices map[string]BlockDevice
+}
+
+var errNotExist = errors.New("driver: no such device")
+
+// NewServer serves devices named by their paths on the server
+func NewServer(devices map[string]BlockDevice) *Server {
+	s := &Server{make(map[string]BlockDevice)}
+	for name, d := range devices {
+		s.devices[path.Clean("/"+name)] = d
+	}
+	return s
+}
+
+func (s *Server) device(p string) (BlockDevice, error) {
+	d, ok := s.devices[path.Clean("/"+p)]
+	if !ok {
+		return nil, errNotExist
+	}
+	return d, nil
+}
+
+func (s *Server) Walk(p string) (exists bool, err error) {
+	p = path.Clean("/" + p)
+	for name := range s.devices {
+		if name == p || p == "/" || strings.HasPrefix(name, p+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Server) List(dir string) (names []string, err error) {
+	dir = path.Clean("/" + dir)
+	seen := make(map[string]bool)
+	for name := range s.devices {
+		rel := strings.TrimPrefix(name, dir)
+		if dir != "/" {
+			if rel == name || rel == "" || rel[0] != '/' {
+				continue
+			}
+			rel = rel[1:]
+		}
+		if i := strings.Index(rel, "/"); i >= 0 {
+			rel = rel[:i]
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (s *Server) Create(p string) error {
+	return errors.New("driver: devices cannot be created")
+}
+
+// Read returns the contents of a device
+func (s *Server) Read(p string) ([]byte, error) {
+	d, err := s.device(p)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, d.Length())
+	if _, err := d.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Store returns a device as a cache.FixedStore
+func (s *Server) Store(p string) (cache.Store, error) {
+	d, err := s.device(p)
+	if err != nil {
+		return nil, err
+	}
+	return Bytes{d}, nil
+}
+
+// Bytes adapts a block device to accesses of any alignment, by reading and
+// writing the whole sectors they touch.  It is a cache.FixedStore, and a
+// cache.FlushStore that flushes the device.
+type Bytes struct {
+	BlockDevice
+}
+
+func (b Bytes) Fixed() {}
+
+func (b Bytes) Size() int64 {
+	return b.Length()
+}
+
+// sectors returns the offset and a buffer of the sectors holding a range
+func (b Bytes) sectors(length int, off int64) (int64, []byte) {
+	size := int64(b.SectorSize())
+	start := off / size * size
+	end := (off + int64(length) + size - 1) / size * size
+	return start, make([]byte, end-start)
+}
+
+func (b Bytes) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrAlignment
+	}
+	if off >= b.Length() {
+		return 0, io.EOF
+	}
+	if rest := b.Length() - off; int64(len(p)) > rest {
+		p, err = p[:rest], io.EOF
+	}
+	start, buf := b.sectors(len(p), off)
+	if _, rerr := b.BlockDevice.ReadAt(buf, start); rerr != nil {
+		return 0, rerr
+	}
+	return copy(p, buf[off-start:]), err
+}
+
+func (b Bytes) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrAlignment
+	}
+	if off+int64(len(p)) > b.Length() {
+		return 0, ErrRange
+	}
+	start, buf := b.sectors(len(p), off)
+	size, last := int64(b.SectorSize()), int64(len(buf))-int64(b.SectorSize())
+	// Only the first and last sectors can be partly written
+	partFirst := off != start
+	partLast := off+int64(len(p)) != start+int64(len(buf))
+	if partFirst {
+		if _, err = b.BlockDevice.ReadAt(buf[:size], start); err != nil {
+			return
+		}
+	}
+	if partLast && (last > 0 || !partFirst) {
+		if _, err = b.BlockDevice.ReadAt(buf[last:], start+last); err != nil {
+			return
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err = b.BlockDevice.WriteAt(buf, start); err != nil {
+		return
+	}
+	return len(p), nil
+}
@@ -0,0 +1,390 @@
+package elf
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/bytelang"
+	"sort"
+)
+
+// Debug is the source information of a native object, written as DWARF
+type Debug struct {
+	Name      string            // Source file
+	Directory string            // Compilation directory
+	Positions map[uint]Position // Source positions of statements, by bytecode offset
+	Variables []Variable
+}
+
+// A Position is a line and column of the source, counting from 1
+type Position struct {
+	Line, Column uint
+}
+
+// A Variable is a named allocation of a function's frame
+type Variable struct {
+	Name     string
+	Function uint  // Bytecode offset of the function
+	Offset   int64 // Offset from the frame pointer
+	Length   uint
+}
+
+// DWARF forms
+const (
+	formAddr      = 0x01
+	formData1     = 0x0b
+	formData2     = 0x05
+	formData4     = 0x06
+	formString    = 0x08
+	formUdata     = 0x0f
+	formRef4      = 0x13
+	formSecOffset = 0x17
+	formExprloc   = 0x18
+)
+
+const (
+	langLoUser     = 0x8000
+	ateUnsigned    = 0x08
+	endBig         = 0x01
+	opFbreg        = 0x91
+	opBreg0        = 0x70
+	cfaDefCfa      = 0x0c
+	cfaOffset      = 0x80
+	lnsCopy        = 0x01
+	lnsAdvancePC   = 0x02
+	lnsAdvanceLine = 0x03
+	lnsColumn      = 0x05
+	lneEnd         = 0x01
+	lneAddress     = 0x02
+)
+
+// Abbreviation codes of the debugging information entries
+const (
+	abbrevUnit = iota + 1
+	abbrevBase
+	abbrevArray
+	abbrevSubrange
+	abbrevFunction
+	abbrevVariable
+)
+
+var abbrevs = []struct {
+	tag      dwarf.Tag
+	children bool
+	attrs    [][2]uint64
+}{
+	abbrevUnit: {dwarf.TagCompileUnit, true, [][2]uint64{
+		{uint64(dwarf.AttrProducer), formString},
+		{uint64(dwarf.AttrLanguage), formData2},
+		{uint64(dwarf.AttrName), formString},
+		{uint64(dwarf.AttrCompDir), formString},
+		{uint64(dwarf.AttrLowpc), formAddr},
+		{uint64(dwarf.AttrHighpc), formData4},
+		{uint64(dwarf.AttrStmtList), formSecOffset},
+	}},
+	abbrevBase: {dwarf.TagBaseType, false, [][2]uint64{
+		{uint64(dwarf.AttrName), formString},
+		{uint64(dwarf.AttrEncoding), formData1},
+		{uint64(dwarf.AttrByteSize), formData1},
+		{uint64(dwarf.AttrEndianity), formData1},
+	}},
+	abbrevArray: {dwarf.TagArrayType, true, [][2]uint64{
+		{uint64(dwarf.AttrType), formRef4},
+	}},
+	abbrevSubrange: {dwarf.TagSubrangeType, false, [][2]uint64{
+		{uint64(dwarf.AttrCount), formUdata},
+	}},
+	abbrevFunction: {dwarf.TagSubprogram, true, [][2]uint64{
+		{uint64(dwarf.AttrName), formString},
+		{uint64(dwarf.AttrLowpc), formAddr},
+		{uint64(dwarf.AttrHighpc), formData4},
+		{uint64(dwarf.AttrFrameBase), formExprloc},
+	}},
+	abbrevVariable: {dwarf.TagVariable, false, [][2]uint64{
+		{uint64(dwarf.AttrName), formString},
+		{uint64(dwarf.AttrType), formRef4},
+		{uint64(dwarf.AttrLocation), formExprloc},
+	}},
+}
+
+// A DWARF section under construction, with relocations against the symbols
+// of the object's sections
+type dwarfSection struct {
+	writer
+	name string
+	rels []relocation
+}
+
+func (s *dwarfSection) uleb(v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		s.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (s *dwarfSection) sleb(v int64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		done := v == 0 && b&0x40 == 0 || v == -1 && b&0x40 != 0
+		if !done {
+			b |= 0x80
+		}
+		s.WriteByte(b)
+		if done {
+			return
+		}
+	}
+}
+
+func (s *dwarfSection) str(v string) {
+	s.WriteString(v)
+	s.WriteByte(0)
+}
+
+// reloc writes a field of the given width, relocated against sym
+func (s *dwarfSection) reloc(typ uint32, width uint64, sym uint32, addend int64) {
+	s.rels = append(s.rels, relocation{uint64(s.Len()), typ, sym, width, addend})
+	s.Write(make([]byte, width))
+}
+
+// length writes a placeholder for a 4-byte length, returning a function that
+// sets it to the length of what follows
+func (s *dwarfSection) length() func() {
+	off := s.Len()
+	s.put(uint32(0))
+	return func() {
+		s.order.PutUint32(s.Bytes()[off:], uint32(s.Len()-off-4))
+	}
+}
+
+// A function of the object, along with those nested within it
+type dwarfFunction struct {
+	bytelang.Symbol
+	offset uint // Bytecode offset
+	nested []*dwarfFunction
+}
+
+// debugSections returns the sections of DWARF version 4 line, variable and
+// frame information for native code.  The section symbol of the text section
+// is at index 1, and those of the returned sections are from index 4.
+func (w *writer) debugSections(o *bytelang.Object, d *Debug, m elf.Machine) (sections []*dwarfSection, err error) {
+	for _, name := range []string{".debug_abbrev", ".debug_info", ".debug_line", ".debug_frame"} {
+		sections = append(sections, &dwarfSection{writer: writer{order: w.order, class: w.class}, name: name})
+	}
+	abbrev, info, line, frame := sections[0], sections[1], sections[2], sections[3]
+	const textSym, abbrevSym, lineSym, frameSym = 1, 4, 6, 7
+	abs32, err := relocationType(m, lang.RelAbs32)
+	if err != nil {
+		return
+	}
+	addrType, addrWidth := abs32, uint64(4)
+	if w.class == elf.ELFCLASS64 {
+		addrWidth = 8
+		if addrType, err = relocationType(m, lang.RelAbs64); err != nil {
+			return
+		}
+	}
+	addr := func(s *dwarfSection, v uint) { s.reloc(addrType, addrWidth, textSym, int64(v)) }
+	// DWARF numbers of the frame pointer and instruction pointer
+	fp, ip := uint64(6), uint64(16)
+	if m == elf.EM_386 {
+		fp, ip = 5, 8
+	}
+
+	for code, a := range abbrevs[1:] {
+		abbrev.uleb(uint64(code + 1))
+		abbrev.uleb(uint64(a.tag))
+		if a.children {
+			abbrev.WriteByte(1)
+		} else {
+			abbrev.WriteByte(0)
+		}
+		for _, attr := range a.attrs {
+			abbrev.uleb(attr[0])
+			abbrev.uleb(attr[1])
+		}
+		abbrev.uleb(0)
+		abbrev.uleb(0)
+	}
+	abbrev.WriteByte(0)
+
+	// Line number program, with a row for each statement
+	end := line.length()
+	line.put(uint16(4))
+	header := line.length()
+	line.Write([]byte{1, 1, 1, 0xfb, 14, 13}) // Minimum instruction length, maximum operations, is_stmt, line base, line range, opcode base
+	line.Write([]byte{0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1})
+	line.WriteByte(0) // No include directories
+	line.str(d.Name)
+	line.Write([]byte{0, 0, 0, 0})
+	header()
+	lines := append([]bytelang.Line{}, o.Lines...)
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address })
+	if len(lines) > 0 {
+		line.Write([]byte{0, byte(1 + addrWidth), lneAddress})
+		addr(line, lines[0].Address)
+		address, row, col := lines[0].Address, uint(1), uint(0)
+		for _, l := range lines {
+			pos, ok := d.Positions[l.Offset]
+			if d.Positions == nil {
+				pos, ok = Position{Line: l.Offset + 1}, true
+			}
+			if !ok {
+				continue
+			}
+			line.WriteByte(lnsAdvancePC)
+			line.uleb(uint64(l.Address - address))
+			line.WriteByte(lnsAdvanceLine)
+			line.sleb(int64(pos.Line) - int64(row))
+			if pos.Column != col {
+				line.WriteByte(lnsColumn)
+				line.uleb(uint64(pos.Column))
+			}
+			line.WriteByte(lnsCopy)
+			address, row, col = l.Address, pos.Line, pos.Column
+		}
+		line.WriteByte(lnsAdvancePC)
+		line.uleb(uint64(uint(len(o.Text)) - address))
+		line.Write([]byte{0, 1, lneEnd})
+	}
+	end()
+
+	// Debugging information: the compilation unit, types, then functions
+	// nested by their address ranges
+	end = info.length()
+	info.put(uint16(4))
+	info.reloc(abs32, 4, abbrevSym, 0)
+	info.WriteByte(byte(addrWidth))
+	info.uleb(abbrevUnit)
+	info.str("bytelang")
+	info.put(uint16(langLoUser))
+	info.str(d.Name)
+	info.str(d.Directory)
+	addr(info, 0)
+	info.put(uint32(len(o.Text)))
+	info.reloc(abs32, 4, lineSym, 0)
+	types := make(map[uint]uint32)
+	typeOf := func(n uint) uint32 {
+		if t, ok := types[n]; ok {
+			return t
+		}
+		types[n] = uint32(info.Len())
+		switch n {
+		case 1, 2, 4, 8:
+			info.uleb(abbrevBase)
+			info.str(fmt.Sprintf("uint%d", 8*n))
+			info.Write([]byte{ateUnsigned, byte(n), endBig})
+		default:
+			info.uleb(abbrevArray)
+			info.put(types[1])
+			info.uleb(abbrevSubrange)
+			info.uleb(uint64(n))
+			info.WriteByte(0)
+		}
+		return types[n]
+	}
+	typeOf(1)
+	var functions []*dwarfFunction
+	for _, s := range o.Symbols {
+		var off uint
+		if _, err := fmt.Sscanf(s.Name, "function.%d", &off); err == nil && s.Function && s.Section == bytelang.Text {
+			functions = append(functions, &dwarfFunction{Symbol: s, offset: off})
+		}
+	}
+	for _, v := range d.Variables {
+		if v.Length > 0 {
+			typeOf(v.Length)
+		}
+	}
+	typeOf(8)
+	sort.SliceStable(functions, func(i, j int) bool {
+		a, b := functions[i], functions[j]
+		return a.Value < b.Value || a.Value == b.Value && a.Size > b.Size
+	})
+	var outer []*dwarfFunction
+	var stack []*dwarfFunction
+	for _, f := range functions {
+		for len(stack) > 0 && f.Value >= stack[len(stack)-1].Value+stack[len(stack)-1].Size {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			outer = append(outer, f)
+		} else {
+			p := stack[len(stack)-1]
+			p.nested = append(p.nested, f)
+		}
+		stack = append(stack, f)
+	}
+	variable := func(name string, n uint, offset int64) {
+		info.uleb(abbrevVariable)
+		info.str(name)
+		info.put(typeOf(n))
+		loc := &dwarfSection{}
+		loc.WriteByte(opFbreg)
+		loc.sleb(offset)
+		info.uleb(uint64(loc.Len()))
+		info.Write(loc.Bytes())
+	}
+	var function func(f *dwarfFunction)
+	function = func(f *dwarfFunction) {
+		info.uleb(abbrevFunction)
+		info.str(f.Name)
+		addr(info, f.Value)
+		info.put(uint32(f.Size))
+		info.Write([]byte{2, byte(opBreg0 + fp), 0})
+		variable("status", 8, 8)
+		for _, v := range d.Variables {
+			if v.Function == f.offset && v.Length > 0 {
+				variable(v.Name, v.Length, v.Offset)
+			}
+		}
+		for _, n := range f.nested {
+			function(n)
+		}
+		info.WriteByte(0)
+	}
+	for _, f := range outer {
+		function(f)
+	}
+	info.WriteByte(0)
+	end()
+
+	// Call frame information: the frame pointer of a function is the stack
+	// pointer of its caller, below which are the return address and saved
+	// frame pointer
+	end = frame.length()
+	frame.put(uint32(0xffffffff))
+	frame.WriteByte(3)
+	frame.WriteByte(0) // No augmentation
+	frame.uleb(1)
+	frame.sleb(-int64(addrWidth))
+	frame.uleb(ip)
+	frame.Write([]byte{cfaDefCfa, byte(fp), 0})
+	frame.Write([]byte{cfaOffset | byte(ip), 1})
+	frame.Write([]byte{cfaOffset | byte(fp), 0})
+	for frame.Len()%int(addrWidth) != 0 {
+		frame.WriteByte(0)
+	}
+	end()
+	for _, f := range outer {
+		end := frame.length()
+		frame.reloc(abs32, 4, frameSym, 0)
+		addr(frame, f.Value)
+		if addrWidth == 8 {
+			frame.put(uint64(f.Size))
+		} else {
+			frame.put(uint32(f.Size))
+		}
+		end()
+	}
+	return
+}
@@ -0,0 +1,270 @@
+package elf
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/asmlang"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// double calls a function nested within the global one
+const double = `
+allocate 16
+store rel sp 0 literal 6
+store bytes 0 rel sp 0 call double
+store rel fp 8 load rel sp 0
+deallocate 16
+double:
+function
+	allocate 8
+	store rel sp 0 literal 2
+	allocate 8
+	store rel sp 0 load rel fp 8
+	store rel fp 8 mult
+	return
+end
+`
+
+// compile returns the native objects of double for each architecture
+func compile(t *testing.T) []*bytelang.Object {
+	b, err := asmlang.Assemble(double)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o64, err := b.CompileAMD64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o32, err := b.CompileI386()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*bytelang.Object{o64, o32}
+}
+
+// functions returns the bytecode offsets of the functions of an object, by
+// symbol name
+func functions(o *bytelang.Object) map[string]uint {
+	fs := make(map[string]uint)
+	for _, s := range o.Symbols {
+		var off uint
+		if _, err := fmt.Sscanf(s.Name, "function.%d", &off); err == nil {
+			fs[s.Name] = off
+		}
+	}
+	return fs
+}
+
+func symbols(o *bytelang.Object) map[string]bytelang.Symbol {
+	m := make(map[string]bytelang.Symbol)
+	for _, s := range o.Symbols {
+		m[s.Name] = s
+	}
+	return m
+}
+
+// debugInfo places the statements of an object on lines from 10, and gives
+// each function a variable
+func debugInfo(o *bytelang.Object) *Debug {
+	d := &Debug{Name: "double.sys", Directory: "/src", Positions: make(map[uint]Position)}
+	for _, l := range o.Lines {
+		d.Positions[l.Offset] = Position{Line: 10 + l.Offset, Column: 3}
+	}
+	for _, off := range functions(o) {
+		if off == 0 {
+			d.Variables = append(d.Variables, Variable{Name: "pair", Function: off, Offset: -16, Length: 16})
+		} else {
+			d.Variables = append(d.Variables, Variable{Name: "n", Function: off, Offset: 8, Length: 8})
+		}
+	}
+	return d
+}
+
+func readDWARF(t *testing.T, o *bytelang.Object, d *Debug) (*elf.File, *dwarf.Data) {
+	r, err := WriteObject(o, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw, err := f.DWARF()
+	if err != nil {
+		t.Fatalf("%s: %v", o.Arch, err)
+	}
+	return f, dw
+}
+
+func TestDWARFInfo(t *testing.T) {
+	for _, o := range compile(t) {
+		d := debugInfo(o)
+		_, dw := readDWARF(t, o, d)
+		fp := map[string]byte{"amd64": 6, "386": 5}[o.Arch]
+		syms := symbols(o)
+
+		r := dw.Reader()
+		cu, err := r.Next()
+		if err != nil || cu.Tag != dwarf.TagCompileUnit {
+			t.Fatalf("%s: first entry %v, %v", o.Arch, cu, err)
+		}
+		if cu.Val(dwarf.AttrName) != "double.sys" || cu.Val(dwarf.AttrCompDir) != "/src" ||
+			cu.Val(dwarf.AttrLowpc) != uint64(0) || cu.Val(dwarf.AttrHighpc) != int64(len(o.Text)) {
+			t.Errorf("%s: compilation unit %+v", o.Arch, cu)
+		}
+
+		// Functions by name, and the variables and parent of each.  Entries
+		// with children, such as array types, end them with a null entry.
+		stack := []string{""} // The unit's children
+		parents := make(map[string]string)
+		variables := make(map[string][]string)
+		for {
+			e, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e == nil {
+				break
+			}
+			name, _ := e.Val(dwarf.AttrName).(string)
+			switch e.Tag {
+			case 0:
+				stack = stack[:len(stack)-1]
+			case dwarf.TagSubprogram:
+				s, ok := syms[name]
+				if !ok || e.Val(dwarf.AttrLowpc) != uint64(s.Value) || e.Val(dwarf.AttrHighpc) != int64(s.Size) {
+					t.Errorf("%s: function %+v, symbol %+v", o.Arch, e, s)
+				}
+				if base := e.Val(dwarf.AttrFrameBase); !bytes.Equal(base.([]byte), []byte{opBreg0 + fp, 0}) {
+					t.Errorf("%s: %s has frame base % x", o.Arch, name, base)
+				}
+				parents[name] = stack[len(stack)-1]
+			case dwarf.TagVariable:
+				typ, err := dw.Type(e.Val(dwarf.AttrType).(dwarf.Offset))
+				if err != nil {
+					t.Fatal(err)
+				}
+				fn := stack[len(stack)-1]
+				variables[fn] = append(variables[fn], fmt.Sprintf("%s %s % x", name, typ, e.Val(dwarf.AttrLocation)))
+			}
+			if e.Children {
+				if e.Tag != dwarf.TagSubprogram {
+					name = ""
+				}
+				stack = append(stack, name)
+			}
+		}
+
+		fs := functions(o)
+		if len(fs) != 2 {
+			t.Fatalf("%s: functions %v", o.Arch, fs)
+		}
+		for name, off := range fs {
+			var want []string
+			if off == 0 {
+				want = []string{"status uint64 91 08", "pair [16]uint8 91 70"}
+				if p := parents[name]; p != "" {
+					t.Errorf("%s: global function nested in %s", o.Arch, p)
+				}
+			} else {
+				want = []string{"status uint64 91 08", "n uint64 91 08"}
+				if parents[name] != "function.0" {
+					t.Errorf("%s: %s nested in %q", o.Arch, name, parents[name])
+				}
+			}
+			if strings.Join(variables[name], "; ") != strings.Join(want, "; ") {
+				t.Errorf("%s: %s has variables %q, want %q", o.Arch, name, variables[name], want)
+			}
+		}
+	}
+}
+
+func TestDWARFLines(t *testing.T) {
+	for _, o := range compile(t) {
+		lines := append([]bytelang.Line{}, o.Lines...)
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address })
+		// Without positions, the line of a statement is its bytecode offset
+		// plus one
+		for _, d := range []*Debug{debugInfo(o), {Name: "double.sys"}} {
+			_, dw := readDWARF(t, o, d)
+			cu, _ := dw.Reader().Next()
+			lr, err := dw.LineReader(cu)
+			if err != nil || lr == nil {
+				t.Fatalf("%s: line reader %v", o.Arch, err)
+			}
+			var rows []dwarf.LineEntry
+			for {
+				var e dwarf.LineEntry
+				if err := lr.Next(&e); err != nil {
+					break
+				}
+				rows = append(rows, e)
+			}
+			if len(rows) != len(lines)+1 {
+				t.Fatalf("%s: %d rows for %d lines", o.Arch, len(rows), len(lines))
+			}
+			for i, l := range lines {
+				want := Position{Line: l.Offset + 1}
+				if d.Positions != nil {
+					want = d.Positions[l.Offset]
+				}
+				e := rows[i]
+				if e.Address != uint64(l.Address) || e.Line != int(want.Line) || e.Column != int(want.Column) || !strings.HasSuffix(e.File.Name, "double.sys") {
+					t.Errorf("%s: row %d is %#x %s:%d:%d, want %#x line %d column %d", o.Arch, i, e.Address, e.File.Name, e.Line, e.Column, l.Address, want.Line, want.Column)
+				}
+			}
+			if end := rows[len(rows)-1]; !end.EndSequence || end.Address != uint64(len(o.Text)) {
+				t.Errorf("%s: sequence ends with %+v", o.Arch, end)
+			}
+		}
+	}
+}
+
+// Go's debug/dwarf does not decode call frame information, so readelf checks
+// that each outermost function has a frame description
+func TestDWARFFrames(t *testing.T) {
+	if _, err := exec.LookPath("readelf"); err != nil {
+		t.Skip("readelf is not installed")
+	}
+	dir := t.TempDir()
+	for _, o := range compile(t) {
+		r, err := WriteObject(o, debugInfo(o))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, r.Size())
+		r.ReadAt(b, 0)
+		name := filepath.Join(dir, o.Arch+".o")
+		if err := os.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("readelf", "--debug-dump=frames", name)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil || stderr.Len() > 0 {
+			t.Fatalf("%s: readelf: %v\n%s", o.Arch, err, stderr.String())
+		}
+		f := symbols(o)["function.0"]
+		width := map[string]int{"amd64": 16, "386": 8}[o.Arch]
+		fde := fmt.Sprintf("FDE cie=00000000 pc=%0*x..%0*x", width, f.Value, width, f.Value+f.Size)
+		if n := strings.Count(string(out), " FDE "); n != 1 || !strings.Contains(string(out), fde) {
+			t.Errorf("%s: frame descriptions lack %q:\n%s", o.Arch, fde, out)
+		}
+		fp := map[string]string{"amd64": "r6 (rbp)", "386": "r5 (ebp)"}[o.Arch]
+		for _, want := range []string{"DW_CFA_def_cfa: " + fp + " ofs 0", "DW_CFA_offset: " + fp + " at cfa+0"} {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("%s: frames lack %q:\n%s", o.Arch, want, out)
+			}
+		}
+	}
+}
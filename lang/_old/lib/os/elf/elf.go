@@ -5,27 +5,637 @@ package elf
 import (
 	"bytes"
 	"debug/elf"
+	"encoding/binary"
+	"fmt"
 	"github.com/vvanpo/system/lang"
 	"io"
+	"sort"
 )
 
+// Read an executable made by Write back into a file.  Files of other
+// toolchains, which lack the code, data and stack sections of the segment
+// model or use other machines and relocations, are rejected, as are files
+// whose loadable segments overlap or fall outside the file, and files whose
+// symbols or relocations fall outside their segments.
 func Read(r io.ReaderAt) (file *lang.File, err error) {
-/*	f, err := elf.NewFile(r)
+	f, err := elf.NewFile(r)
 	if err != nil {
+		return nil, fmt.Errorf("elf: %v", err)
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("elf: %v is not an executable", f.Type)
+	}
+	if f.Machine != elf.EM_X86_64 && f.Machine != elf.EM_386 {
+		return nil, fmt.Errorf("elf: unsupported machine %v", f.Machine)
+	}
+	if (f.Machine == elf.EM_X86_64) != (f.Class == elf.ELFCLASS64) {
+		return nil, fmt.Errorf("elf: machine %v in class %v", f.Machine, f.Class)
+	}
+	if err = checkPrograms(f); err != nil {
+		return
+	}
+	file = new(lang.File)
+	segments := make(map[elf.SectionIndex]lang.Segment)
+	for _, seg := range []lang.Segment{lang.CodeSegment, lang.DataSegment, lang.StackSegment} {
+		name := segmentName[seg]
+		s := f.Section(name)
+		if s == nil {
+			return nil, fmt.Errorf("elf: missing section %s", name)
+		}
+		segments[sectionIndex(f, s)] = seg
+		switch seg {
+		case lang.CodeSegment:
+			file.Code, err = sectionData(s)
+		case lang.DataSegment:
+			file.Data, err = sectionData(s)
+		case lang.StackSegment:
+			if s.Type != elf.SHT_NOBITS {
+				return nil, fmt.Errorf("elf: section %s has contents", name)
+			}
+			file.Stack = uint(s.Size)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if f.Entry >= uint64(len(file.Code)) {
+		return nil, fmt.Errorf("elf: entry point %#x outside the code segment", f.Entry)
+	}
+	file.Entry = uint(f.Entry)
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("elf: %v", err)
+	}
+	if file.Symbols, err = readSymbols(file, symbols, segments); err != nil {
 		return
 	}
-	d := f.fileHeader.Data
-	c := f.fileHeader.Class
-	m := f.fileHeader.Machine
-*/	file = new(lang.File)
-	// To return lang code format
+	if file.Relocations, err = readRelocations(f, file.Code, symbols, segments); err != nil {
+		return
+	}
+	if s := f.Section(".bytelang"); s != nil {
+		if file.Bytelang, err = sectionData(s); err != nil {
+			return
+		}
+	}
+	if s := f.Section(".metadata"); s != nil {
+		var b []byte
+		if b, err = sectionData(s); err != nil {
+			return
+		}
+		if file.Metadata, err = readMetadata(b); err != nil {
+			return
+		}
+	}
 	return
 }
 
-func Write(f lang.File, d elf.Data, c elf.Class, m elf.Machine) (r *bytes.Reader) {
-	var b []byte
-	b = append(b, elf.ELFMAG...)
-	r = bytes.NewReader(b)
+// checkPrograms rejects loadable segments that overlap in the file, store
+// more than they load, or lie past the end of the file
+func checkPrograms(f *elf.File) error {
+	var loads []*elf.Prog
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if p.Filesz > p.Memsz {
+			return fmt.Errorf("elf: segment at %#x stores more than it loads", p.Off)
+		}
+		if p.Off+p.Filesz < p.Off {
+			return fmt.Errorf("elf: segment at %#x outside the file", p.Off)
+		}
+		if p.Filesz > 0 {
+			if _, err := p.ReadAt(make([]byte, 1), int64(p.Filesz-1)); err != nil {
+				return fmt.Errorf("elf: segment at %#x outside the file", p.Off)
+			}
+		}
+		loads = append(loads, p)
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].Off < loads[j].Off })
+	for i := 1; i < len(loads); i++ {
+		if prev := loads[i-1]; loads[i].Off < prev.Off+prev.Filesz {
+			return fmt.Errorf("elf: segment at %#x overlaps the segment at %#x", loads[i].Off, prev.Off)
+		}
+	}
+	return nil
+}
+
+var segmentName = map[lang.Segment]string{
+	lang.CodeSegment:  ".text",
+	lang.DataSegment:  ".data",
+	lang.StackSegment: ".stack",
+}
+
+func sectionIndex(f *elf.File, s *elf.Section) elf.SectionIndex {
+	for i := range f.Sections {
+		if f.Sections[i] == s {
+			return elf.SectionIndex(i)
+		}
+	}
+	return elf.SHN_UNDEF
+}
+
+func sectionData(s *elf.Section) (b []byte, err error) {
+	if b, err = s.Data(); err != nil {
+		return nil, fmt.Errorf("elf: section %s: %v", s.Name, err)
+	}
 	return
 }
 
+// segmentLength returns the length of a segment of a file
+func segmentLength(file *lang.File, seg lang.Segment) uint {
+	switch seg {
+	case lang.CodeSegment:
+		return uint(len(file.Code))
+	case lang.DataSegment:
+		return uint(len(file.Data))
+	}
+	return file.Stack
+}
+
+// readSymbols lifts the symbols defined in the segments, skipping the
+// section symbols
+func readSymbols(file *lang.File, symbols []elf.Symbol, segments map[elf.SectionIndex]lang.Segment) (s []lang.Symbol, err error) {
+	for _, sym := range symbols {
+		typ, bind := elf.ST_TYPE(sym.Info), elf.ST_BIND(sym.Info)
+		if typ == elf.STT_SECTION {
+			continue
+		}
+		seg, ok := segments[sym.Section]
+		if !ok {
+			return nil, fmt.Errorf("elf: symbol %s outside the segments", sym.Name)
+		}
+		if sym.Value+sym.Size < sym.Value || sym.Value+sym.Size > uint64(segmentLength(file, seg)) {
+			return nil, fmt.Errorf("elf: symbol %s overruns section %s", sym.Name, segmentName[seg])
+		}
+		if typ != elf.STT_FUNC && typ != elf.STT_OBJECT && typ != elf.STT_NOTYPE {
+			return nil, fmt.Errorf("elf: symbol %s has unsupported type %v", sym.Name, typ)
+		}
+		if bind != elf.STB_LOCAL && bind != elf.STB_GLOBAL {
+			return nil, fmt.Errorf("elf: symbol %s has unsupported binding %v", sym.Name, bind)
+		}
+		s = append(s, lang.Symbol{
+			Name:     sym.Name,
+			Segment:  seg,
+			Value:    uint(sym.Value),
+			Size:     uint(sym.Size),
+			Function: typ == elf.STT_FUNC,
+			Global:   bind == elf.STB_GLOBAL,
+		})
+	}
+	return
+}
+
+// readRelocations lifts the relocations of the code segment, which must be
+// against the section symbol of a segment.  Addends stored in place are
+// cleared from code.
+func readRelocations(f *elf.File, code []byte, symbols []elf.Symbol, segments map[elf.SectionIndex]lang.Segment) (r []lang.Relocation, err error) {
+	s := f.Section(".rela.text")
+	if f.Class == elf.ELFCLASS32 {
+		s = f.Section(".rel.text")
+	}
+	if s == nil {
+		return
+	}
+	b, err := sectionData(s)
+	if err != nil {
+		return
+	}
+	size := map[elf.Class]int{elf.ELFCLASS32: 8, elf.ELFCLASS64: 24}[f.Class]
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("elf: section %s has a partial entry", s.Name)
+	}
+	for ; len(b) > 0; b = b[size:] {
+		var rel lang.Relocation
+		var sym, typ uint32
+		var off uint64
+		if f.Class == elf.ELFCLASS32 {
+			var e elf.Rel32
+			binary.Read(bytes.NewReader(b), f.ByteOrder, &e)
+			off, sym, typ = uint64(e.Off), elf.R_SYM32(e.Info), elf.R_TYPE32(e.Info)
+		} else {
+			var e elf.Rela64
+			binary.Read(bytes.NewReader(b), f.ByteOrder, &e)
+			off, sym, typ = e.Off, elf.R_SYM64(e.Info), elf.R_TYPE64(e.Info)
+			rel.Addend = e.Addend
+		}
+		if rel.Type, err = langRelocationType(f.Machine, typ); err != nil {
+			return
+		}
+		width := uint64(4)
+		if rel.Type == lang.RelAbs64 {
+			width = 8
+		}
+		if off+width < off || off+width > uint64(len(code)) {
+			return nil, fmt.Errorf("elf: relocation at %#x outside the code segment", off)
+		}
+		rel.Offset = uint(off)
+		// Symbols omits the null symbol
+		if sym == 0 || int(sym) > len(symbols) || elf.ST_TYPE(symbols[sym-1].Info) != elf.STT_SECTION {
+			return nil, fmt.Errorf("elf: relocation at %#x not against a segment", off)
+		}
+		seg, ok := segments[symbols[sym-1].Section]
+		if !ok {
+			return nil, fmt.Errorf("elf: relocation at %#x not against a segment", off)
+		}
+		rel.Segment = seg
+		if f.Class == elf.ELFCLASS32 {
+			rel.Addend = int64(int32(f.ByteOrder.Uint32(code[off:])))
+			f.ByteOrder.PutUint32(code[off:], 0)
+		}
+		r = append(r, rel)
+	}
+	return
+}
+
+// langRelocationType is the inverse of relocationType
+func langRelocationType(m elf.Machine, typ uint32) (lang.RelocationType, error) {
+	for _, t := range []lang.RelocationType{lang.RelPC32, lang.RelAbs32, lang.RelAbs64} {
+		if r, err := relocationType(m, t); err == nil && r == typ {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("elf: unsupported relocation type %d for %v", typ, m)
+}
+
+func readMetadata(b []byte) (m map[string]string, err error) {
+	fields := bytes.Split(b, []byte{0})
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("elf: malformed section .metadata")
+	}
+	m = make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		m[string(fields[i])] = string(fields[i+1])
+	}
+	return
+}
+
+// A section of the output file, before its offset is known
+type section struct {
+	name    string
+	typ     elf.SectionType
+	flags   elf.SectionFlag
+	data    []byte
+	size    uint64 // Length of SHT_NOBITS sections
+	link    uint32
+	info    uint32
+	align   uint64
+	entsize uint64
+	offset  uint64
+}
+
+// A string table under construction
+type strtab struct {
+	data []byte
+	off  map[string]uint32
+}
+
+func newStrtab() *strtab {
+	return &strtab{data: []byte{0}, off: map[string]uint32{"": 0}}
+}
+
+func (s *strtab) add(name string) uint32 {
+	if off, ok := s.off[name]; ok {
+		return off
+	}
+	off := uint32(len(s.data))
+	s.data = append(append(s.data, name...), 0)
+	s.off[name] = off
+	return off
+}
+
+type writer struct {
+	bytes.Buffer
+	order binary.ByteOrder
+	class elf.Class
+}
+
+func (w *writer) put(v interface{}) {
+	binary.Write(&w.Buffer, w.order, v)
+}
+
+func (w *writer) align(n uint64) {
+	for uint64(w.Len())%n != 0 {
+		w.WriteByte(0)
+	}
+}
+
+// Section indices of the segments
+var segmentSection = map[lang.Segment]uint16{
+	lang.CodeSegment:  1,
+	lang.DataSegment:  2,
+	lang.StackSegment: 3,
+}
+
+// relocationType returns the machine's relocation type
+func relocationType(m elf.Machine, t lang.RelocationType) (uint32, error) {
+	switch {
+	case m == elf.EM_X86_64 && t == lang.RelPC32:
+		return uint32(elf.R_X86_64_PC32), nil
+	case m == elf.EM_X86_64 && t == lang.RelAbs32:
+		return uint32(elf.R_X86_64_32), nil
+	case m == elf.EM_X86_64 && t == lang.RelAbs64:
+		return uint32(elf.R_X86_64_64), nil
+	case m == elf.EM_386 && t == lang.RelPC32:
+		return uint32(elf.R_386_PC32), nil
+	case m == elf.EM_386 && t == lang.RelAbs32:
+		return uint32(elf.R_386_32), nil
+	}
+	return 0, fmt.Errorf("elf: relocation type %d unsupported for %v", t, m)
+}
+
+// Write an executable.  Following the segment-relative loader model, the
+// code, data and stack segments are described by program headers in that
+// order, each with a virtual address of zero; the entry point, which must lie
+// in the code, and the symbols and relocations are relative to their segment.  Relocations are stored in
+// .rela.text, or .rel.text with addends in place for 32-bit classes, and are
+// applied by the loader once it has chosen the segment base addresses.  Any
+// bytecode and metadata are kept in the unallocated .bytelang and .metadata
+// sections.
+func Write(f lang.File, d elf.Data, c elf.Class, m elf.Machine) (r *bytes.Reader, err error) {
+	w := &writer{class: c}
+	switch d {
+	case elf.ELFDATA2LSB:
+		w.order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		w.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("elf: invalid data encoding %v", d)
+	}
+	if c != elf.ELFCLASS32 && c != elf.ELFCLASS64 {
+		return nil, fmt.Errorf("elf: invalid class %v", c)
+	}
+	if f.Entry >= uint(len(f.Code)) {
+		return nil, fmt.Errorf("elf: entry point %#x outside the code segment", f.Entry)
+	}
+	code := append([]byte{}, f.Code...)
+	sections := []*section{
+		{},
+		{name: ".text", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, data: code, align: 16},
+		{name: ".data", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, data: f.Data, align: 16},
+		{name: ".stack", typ: elf.SHT_NOBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, size: uint64(f.Stack), align: 16},
+	}
+	var symbols []symbol
+	for _, s := range f.Symbols {
+		symbols = append(symbols, symbol{s.Name, symbolInfo(s.Global, s.Function), segmentSection[s.Segment], uint64(s.Value), uint64(s.Size)})
+	}
+	var relocations []relocation
+	for _, r := range f.Relocations {
+		typ, err := relocationType(m, r.Type)
+		if err != nil {
+			return nil, err
+		}
+		relocations = append(relocations, relocation{uint64(r.Offset), typ, uint32(segmentSection[r.Segment]), width(r.Type), r.Addend})
+	}
+	names := newStrtab()
+	symtab, locals, _ := w.symbols(symbols, 3, names)
+	rel, err := w.relocations(relocations, code, ".text", 1)
+	if err != nil {
+		return
+	}
+	if len(rel.data) > 0 {
+		sections = append(sections, rel)
+	}
+	if len(f.Bytelang) > 0 {
+		sections = append(sections, &section{name: ".bytelang", typ: elf.SHT_PROGBITS, data: f.Bytelang, align: 1})
+	}
+	if len(f.Metadata) > 0 {
+		sections = append(sections, &section{name: ".metadata", typ: elf.SHT_PROGBITS, data: metadata(f.Metadata), align: 1})
+	}
+	const phnum = 3
+	return w.file(elf.ET_EXEC, m, uint64(f.Entry), phnum, sections, symtab, locals, names, func() {
+		text, data, stack := sections[1], sections[2], sections[3]
+		w.program(elf.PF_R|elf.PF_X, text.offset, uint64(len(text.data)), uint64(len(text.data)), text.align)
+		w.program(elf.PF_R|elf.PF_W, data.offset, uint64(len(data.data)), uint64(len(data.data)), data.align)
+		w.program(elf.PF_R|elf.PF_W, data.offset+uint64(len(data.data)), 0, stack.size, stack.align)
+	}), nil
+}
+
+// file lays out and writes a file of the given sections, following them with
+// the symbol and string tables and linking any relocation sections to them.
+// programs writes phnum program headers, once the section offsets are known.
+func (w *writer) file(typ elf.Type, m elf.Machine, entry, phnum uint64, sections []*section, symtab []byte, locals uint32, names *strtab, programs func()) *bytes.Reader {
+	symIndex := uint32(len(sections))
+	for _, s := range sections {
+		if s.typ == elf.SHT_REL || s.typ == elf.SHT_RELA {
+			s.link = symIndex
+		}
+	}
+	sections = append(sections,
+		&section{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab, link: symIndex + 1, info: locals, align: w.size(4, 8), entsize: w.size(16, 24)},
+		&section{name: ".strtab", typ: elf.SHT_STRTAB, data: names.data, align: 1},
+		&section{name: ".shstrtab", typ: elf.SHT_STRTAB, align: 1},
+	)
+	shstrtab := newStrtab()
+	for _, s := range sections {
+		shstrtab.add(s.name)
+	}
+	sections[len(sections)-1].data = shstrtab.data
+
+	// Lay out the file: headers, section contents, then section headers
+	ehsize, phentsize, shentsize := w.size(52, 64), w.size(32, 56), w.size(40, 64)
+	off := ehsize + phnum*phentsize
+	for _, s := range sections[1:] {
+		off = (off + s.align - 1) / s.align * s.align
+		s.offset = off
+		off += uint64(len(s.data))
+	}
+	shoff := (off + 7) &^ 7
+
+	w.header(typ, m, entry, ehsize, phentsize, phnum, shoff, shentsize, len(sections), len(sections)-1)
+	if programs != nil {
+		programs()
+	}
+	for _, s := range sections[1:] {
+		w.align(s.align)
+		w.Write(s.data)
+	}
+	w.align(8)
+	for _, s := range sections {
+		w.section(s, shstrtab.add(s.name))
+	}
+	return bytes.NewReader(w.Bytes())
+}
+
+// metadata encodes name and value pairs as null-terminated strings, sorted by
+// name
+func metadata(m map[string]string) (b []byte) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b = append(append(b, name...), 0)
+		b = append(append(b, m[name]...), 0)
+	}
+	return
+}
+
+// size returns the size of a structure for the writer's class
+func (w *writer) size(size32, size64 uint64) uint64 {
+	if w.class == elf.ELFCLASS32 {
+		return size32
+	}
+	return size64
+}
+
+func (w *writer) header(typ elf.Type, m elf.Machine, entry, ehsize, phentsize, phnum, shoff, shentsize uint64, shnum, shstrndx int) {
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(w.class)
+	if w.order == binary.LittleEndian {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	} else {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	phoff := ehsize
+	if phnum == 0 {
+		phoff = 0
+	}
+	if w.class == elf.ELFCLASS32 {
+		w.put(elf.Header32{
+			Ident: ident, Type: uint16(typ), Machine: uint16(m),
+			Version: uint32(elf.EV_CURRENT), Entry: uint32(entry),
+			Phoff: uint32(phoff), Shoff: uint32(shoff), Ehsize: uint16(ehsize),
+			Phentsize: uint16(phentsize), Phnum: uint16(phnum),
+			Shentsize: uint16(shentsize), Shnum: uint16(shnum), Shstrndx: uint16(shstrndx),
+		})
+		return
+	}
+	w.put(elf.Header64{
+		Ident: ident, Type: uint16(typ), Machine: uint16(m),
+		Version: uint32(elf.EV_CURRENT), Entry: entry,
+		Phoff: phoff, Shoff: shoff, Ehsize: uint16(ehsize),
+		Phentsize: uint16(phentsize), Phnum: uint16(phnum),
+		Shentsize: uint16(shentsize), Shnum: uint16(shnum), Shstrndx: uint16(shstrndx),
+	})
+}
+
+// program writes the header of a loadable segment
+func (w *writer) program(flags elf.ProgFlag, off, filesz, memsz, align uint64) {
+	if w.class == elf.ELFCLASS32 {
+		w.put(elf.Prog32{
+			Type: uint32(elf.PT_LOAD), Off: uint32(off), Filesz: uint32(filesz),
+			Memsz: uint32(memsz), Flags: uint32(flags), Align: uint32(align),
+		})
+		return
+	}
+	w.put(elf.Prog64{
+		Type: uint32(elf.PT_LOAD), Flags: uint32(flags), Off: off,
+		Filesz: filesz, Memsz: memsz, Align: align,
+	})
+}
+
+func (w *writer) section(s *section, name uint32) {
+	size := uint64(len(s.data))
+	if s.typ == elf.SHT_NOBITS {
+		size = s.size
+	}
+	if w.class == elf.ELFCLASS32 {
+		w.put(elf.Section32{
+			Name: name, Type: uint32(s.typ), Flags: uint32(s.flags),
+			Off: uint32(s.offset), Size: uint32(size), Link: s.link, Info: s.info,
+			Addralign: uint32(s.align), Entsize: uint32(s.entsize),
+		})
+		return
+	}
+	w.put(elf.Section64{
+		Name: name, Type: uint32(s.typ), Flags: uint64(s.flags),
+		Off: s.offset, Size: size, Link: s.link, Info: s.info,
+		Addralign: s.align, Entsize: s.entsize,
+	})
+}
+
+// A symbol table entry
+type symbol struct {
+	name        string
+	info        byte
+	shndx       uint16
+	value, size uint64
+}
+
+func symbolInfo(global, function bool) byte {
+	bind, typ := elf.STB_LOCAL, elf.STT_OBJECT
+	if global {
+		bind = elf.STB_GLOBAL
+	}
+	if function {
+		typ = elf.STT_FUNC
+	}
+	return elf.ST_INFO(bind, typ)
+}
+
+// symbols encodes the symbol table: the null symbol, a section symbol for
+// each of the first sections, then the local and global symbols.  It also
+// returns the index of the first global symbol, and the index of each symbol
+// by name.
+func (w *writer) symbols(symbols []symbol, sections uint16, names *strtab) (b []byte, locals uint32, index map[string]uint32) {
+	sorted := append([]symbol{}, symbols...)
+	local := func(s symbol) bool { return elf.ST_BIND(s.info) == elf.STB_LOCAL }
+	sort.SliceStable(sorted, func(i, j int) bool { return local(sorted[i]) && !local(sorted[j]) })
+	sym := &writer{order: w.order, class: w.class}
+	entry := func(name uint32, info byte, shndx uint16, value, size uint64) {
+		if w.class == elf.ELFCLASS32 {
+			sym.put(elf.Sym32{Name: name, Value: uint32(value), Size: uint32(size), Info: info, Shndx: shndx})
+		} else {
+			sym.put(elf.Sym64{Name: name, Info: info, Shndx: shndx, Value: value, Size: size})
+		}
+	}
+	entry(0, 0, 0, 0, 0)
+	for i := uint16(1); i <= sections; i++ {
+		entry(0, elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), i, 0, 0)
+	}
+	locals = 1 + uint32(sections)
+	index = make(map[string]uint32)
+	for i, s := range sorted {
+		if local(s) {
+			locals++
+		}
+		index[s.name] = 1 + uint32(sections) + uint32(i)
+		entry(names.add(s.name), s.info, s.shndx, s.value, s.size)
+	}
+	return sym.Bytes(), locals, index
+}
+
+// A relocation of a section
+type relocation struct {
+	offset uint64
+	typ    uint32
+	sym    uint32
+	width  uint64 // Length of the patched field
+	addend int64
+}
+
+func width(t lang.RelocationType) uint64 {
+	if t == lang.RelAbs64 {
+		return 8
+	}
+	return 4
+}
+
+// relocations encodes the relocations of the section named target, at index
+// info.  32-bit classes store the addend in the patched field of data.
+func (w *writer) relocations(relocations []relocation, data []byte, target string, info uint32) (s *section, err error) {
+	rel := &writer{order: w.order, class: w.class}
+	s = &section{name: ".rela" + target, typ: elf.SHT_RELA, info: info, align: 8, entsize: w.size(12, 24)}
+	if w.class == elf.ELFCLASS32 {
+		s = &section{name: ".rel" + target, typ: elf.SHT_REL, info: info, align: 4, entsize: 8}
+	}
+	for _, r := range relocations {
+		if r.offset+r.width > uint64(len(data)) {
+			return nil, fmt.Errorf("elf: relocation at %#x outside section %s", r.offset, target)
+		}
+		if w.class == elf.ELFCLASS32 {
+			if r.width == 8 {
+				return nil, fmt.Errorf("elf: 64-bit relocation in 32-bit class")
+			}
+			w.order.PutUint32(data[r.offset:], uint32(r.addend))
+			rel.put(elf.Rel32{Off: uint32(r.offset), Info: elf.R_INFO32(r.sym, r.typ)})
+		} else {
+			rel.put(elf.Rela64{Off: r.offset, Info: elf.R_INFO(r.sym, r.typ), Addend: r.addend})
+		}
+	}
+	s.data = rel.Bytes()
+	return
+}
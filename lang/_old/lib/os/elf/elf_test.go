@@ -0,0 +1,230 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+)
+
+// program is a file of each segment, with a relocation against the data
+// segment
+var program = lang.File{
+	Code:  []byte{0x8d, 0x05, 0, 0, 0, 0, 0xc3, 0x90},
+	Data:  []byte("hello, world"),
+	Stack: 1 << 16,
+	Entry: 0,
+	Symbols: []lang.Symbol{
+		{Name: "msg", Segment: lang.DataSegment, Size: 12},
+		{Name: "main", Segment: lang.CodeSegment, Size: 7, Function: true, Global: true},
+	},
+	Relocations: []lang.Relocation{{Offset: 2, Type: lang.RelPC32, Segment: lang.DataSegment, Addend: -4}},
+	Bytelang:    []byte{0, 0, 0, 0, 0, 0, 0, 1},
+	Metadata:    map[string]string{"source": "hello.sys"},
+}
+
+var targets = []struct {
+	class elf.Class
+	data  elf.Data
+	mach  elf.Machine
+	rel   uint32 // Type of the relocation
+}{
+	{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, uint32(elf.R_X86_64_PC32)},
+	{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_386, uint32(elf.R_386_PC32)},
+	{elf.ELFCLASS32, elf.ELFDATA2MSB, elf.EM_386, uint32(elf.R_386_PC32)},
+}
+
+func write(t *testing.T, class elf.Class, data elf.Data, m elf.Machine) []byte {
+	r, err := Write(program, data, class, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, r.Size())
+	r.ReadAt(b, 0)
+	return b
+}
+
+func TestWrite(t *testing.T) {
+	for _, target := range targets {
+		b := write(t, target.class, target.data, target.mach)
+		f, err := elf.NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v %v: %v", target.class, target.data, err)
+		}
+		h := f.FileHeader
+		if h.Class != target.class || h.Data != target.data || h.Machine != target.mach || h.Type != elf.ET_EXEC || h.Entry != uint64(program.Entry) {
+			t.Errorf("%v %v: header %+v", target.class, target.data, h)
+		}
+
+		// The program headers of the code, data and stack segments
+		want := []struct {
+			flags         elf.ProgFlag
+			filesz, memsz uint64
+		}{
+			{elf.PF_R | elf.PF_X, 8, 8},
+			{elf.PF_R | elf.PF_W, 12, 12},
+			{elf.PF_R | elf.PF_W, 0, 1 << 16},
+		}
+		if len(f.Progs) != len(want) {
+			t.Fatalf("%v %v: %d program headers", target.class, target.data, len(f.Progs))
+		}
+		for i, p := range f.Progs {
+			if p.Type != elf.PT_LOAD || p.Vaddr != 0 || p.Flags != want[i].flags || p.Filesz != want[i].filesz || p.Memsz != want[i].memsz {
+				t.Errorf("%v %v: program header %d is %+v", target.class, target.data, i, p.ProgHeader)
+			}
+		}
+
+		// 32-bit classes keep the addend in the relocated field
+		text, _ := f.Section(".text").Data()
+		code := append([]byte{}, program.Code...)
+		rel := f.Section(".rela.text")
+		if target.class == elf.ELFCLASS32 {
+			f.ByteOrder.PutUint32(code[2:], uint32(0xfffffffc))
+			rel = f.Section(".rel.text")
+		}
+		if !bytes.Equal(text, code) {
+			t.Errorf("%v %v: .text holds % x", target.class, target.data, text)
+		}
+		data, _ := f.Section(".data").Data()
+		if !bytes.Equal(data, program.Data) {
+			t.Errorf("%v %v: .data holds %q", target.class, target.data, data)
+		}
+		if s := f.Section(".stack"); s.Type != elf.SHT_NOBITS || s.Size != 1<<16 {
+			t.Errorf("%v %v: .stack is %+v", target.class, target.data, s.SectionHeader)
+		}
+
+		symbols, err := f.Symbols()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]elf.Symbol)
+		for _, s := range symbols {
+			found[s.Name] = s
+		}
+		if s := found["main"]; f.Sections[s.Section].Name != ".text" || s.Size != 7 || elf.ST_TYPE(s.Info) != elf.STT_FUNC || elf.ST_BIND(s.Info) != elf.STB_GLOBAL {
+			t.Errorf("%v %v: symbol main is %+v", target.class, target.data, s)
+		}
+		if s := found["msg"]; f.Sections[s.Section].Name != ".data" || s.Size != 12 || elf.ST_BIND(s.Info) != elf.STB_LOCAL {
+			t.Errorf("%v %v: symbol msg is %+v", target.class, target.data, s)
+		}
+
+		if rel == nil {
+			t.Fatalf("%v %v: no relocation section", target.class, target.data)
+		}
+		rb, _ := rel.Data()
+		var off uint64
+		var sym, typ uint32
+		if target.class == elf.ELFCLASS32 {
+			var e elf.Rel32
+			binary.Read(bytes.NewReader(rb), f.ByteOrder, &e)
+			off, sym, typ = uint64(e.Off), elf.R_SYM32(e.Info), elf.R_TYPE32(e.Info)
+		} else {
+			var e elf.Rela64
+			binary.Read(bytes.NewReader(rb), f.ByteOrder, &e)
+			off, sym, typ = e.Off, elf.R_SYM64(e.Info), elf.R_TYPE64(e.Info)
+			if e.Addend != -4 {
+				t.Errorf("relocation addend %d", e.Addend)
+			}
+		}
+		if off != 2 || typ != target.rel || sym == 0 || f.Sections[symbols[sym-1].Section].Name != ".data" {
+			t.Errorf("%v %v: relocation at %d of type %d against symbol %d", target.class, target.data, off, typ, sym)
+		}
+
+		got, err := Read(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, program) {
+			t.Errorf("%v %v: read back as %+v", target.class, target.data, *got)
+		}
+	}
+}
+
+func TestReadelf(t *testing.T) {
+	if _, err := exec.LookPath("readelf"); err != nil {
+		t.Skip("readelf is not installed")
+	}
+	dir := t.TempDir()
+	for _, target := range targets {
+		name := filepath.Join(dir, target.class.String()+target.data.String())
+		if err := os.WriteFile(name, write(t, target.class, target.data, target.mach), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("readelf", "-aW", name)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil || stderr.Len() > 0 {
+			t.Fatalf("%v %v: readelf: %v\n%s", target.class, target.data, err, stderr.String())
+		}
+		for _, s := range []string{"EXEC (Executable file)", "LOAD", ".text", ".data", ".stack", ".bytelang", ".metadata", "main", "msg", "_PC32"} {
+			if !strings.Contains(string(out), s) {
+				t.Errorf("%v %v: readelf output lacks %q:\n%s", target.class, target.data, s, out)
+			}
+		}
+	}
+}
+
+// Files of other toolchains, and corrupt files, are rejected
+func TestReadErrors(t *testing.T) {
+	le := binary.LittleEndian
+	// Offsets in the 64-bit header, and in the first two program headers
+	const machine, entry, code, data = 18, 24, 64, 64 + 56
+	tests := []struct {
+		class elf.Class
+		patch func(b []byte) []byte
+		want  string
+	}{
+		{elf.ELFCLASS64, func(b []byte) []byte { return b[:40] }, "elf: "},
+		{elf.ELFCLASS64, func(b []byte) []byte { return b[:100] }, "elf: "},
+		{elf.ELFCLASS64, func(b []byte) []byte { le.PutUint16(b[16:], uint16(elf.ET_REL)); return b }, "elf: ET_REL is not an executable"},
+		{elf.ELFCLASS64, func(b []byte) []byte { le.PutUint16(b[machine:], uint16(elf.EM_ARM)); return b }, "elf: unsupported machine EM_ARM"},
+		{elf.ELFCLASS64, func(b []byte) []byte { le.PutUint16(b[machine:], uint16(elf.EM_386)); return b }, "elf: machine EM_386 in class ELFCLASS64"},
+		{elf.ELFCLASS32, func(b []byte) []byte { le.PutUint16(b[machine:], uint16(elf.EM_X86_64)); return b }, "elf: machine EM_X86_64 in class ELFCLASS32"},
+		{elf.ELFCLASS64, func(b []byte) []byte { le.PutUint64(b[entry:], 8); return b }, "elf: entry point 0x8 outside the code segment"},
+		{elf.ELFCLASS64, func(b []byte) []byte {
+			le.PutUint64(b[data+8:], uint64(len(b)-4))
+			return b
+		}, "outside the file"},
+		{elf.ELFCLASS64, func(b []byte) []byte {
+			le.PutUint64(b[data+32:], 1<<40)
+			le.PutUint64(b[data+40:], 1<<40)
+			return b
+		}, "outside the file"},
+		{elf.ELFCLASS64, func(b []byte) []byte {
+			le.PutUint64(b[data+8:], le.Uint64(b[code+8:])+4)
+			return b
+		}, "overlaps the segment"},
+		{elf.ELFCLASS64, func(b []byte) []byte { le.PutUint64(b[code+32:], 9); return b }, "stores more than it loads"},
+	}
+	for i, test := range tests {
+		mach := elf.EM_X86_64
+		if test.class == elf.ELFCLASS32 {
+			mach = elf.EM_386
+		}
+		b := test.patch(write(t, test.class, elf.ELFDATA2LSB, mach))
+		if _, err := Read(bytes.NewReader(b)); err == nil || !strings.Contains(err.Error(), test.want) || !strings.HasPrefix(err.Error(), "elf: ") {
+			t.Errorf("%d: got %v, want %q", i, err, test.want)
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	f := program
+	f.Entry = uint(len(f.Code))
+	if _, err := Write(f, elf.ELFDATA2LSB, elf.ELFCLASS64, elf.EM_X86_64); err == nil || err.Error() != "elf: entry point 0x8 outside the code segment" {
+		t.Errorf("entry past the code: got %v", err)
+	}
+	f = program
+	f.Code = nil
+	if _, err := Write(f, elf.ELFDATA2LSB, elf.ELFCLASS64, elf.EM_X86_64); err == nil || !strings.Contains(err.Error(), "entry point 0x0") {
+		t.Errorf("no code: got %v", err)
+	}
+}
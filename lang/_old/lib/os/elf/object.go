@@ -0,0 +1,99 @@
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// Section indices of the sections of a native object
+var objectSection = map[bytelang.Section]uint16{
+	bytelang.Text: 1,
+	bytelang.Data: 2,
+	bytelang.Bss:  3,
+}
+
+// WriteObject writes native code as a relocatable object, for linking with
+// the objects of other languages by a system linker.  The global symbols of
+// the object, which are its entry point and the trampolines of its exports,
+// are visible to other objects, and relocations against symbols it does not
+// define refer to theirs.  Relocations are stored as in Write.  Given debug,
+// the object also has DWARF sections describing the lines, frames and
+// variables of its functions.
+func WriteObject(o *bytelang.Object, debug *Debug) (r *bytes.Reader, err error) {
+	w := &writer{order: binary.LittleEndian}
+	var m elf.Machine
+	switch o.Arch {
+	case "amd64":
+		w.class, m = elf.ELFCLASS64, elf.EM_X86_64
+	case "386":
+		w.class, m = elf.ELFCLASS32, elf.EM_386
+	default:
+		return nil, fmt.Errorf("elf: unsupported architecture %q", o.Arch)
+	}
+	text := append([]byte{}, o.Text...)
+	sections := []*section{
+		{},
+		{name: ".text", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, data: text, align: 16},
+		{name: ".data", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, data: o.Data, align: 16},
+		{name: ".bss", typ: elf.SHT_NOBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, size: uint64(o.Bss), align: 16},
+	}
+	length := map[bytelang.Section]uint{bytelang.Text: uint(len(o.Text)), bytelang.Data: uint(len(o.Data)), bytelang.Bss: o.Bss}
+	var symbols []symbol
+	defined := make(map[string]bool)
+	for _, s := range o.Symbols {
+		if s.Value+s.Size < s.Value || s.Value+s.Size > length[s.Section] {
+			return nil, fmt.Errorf("elf: symbol %s outside its section", s.Name)
+		}
+		symbols = append(symbols, symbol{s.Name, symbolInfo(s.Global, s.Function), objectSection[s.Section], uint64(s.Value), uint64(s.Size)})
+		defined[s.Name] = true
+	}
+	for _, r := range o.Relocations {
+		if r.Symbol != "" && !defined[r.Symbol] {
+			symbols = append(symbols, symbol{name: r.Symbol, info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE)})
+			defined[r.Symbol] = true
+		}
+	}
+	var dwarf []*dwarfSection
+	if debug != nil {
+		if dwarf, err = w.debugSections(o, debug, m); err != nil {
+			return
+		}
+		for _, s := range dwarf {
+			sections = append(sections, &section{name: s.name, typ: elf.SHT_PROGBITS, data: s.Bytes(), align: 1})
+		}
+	}
+	names := newStrtab()
+	symtab, locals, index := w.symbols(symbols, uint16(len(sections)-1), names)
+	var relocations []relocation
+	for _, r := range o.Relocations {
+		typ, err := relocationType(m, r.Type)
+		if err != nil {
+			return nil, err
+		}
+		sym := uint32(objectSection[r.Section])
+		if r.Symbol != "" {
+			sym = index[r.Symbol]
+		}
+		relocations = append(relocations, relocation{uint64(r.Offset), typ, sym, width(r.Type), r.Addend})
+	}
+	rel, err := w.relocations(relocations, text, ".text", 1)
+	if err != nil {
+		return
+	}
+	if len(rel.data) > 0 {
+		sections = append(sections, rel)
+	}
+	for i, s := range dwarf {
+		rel, err := w.relocations(s.rels, sections[4+i].data, s.name, uint32(4+i))
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, rel)
+	}
+	// Marks the stack as non-executable for GNU linkers
+	sections = append(sections, &section{name: ".note.GNU-stack", typ: elf.SHT_PROGBITS, align: 1})
+	return w.file(elf.ET_REL, m, 0, 0, sections, symtab, locals, names, nil), nil
+}
@@ -0,0 +1,104 @@
+package elf
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/vvanpo/system/lang/asmlang"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// exported doubles its parameter, which an export places just above the
+// status word, into the status word
+const exported = `
+allocate 16
+store rel sp 8 literal 6
+store bytes 0 rel sp 0 call double
+store rel fp 8 load rel sp 0
+deallocate 16
+double:
+function
+	allocate 8
+	store rel sp 0 literal 2
+	allocate 8
+	store rel sp 0 load rel fp 16
+	store rel fp 8 mult
+	return
+end
+`
+
+// linkMain calls the entry point of exported, then the export of its nested
+// function, exiting with 42 if both return what they should
+const linkMain = `
+#include <stdint.h>
+
+int64_t bytelang_main(void);
+int64_t sys_double(int64_t);
+
+int main(void) {
+	if (bytelang_main() != 12)
+		return 1;
+	return sys_double(21);
+}
+`
+
+// The relocatable object of native code links with C, as a position
+// dependent or independent executable
+func TestLinkC(t *testing.T) {
+	for _, tool := range []string{"gcc", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	b, err := asmlang.Assemble(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := b.CompileAMD64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fn uint
+	for _, off := range functions(o) {
+		if off != 0 {
+			fn = off
+		}
+	}
+	o, err = b.CompileAMD64(bytelang.Export{Name: "sys_double", Function: fn, Params: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := WriteObject(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	object, source := filepath.Join(dir, "double.o"), filepath.Join(dir, "main.c")
+	f, err := os.Create(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(source, []byte(linkMain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"-pie", "-no-pie"} {
+		exe := filepath.Join(dir, "main"+mode)
+		if out, err := exec.Command("gcc", mode, "-o", exe, source, object).CombinedOutput(); err != nil {
+			t.Fatalf("gcc %s: %v\n%s", mode, err, out)
+		}
+		err := exec.Command(exe).Run()
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != 42 {
+			t.Errorf("%s: exits with %v, want status 42", mode, err)
+		}
+	}
+}
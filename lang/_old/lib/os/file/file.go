@@ -0,0 +1,336 @@
+// Files as mutable lists of bytes.  Bytes can be prepended, appended,
+// inserted, removed and overwritten anywhere in a file, and a reader can
+// block until the file reaches a length, so that a file can serve as a queue
+// or a stack.
+//
+// A file is a piece table: an ordered list of pieces, each a slice of either
+// the original contents or of a chunk of the bytes added since.  Neither is
+// ever modified in place, so an edit only splits and splices pieces, without
+// moving the bytes of the file.  The original contents may be those of a
+// backing store, read as they are needed.  Added bytes fill a chunk before
+// the next is allocated, and a chunk is dropped once no piece refers to it,
+// so that a file used as a queue does not grow without bound.  Pieces that
+// continue one another are merged, and pieces are found by binary search on
+// their offsets.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Minimum length of a chunk of added bytes
+const chunkLength = 4096
+
+// A File is safe for concurrent use
+type File struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // Signalled when the file grows or closes
+	pieces []piece
+	add    []byte      // Chunk that added bytes are appended to
+	store  io.ReaderAt // Original contents, if backed by a store
+	length uint64
+	closed bool
+	fixed  bool
+}
+
+// A piece is a slice of a chunk, or of the backing store if chunk is nil
+type piece struct {
+	chunk  []byte
+	offset uint64 // Into the chunk or the backing store
+	length uint64
+	pos    uint64 // Offset of the piece in the file
+}
+
+var (
+	ErrFixed    = errors.New("file: length is fixed")
+	ErrClosed   = errors.New("file: closed")
+	ErrCanceled = errors.New("file: wait canceled")
+)
+
+// New returns a file holding a copy of data
+func New(data []byte) *File {
+	f := &File{length: uint64(len(data))}
+	f.cond = sync.NewCond(&f.mu)
+	if len(data) > 0 {
+		f.pieces = []piece{{chunk: append([]byte(nil), data...), length: uint64(len(data))}}
+	}
+	return f
+}
+
+// Open returns a file whose original contents are the first length bytes of
+// a store.  Edits to the file are not written to the store.
+func Open(store io.ReaderAt, length uint64) *File {
+	f := &File{length: length, store: store}
+	f.cond = sync.NewCond(&f.mu)
+	if length > 0 {
+		f.pieces = []piece{{length: length}}
+	}
+	return f
+}
+
+// Fix the length of the file, so that writes past its end, inserts and
+// removals fail, as for the file of a block device
+func (f *File) Fix() {
+	f.mu.Lock()
+	f.fixed = true
+	f.mu.Unlock()
+}
+
+func (f *File) Length() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.length
+}
+
+// Bytes returns a copy of the contents of the file
+func (f *File) Bytes() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read(0, f.length)
+}
+
+// Read returns a copy of length bytes at an offset
+func (f *File) Read(offset, length uint64) (data []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err = f.check(offset, length); err != nil {
+		return
+	}
+	return f.read(offset, length)
+}
+
+func (f *File) read(offset, length uint64) (data []byte, err error) {
+	data = make([]byte, length)
+	var n uint64
+	for i := f.find(offset); n < length; i++ {
+		p := f.pieces[i]
+		lo, hi := uint64(0), p.length
+		if offset > p.pos {
+			lo = offset - p.pos
+		}
+		if offset+length < p.pos+p.length {
+			hi = offset + length - p.pos
+		}
+		p = p.slice(lo, hi)
+		if p.chunk != nil {
+			copy(data[n:], p.bytes())
+		} else if _, err = f.store.ReadAt(data[n:n+p.length], int64(p.offset)); err != nil && err != io.EOF {
+			return nil, err
+		}
+		n += p.length
+	}
+	return data, nil
+}
+
+func (p piece) slice(lo, hi uint64) piece {
+	return piece{chunk: p.chunk, offset: p.offset + lo, length: hi - lo, pos: p.pos + lo}
+}
+
+func (p piece) bytes() []byte {
+	return p.chunk[p.offset : p.offset+p.length]
+}
+
+// continues reports whether piece q continues piece p, in the same chunk or
+// in the backing store
+func (p piece) continues(q piece) bool {
+	if (p.chunk == nil) != (q.chunk == nil) || p.offset+p.length != q.offset {
+		return false
+	}
+	return p.chunk == nil || &p.chunk[0] == &q.chunk[0]
+}
+
+// Write overwrites bytes at an offset, extending the file if they pass its
+// end
+func (f *File) Write(offset uint64, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if offset > f.length {
+		return f.check(offset, 0)
+	}
+	if f.fixed && uint64(len(data)) > f.length-offset {
+		return ErrFixed
+	}
+	n := uint64(len(data))
+	if n > f.length-offset {
+		n = f.length - offset
+	}
+	f.remove(offset, n)
+	f.insert(offset, data)
+	return nil
+}
+
+func (f *File) Insert(offset uint64, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(offset, 0); err != nil {
+		return err
+	}
+	if f.fixed {
+		return ErrFixed
+	}
+	f.insert(offset, data)
+	return nil
+}
+
+func (f *File) Prepend(data []byte) error {
+	return f.Insert(0, data)
+}
+
+func (f *File) Append(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fixed {
+		return ErrFixed
+	}
+	f.insert(f.length, data)
+	return nil
+}
+
+// Remove a slice of the file
+func (f *File) Remove(offset, length uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(offset, length); err != nil {
+		return err
+	}
+	if f.fixed {
+		return ErrFixed
+	}
+	f.remove(offset, length)
+	return nil
+}
+
+// Wait blocks until the file is at least length bytes long, and returns its
+// length.  The wait ends with an error if the file is closed, or once the
+// cancel channel, if not nil, is closed.
+func (f *File) Wait(length uint64, cancel <-chan struct{}) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cancel != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-cancel:
+				f.mu.Lock()
+				f.cond.Broadcast()
+				f.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for f.length < length && !f.closed && !closed(cancel) {
+		f.cond.Wait()
+	}
+	switch {
+	case f.length >= length:
+		return f.length, nil
+	case f.closed:
+		return f.length, ErrClosed
+	}
+	return f.length, ErrCanceled
+}
+
+// Close ends the waits on the file.  The file remains readable and
+// writable, but waits for a length it has not reached fail.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+	return nil
+}
+
+func closed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *File) check(offset, length uint64) error {
+	if offset > f.length || length > f.length-offset {
+		return fmt.Errorf("file: slice [%d:%d] out of range of length %d", offset, offset+length, f.length)
+	}
+	return nil
+}
+
+// find returns the index of the piece holding an offset, or the number of
+// pieces if the offset is at the end of the file
+func (f *File) find(offset uint64) int {
+	return sort.Search(len(f.pieces), func(i int) bool {
+		return f.pieces[i].pos+f.pieces[i].length > offset
+	})
+}
+
+// split the piece holding an offset, and return the index of the piece
+// starting there
+func (f *File) split(offset uint64) int {
+	i := f.find(offset)
+	if i == len(f.pieces) || f.pieces[i].pos == offset {
+		return i
+	}
+	p := f.pieces[i]
+	k := offset - p.pos
+	f.pieces = append(f.pieces[:i+1], f.pieces[i:]...)
+	f.pieces[i], f.pieces[i+1] = p.slice(0, k), p.slice(k, p.length)
+	return i + 1
+}
+
+// move the pieces from index i along the file, by a length added or removed
+// before them
+func (f *File) move(i int, length uint64) {
+	for ; i < len(f.pieces); i++ {
+		f.pieces[i].pos += length
+	}
+}
+
+// merge the piece at index i into the one before it, if it continues it
+func (f *File) merge(i int) {
+	if i <= 0 || i >= len(f.pieces) || !f.pieces[i-1].continues(f.pieces[i]) {
+		return
+	}
+	f.pieces[i-1].length += f.pieces[i].length
+	f.pieces = append(f.pieces[:i], f.pieces[i+1:]...)
+}
+
+func (f *File) insert(offset uint64, data []byte) {
+	n := uint64(len(data))
+	if n == 0 {
+		return
+	}
+	if uint64(cap(f.add)-len(f.add)) < n {
+		size := uint64(chunkLength)
+		if n > size {
+			size = n
+		}
+		f.add = make([]byte, 0, size)
+	}
+	p := piece{chunk: f.add[:cap(f.add)], offset: uint64(len(f.add)), length: n, pos: offset}
+	f.add = append(f.add, data...)
+	i := f.split(offset)
+	f.pieces = append(f.pieces[:i], append([]piece{p}, f.pieces[i:]...)...)
+	f.move(i+1, n)
+	f.merge(i + 1)
+	f.merge(i)
+	f.length += n
+	f.cond.Broadcast()
+}
+
+func (f *File) remove(offset, length uint64) {
+	if length == 0 {
+		return
+	}
+	i := f.split(offset)
+	j := f.split(offset + length)
+	f.pieces = append(f.pieces[:i], f.pieces[j:]...)
+	f.move(i, -length)
+	f.merge(i)
+	f.length -= length
+}
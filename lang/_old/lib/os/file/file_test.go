@@ -0,0 +1,163 @@
+package file
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// check that the pieces of a file tile it, and that no piece continues the
+// one before it
+func check(t *testing.T, f *File) {
+	var pos uint64
+	for i, p := range f.pieces {
+		if p.pos != pos || p.length == 0 {
+			t.Fatalf("piece %d at %d of length %d, want it at %d", i, p.pos, p.length, pos)
+		}
+		if i > 0 && f.pieces[i-1].continues(p) {
+			t.Fatalf("piece %d continues the one before it", i)
+		}
+		pos += p.length
+	}
+	if pos != f.length {
+		t.Fatalf("pieces cover %d bytes of %d", pos, f.length)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	want := []byte("initial contents of a backing store")
+	f := Open(bytes.NewReader(append([]byte{}, want...)), uint64(len(want)))
+	for i := 0; i < 20000; i++ {
+		n := uint64(len(want))
+		off := uint64(r.Intn(int(n) + 1))
+		d := make([]byte, r.Intn(8))
+		r.Read(d)
+		var err error
+		switch r.Intn(5) {
+		case 0:
+			err = f.Insert(off, d)
+			want = append(want[:off], append(append([]byte{}, d...), want[off:]...)...)
+		case 1:
+			l := uint64(r.Intn(int(n-off) + 1))
+			err = f.Remove(off, l)
+			want = append(want[:off], want[off+l:]...)
+		case 2:
+			err = f.Write(off, d)
+			if end := off + uint64(len(d)); end > n {
+				want = append(want, make([]byte, end-n)...)
+			}
+			copy(want[off:], d)
+		case 3:
+			err = f.Prepend(d)
+			want = append(append([]byte{}, d...), want...)
+		case 4:
+			err = f.Append(d)
+			want = append(want, d...)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, f)
+		off = uint64(r.Intn(len(want) + 1))
+		l := uint64(r.Intn(len(want) - int(off) + 1))
+		if got, err := f.Read(off, l); err != nil || !bytes.Equal(got, want[off:off+l]) {
+			t.Fatalf("read [%d:%d] returns %q, %v; want %q", off, off+l, got, err, want[off:off+l])
+		}
+	}
+	if got, _ := f.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("file holds %q, want %q", got, want)
+	}
+	if _, err := f.Read(uint64(len(want)), 1); err == nil {
+		t.Error("read past the end of the file")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	f := New(nil)
+	for i := 0; i < 1000; i++ {
+		f.Append([]byte{byte(i)})
+	}
+	for i := uint64(1000); i < 2000; i++ {
+		f.Write(i, []byte{byte(i)})
+	}
+	check(t, f)
+	if len(f.pieces) != 1 {
+		t.Errorf("appended bytes are in %d pieces", len(f.pieces))
+	}
+}
+
+// A file used as a queue refers only to the chunks of its queued bytes, and
+// the chunk being filled
+func TestQueue(t *testing.T) {
+	f := New(nil)
+	for i := 0; i < 100000; i++ {
+		f.Append(bytes.Repeat([]byte{byte(i)}, 100))
+		if cap(f.add) > chunkLength {
+			t.Fatalf("chunk grew to %d bytes", cap(f.add))
+		}
+		if got, err := f.Read(0, 100); err != nil || got[0] != byte(i) {
+			t.Fatalf("dequeued %v, %v", got, err)
+		}
+		f.Remove(0, 100)
+	}
+	check(t, f)
+	if len(f.pieces) != 0 {
+		t.Errorf("empty queue holds %d pieces", len(f.pieces))
+	}
+}
+
+func TestFix(t *testing.T) {
+	f := New([]byte("block"))
+	f.Fix()
+	if err := f.Write(3, []byte("ok")); err != nil {
+		t.Error(err)
+	}
+	if err := f.Write(4, []byte("ks")); err != ErrFixed {
+		t.Errorf("write past the end returns %v", err)
+	}
+	if err := f.Insert(0, []byte("a")); err != ErrFixed {
+		t.Errorf("insert returns %v", err)
+	}
+	if err := f.Remove(0, 1); err != ErrFixed {
+		t.Errorf("remove returns %v", err)
+	}
+	if b, _ := f.Bytes(); string(b) != "blook" {
+		t.Errorf("file holds %q", b)
+	}
+}
+
+func TestWait(t *testing.T) {
+	f := New(nil)
+	done := make(chan uint64)
+	go func() {
+		n, _ := f.Wait(3, nil)
+		done <- n
+	}()
+	time.Sleep(10 * time.Millisecond)
+	f.Append([]byte("ab"))
+	f.Append([]byte("cd"))
+	if n := <-done; n != 4 {
+		t.Errorf("wait returns length %d", n)
+	}
+	cancel := make(chan struct{})
+	errs := make(chan error)
+	go func() {
+		_, err := f.Wait(10, cancel)
+		errs <- err
+	}()
+	go func() {
+		_, err := f.Wait(10, nil)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(cancel)
+	if err := <-errs; err != ErrCanceled {
+		t.Errorf("canceled wait returns %v", err)
+	}
+	f.Close()
+	if err := <-errs; err != ErrClosed {
+		t.Errorf("wait on a closed file returns %v", err)
+	}
+}
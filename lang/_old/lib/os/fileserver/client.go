@@ -0,0 +1,318 @@
+package fileserver
+
+import (
+	"errors"
+	"github.com/vvanpo/system/lang/lib/os/cache"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Client makes requests of a file server over a connection.  It serves as
+// a namespace.Server and a bytelang.FileServer.
+type Client struct {
+	// Time to wait for a response before the server is taken to be
+	// unresponsive, or zero to wait indefinitely.  Waits for a file's
+	// length are not limited.
+	Timeout time.Duration
+
+	conn    io.ReadWriteCloser
+	write   sync.Mutex
+	mu      sync.Mutex
+	tag     uint32
+	pending map[uint32]chan *message
+	err     error // Set once the connection fails
+}
+
+var (
+	ErrTimeout = errors.New("fileserver: server did not respond")
+	ErrClosed  = errors.New("fileserver: connection closed")
+)
+
+// NewClient makes requests over a connection
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{conn: conn, pending: make(map[uint32]chan *message)}
+	go c.receive()
+	return c
+}
+
+// Dial connects to a server listening on a network address, such as a Unix
+// socket
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Connect serves a file system over an in-process pipe, and returns its
+// client
+func Connect(fs FileSystem) *Client {
+	client, server := net.Pipe()
+	go Serve(server, fs)
+	return NewClient(client)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// receive dispatches responses to their requests
+func (c *Client) receive() {
+	for {
+		m, err := readMessage(c.conn)
+		c.mu.Lock()
+		if err != nil {
+			c.err = ErrClosed
+			for tag, ch := range c.pending {
+				close(ch)
+				delete(c.pending, tag)
+			}
+			c.mu.Unlock()
+			return
+		}
+		ch, ok := c.pending[m.tag]
+		delete(c.pending, m.tag)
+		c.mu.Unlock()
+		if ok {
+			ch <- m
+		}
+	}
+}
+
+// call sends a request and waits for its response
+func (c *Client) call(m *message) (*message, error) {
+	if len(m.path) > maxPath {
+		return nil, errors.New("fileserver: path too long")
+	}
+	if len(m.data) > maxData || m.typ == tRead && m.length > maxData {
+		return nil, errors.New("fileserver: message too long")
+	}
+	ch := make(chan *message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.tag++
+	m.tag = c.tag
+	c.pending[m.tag] = ch
+	c.mu.Unlock()
+	c.write.Lock()
+	_, err := c.conn.Write(m.encode())
+	c.write.Unlock()
+	if err != nil {
+		c.forget(m.tag)
+		return nil, err
+	}
+	var timeout <-chan time.Time
+	if c.Timeout > 0 && m.typ != tWait {
+		t := time.NewTimer(c.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case r, ok := <-ch:
+		switch {
+		case !ok:
+			return nil, ErrClosed
+		case r.typ == rError:
+			return nil, errors.New(string(r.data))
+		case r.typ != m.typ|response:
+			return nil, errors.New("fileserver: mismatched response")
+		}
+		return r, nil
+	case <-timeout:
+		c.forget(m.tag)
+		return nil, ErrTimeout
+	}
+}
+
+func (c *Client) forget(tag uint32) {
+	c.mu.Lock()
+	delete(c.pending, tag)
+	c.mu.Unlock()
+}
+
+// Walk reports whether a file exists
+func (c *Client) Walk(path string) (exists bool, err error) {
+	r, err := c.call(&message{typ: tWalk, path: path})
+	if err != nil {
+		return
+	}
+	return r.length != 0, nil
+}
+
+// List returns the names of the files in a directory
+func (c *Client) List(dir string) (names []string, err error) {
+	r, err := c.call(&message{typ: tList, path: dir})
+	if err != nil || len(r.data) == 0 {
+		return
+	}
+	return strings.Split(strings.TrimSuffix(string(r.data), "\n"), "\n"), nil
+}
+
+func (c *Client) Create(path string) error {
+	_, err := c.call(&message{typ: tCreate, path: path})
+	return err
+}
+
+// Open opens a file on the server
+func (c *Client) Open(path string) (*RemoteFile, error) {
+	r, err := c.call(&message{typ: tOpen, path: path})
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFile{c, r.fid}, nil
+}
+
+// Read returns the contents of a file
+func (c *Client) Read(path string) (data []byte, err error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	n, err := f.length()
+	if err != nil {
+		return
+	}
+	return f.Read(0, n)
+}
+
+// Store opens a file on the server as a cache.Store
+func (c *Client) Store(path string) (cache.Store, error) {
+	return c.Open(path)
+}
+
+// A RemoteFile is a File opened on a server.  It is also a cache.Store.
+type RemoteFile struct {
+	c   *Client
+	fid uint32
+}
+
+// Read requests at most maxData bytes at a time, so that a longer read is
+// not atomic, and ends early if the server returns fewer than requested
+func (f *RemoteFile) Read(offset, length uint64) (data []byte, err error) {
+	for {
+		n := length - uint64(len(data))
+		if n > maxData {
+			n = maxData
+		}
+		r, err := f.c.call(&message{typ: tRead, fid: f.fid, offset: offset + uint64(len(data)), length: n})
+		if err != nil {
+			return nil, err
+		}
+		if data == nil && uint64(len(r.data)) == length {
+			return r.data, nil
+		}
+		data = append(data, r.data...)
+		if uint64(len(r.data)) < n || uint64(len(data)) == length {
+			return data, nil
+		}
+	}
+}
+
+// Write, like Insert, sends at most maxData bytes at a time, so that a
+// longer write is not atomic
+func (f *RemoteFile) Write(offset uint64, data []byte) error {
+	return f.send(tWrite, offset, data)
+}
+
+func (f *RemoteFile) Insert(offset uint64, data []byte) error {
+	return f.send(tInsert, offset, data)
+}
+
+func (f *RemoteFile) send(typ byte, offset uint64, data []byte) error {
+	for {
+		n := len(data)
+		if n > maxData {
+			n = maxData
+		}
+		if _, err := f.c.call(&message{typ: typ, fid: f.fid, offset: offset, data: data[:n]}); err != nil {
+			return err
+		}
+		offset, data = offset+uint64(n), data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+func (f *RemoteFile) Remove(offset, length uint64) error {
+	_, err := f.c.call(&message{typ: tRemove, fid: f.fid, offset: offset, length: length})
+	return err
+}
+
+// Length returns the length of the file, or zero if the request failed
+func (f *RemoteFile) Length() uint64 {
+	n, _ := f.length()
+	return n
+}
+
+func (f *RemoteFile) length() (uint64, error) {
+	r, err := f.c.call(&message{typ: tLength, fid: f.fid})
+	if err != nil {
+		return 0, err
+	}
+	return r.length, nil
+}
+
+func (f *RemoteFile) Wait(length uint64) (uint64, error) {
+	r, err := f.c.call(&message{typ: tWait, fid: f.fid, length: length})
+	if err != nil {
+		return 0, err
+	}
+	return r.length, nil
+}
+
+func (f *RemoteFile) Close() error {
+	_, err := f.c.call(&message{typ: tClose, fid: f.fid})
+	return err
+}
+
+func (f *RemoteFile) ReadAt(b []byte, off int64) (n int, err error) {
+	length, err := f.length()
+	if err != nil {
+		return
+	}
+	if off < 0 || uint64(off) >= length {
+		return 0, io.EOF
+	}
+	if rest := length - uint64(off); uint64(len(b)) > rest {
+		b, err = b[:rest], io.EOF
+	}
+	data, rerr := f.Read(uint64(off), uint64(len(b)))
+	if rerr != nil {
+		return 0, rerr
+	}
+	return copy(b, data), err
+}
+
+func (f *RemoteFile) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("fileserver: negative offset")
+	}
+	length, err := f.length()
+	if err != nil {
+		return
+	}
+	// Unlike Write, WriteAt fills the gap to an offset past the end
+	data := b
+	if uint64(off) > length {
+		data = append(make([]byte, uint64(off)-length), b...)
+		off = int64(length)
+	}
+	if err = f.Write(uint64(off), data); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// Size returns the length of the file, or zero if the request failed
+func (f *RemoteFile) Size() int64 {
+	return int64(f.Length())
+}
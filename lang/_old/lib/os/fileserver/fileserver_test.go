@@ -0,0 +1,256 @@
+package fileserver
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func memory() *Memory {
+	m := NewMemory()
+	m.Add("/a/b", []byte("x"))
+	m.Add("/a/d/e", nil)
+	return m
+}
+
+// exercise makes each request of a client of memory()
+func exercise(t *testing.T, c *Client) {
+	if exists, err := c.Walk("/a/b"); !exists || err != nil {
+		t.Errorf("walk /a/b: got %v, %v", exists, err)
+	}
+	if exists, err := c.Walk("/none"); exists || err != nil {
+		t.Errorf("walk /none: got %v, %v", exists, err)
+	}
+	if err := c.Create("/a/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("/a/c"); err == nil || err.Error() != errExist.Error() {
+		t.Errorf("second create: got %v", err)
+	}
+	if names, err := c.List("/a"); err != nil || strings.Join(names, " ") != "b c d" {
+		t.Errorf("list /a: got %q, %v", names, err)
+	}
+
+	f, err := c.Open("/a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan uint64)
+	go func() {
+		n, _ := f.Wait(5)
+		waited <- n
+	}()
+	if err := f.Write(0, []byte("hel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Insert(3, []byte("lo world")); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-waited; n != 11 {
+		t.Errorf("waited for length %d", n)
+	}
+	if err := f.Remove(5, 6); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Read("/a/c"); string(data) != "hello" || err != nil {
+		t.Errorf("read /a/c: got %q, %v", data, err)
+	}
+	if _, err := f.Read(3, 10); err == nil {
+		t.Error("read past the end")
+	}
+
+	// Closing a handle ends its waits, and not those of others
+	g, err := c.Open("/a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := make(chan error)
+	go func() {
+		_, err := g.Wait(100)
+		failed <- err
+	}()
+	g.Close()
+	if err := <-failed; err == nil {
+		t.Error("wait survived its handle")
+	}
+	f.Close()
+	if _, err := f.Read(0, 1); err == nil || err.Error() != "unknown fid" {
+		t.Errorf("read after close: got %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	c := Connect(memory())
+	defer c.Close()
+	exercise(t, c)
+}
+
+func TestUnixSocket(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeListener(l, memory())
+	c, err := Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exercise(t, c)
+	c.Close()
+	if _, err := c.Walk("/"); err != ErrClosed {
+		t.Errorf("walk after close: got %v", err)
+	}
+}
+
+// recorder is a file system that records the lengths of the reads and
+// writes made of its files
+type recorder struct {
+	*Memory
+	mu      sync.Mutex
+	lengths []uint64
+}
+
+type recorded struct {
+	File
+	r *recorder
+}
+
+func (r *recorder) Open(p string) (File, error) {
+	f, err := r.Memory.Open(p)
+	return recorded{f, r}, err
+}
+
+func (r *recorder) record(n uint64) {
+	r.mu.Lock()
+	r.lengths = append(r.lengths, n)
+	r.mu.Unlock()
+}
+
+func (f recorded) Read(offset, length uint64) ([]byte, error) {
+	f.r.record(length)
+	return f.File.Read(offset, length)
+}
+
+func (f recorded) Write(offset uint64, data []byte) error {
+	f.r.record(uint64(len(data)))
+	return f.File.Write(offset, data)
+}
+
+func (f recorded) Insert(offset uint64, data []byte) error {
+	f.r.record(uint64(len(data)))
+	return f.File.Insert(offset, data)
+}
+
+// Reads and writes longer than a message are split across requests
+func TestLarge(t *testing.T) {
+	r := &recorder{Memory: NewMemory()}
+	c := Connect(r)
+	defer c.Close()
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), (maxData+100)/16)
+	r.Add("/large", large)
+	data, err := c.Read("/large")
+	if err != nil || !bytes.Equal(data, large) {
+		t.Fatalf("read %d bytes of %d, %v", len(data), len(large), err)
+	}
+
+	if err := c.Create("/copy"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Open("/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(0, large); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Insert(16, large); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte{}, large[:16]...), large...), large[16:]...)
+	b := make([]byte, len(want)+1)
+	if n, err := f.ReadAt(b, 0); n != len(want) || !bytes.Equal(b[:n], want) {
+		t.Errorf("read back %d bytes of %d, %v", n, len(want), err)
+	}
+
+	// Two requests for each of the read, write and insert, and three for
+	// the ReadAt of both copies
+	if len(r.lengths) != 9 {
+		t.Errorf("%d requests", len(r.lengths))
+	}
+	for _, n := range r.lengths {
+		if n > maxData {
+			t.Errorf("request of %d bytes", n)
+		}
+	}
+}
+
+// listing lists a directory of names too long for a response
+type listing struct{ *Memory }
+
+func (listing) List(dir string) ([]string, error) {
+	return []string{strings.Repeat("x", maxData)}, nil
+}
+
+// Requests and responses too long for a message fail alone, leaving the
+// connection open
+func TestTooLong(t *testing.T) {
+	m := memory()
+	c := Connect(listing{m})
+	defer c.Close()
+	if _, err := c.List("/"); err == nil || err.Error() != "response too long" {
+		t.Errorf("long list: got %v", err)
+	}
+	if err := c.Create(strings.Repeat("/x", 1<<15)); err == nil || err.Error() != "fileserver: path too long" {
+		t.Errorf("long path: got %v", err)
+	}
+	if _, err := c.call(&message{typ: tRead, length: maxData + 1}); err == nil || err.Error() != "fileserver: message too long" {
+		t.Errorf("long read: got %v", err)
+	}
+
+	// A client that does not split its reads
+	client, server := net.Pipe()
+	go Serve(server, m)
+	defer client.Close()
+	requests := []*message{{typ: tOpen, tag: 1, path: "/a/b"}, {typ: tRead, tag: 2, fid: 1, length: maxData + 1}}
+	responses := []*message{{typ: tOpen | response, tag: 1, fid: 1}, {typ: rError, tag: 2, data: []byte("read too long")}}
+	for i, want := range responses {
+		client.Write(requests[i].encode())
+		r, err := readMessage(client)
+		if err != nil || r.typ != want.typ || r.tag != want.tag || r.fid != want.fid || !bytes.Equal(r.data, want.data) {
+			t.Errorf("got %+v, %v; want %+v", r, err, want)
+		}
+	}
+
+	if exists, err := c.Walk("/a/b"); !exists || err != nil {
+		t.Errorf("walk after failures: got %v, %v", exists, err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	// A server that never responds
+	go func() {
+		for {
+			if _, err := readMessage(server); err != nil {
+				return
+			}
+		}
+	}()
+	c := NewClient(client)
+	defer c.Close()
+	c.Timeout = 10 * time.Millisecond
+	if _, err := c.Walk("/"); err != ErrTimeout {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) != 0 {
+		t.Errorf("%d requests still pending", len(c.pending))
+	}
+}
@@ -0,0 +1,109 @@
+package fileserver
+
+import (
+	"errors"
+	"github.com/vvanpo/system/lang/lib/os/file"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Memory file system holds its files in memory.  Directories are implied
+// by the paths of the files beneath them.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]*file.File
+}
+
+// A handle of an open memory file
+type memoryHandle struct {
+	*file.File
+	closed chan struct{}
+	once   sync.Once
+}
+
+var (
+	errNotExist = errors.New("file does not exist")
+	errExist    = errors.New("file exists")
+)
+
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*file.File)}
+}
+
+// Add a file with its contents, replacing any of the same path
+func (m *Memory) Add(p string, data []byte) {
+	f := file.New(data)
+	m.mu.Lock()
+	m.files[path.Clean("/"+p)] = f
+	m.mu.Unlock()
+}
+
+func (m *Memory) Walk(p string) (exists bool, err error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return true, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.files {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *Memory) List(dir string) (names []string, err error) {
+	dir = path.Clean("/" + dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool)
+	for name := range m.files {
+		rel := strings.TrimPrefix(name, dir)
+		if dir != "/" {
+			if rel == name || rel == "" || rel[0] != '/' {
+				continue
+			}
+			rel = rel[1:]
+		}
+		if i := strings.Index(rel, "/"); i >= 0 {
+			rel = rel[:i]
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (m *Memory) Create(p string) error {
+	if exists, _ := m.Walk(p); exists {
+		return errExist
+	}
+	m.Add(p, nil)
+	return nil
+}
+
+func (m *Memory) Open(p string) (File, error) {
+	m.mu.Lock()
+	f, ok := m.files[path.Clean("/"+p)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, errNotExist
+	}
+	return &memoryHandle{File: f, closed: make(chan struct{})}, nil
+}
+
+func (h *memoryHandle) Wait(length uint64) (uint64, error) {
+	return h.File.Wait(length, h.closed)
+}
+
+// Close ends the waits of the handle, leaving those of other handles
+func (h *memoryHandle) Close() error {
+	h.once.Do(func() { close(h.closed) })
+	return nil
+}
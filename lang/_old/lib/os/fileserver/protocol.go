@@ -0,0 +1,116 @@
+// Protocol between file servers and their clients.  A client sends requests
+// over a connection, such as a pipe or a Unix socket, and the server answers
+// each with a response of the same tag, in any order, so that requests that
+// block, such as waits for a file's length, do not hold up the others.
+//
+// Every message is a 32-bit big-endian length of the rest of the message,
+// followed by its fields:
+//
+//	type	1 byte
+//	tag	4 bytes
+//	fid	4 bytes, the file of an open
+//	offset	8 bytes
+//	length	8 bytes
+//	path	2-byte length, and bytes
+//	data	4-byte length, and bytes
+//
+// A response has the type of its request with the high bit set, or is an
+// error whose data is the message.  Fields a message does not use are zero.
+// Messages are at most 16MiB long, so a read may not ask for more data than
+// fits in one.
+package fileserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Request types
+const (
+	tWalk   byte = 1 + iota // Path; length 1 in the response if it exists
+	tList                   // Path; data of the names, each ended by a newline
+	tCreate                 // Path
+	tOpen                   // Path; the fid in the response
+	tClose                  // Fid
+	tRead                   // Fid, offset and length; data in the response
+	tWrite                  // Fid, offset and data, overwriting
+	tInsert                 // Fid, offset and data
+	tRemove                 // Fid, offset and length
+	tLength                 // Fid; length in the response
+	tWait                   // Fid and length; responds once the file is as long
+)
+
+const (
+	response byte = 0x80
+	rError   byte = 0xff
+)
+
+const (
+	headerLength = 1 + 4 + 4 + 8 + 8
+	maxMessage   = 1 << 24
+	maxPath      = 1<<16 - 1
+	// The most data a message of any path holds.  Reads and writes of more
+	// are split across requests.
+	maxData = maxMessage - headerLength - 2 - maxPath - 4
+)
+
+type message struct {
+	typ    byte
+	tag    uint32
+	fid    uint32
+	offset uint64
+	length uint64
+	path   string
+	data   []byte
+}
+
+func (m *message) encode() []byte {
+	n := headerLength + 2 + len(m.path) + 4 + len(m.data)
+	b := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	b = append(b, m.typ)
+	b = binary.BigEndian.AppendUint32(b, m.tag)
+	b = binary.BigEndian.AppendUint32(b, m.fid)
+	b = binary.BigEndian.AppendUint64(b, m.offset)
+	b = binary.BigEndian.AppendUint64(b, m.length)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.path)))
+	b = append(b, m.path...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(m.data)))
+	return append(b, m.data...)
+}
+
+func readMessage(r io.Reader) (m *message, err error) {
+	var size [4]byte
+	if _, err = io.ReadFull(r, size[:]); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < headerLength+6 || n > maxMessage {
+		return nil, fmt.Errorf("fileserver: invalid message length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	m = &message{
+		typ:    b[0],
+		tag:    binary.BigEndian.Uint32(b[1:]),
+		fid:    binary.BigEndian.Uint32(b[5:]),
+		offset: binary.BigEndian.Uint64(b[9:]),
+		length: binary.BigEndian.Uint64(b[17:]),
+	}
+	b = b[headerLength:]
+	p := int(binary.BigEndian.Uint16(b))
+	if 2+p+4 > len(b) {
+		return nil, errors.New("fileserver: invalid path length")
+	}
+	m.path, b = string(b[2:2+p]), b[2+p:]
+	d := int(binary.BigEndian.Uint32(b))
+	if 4+d != len(b) {
+		return nil, errors.New("fileserver: invalid data length")
+	}
+	m.data = b[4:]
+	return
+}
@@ -0,0 +1,172 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A FileSystem is the hierarchy of files a server serves
+type FileSystem interface {
+	Walk(path string) (exists bool, err error)
+	List(dir string) (names []string, err error)
+	Create(path string) error
+	Open(path string) (File, error)
+}
+
+// A File is a mutable list of bytes
+type File interface {
+	Read(offset, length uint64) ([]byte, error)
+	// Write overwrites bytes, extending the file if they pass its end
+	Write(offset uint64, data []byte) error
+	Insert(offset uint64, data []byte) error
+	Remove(offset, length uint64) error
+	Length() uint64
+	// Wait blocks until the file is at least length bytes long, and
+	// returns its length.  Closing the file ends the wait with an error.
+	Wait(length uint64) (uint64, error)
+	Close() error
+}
+
+type connection struct {
+	fs    FileSystem
+	conn  io.ReadWriteCloser
+	write sync.Mutex // Held while writing a response
+	files sync.Map   // Open files by fid
+	fids  uint32
+	mu    sync.Mutex
+}
+
+// Serve answers the requests of a connection from a file system, until the
+// connection closes.  Requests are served concurrently, and the files left
+// open are closed at the end.
+func Serve(conn io.ReadWriteCloser, fs FileSystem) error {
+	c := &connection{fs: fs, conn: conn}
+	var requests sync.WaitGroup
+	defer func() {
+		// Closing the files ends the waits on them
+		conn.Close()
+		c.closeFiles()
+		requests.Wait()
+		c.closeFiles()
+	}()
+	for {
+		m, err := readMessage(conn)
+		if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			c.respond(m)
+		}()
+	}
+}
+
+func (c *connection) closeFiles() {
+	c.files.Range(func(fid, f interface{}) bool {
+		if _, ok := c.files.LoadAndDelete(fid); ok {
+			f.(File).Close()
+		}
+		return true
+	})
+}
+
+// ServeListener serves each connection accepted by a listener, such as that
+// of a Unix socket
+func ServeListener(l net.Listener, fs FileSystem) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go Serve(conn, fs)
+	}
+}
+
+func (c *connection) respond(m *message) {
+	r, err := c.serve(m)
+	if err == nil && len(r.data) > maxData {
+		err = errors.New("response too long")
+	}
+	if err != nil {
+		r = &message{typ: rError, data: []byte(err.Error())}
+	} else {
+		r.typ = m.typ | response
+	}
+	r.tag = m.tag
+	c.write.Lock()
+	defer c.write.Unlock()
+	c.conn.Write(r.encode())
+}
+
+func (c *connection) serve(m *message) (r *message, err error) {
+	r = new(message)
+	switch m.typ {
+	case tWalk:
+		exists, err := c.fs.Walk(m.path)
+		if exists {
+			r.length = 1
+		}
+		return r, err
+	case tList:
+		names, err := c.fs.List(m.path)
+		for _, name := range names {
+			if strings.Contains(name, "\n") {
+				return nil, errors.New("name contains a newline")
+			}
+			r.data = append(r.data, name+"\n"...)
+		}
+		return r, err
+	case tCreate:
+		return r, c.fs.Create(m.path)
+	case tOpen:
+		f, err := c.fs.Open(m.path)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.fids++
+		r.fid = c.fids
+		c.mu.Unlock()
+		c.files.Store(r.fid, f)
+		return r, nil
+	}
+	v, ok := c.files.Load(m.fid)
+	if !ok {
+		return nil, errors.New("unknown fid")
+	}
+	f := v.(File)
+	switch m.typ {
+	case tClose:
+		if _, ok := c.files.LoadAndDelete(m.fid); ok {
+			err = f.Close()
+		}
+	case tRead:
+		if m.length > maxData {
+			return nil, errors.New("read too long")
+		}
+		r.data, err = f.Read(m.offset, m.length)
+	case tWrite:
+		err = f.Write(m.offset, m.data)
+	case tInsert:
+		err = f.Insert(m.offset, m.data)
+	case tRemove:
+		err = f.Remove(m.offset, m.length)
+	case tLength:
+		r.length = f.Length()
+	case tWait:
+		r.length, err = f.Wait(m.length)
+	default:
+		err = errors.New("unknown request")
+	}
+	return
+}
@@ -0,0 +1,365 @@
+// Flat binary images, loaded verbatim at a known address, such as boot
+// sectors and firmware blobs
+package flat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/bytelang"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Section is a named run of bytes placed in the image, followed by Bss
+// zeroed bytes.  The zeroed bytes are only stored in the image when a later
+// section is placed after them.
+type Section struct {
+	Name        string
+	Data        []byte
+	Bss         uint64
+	Align       uint64 // Alignment of the start address, or that of Config if zero
+	Start       uint64 // Address of the section, if not zero; otherwise it follows the previous section
+	Symbols     []Symbol
+	Relocations []Relocation
+}
+
+type Symbol struct {
+	Name  string
+	Value uint64 // Offset into the section
+	Size  uint64
+}
+
+// A relocation patches the section at Offset with the address of a symbol or
+// section, named by Symbol, plus Addend
+type Relocation struct {
+	Offset uint64
+	Type   lang.RelocationType
+	Symbol string
+	Addend int64
+}
+
+type Config struct {
+	Origin   uint64           // Address of the first byte of the image
+	Sections []string         // Names of the sections placed first, in this order; the others follow in their given order
+	Align    uint64           // Alignment of sections that do not set their own, or 1 if zero
+	Fill     byte             // Padding byte between sections
+	Length   uint64           // Length the image is padded to, if not zero
+	Order    binary.ByteOrder // Of relocated fields, or little-endian if nil
+}
+
+// A Map lists the sections and symbols of an image with their addresses,
+// sorted by address, each section before its symbols
+type Map []Entry
+
+type Entry struct {
+	Address uint64
+	Size    uint64
+	Section string
+	Name    string // Symbol name, or empty for the section itself
+}
+
+// Link places sections one after another from the origin, padding each to its
+// alignment, and applies their relocations now that the addresses are known.
+// Sections at a fixed start address may not overlap those placed before them.
+func Link(sections []Section, c Config) (image []byte, m Map, err error) {
+	ordered, err := arrange(sections, c.Sections)
+	if err != nil {
+		return
+	}
+	base, err := place(ordered, c)
+	if err != nil {
+		return
+	}
+	order := c.Order
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	addr := make(map[string]uint64)
+	end := c.Origin // End of the stored bytes
+	for i, s := range ordered {
+		if err = define(addr, s.Name, base[i]); err != nil {
+			return
+		}
+		m = append(m, Entry{base[i], uint64(len(s.Data)) + s.Bss, s.Name, ""})
+		for _, sym := range s.Symbols {
+			if sym.Value+sym.Size > uint64(len(s.Data))+s.Bss {
+				return nil, nil, fmt.Errorf("flat: symbol %s outside section %s", sym.Name, s.Name)
+			}
+			if err = define(addr, sym.Name, base[i]+sym.Value); err != nil {
+				return
+			}
+			m = append(m, Entry{base[i] + sym.Value, sym.Size, s.Name, sym.Name})
+		}
+		if len(s.Data) > 0 {
+			end = base[i] + uint64(len(s.Data))
+		}
+	}
+	if c.Length != 0 && end-c.Origin > c.Length {
+		return nil, nil, fmt.Errorf("flat: image of %d bytes exceeds its length of %d", end-c.Origin, c.Length)
+	}
+	length := end - c.Origin
+	if c.Length != 0 {
+		length = c.Length
+	}
+	image = make([]byte, length)
+	for i := range image {
+		image[i] = c.Fill
+	}
+	for i, s := range ordered {
+		off := base[i] - c.Origin
+		var data []byte
+		if len(s.Data) > 0 {
+			data = image[off : off+uint64(len(s.Data))]
+			copy(data, s.Data)
+		}
+		// Zeroed memory stored between sections
+		for j := off + uint64(len(s.Data)); j < off+uint64(len(s.Data))+s.Bss && j < length; j++ {
+			image[j] = 0
+		}
+		for _, r := range s.Relocations {
+			if err = relocate(data, base[i], r, addr, order); err != nil {
+				return nil, nil, fmt.Errorf("flat: section %s: %v", s.Name, err)
+			}
+		}
+	}
+	sort.SliceStable(m, func(i, j int) bool {
+		return m[i].Address < m[j].Address || m[i].Address == m[j].Address && m[i].Name == "" && m[j].Name != ""
+	})
+	return
+}
+
+// Place lays out sections as Link does, without linking them, and returns
+// the address of each by name.  Only the names, lengths and placement of the
+// sections are used, so assemblers can find the addresses of their labels
+// before their contents are final.
+func Place(sections []Section, c Config) (addr map[string]uint64, err error) {
+	ordered, err := arrange(sections, c.Sections)
+	if err != nil {
+		return
+	}
+	base, err := place(ordered, c)
+	if err != nil {
+		return
+	}
+	addr = make(map[string]uint64)
+	for i, s := range ordered {
+		addr[s.Name] = base[i]
+	}
+	return
+}
+
+// place returns the address of each section, in order
+func place(sections []Section, c Config) (base []uint64, err error) {
+	pc := c.Origin
+	for _, s := range sections {
+		align := s.Align
+		if align == 0 {
+			align = c.Align
+		}
+		if align == 0 {
+			align = 1
+		}
+		if align&(align-1) != 0 {
+			return nil, fmt.Errorf("flat: section %s alignment %d is not a power of two", s.Name, align)
+		}
+		if s.Start != 0 {
+			if s.Start < pc {
+				return nil, fmt.Errorf("flat: section %s at %#x overlaps the previous section, which ends at %#x", s.Name, s.Start, pc)
+			}
+			if s.Start&(align-1) != 0 {
+				return nil, fmt.Errorf("flat: section %s at %#x is not %d-byte aligned", s.Name, s.Start, align)
+			}
+			pc = s.Start
+		}
+		pc = (pc + align - 1) &^ (align - 1)
+		base = append(base, pc)
+		pc += uint64(len(s.Data)) + s.Bss
+	}
+	return
+}
+
+// arrange returns the sections named by names first, then the others
+func arrange(sections []Section, names []string) (ordered []Section, err error) {
+	index := make(map[string]int)
+	for i, s := range sections {
+		if _, ok := index[s.Name]; ok {
+			return nil, fmt.Errorf("flat: duplicate section %s", s.Name)
+		}
+		index[s.Name] = i
+	}
+	placed := make(map[string]bool)
+	for _, n := range names {
+		i, ok := index[n]
+		if !ok {
+			return nil, fmt.Errorf("flat: no section %s to order", n)
+		}
+		if placed[n] {
+			return nil, fmt.Errorf("flat: section %s ordered twice", n)
+		}
+		placed[n] = true
+		ordered = append(ordered, sections[i])
+	}
+	for _, s := range sections {
+		if !placed[s.Name] {
+			ordered = append(ordered, s)
+		}
+	}
+	return
+}
+
+func define(addr map[string]uint64, name string, a uint64) error {
+	if _, ok := addr[name]; ok {
+		return fmt.Errorf("flat: duplicate symbol %s", name)
+	}
+	addr[name] = a
+	return nil
+}
+
+func relocate(data []byte, base uint64, r Relocation, addr map[string]uint64, order binary.ByteOrder) error {
+	s, ok := addr[r.Symbol]
+	if !ok {
+		return fmt.Errorf("undefined symbol %s", r.Symbol)
+	}
+	width := uint64(4)
+	if r.Type == lang.RelAbs64 {
+		width = 8
+	}
+	if r.Offset+width < r.Offset || r.Offset+width > uint64(len(data)) {
+		return fmt.Errorf("relocation at %#x outside the section", r.Offset)
+	}
+	v := int64(s) + r.Addend
+	switch r.Type {
+	case lang.RelPC32:
+		v -= int64(base + r.Offset)
+		if v != int64(int32(v)) {
+			return fmt.Errorf("relocation at %#x out of range of %s", r.Offset, r.Symbol)
+		}
+		order.PutUint32(data[r.Offset:], uint32(v))
+	case lang.RelAbs32:
+		if uint64(v) > 0xffffffff {
+			return fmt.Errorf("relocation at %#x out of range of %s", r.Offset, r.Symbol)
+		}
+		order.PutUint32(data[r.Offset:], uint32(v))
+	case lang.RelAbs64:
+		order.PutUint64(data[r.Offset:], uint64(v))
+	default:
+		return fmt.Errorf("invalid relocation type %d", r.Type)
+	}
+	return nil
+}
+
+// Segment names of a file, as sections
+var segmentSection = map[lang.Segment]string{
+	lang.CodeSegment:  "code",
+	lang.DataSegment:  "data",
+	lang.StackSegment: "stack",
+}
+
+// Write links a file into an image of its code, data and stack segments, as
+// the sections code, data and stack, and returns the address of its entry
+// point.  Its relocations are applied with the segments at their linked
+// addresses, so the image is no longer segment-relative.
+func Write(f lang.File, c Config) (image []byte, m Map, entry uint64, err error) {
+	sections := []Section{{Name: "code", Data: f.Code}, {Name: "data", Data: f.Data}, {Name: "stack", Bss: uint64(f.Stack)}}
+	for _, s := range f.Symbols {
+		i := int(s.Segment)
+		sections[i].Symbols = append(sections[i].Symbols, Symbol{s.Name, uint64(s.Value), uint64(s.Size)})
+	}
+	for _, r := range f.Relocations {
+		sections[0].Relocations = append(sections[0].Relocations, Relocation{uint64(r.Offset), r.Type, segmentSection[r.Segment], r.Addend})
+	}
+	if image, m, err = Link(sections, c); err != nil {
+		return
+	}
+	for _, e := range m {
+		if e.Section == "code" && e.Name == "" {
+			entry = e.Address + uint64(f.Entry)
+		}
+	}
+	return
+}
+
+// Native section names
+var objectSection = map[bytelang.Section]string{
+	bytelang.Text: ".text",
+	bytelang.Data: ".data",
+	bytelang.Bss:  ".bss",
+}
+
+// WriteObject links native code into an image of its .text, .data and .bss
+// sections, and returns the address of its entry point.  The object may not
+// refer to symbols it does not define.  The caller provides the stack the
+// entry point runs on, of at least bytelang.NativeStack bytes.
+func WriteObject(o *bytelang.Object, c Config) (image []byte, m Map, entry uint64, err error) {
+	sections := []Section{{Name: ".text", Data: o.Text}, {Name: ".data", Data: o.Data}, {Name: ".bss", Bss: uint64(o.Bss)}}
+	for _, s := range o.Symbols {
+		i := int(s.Section)
+		sections[i].Symbols = append(sections[i].Symbols, Symbol{s.Name, uint64(s.Value), uint64(s.Size)})
+	}
+	for _, r := range o.Relocations {
+		sym := r.Symbol
+		if sym == "" {
+			sym = objectSection[r.Section]
+		}
+		sections[0].Relocations = append(sections[0].Relocations, Relocation{uint64(r.Offset), r.Type, sym, r.Addend})
+	}
+	if image, m, err = Link(sections, c); err != nil {
+		return
+	}
+	for _, e := range m {
+		if e.Name == o.Entry {
+			return image, m, e.Address, nil
+		}
+	}
+	return nil, nil, 0, fmt.Errorf("flat: undefined entry point %s", o.Entry)
+}
+
+// WriteMap writes a map as the symbol map sidecar of an image, one entry per
+// line: the address and size in hexadecimal, then the section, and the symbol
+// name for symbols
+func WriteMap(w io.Writer, m Map) error {
+	digits := 8
+	for _, e := range m {
+		if e.Address+e.Size > 0xffffffff {
+			digits = 16
+		}
+	}
+	for _, e := range m {
+		line := fmt.Sprintf("%0*x %0*x %s", digits, e.Address, digits, e.Size, e.Section)
+		if e.Name != "" {
+			line += " " + e.Name
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMap reads a map written by WriteMap
+func ReadMap(r io.Reader) (m Map, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 3 && len(f) != 4 {
+			return nil, fmt.Errorf("flat: malformed map entry %q", scanner.Text())
+		}
+		var e Entry
+		if e.Address, err = strconv.ParseUint(f[0], 16, 64); err != nil {
+			return nil, fmt.Errorf("flat: malformed map address %q", f[0])
+		}
+		if e.Size, err = strconv.ParseUint(f[1], 16, 64); err != nil {
+			return nil, fmt.Errorf("flat: malformed map size %q", f[1])
+		}
+		e.Section = f[2]
+		if len(f) == 4 {
+			e.Name = f[3]
+		}
+		m = append(m, e)
+	}
+	return m, scanner.Err()
+}
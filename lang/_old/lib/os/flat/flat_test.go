@@ -0,0 +1,179 @@
+package flat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+)
+
+func entry(address, size uint64, section, name string) Entry {
+	return Entry{Address: address, Size: size, Section: section, Name: name}
+}
+
+// sections are placed as b, a, c, d by the configuration of TestLink
+func sections() []Section {
+	return []Section{
+		{Name: "a", Data: make([]byte, 8), Symbols: []Symbol{{"entry", 4, 0}}, Relocations: []Relocation{
+			{Offset: 0, Type: lang.RelAbs32, Symbol: "d", Addend: 2},
+			{Offset: 4, Type: lang.RelPC32, Symbol: "cs", Addend: -4},
+		}},
+		{Name: "b", Data: []byte("bb"), Bss: 3},
+		{Name: "c", Data: []byte("c"), Align: 16, Symbols: []Symbol{{"cs", 0, 1}}},
+		{Name: "d", Bss: 8},
+	}
+}
+
+func TestLink(t *testing.T) {
+	c := Config{Origin: 0x1000, Sections: []string{"b"}, Align: 4, Fill: 0xcc}
+	image, m, err := Link(sections(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bss of b is stored as zeros, and that of d, the last section,
+	// is not stored
+	want := []byte{
+		'b', 'b', 0, 0, 0, 0xcc, 0xcc, 0xcc,
+		0x16, 0x10, 0, 0, // d + 2
+		0x00, 0, 0, 0, // cs - 4 - 0x100c
+		'c',
+	}
+	if !bytes.Equal(image, want) {
+		t.Errorf("image % x", image)
+	}
+	wantMap := Map{
+		entry(0x1000, 5, "b", ""),
+		entry(0x1008, 8, "a", ""),
+		entry(0x100c, 0, "a", "entry"),
+		entry(0x1010, 1, "c", ""),
+		entry(0x1010, 1, "c", "cs"),
+		entry(0x1014, 8, "d", ""),
+	}
+	if !reflect.DeepEqual(m, wantMap) {
+		t.Errorf("map %v, want %v", m, wantMap)
+	}
+	addr, err := Place(sections(), c)
+	if err != nil || !reflect.DeepEqual(addr, map[string]uint64{"a": 0x1008, "b": 0x1000, "c": 0x1010, "d": 0x1014}) {
+		t.Errorf("placed at %#x, %v", addr, err)
+	}
+
+	// Padded to a length, which stores the bss of d
+	c.Length = 32
+	want = append(append(append(want, 0xcc, 0xcc, 0xcc), make([]byte, 8)...), 0xcc, 0xcc, 0xcc, 0xcc)
+	if image, _, err = Link(sections(), c); err != nil || !bytes.Equal(image, want) {
+		t.Errorf("padded image % x, %v", image, err)
+	}
+	c.Length = 16
+	if _, _, err = Link(sections(), c); err == nil || err.Error() != "flat: image of 17 bytes exceeds its length of 16" {
+		t.Errorf("image past its length: got %v", err)
+	}
+}
+
+// A section at a start address follows the padding before it
+func TestStart(t *testing.T) {
+	s := []Section{{Name: "a", Data: []byte{1}}, {Name: "b", Data: []byte{2}, Start: 0x108}}
+	image, _, err := Link(s, Config{Origin: 0x100})
+	if err != nil || !bytes.Equal(image, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2}) {
+		t.Errorf("image % x, %v", image, err)
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	s := []Section{{Name: "s", Data: make([]byte, 8), Relocations: []Relocation{{Offset: 0, Type: lang.RelAbs64, Symbol: "s", Addend: 1}}}}
+	image, _, err := Link(s, Config{Origin: 0x10, Order: binary.BigEndian})
+	if err != nil || !bytes.Equal(image, []byte{0, 0, 0, 0, 0, 0, 0, 0x11}) {
+		t.Errorf("image % x, %v", image, err)
+	}
+
+	tests := []struct {
+		origin     uint64
+		relocation Relocation
+		want       string
+	}{
+		{0, Relocation{Offset: 0, Type: lang.RelAbs32, Symbol: "s", Addend: 1 << 32}, "relocation at 0x0 out of range of s"},
+		{0, Relocation{Offset: 0, Type: lang.RelAbs32, Symbol: "s", Addend: -1}, "out of range"},
+		{1 << 32, Relocation{Offset: 4, Type: lang.RelAbs32, Symbol: "s"}, "relocation at 0x4 out of range of s"},
+		{0, Relocation{Offset: 0, Type: lang.RelPC32, Symbol: "s", Addend: 1 << 31}, "out of range"},
+		{0, Relocation{Offset: 0, Type: lang.RelPC32, Symbol: "s", Addend: -1<<31 - 1}, "out of range"},
+		{0, Relocation{Offset: 5, Type: lang.RelPC32, Symbol: "s"}, "relocation at 0x5 outside the section"},
+		{0, Relocation{Offset: 1, Type: lang.RelAbs64, Symbol: "s"}, "outside the section"},
+		{0, Relocation{Offset: ^uint64(0), Type: lang.RelAbs32, Symbol: "s"}, "outside the section"},
+		{0, Relocation{Offset: 0, Type: lang.RelAbs32, Symbol: "t"}, "undefined symbol t"},
+		{0, Relocation{Offset: 0, Type: 3, Symbol: "s"}, "invalid relocation type 3"},
+	}
+	for _, test := range tests {
+		s[0].Relocations = []Relocation{test.relocation}
+		_, _, err := Link(s, Config{Origin: test.origin})
+		if err == nil || !strings.Contains(err.Error(), test.want) || !strings.HasPrefix(err.Error(), "flat: section s: ") {
+			t.Errorf("%+v: got %v, want %q", test.relocation, err, test.want)
+		}
+	}
+	// In range at the limits
+	s[0].Relocations = []Relocation{{Offset: 0, Type: lang.RelPC32, Symbol: "s", Addend: 1<<31 - 1}, {Offset: 4, Type: lang.RelAbs32, Symbol: "s", Addend: 0xffffffff}}
+	if _, _, err := Link(s, Config{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		sections []Section
+		c        Config
+		want     string
+	}{
+		{[]Section{{Name: "a", Data: []byte{1, 2}}, {Name: "b", Start: 0x101}}, Config{Origin: 0x100}, "flat: section b at 0x101 overlaps the previous section, which ends at 0x102"},
+		{[]Section{{Name: "a", Start: 0x80}}, Config{Origin: 0x100}, "section a at 0x80 overlaps"},
+		{[]Section{{Name: "a", Start: 0x102, Align: 4}}, Config{}, "flat: section a at 0x102 is not 4-byte aligned"},
+		{[]Section{{Name: "a", Align: 3}}, Config{}, "flat: section a alignment 3 is not a power of two"},
+		{[]Section{{Name: "a"}}, Config{Align: 6}, "alignment 6 is not a power of two"},
+		{[]Section{{Name: "a"}, {Name: "a"}}, Config{}, "flat: duplicate section a"},
+		{[]Section{{Name: "a"}}, Config{Sections: []string{"b"}}, "flat: no section b to order"},
+		{[]Section{{Name: "a"}}, Config{Sections: []string{"a", "a"}}, "flat: section a ordered twice"},
+		{[]Section{{Name: "a", Symbols: []Symbol{{"x", 0, 0}}}, {Name: "b", Symbols: []Symbol{{"x", 0, 0}}}}, Config{}, "flat: duplicate symbol x"},
+		{[]Section{{Name: "a", Symbols: []Symbol{{"a", 0, 0}}}}, Config{}, "flat: duplicate symbol a"},
+		{[]Section{{Name: "a", Data: []byte{1}, Bss: 1, Symbols: []Symbol{{"x", 1, 2}}}}, Config{}, "flat: symbol x outside section a"},
+	}
+	for _, test := range tests {
+		if _, _, err := Link(test.sections, test.c); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%+v: got %v, want %q", test.sections, err, test.want)
+		}
+	}
+}
+
+// The symbol map sidecar of an image reads back as its map
+func TestMap(t *testing.T) {
+	_, m, err := Link(sections(), Config{Origin: 0x1000, Sections: []string{"b"}, Align: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteMap(&b, m); err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.SplitN(b.String(), "\n", 2)[0]; line != "00001000 00000005 b" {
+		t.Errorf("first line %q", line)
+	}
+	if got, err := ReadMap(&b); !reflect.DeepEqual(got, m) || err != nil {
+		t.Errorf("read back %v, %v", got, err)
+	}
+
+	// Addresses past 32 bits widen every line
+	m = Map{entry(0, 0x10, "low", ""), entry(0xfffffff8, 0x10, "high", "top")}
+	b.Reset()
+	WriteMap(&b, m)
+	if want := "0000000000000000 0000000000000010 low\n00000000fffffff8 0000000000000010 high top\n"; b.String() != want {
+		t.Errorf("wrote %q", b.String())
+	}
+	if got, err := ReadMap(&b); !reflect.DeepEqual(got, m) || err != nil {
+		t.Errorf("read back %v, %v", got, err)
+	}
+
+	for _, text := range []string{"1000 5", "1000 5 b x y", "x000 5 b", "1000 -5 b"} {
+		if _, err := ReadMap(strings.NewReader(text + "\n")); err == nil || !strings.HasPrefix(err.Error(), "flat: malformed map") {
+			t.Errorf("%q: got %v", text, err)
+		}
+	}
+}
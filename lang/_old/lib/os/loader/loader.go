@@ -0,0 +1,169 @@
+// The process loader.  A binary addresses its code, data and stack segments
+// each from zero, and the loader chooses the base address of each segment
+// and applies the relocations of the code against those bases, so that
+// programs never depend on where they are placed or on the page size.
+// Bytecode kept by a binary is run in the VM, which addresses segments by
+// id, and its machine code natively.
+package loader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/bytelang"
+	"github.com/vvanpo/system/lang/lib/os/elf"
+	"io"
+	"math/rand"
+	"os"
+)
+
+// Bases are the base addresses of the segments, by lang.Segment
+type Bases [3]uint64
+
+// An Image is a binary placed at its bases, with its relocations applied
+type Image struct {
+	Bases    Bases
+	Segments [3][]byte // Contents of the segments, the stack zeroed
+	Entry    uint64    // Address of the entry point
+	file     *lang.File
+	bytelang *bytelang.Bytelang // Kept bytecode, if any
+}
+
+var segmentName = map[lang.Segment]string{
+	lang.CodeSegment:  "code",
+	lang.DataSegment:  "data",
+	lang.StackSegment: "stack",
+}
+
+// Read a binary, either an executable written by elf.Write or a .bytelang
+// file.  The bytecode of a .bytelang file is compiled for x86-64, and kept
+// in the binary.
+func Read(r io.ReaderAt, size int64) (f *lang.File, err error) {
+	magic := make([]byte, 4)
+	if _, err = r.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return
+	}
+	if string(magic) == "\x7fELF" {
+		return elf.Read(r)
+	}
+	b, err := bytelang.Read(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return
+	}
+	o, err := b.CompileAMD64()
+	if err != nil {
+		return
+	}
+	if f, err = o.File(); err != nil {
+		return
+	}
+	f.Bytelang = []byte(b.Compile())
+	return
+}
+
+// Load places a binary at its bases, which may not overlap, and relocates
+// its code.  Relocated fields are little-endian, as on x86.
+func Load(f *lang.File, bases Bases) (img *Image, err error) {
+	img = &Image{Bases: bases, file: f}
+	img.Segments[lang.CodeSegment] = append([]byte(nil), f.Code...)
+	img.Segments[lang.DataSegment] = append([]byte(nil), f.Data...)
+	img.Segments[lang.StackSegment] = make([]byte, f.Stack)
+	for i, s := range img.Segments {
+		end := bases[i] + uint64(len(s))
+		if end < bases[i] {
+			return nil, fmt.Errorf("loader: %s segment overflows the address space", segmentName[lang.Segment(i)])
+		}
+		for j := 0; j < i; j++ {
+			if bases[i] < bases[j]+uint64(len(img.Segments[j])) && bases[j] < end {
+				return nil, fmt.Errorf("loader: %s and %s segments overlap", segmentName[lang.Segment(j)], segmentName[lang.Segment(i)])
+			}
+		}
+	}
+	if f.Entry >= uint(len(f.Code)) && len(f.Code) > 0 {
+		return nil, fmt.Errorf("loader: entry point %#x outside the code segment", f.Entry)
+	}
+	img.Entry = bases[lang.CodeSegment] + uint64(f.Entry)
+	for _, r := range f.Relocations {
+		if err = img.relocate(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.Bytelang) > 0 {
+		if img.bytelang, err = bytelang.Decode(string(f.Bytelang)); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// relocate patches the code with the base address of a segment
+func (img *Image) relocate(r lang.Relocation) error {
+	code := img.Segments[lang.CodeSegment]
+	width := uint64(4)
+	if r.Type == lang.RelAbs64 {
+		width = 8
+	}
+	off := uint64(r.Offset)
+	if off+width < off || off+width > uint64(len(code)) {
+		return fmt.Errorf("loader: relocation at %#x outside the code segment", off)
+	}
+	if r.Segment < lang.CodeSegment || r.Segment > lang.StackSegment {
+		return fmt.Errorf("loader: relocation at %#x against invalid segment %d", off, r.Segment)
+	}
+	v := int64(img.Bases[r.Segment]) + r.Addend
+	switch r.Type {
+	case lang.RelPC32:
+		v -= int64(img.Bases[lang.CodeSegment] + off)
+		if v != int64(int32(v)) {
+			return fmt.Errorf("loader: relocation at %#x out of range of the %s segment", off, segmentName[r.Segment])
+		}
+		binary.LittleEndian.PutUint32(code[off:], uint32(v))
+	case lang.RelAbs32:
+		if uint64(v) > 0xffffffff {
+			return fmt.Errorf("loader: relocation at %#x out of range of the %s segment", off, segmentName[r.Segment])
+		}
+		binary.LittleEndian.PutUint32(code[off:], uint32(v))
+	case lang.RelAbs64:
+		binary.LittleEndian.PutUint64(code[off:], uint64(v))
+	default:
+		return fmt.Errorf("loader: invalid relocation type %d", r.Type)
+	}
+	return nil
+}
+
+// Symbol returns the address of a symbol
+func (img *Image) Symbol(name string) (addr uint64, ok bool) {
+	for _, s := range img.file.Symbols {
+		if s.Name == name {
+			return img.Bases[s.Segment] + uint64(s.Value), true
+		}
+	}
+	return
+}
+
+// Randomize chooses random bases for a binary, aligned to pages, in a random
+// order and within a gigabyte of each other so that the code reaches the
+// other segments by 32-bit displacements
+func Randomize(f *lang.File, r *rand.Rand) (bases Bases) {
+	page := uint64(os.Getpagesize())
+	lengths := [3]uint64{uint64(len(f.Code)), uint64(len(f.Data)), uint64(f.Stack)}
+	// Above the low 4GiB, and below the top of 47-bit user address spaces
+	addr := (1<<32 + uint64(r.Int63n(1<<46))) &^ (page - 1)
+	for _, i := range r.Perm(len(bases)) {
+		addr += uint64(r.Int63n(1<<28)) &^ (page - 1)
+		bases[i] = addr
+		addr += (lengths[i] + page - 1) &^ (page - 1)
+	}
+	return
+}
+
+// RunVM runs the bytecode of the image in a new virtual machine, serving its
+// system calls from sys.  The VM addresses memory by segment id and offset,
+// and bytecode sees only such addresses, natively too, so the run is the
+// same at any bases and the bases of the image are not applied.
+func (img *Image) RunVM(sys bytelang.System, modules ...*bytelang.Bytelang) (status uint, err error) {
+	if img.bytelang == nil {
+		return 0, fmt.Errorf("loader: binary has no bytecode")
+	}
+	return img.bytelang.RunSystem(sys, modules...)
+}
@@ -0,0 +1,224 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/asmlang"
+	"github.com/vvanpo/system/lang/bytelang"
+	lelf "github.com/vvanpo/system/lang/lib/os/elf"
+)
+
+var programs = []struct {
+	name   string
+	source string
+	status uint // Zero to compare the VM and native code alone
+	fault  bool
+}{
+	{"exit", `
+		allocate 8
+		store rel fp 8 literal 42
+		deallocate 8
+	`, 42, false},
+	{"function call", `
+		allocate 16
+		store rel sp 0 literal 6
+		store bytes 0 rel sp 0 call double
+		store rel fp 8 load rel sp 0
+		deallocate 16
+		double:
+		function
+			allocate 8
+			store rel sp 0 literal 2
+			allocate 8
+			store rel sp 0 load rel fp 8
+			store rel fp 8 mult
+			return
+		end
+	`, 12, false},
+	// The bytecode is in the data segment of native code, which addresses
+	// it through relocations
+	{"bytecode read", `
+		allocate 8
+		store rel fp 8 load segment 1 8
+		deallocate 8
+	`, 0, false},
+	// Addresses seen by bytecode are segment ids and offsets, whatever the
+	// bases
+	{"instruction pointer", `
+		allocate 8
+		store rel fp 8 load val ip
+		deallocate 8
+	`, 1<<48 | 0x11, false},
+	{"fault", `
+		allocate 8
+		store rel fp 8 load segment 9 0
+		deallocate 8
+	`, ^uint(0), true},
+}
+
+// read returns the binary of the .bytelang file of a program
+func read(t *testing.T, source string) *lang.File {
+	b, err := asmlang.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// checkBases checks that random bases are aligned to pages, and place the
+// segments apart within a gigabyte
+func checkBases(t *testing.T, f *lang.File, bases Bases) {
+	page := uint64(os.Getpagesize())
+	lengths := Bases{uint64(len(f.Code)), uint64(len(f.Data)), uint64(f.Stack)}
+	low, high := bases[0], bases[0]+lengths[0]
+	for i, b := range bases {
+		if b%page != 0 || b < 1<<32 || b+lengths[i] > 1<<47 {
+			t.Errorf("bases %#x: %s segment misplaced", bases, segmentName[lang.Segment(i)])
+		}
+		if b < low {
+			low = b
+		}
+		if b+lengths[i] > high {
+			high = b + lengths[i]
+		}
+	}
+	if high-low >= 1<<30 {
+		t.Errorf("bases %#x span %#x bytes", bases, high-low)
+	}
+}
+
+// Programs run to the same status in the VM and natively, wherever their
+// segments are placed
+func TestRandomize(t *testing.T) {
+	native := runtime.GOOS == "linux" && runtime.GOARCH == "amd64"
+	r := rand.New(rand.NewSource(1))
+	for _, p := range programs {
+		f := read(t, p.source)
+		if p.name == "bytecode read" && len(f.Relocations) == 0 {
+			t.Errorf("%s: no relocations", p.name)
+		}
+		for i := 0; i < 20; i++ {
+			bases := Randomize(f, r)
+			checkBases(t, f, bases)
+			img, err := Load(f, bases)
+			if err != nil {
+				t.Fatalf("%s: bases %#x: %v", p.name, bases, err)
+			}
+			if img.Entry != bases[lang.CodeSegment]+uint64(f.Entry) {
+				t.Errorf("%s: entry %#x", p.name, img.Entry)
+			}
+			status, err := img.RunVM(bytelang.System{})
+			if p.status != 0 && status != p.status || (err != nil) != p.fault {
+				t.Errorf("%s: runs in the VM to %#x, %v", p.name, status, err)
+			}
+			if !native {
+				continue
+			}
+			nstatus, reason, err := img.RunNative()
+			if err != nil || nstatus != status || (reason != 0) != p.fault {
+				t.Errorf("%s: bases %#x: runs natively to %#x, reason %d, %v; the VM to %#x", p.name, bases, nstatus, reason, err, status)
+			}
+		}
+	}
+	if !native {
+		t.Skipf("native code is not run on %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+}
+
+// An executable written by elf.Write loads like the .bytelang file it came
+// from
+func TestReadELF(t *testing.T) {
+	f := read(t, programs[1].source)
+	rd, err := lelf.Write(*f, elf.ELFDATA2LSB, elf.ELFCLASS64, elf.EM_X86_64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Read(rd, rd.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases := Randomize(g, rand.New(rand.NewSource(2)))
+	img, err := Load(g, bases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := img.RunVM(bytelang.System{}); status != 12 || err != nil {
+		t.Errorf("runs in the VM to %d, %v", status, err)
+	}
+	if addr, ok := img.Symbol("function.0"); !ok || addr < bases[lang.CodeSegment] || addr >= bases[lang.CodeSegment]+uint64(len(g.Code)) {
+		t.Errorf("function.0 at %#x, %v; code at %#x", addr, ok, bases[lang.CodeSegment])
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	f := &lang.File{
+		Code:  make([]byte, 24),
+		Data:  []byte{1},
+		Stack: 16,
+		Relocations: []lang.Relocation{
+			{Offset: 0, Type: lang.RelAbs64, Segment: lang.DataSegment, Addend: 3},
+			{Offset: 8, Type: lang.RelPC32, Segment: lang.StackSegment, Addend: -4},
+			{Offset: 12, Type: lang.RelAbs32, Segment: lang.CodeSegment},
+			{Offset: 16, Type: lang.RelAbs64, Segment: lang.StackSegment, Addend: 16},
+		},
+	}
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 100; i++ {
+		// Apart, and within 1GiB for the 32-bit relocations
+		var bases Bases
+		for j, k := range r.Perm(3) {
+			bases[k] = uint64(j)<<28 + uint64(r.Intn(1<<27))
+		}
+		img, err := Load(f, bases)
+		if err != nil {
+			t.Fatalf("bases %#x: %v", bases, err)
+		}
+		code := img.Segments[lang.CodeSegment]
+		le := binary.LittleEndian
+		if le.Uint64(code) != bases[1]+3 || le.Uint32(code[8:]) != uint32(bases[2]-4-(bases[0]+8)) ||
+			le.Uint32(code[12:]) != uint32(bases[0]) || le.Uint64(code[16:]) != bases[2]+16 {
+			t.Errorf("bases %#x: code % x", bases, code)
+		}
+		if len(f.Code) != len(code) || bytes.Equal(f.Code, code) {
+			t.Fatal("the binary was relocated in place")
+		}
+	}
+
+	tests := []struct {
+		bases       Bases
+		relocations []lang.Relocation
+		want        string
+	}{
+		{Bases{0, 0x10, 0x100}, nil, "code and data segments overlap"},
+		{Bases{0, 0x100, 0x100}, nil, "data and stack segments overlap"},
+		{Bases{0x100, 0x200, 0x108}, nil, "code and stack segments overlap"},
+		{Bases{^uint64(0) - 8, 0, 0x100}, nil, "code segment overflows"},
+		{Bases{0, 1 << 40, 1 << 41}, []lang.Relocation{{Offset: 8, Type: lang.RelPC32, Segment: lang.DataSegment}}, "out of range of the data segment"},
+		{Bases{0, 1 << 40, 1 << 41}, []lang.Relocation{{Offset: 8, Type: lang.RelAbs32, Segment: lang.StackSegment}}, "out of range of the stack segment"},
+		{Bases{0, 0x100, 0x200}, []lang.Relocation{{Offset: 20, Type: lang.RelAbs64}}, "outside the code segment"},
+		{Bases{0, 0x100, 0x200}, []lang.Relocation{{Offset: 0, Type: lang.RelAbs64, Segment: 3}}, "invalid segment 3"},
+	}
+	for _, test := range tests {
+		g := *f
+		g.Relocations = test.relocations
+		if _, err := Load(&g, test.bases); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("bases %#x: got %v, want %q", test.bases, err, test.want)
+		}
+	}
+}
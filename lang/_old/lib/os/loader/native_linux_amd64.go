@@ -0,0 +1,218 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	isa "github.com/vvanpo/system/lang/asm/x86"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Linux system calls made by the start routine
+const (
+	sysWrite     = 1
+	sysExitGroup = 231
+)
+
+// The lowest address the start routine is placed at
+const stubBase = 0x400000
+
+// RunNative runs the machine code of the image in a child process of the
+// host: a static executable whose segments are mapped at their bases, which
+// must be aligned to pages, and whose start routine calls the entry point on
+// the stack segment.  The stack segment must hold at least
+// bytelang.NativeStack bytes.  It returns the exit status, and the fault
+// reason of native code; the image's data segment is left as the process
+// left it.
+func (img *Image) RunNative() (status, reason uint, err error) {
+	page := uint64(os.Getpagesize())
+	for i, b := range img.Bases {
+		if b%page != 0 {
+			return 0, 0, fmt.Errorf("loader: %s segment not aligned to a page", segmentName[lang.Segment(i)])
+		}
+	}
+	if len(img.Segments[lang.CodeSegment]) == 0 {
+		return 0, 0, errors.New("loader: binary has no machine code")
+	}
+	exe, err := img.executable(page)
+	if err != nil {
+		return
+	}
+	out, err := run(exe)
+	if err != nil {
+		return 0, 0, fmt.Errorf("loader: native process: %v", err)
+	}
+	data := img.Segments[lang.DataSegment]
+	if len(out) != 16+len(data) {
+		return 0, 0, fmt.Errorf("loader: native process wrote %d bytes, want %d", len(out), 16+len(data))
+	}
+	copy(data, out[16:])
+	le := binary.LittleEndian
+	return uint(le.Uint64(out)), uint(le.Uint64(out[8:])), nil
+}
+
+// executable returns the image as a static executable.  Its start routine
+// calls the entry point, writes the returned rax and rcx to standard output
+// followed by the data segment, and exits.
+func (img *Image) executable(page uint64) ([]byte, error) {
+	round := func(n uint64) uint64 { return (n + page - 1) &^ (page - 1) }
+	// The start routine takes the first page that no segment overlaps
+	stub := uint64(stubBase)
+	for moved := true; moved; {
+		moved = false
+		for i, s := range img.Segments {
+			if b := img.Bases[i]; len(s) > 0 && stub < b+round(uint64(len(s))) && b < stub+page {
+				stub, moved = b+round(uint64(len(s))), true
+			}
+		}
+	}
+	code, entry, err := start(stub, img.Entry,
+		img.Bases[lang.StackSegment]+uint64(len(img.Segments[lang.StackSegment])),
+		img.Bases[lang.DataSegment], uint64(len(img.Segments[lang.DataSegment])))
+	if err != nil {
+		return nil, err
+	}
+
+	// A loadable segment of the start routine, then of each segment
+	type load struct {
+		addr  uint64
+		data  []byte
+		memsz uint64
+		flags elf.ProgFlag
+	}
+	loads := []load{{stub, code, uint64(len(code)), elf.PF_R | elf.PF_X}}
+	flags := [3]elf.ProgFlag{elf.PF_R | elf.PF_X, elf.PF_R | elf.PF_W, elf.PF_R | elf.PF_W}
+	for i, s := range img.Segments {
+		if len(s) == 0 {
+			continue
+		}
+		l := load{img.Bases[i], s, uint64(len(s)), flags[i]}
+		if lang.Segment(i) == lang.StackSegment {
+			l.data = nil
+		}
+		loads = append(loads, l)
+	}
+
+	var b bytes.Buffer
+	headers := uint64(64 + 56*len(loads))
+	h := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     uint16(len(loads)),
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&b, binary.LittleEndian, h)
+	off := round(headers)
+	for _, l := range loads {
+		binary.Write(&b, binary.LittleEndian, elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(l.flags),
+			Off:    off,
+			Vaddr:  l.addr,
+			Paddr:  l.addr,
+			Filesz: uint64(len(l.data)),
+			Memsz:  l.memsz,
+			Align:  page,
+		})
+		off += round(uint64(len(l.data)))
+	}
+	for _, l := range loads {
+		b.Write(make([]byte, round(uint64(b.Len()))-uint64(b.Len())))
+		b.Write(l.data)
+	}
+	return b.Bytes(), nil
+}
+
+// start assembles the start routine at addr, returning it and the address
+// of its entry.  A subroutine writing rdx bytes at rsi to standard output
+// precedes the entry, so that every jump is backward.
+func start(addr, entry, stack, data, length uint64) (code []byte, start uint64, err error) {
+	labels := make(map[string]uint64)
+	asm := func(mnemonic string, operands ...isa.Operand) {
+		if err != nil {
+			return
+		}
+		var b []byte
+		b, err = isa.Encode(isa.Mode64, addr+uint64(len(code)), mnemonic, operands...)
+		code = append(code, b...)
+	}
+	label := func(name string) {
+		labels[name] = addr + uint64(len(code))
+	}
+	label("fail")
+	asm("mov", isa.EAX, isa.Imm(sysExitGroup))
+	asm("mov", isa.EDI, isa.Imm(1))
+	asm("syscall")
+	label("loop")
+	asm("mov", isa.EAX, isa.Imm(sysWrite))
+	asm("mov", isa.EDI, isa.Imm(1))
+	asm("syscall")
+	asm("test", isa.RAX, isa.RAX)
+	asm("jle", isa.Rel(labels["fail"]))
+	asm("add", isa.RSI, isa.RAX)
+	asm("sub", isa.RDX, isa.RAX)
+	label("write")
+	asm("test", isa.RDX, isa.RDX)
+	asm("jnz", isa.Rel(labels["loop"]))
+	asm("ret")
+
+	label("start")
+	asm("mov", isa.RSP, isa.Imm(stack&^15))
+	asm("mov", isa.RAX, isa.Imm(entry))
+	asm("call", isa.RAX)
+	asm("push", isa.RCX)
+	asm("push", isa.RAX)
+	asm("mov", isa.RSI, isa.RSP)
+	asm("mov", isa.EDX, isa.Imm(16))
+	asm("call", isa.Rel(labels["write"]))
+	asm("mov", isa.RSI, isa.Imm(data))
+	asm("mov", isa.RDX, isa.Imm(length))
+	asm("call", isa.Rel(labels["write"]))
+	asm("mov", isa.EAX, isa.Imm(sysExitGroup))
+	asm("xor", isa.EDI, isa.EDI)
+	asm("syscall")
+	return code, labels["start"], err
+}
+
+// run writes an executable to a temporary file, and returns the standard
+// output of running it
+func run(exe []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "native-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(exe)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Another thread forking while the file was open for writing makes it
+	// briefly busy
+	for i := 0; ; i++ {
+		out, err := exec.Command(f.Name()).Output()
+		if !errors.Is(err, syscall.ETXTBSY) || i == 10 {
+			return out, err
+		}
+		time.Sleep(time.Duration(i+1) * time.Millisecond)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !amd64
+
+package loader
+
+import "errors"
+
+// RunNative is unsupported on this host
+func (img *Image) RunNative() (status, reason uint, err error) {
+	return 0, 0, errors.New("loader: native processes are unsupported on this host")
+}
@@ -0,0 +1,262 @@
+// Multiboot kernel images
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+const (
+	magic        = 0x1badb002
+	flagAddress  = 1 << 16 // Header fields give the load addresses
+	headerLength = 32
+	searchLength = 8192 // The header is within this many bytes of the image
+	minAddress   = 0x100000
+	elfOffset    = 0x1000 // File offset of the loaded contents of an ELF image
+)
+
+type Format int
+
+const (
+	Flat Format = iota // Loaded according to the address fields of the header
+	ELF                // Loaded according to ELF program headers
+)
+
+type Config struct {
+	Format Format
+	Load   uint32 // Physical load address, or 1MiB if zero
+	// I/O port written with the low byte of the exit status once the entry
+	// point returns, if not zero, such as that of QEMU's isa-debug-exit device
+	ExitPort uint16
+}
+
+// Compile compiles a Bytelang structure for i386 and links it into a kernel
+// image
+func Compile(b *bytelang.Bytelang, c Config) (image []byte, err error) {
+	o, err := b.CompileI386()
+	if err != nil {
+		return
+	}
+	return Build(o, c)
+}
+
+// Build links an i386 object into a kernel image that a multiboot loader,
+// such as qemu-system-i386 -kernel, loads at the configured address.  A boot
+// stub sets up a stack and calls the entry point, halting once it returns.
+// The text, data and bss sections follow the stub, each 16-byte aligned, and
+// the stack follows the bss.  The image is checked before it is returned.
+func Build(o *bytelang.Object, c Config) (image []byte, err error) {
+	if o.Arch != "386" {
+		return nil, fmt.Errorf("multiboot: image requires a 386 object, not %q", o.Arch)
+	}
+	entry, ok := symbol(o, o.Entry)
+	if !ok || entry.Section != bytelang.Text {
+		return nil, fmt.Errorf("multiboot: undefined entry point %s", o.Entry)
+	}
+	load := uint(c.Load)
+	if load == 0 {
+		load = minAddress
+	}
+	align := func(n uint) uint { return (n + 15) &^ 15 }
+	stub := uint(headerLength)
+	stubLength := uint(14)
+	if c.ExitPort != 0 {
+		stubLength += 5
+	}
+	text := align(stub + stubLength)
+	data := align(text + uint(len(o.Text)))
+	end := data + uint(len(o.Data))
+	bss := align(end)
+	stack := align(bss+o.Bss) + bytelang.NativeStack
+	base := map[bytelang.Section]uint{bytelang.Text: load + text, bytelang.Data: load + data, bytelang.Bss: load + bss}
+
+	image = make([]byte, end)
+	put := func(off uint, v uint) {
+		binary.LittleEndian.PutUint32(image[off:], uint32(v))
+	}
+	flags := uint(flagAddress)
+	if c.Format == ELF {
+		flags = 0
+	}
+	put(0, magic)
+	put(4, flags)
+	put(8, -(magic+flags)&0xffffffff)
+	put(12, load)
+	put(16, load)
+	put(20, load+end)
+	put(24, load+stack)
+	put(28, load+stub)
+
+	image[stub] = 0xbc // mov esp, stack
+	put(stub+1, load+stack)
+	image[stub+5] = 0xe8 // call entry
+	put(stub+6, base[bytelang.Text]+entry.Value-(load+stub+10))
+	halt := stub + 10
+	if c.ExitPort != 0 {
+		image[halt] = 0x66 // mov dx, port
+		image[halt+1] = 0xba
+		binary.LittleEndian.PutUint16(image[halt+2:], c.ExitPort)
+		image[halt+4] = 0xee // out dx, al
+		halt += 5
+	}
+	copy(image[halt:], []byte{0xfa, 0xf4, 0xeb, 0xfd}) // cli; hlt; jmp to hlt
+
+	copy(image[text:], o.Text)
+	copy(image[data:], o.Data)
+	for _, r := range o.Relocations {
+		s := base[r.Section]
+		if r.Symbol != "" {
+			sym, ok := symbol(o, r.Symbol)
+			if !ok {
+				return nil, fmt.Errorf("multiboot: undefined symbol %s", r.Symbol)
+			}
+			s = base[sym.Section] + sym.Value
+		}
+		p := text + r.Offset
+		v := int64(s) + r.Addend
+		switch r.Type {
+		case lang.RelAbs32:
+		case lang.RelPC32:
+			v -= int64(load + p)
+		default:
+			return nil, errors.New("multiboot: 64-bit relocation in 386 object")
+		}
+		put(p, uint(v))
+	}
+	if c.Format == ELF {
+		image = wrap(image, load, load+stub, load+stack)
+	}
+	if _, err = Check(image); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func symbol(o *bytelang.Object, name string) (bytelang.Symbol, bool) {
+	for _, s := range o.Symbols {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return bytelang.Symbol{}, false
+}
+
+// wrap places a flat image in an ELF executable with a single loadable
+// segment, which extends to the end of the stack
+func wrap(flat []byte, load, entry, end uint) []byte {
+	var b bytes.Buffer
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&b, binary.LittleEndian, elf.Header32{
+		Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_386),
+		Version: uint32(elf.EV_CURRENT), Entry: uint32(entry), Phoff: 52,
+		Ehsize: 52, Phentsize: 32, Phnum: 1, Shentsize: 40,
+	})
+	binary.Write(&b, binary.LittleEndian, elf.Prog32{
+		Type: uint32(elf.PT_LOAD), Off: elfOffset, Vaddr: uint32(load), Paddr: uint32(load),
+		Filesz: uint32(len(flat)), Memsz: uint32(end - load),
+		Flags: uint32(elf.PF_R | elf.PF_W | elf.PF_X), Align: 0x1000,
+	})
+	b.Write(make([]byte, elfOffset-b.Len()))
+	b.Write(flat)
+	return b.Bytes()
+}
+
+// A Header is the multiboot header of an image
+type Header struct {
+	Offset      uint // Offset of the header into the image
+	Flags       uint32
+	HeaderAddr  uint32
+	LoadAddr    uint32
+	LoadEndAddr uint32
+	BssEndAddr  uint32
+	EntryAddr   uint32
+}
+
+// Check verifies that an image satisfies the multiboot specification, as
+// loaded by its address fields or as an i386 ELF executable.  Images must be
+// loaded at or above 1MiB, and request no features other than page-aligned
+// modules and memory information.
+func Check(image []byte) (h Header, err error) {
+	word := func(off uint) uint32 { return binary.LittleEndian.Uint32(image[off:]) }
+	found := false
+	for off := uint(0); off+12 <= uint(len(image)) && off < searchLength; off += 4 {
+		if word(off) == magic && word(off)+word(off+4)+word(off+8) == 0 {
+			h.Offset, h.Flags, found = off, word(off+4), true
+			break
+		}
+	}
+	if !found {
+		return h, errors.New("multiboot: no header in the first 8192 bytes")
+	}
+	if required := h.Flags & 0xffff &^ 3; required != 0 {
+		return h, fmt.Errorf("multiboot: unsupported required flags %#x", required)
+	}
+	if h.Flags&flagAddress == 0 {
+		return h, checkELF(image)
+	}
+	if h.Offset+headerLength > uint(len(image)) {
+		return h, errors.New("multiboot: truncated header")
+	}
+	h.HeaderAddr, h.LoadAddr, h.LoadEndAddr = word(h.Offset+12), word(h.Offset+16), word(h.Offset+20)
+	h.BssEndAddr, h.EntryAddr = word(h.Offset+24), word(h.Offset+28)
+	switch {
+	case h.LoadAddr < minAddress:
+		return h, fmt.Errorf("multiboot: load address %#x below 1MiB", h.LoadAddr)
+	case h.HeaderAddr < h.LoadAddr || uint(h.HeaderAddr-h.LoadAddr) > h.Offset:
+		return h, fmt.Errorf("multiboot: header address %#x outside the image", h.HeaderAddr)
+	}
+	// Offset into the image from which it is loaded
+	start := h.Offset - uint(h.HeaderAddr-h.LoadAddr)
+	loadEnd := uint(h.LoadEndAddr)
+	if h.LoadEndAddr == 0 {
+		loadEnd = uint(h.LoadAddr) + uint(len(image)) - start
+	}
+	switch {
+	case loadEnd <= uint(h.LoadAddr) || loadEnd-uint(h.LoadAddr) > uint(len(image))-start:
+		return h, fmt.Errorf("multiboot: load end address %#x outside the image", loadEnd)
+	case h.BssEndAddr != 0 && uint(h.BssEndAddr) < loadEnd:
+		return h, fmt.Errorf("multiboot: bss end address %#x below the load end address", h.BssEndAddr)
+	case h.EntryAddr < h.LoadAddr || uint(h.EntryAddr) >= loadEnd:
+		return h, fmt.Errorf("multiboot: entry address %#x not loaded", h.EntryAddr)
+	}
+	return
+}
+
+func checkELF(image []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return fmt.Errorf("multiboot: header without address fields in a file that is not ELF: %v", err)
+	}
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_386 || f.Type != elf.ET_EXEC {
+		return fmt.Errorf("multiboot: ELF image is not an i386 executable")
+	}
+	entry := false
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		switch {
+		case p.Paddr < minAddress:
+			return fmt.Errorf("multiboot: segment loaded at %#x below 1MiB", p.Paddr)
+		case p.Filesz > p.Memsz || p.Off+p.Filesz > uint64(len(image)):
+			return fmt.Errorf("multiboot: segment at %#x outside the image", p.Paddr)
+		}
+		if p.Flags&elf.PF_X != 0 && f.Entry >= p.Vaddr && f.Entry < p.Vaddr+p.Filesz {
+			entry = true
+		}
+	}
+	if !entry {
+		return fmt.Errorf("multiboot: entry address %#x not in a loaded executable segment", f.Entry)
+	}
+	return nil
+}
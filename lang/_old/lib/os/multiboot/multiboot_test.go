@@ -0,0 +1,155 @@
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vvanpo/system/lang/asmlang"
+	"github.com/vvanpo/system/lang/bytelang"
+)
+
+// exit42 exits with status 42
+const exit42 = `
+allocate 8
+store rel sp 0 literal 42
+store rel fp 8 load rel sp 0
+deallocate 8
+`
+
+func program(t *testing.T) *bytelang.Bytelang {
+	b, err := asmlang.Assemble(exit42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var configs = []Config{
+	{},
+	{Format: ELF},
+	{ExitPort: 0xf4},
+	{Format: ELF, ExitPort: 0xf4, Load: 0x200000},
+}
+
+func TestCheck(t *testing.T) {
+	for _, c := range configs {
+		image, err := Compile(program(t), c)
+		if err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+		h, err := Check(image)
+		if err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+		load := c.Load
+		if load == 0 {
+			load = minAddress
+		}
+		if c.Format == Flat {
+			if h.Offset != 0 || h.Flags != flagAddress || h.HeaderAddr != load || h.LoadAddr != load ||
+				h.LoadEndAddr != load+uint32(len(image)) || h.BssEndAddr <= h.LoadEndAddr || h.EntryAddr != load+headerLength {
+				t.Errorf("%+v: header %+v", c, h)
+			}
+			continue
+		}
+		if h.Offset != elfOffset || h.Flags != 0 {
+			t.Errorf("%+v: header %+v", c, h)
+		}
+		f, err := elf.NewFile(bytes.NewReader(image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := f.Progs[0]
+		if f.Entry != uint64(load+headerLength) || p.Paddr != uint64(load) || p.Off != elfOffset || p.Memsz <= p.Filesz {
+			t.Errorf("%+v: entry %#x, segment %+v", c, f.Entry, p.ProgHeader)
+		}
+		// The ELF segment holds the flat image
+		flat, err := Compile(program(t), Config{ExitPort: c.ExitPort, Load: c.Load})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := image[elfOffset:]; !bytes.Equal(got[headerLength:], flat[headerLength:]) {
+			t.Errorf("%+v: segment differs from the flat image", c)
+		}
+	}
+}
+
+func TestCheckRejects(t *testing.T) {
+	image, err := Compile(program(t), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	word := func(b []byte, off int, v uint32) {
+		binary.LittleEndian.PutUint32(b[off:], v)
+	}
+	// header sets a field of the header, keeping the checksum
+	header := func(off int, v uint32) func([]byte) {
+		return func(b []byte) {
+			old := binary.LittleEndian.Uint32(b[off:])
+			word(b, off, v)
+			if off < 12 {
+				word(b, 8, binary.LittleEndian.Uint32(b[8:])+old-v)
+			}
+		}
+	}
+	tests := []struct {
+		mutate func([]byte)
+		want   string
+	}{
+		{func(b []byte) { b[0] = 0 }, "no header"},
+		{func(b []byte) { b[8]++ }, "no header"},
+		{header(4, flagAddress|4), "unsupported required flags 0x4"},
+		{header(16, minAddress/2), "load address 0x80000 below 1MiB"},
+		{header(12, minAddress-headerLength), "header address"},
+		{header(12, minAddress+headerLength), "header address"},
+		{header(20, minAddress+1<<20), "load end address"},
+		{header(24, minAddress+1), "bss end address"},
+		{header(28, minAddress-1), "entry address"},
+		{header(4, 0), "not ELF"},
+	}
+	for _, test := range tests {
+		b := append([]byte{}, image...)
+		test.mutate(b)
+		_, err := Check(b)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %q", err, test.want)
+		}
+	}
+
+	image, err = Compile(program(t), Config{Format: ELF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry point of the ELF header, and the flags of its segment
+	for off, v := range map[int]uint32{24: minAddress - 1, 52 + 24: uint32(elf.PF_R)} {
+		b := append([]byte{}, image...)
+		word(b, off, v)
+		if _, err := Check(b); err == nil || !strings.Contains(err.Error(), "not in a loaded executable segment") {
+			t.Errorf("ELF field at %d: got %v", off, err)
+		}
+	}
+}
+
+func TestBoot(t *testing.T) {
+	if _, err := exec.LookPath("qemu-system-i386"); err != nil {
+		t.Skip("qemu-system-i386 is not installed")
+	}
+	for _, c := range configs {
+		if c.ExitPort == 0 {
+			continue
+		}
+		image, err := Compile(program(t), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := Boot(image, c.ExitPort, 10*time.Second)
+		if err != nil || status != 42 {
+			t.Errorf("%+v: booted to %d, %v", c, status, err)
+		}
+	}
+}
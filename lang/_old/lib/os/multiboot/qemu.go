@@ -0,0 +1,50 @@
+package multiboot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// ErrNoQEMU is returned by Boot where QEMU is not installed
+var ErrNoQEMU = errors.New("multiboot: qemu-system-i386 not found")
+
+// Boot runs an image in QEMU with an isa-debug-exit device at port, as set in
+// the ExitPort of the image's configuration, and returns the exit status.
+// QEMU only reports the low 7 bits of the status.
+func Boot(image []byte, port uint16, timeout time.Duration) (status byte, err error) {
+	qemu, err := exec.LookPath("qemu-system-i386")
+	if err != nil {
+		return 0, ErrNoQEMU
+	}
+	f, err := ioutil.TempFile("", "kernel")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(image)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, qemu, "-kernel", f.Name(), "-display", "none", "-no-reboot",
+		"-device", fmt.Sprintf("isa-debug-exit,iobase=%#x,iosize=1", port))
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("multiboot: no exit after %v", timeout)
+	}
+	// The device exits with the status shifted left and the low bit set
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode()&1 == 0 {
+		return 0, fmt.Errorf("multiboot: qemu: %v: %s", err, out)
+	}
+	return byte(exit.ExitCode() >> 1), nil
+}
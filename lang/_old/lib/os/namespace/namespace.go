@@ -0,0 +1,244 @@
+// Process namespace files, which bind local paths to locations on file
+// servers.  Each line holds an entry, and entries indented by a tab beneath
+// another are bound within it:
+//
+//	/data/bound-file --> server:/some/location	attributes
+//	/home
+//		user --> home:/user	write
+//			tmp --> scratch:/
+//
+// The path of a top-level entry is absolute, and that of a nested entry is
+// relative to its parent.  An entry without a binding only groups the
+// entries beneath it, and paths not bound by any entry belong to the
+// ephemeral root of the process.  Blank lines and lines beginning with # are
+// ignored.
+//
+// Entries sharing a bindpoint form a union directory, as in Plan 9.  They
+// are ordered as in the file, and each is a union with the entries below it
+// unless it has the hide attribute.  A file is found on the first server of
+// the union that has it, and is created on the first with the write
+// attribute.
+package namespace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// The server name of paths in the ephemeral root
+const Root = ""
+
+type Namespace struct {
+	Entries []*Entry
+}
+
+type Entry struct {
+	Path       string // Local path, relative to the parent entry
+	Server     string // Empty for entries without a binding
+	Remote     string // Absolute path on the server
+	Attributes []string
+	Entries    []*Entry
+}
+
+const arrow = "-->"
+
+// Read parses a namespace file
+func Read(r io.Reader) (ns *Namespace, err error) {
+	ns = new(Namespace)
+	parents := []*[]*Entry{&ns.Entries} // Entry lists by depth
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if t := strings.TrimSpace(line); t == "" || t[0] == '#' {
+			continue
+		}
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		if depth >= len(parents) {
+			return nil, fmt.Errorf("namespace: line %d: entry indented beneath no parent", n)
+		}
+		e, err := parseEntry(strings.TrimLeft(line, "\t"))
+		if err != nil {
+			return nil, fmt.Errorf("namespace: line %d: %v", n, err)
+		}
+		parents = parents[:depth+1]
+		*parents[depth] = append(*parents[depth], e)
+		parents = append(parents, &e.Entries)
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	return ns, ns.Validate()
+}
+
+func parseEntry(line string) (e *Entry, err error) {
+	w := strings.Fields(line)
+	if line[0] == ' ' {
+		return nil, errors.New("entries are indented by tabs")
+	}
+	e = &Entry{Path: w[0]}
+	if len(w) == 1 {
+		return
+	}
+	if w[1] != arrow || len(w) < 3 {
+		return nil, fmt.Errorf("expected %s server:/path after %s", arrow, w[0])
+	}
+	i := strings.Index(w[2], ":")
+	if i < 0 {
+		return nil, fmt.Errorf("missing server in %s", w[2])
+	}
+	e.Server, e.Remote, e.Attributes = w[2][:i], w[2][i+1:], w[3:]
+	return
+}
+
+// Write serialises a namespace in the format read by Read
+func Write(w io.Writer, ns *Namespace) error {
+	b := bufio.NewWriter(w)
+	var write func(entries []*Entry, depth int)
+	write = func(entries []*Entry, depth int) {
+		for _, e := range entries {
+			b.WriteString(strings.Repeat("\t", depth) + e.Path)
+			if e.Server != "" {
+				fmt.Fprintf(b, " %s %s:%s", arrow, e.Server, e.Remote)
+				for i, a := range e.Attributes {
+					if i == 0 {
+						b.WriteString("\t" + a)
+					} else {
+						b.WriteString(" " + a)
+					}
+				}
+			}
+			b.WriteString("\n")
+			write(e.Entries, depth+1)
+		}
+	}
+	write(ns.Entries, 0)
+	return b.Flush()
+}
+
+// Validate checks that paths are clean, and that nested entries are
+// relative and top-level ones absolute
+func (ns *Namespace) Validate() error {
+	var validate func(entries []*Entry, parent string) error
+	validate = func(entries []*Entry, parent string) error {
+		for _, e := range entries {
+			local := path.Join(parent, e.Path)
+			switch {
+			case e.Path == "" || path.Clean(e.Path) != e.Path || e.Path == "." || strings.HasPrefix(e.Path, "../") || e.Path == "..":
+				return fmt.Errorf("namespace: invalid path %q", e.Path)
+			case parent == "" && !path.IsAbs(e.Path):
+				return fmt.Errorf("namespace: top-level path %s is not absolute", e.Path)
+			case parent != "" && path.IsAbs(e.Path):
+				return fmt.Errorf("namespace: nested path %s is not relative", e.Path)
+			case e.Server == "" && (e.Remote != "" || len(e.Attributes) > 0):
+				return fmt.Errorf("namespace: %s has no server", local)
+			case e.Server != "" && !validServer(e.Server):
+				return fmt.Errorf("namespace: invalid server name %q", e.Server)
+			case e.Server != "" && (!path.IsAbs(e.Remote) || path.Clean(e.Remote) != e.Remote):
+				return fmt.Errorf("namespace: invalid remote path %q", e.Remote)
+			}
+			for _, a := range e.Attributes {
+				if a == "" || strings.ContainsAny(a, " \t\n") {
+					return fmt.Errorf("namespace: invalid attribute %q of %s", a, local)
+				}
+			}
+			if err := validate(e.Entries, local); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return validate(ns.Entries, "")
+}
+
+func validServer(s string) bool {
+	return !strings.ContainsAny(s, ": \t\n/")
+}
+
+// Attributes of entries
+const (
+	// Hide the entries below the entry at its bindpoint
+	HideAttribute = "hide"
+	// Create files under the bindpoint on the entry's server
+	WriteAttribute = "write"
+)
+
+// A Binding is a location a local path is bound to
+type Binding struct {
+	Server string
+	Remote string
+	Write  bool
+}
+
+// Bindings returns the union a local path is bound to: the entries whose
+// bindpoint is its nearest ancestor, in order, up to the first that hides
+// those below it.  Unbound paths are bound to themselves on Root, which is
+// writable.
+func (ns *Namespace) Bindings(local string) (union []Binding, err error) {
+	if !path.IsAbs(local) {
+		return nil, fmt.Errorf("namespace: %s is not absolute", local)
+	}
+	local = path.Clean(local)
+	bind, hidden := "", false
+	ns.walk(func(b string, e *Entry) {
+		if e.Server == "" || !within(local, b) || len(b) < len(bind) {
+			return
+		}
+		if len(b) > len(bind) {
+			union, bind, hidden = nil, b, false
+		}
+		if hidden {
+			return
+		}
+		union = append(union, Binding{
+			Server: e.Server,
+			Remote: path.Join(e.Remote, strings.TrimPrefix(local, b)),
+			Write:  e.has(WriteAttribute),
+		})
+		hidden = e.has(HideAttribute)
+	})
+	if union == nil {
+		union = []Binding{{Server: Root, Remote: local, Write: true}}
+	}
+	return
+}
+
+// Resolve returns the server and remote path of the first entry of the
+// union a local path is bound to
+func (ns *Namespace) Resolve(local string) (server, remote string, err error) {
+	union, err := ns.Bindings(local)
+	if err != nil {
+		return
+	}
+	return union[0].Server, union[0].Remote, nil
+}
+
+func (e *Entry) has(attribute string) bool {
+	for _, a := range e.Attributes {
+		if a == attribute {
+			return true
+		}
+	}
+	return false
+}
+
+// walk calls fn with each entry and its bindpoint, parents first
+func (ns *Namespace) walk(fn func(bind string, e *Entry)) {
+	var walk func(entries []*Entry, parent string)
+	walk = func(entries []*Entry, parent string) {
+		for _, e := range entries {
+			bind := path.Join(parent, e.Path)
+			fn(bind, e)
+			walk(e.Entries, bind)
+		}
+	}
+	walk(ns.Entries, "")
+}
+
+// within reports whether a path is dir or beneath it
+func within(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
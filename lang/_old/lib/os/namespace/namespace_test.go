@@ -0,0 +1,80 @@
+package namespace
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nested is the example of the package comment, with a comment, a blank
+// line and a second nested entry
+const nested = `/data/bound-file --> server:/some/location	attributes
+# The home directory
+/home
+	user --> home:/user	write
+
+		tmp --> scratch:/
+	guest --> home:/guest	hide write
+`
+
+func TestRead(t *testing.T) {
+	want := &Namespace{Entries: []*Entry{
+		{Path: "/data/bound-file", Server: "server", Remote: "/some/location", Attributes: []string{"attributes"}},
+		{Path: "/home", Entries: []*Entry{
+			{Path: "user", Server: "home", Remote: "/user", Attributes: []string{"write"}, Entries: []*Entry{
+				{Path: "tmp", Server: "scratch", Remote: "/", Attributes: []string{}},
+			}},
+			{Path: "guest", Server: "home", Remote: "/guest", Attributes: []string{"hide", "write"}},
+		}},
+	}}
+	if ns := read(t, nested); !reflect.DeepEqual(ns, want) {
+		t.Errorf("read %+v", ns)
+	}
+	if server, remote, err := want.Resolve("/home/user/tmp/x"); server != "scratch" || remote != "/x" || err != nil {
+		t.Errorf("/home/user/tmp/x resolves to %s:%s, %v", server, remote, err)
+	}
+}
+
+// A namespace reads back as itself once written, in the format of its
+// source less the comments and blank lines
+func TestWrite(t *testing.T) {
+	ns := read(t, nested)
+	var b bytes.Buffer
+	if err := Write(&b, ns); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(strings.Replace(nested, "# The home directory\n", "", 1), "\n\n", "\n", 1)
+	if b.String() != want {
+		t.Errorf("wrote\n%s", b.String())
+	}
+	if got := read(t, b.String()); !reflect.DeepEqual(got, ns) {
+		t.Errorf("read back %+v", got)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"/a\n\t\tb\n", "namespace: line 2: entry indented beneath no parent"},
+		{"\t/a\n", "namespace: line 1: entry indented beneath no parent"},
+		{"/a\n  b\n", "namespace: line 2: entries are indented by tabs"},
+		{"/a -> s:/\n", "namespace: line 1: expected --> server:/path after /a"},
+		{"/a -->\n", "namespace: line 1: expected --> server:/path after /a"},
+		{"/a --> /b\n", "namespace: line 1: missing server in /b"},
+		{"a --> s:/\n", "namespace: top-level path a is not absolute"},
+		{"/a\n\t/b\n", "namespace: nested path /b is not relative"},
+		{"/a/\n", `namespace: invalid path "/a/"`},
+		{"/a\n\t../b\n", `namespace: invalid path "../b"`},
+		{"/a --> s/t:/\n", `namespace: invalid server name "s/t"`},
+		{"/a --> s:b\n", `namespace: invalid remote path "b"`},
+		{"/a --> s:/b/\n", `namespace: invalid remote path "/b/"`},
+	}
+	for _, test := range tests {
+		if _, err := Read(strings.NewReader(test.source)); err == nil || err.Error() != test.want {
+			t.Errorf("%q: got %v, want %q", test.source, err, test.want)
+		}
+	}
+}
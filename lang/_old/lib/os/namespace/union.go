@@ -0,0 +1,153 @@
+package namespace
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// A Server is a file server bound by namespace entries.  An error means the
+// server failed to respond, as opposed to the file not existing.
+type Server interface {
+	// Walk reports whether a file exists
+	Walk(path string) (exists bool, err error)
+	// List returns the names of the files in a directory, or none if it
+	// does not exist
+	List(dir string) (names []string, err error)
+	Create(path string) error
+}
+
+var ErrNotExist = errors.New("namespace: file does not exist")
+
+// Open finds the binding of the union holding a file.  The servers of the
+// union are walked in order, and one that fails to respond fails the open,
+// since whether it holds the file is unknown.
+func (ns *Namespace) Open(local string, servers map[string]Server) (b Binding, err error) {
+	union, err := ns.Bindings(local)
+	if err != nil {
+		return
+	}
+	for _, b = range union {
+		s, err := server(servers, b)
+		if err != nil {
+			return b, err
+		}
+		exists, err := s.Walk(b.Remote)
+		if err != nil {
+			return b, fmt.Errorf("namespace: server %q: %v", b.Server, err)
+		}
+		if exists {
+			return b, nil
+		}
+	}
+	return Binding{}, ErrNotExist
+}
+
+// Create creates a file on the first writable binding of its union.  If the
+// creation fails, it fails entirely rather than cascading down the union.
+func (ns *Namespace) Create(local string, servers map[string]Server) (b Binding, err error) {
+	if path.Clean(local) == "/" {
+		return b, errors.New("namespace: cannot create /")
+	}
+	union, err := ns.Bindings(local)
+	if err != nil {
+		return
+	}
+	for _, b = range union {
+		if !b.Write {
+			continue
+		}
+		s, err := server(servers, b)
+		if err != nil {
+			return b, err
+		}
+		if err := s.Create(b.Remote); err != nil {
+			return b, fmt.Errorf("namespace: server %q: %v", b.Server, err)
+		}
+		return b, nil
+	}
+	return Binding{}, fmt.Errorf("namespace: no writable binding for %s", local)
+}
+
+// List returns the names in a directory of the union, without duplicates,
+// in the order of the union
+func (ns *Namespace) List(local string, servers map[string]Server) (names []string, err error) {
+	union, err := ns.Bindings(local)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, b := range union {
+		s, err := server(servers, b)
+		if err != nil {
+			return nil, err
+		}
+		list, err := s.List(b.Remote)
+		if err != nil {
+			return nil, fmt.Errorf("namespace: server %q: %v", b.Server, err)
+		}
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return
+}
+
+func server(servers map[string]Server, b Binding) (Server, error) {
+	s, ok := servers[b.Server]
+	if !ok {
+		return nil, fmt.Errorf("namespace: no server %q", b.Server)
+	}
+	return s, nil
+}
+
+// Files returns the paths of all files in the namespace, sorted.  Each
+// bindpoint is listed recursively, along with the ephemeral root if servers
+// has one.  A path listing no names is taken to be a file if it exists.
+func (ns *Namespace) Files(servers map[string]Server) (files []string, err error) {
+	var binds []string
+	if _, ok := servers[Root]; ok {
+		binds = append(binds, "/")
+	}
+	ns.walk(func(bind string, e *Entry) {
+		if e.Server != "" {
+			binds = append(binds, bind)
+		}
+	})
+	seen := make(map[string]bool)
+	var list func(p string) error
+	list = func(p string) error {
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		names, err := ns.List(p, servers)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := list(path.Join(p, name)); err != nil {
+				return err
+			}
+		}
+		if len(names) == 0 {
+			if _, err := ns.Open(p, servers); err == nil {
+				files = append(files, p)
+			} else if err != ErrNotExist {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, b := range binds {
+		if err = list(b); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return
+}
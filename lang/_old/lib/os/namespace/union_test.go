@@ -0,0 +1,236 @@
+package namespace
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fake is an in-process file server holding the files of a map, which
+// refuses creations if readOnly
+type fake struct {
+	files    map[string]bool
+	readOnly bool
+}
+
+func newFake(files ...string) *fake {
+	f := &fake{files: make(map[string]bool)}
+	for _, p := range files {
+		f.files[p] = true
+	}
+	return f
+}
+
+func (f *fake) Walk(p string) (bool, error) {
+	if f.files[p] {
+		return true, nil
+	}
+	names, _ := f.List(p)
+	return len(names) > 0, nil
+}
+
+func (f *fake) List(dir string) (names []string, err error) {
+	seen := make(map[string]bool)
+	for p := range f.files {
+		if rel := strings.TrimPrefix(p, dir); within(p, dir) && p != dir {
+			name := strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (f *fake) Create(p string) error {
+	if f.readOnly {
+		return errors.New("read-only file system")
+	}
+	f.files[path.Clean(p)] = true
+	return nil
+}
+
+// unresponsive is a file server that never responds
+type unresponsive struct{}
+
+var errTimeout = errors.New("timed out")
+
+func (unresponsive) Walk(string) (bool, error)     { return false, errTimeout }
+func (unresponsive) List(string) ([]string, error) { return nil, errTimeout }
+func (unresponsive) Create(string) error           { return errTimeout }
+
+// union binds a, b, c and d at /bin, with c hiding d, and tests the failure
+// of unresponsive and read-only servers at /u and /ro
+const union = `/bin --> a:/bin
+/bin --> b:/
+/bin --> c:/	write hide
+/bin --> d:/	write
+/u --> dead:/	write
+/u --> b:/	write
+/ro --> readonly:/	write
+/ro --> b:/	write
+`
+
+func servers() map[string]Server {
+	return map[string]Server{
+		Root:       newFake("/tmp/scratch"),
+		"a":        newFake("/bin/ls"),
+		"b":        newFake("/ls", "/cat", "/lib/libc"),
+		"c":        newFake("/sh"),
+		"d":        newFake("/vi"),
+		"dead":     unresponsive{},
+		"readonly": &fake{files: make(map[string]bool), readOnly: true},
+	}
+}
+
+func read(t *testing.T, s string) *Namespace {
+	ns, err := Read(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+func TestBindings(t *testing.T) {
+	ns := read(t, union+"/bin/sub --> e:/x\n")
+	tests := []struct {
+		local string
+		want  []Binding
+	}{
+		{"/bin/ls", []Binding{{"a", "/bin/ls", false}, {"b", "/ls", false}, {"c", "/ls", true}}},
+		{"/bin/sub/../cat", []Binding{{"a", "/bin/cat", false}, {"b", "/cat", false}, {"c", "/cat", true}}},
+		{"/bin/sub/y", []Binding{{"e", "/x/y", false}}},
+		{"/binary", []Binding{{Root, "/binary", true}}},
+		{"/", []Binding{{Root, "/", true}}},
+	}
+	for _, test := range tests {
+		got, err := ns.Bindings(test.local)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, %v; want %v", test.local, got, err, test.want)
+		}
+	}
+	if _, err := ns.Bindings("bin"); err == nil {
+		t.Error("relative path bound")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ns := read(t, union)
+	tests := []struct {
+		local string
+		want  Binding
+		err   string
+	}{
+		// The first server of the union holding the file
+		{"/bin/ls", Binding{"a", "/bin/ls", false}, ""},
+		{"/bin/cat", Binding{"b", "/cat", false}, ""},
+		{"/bin/sh", Binding{"c", "/sh", true}, ""},
+		{"/bin/lib/libc", Binding{"b", "/lib/libc", false}, ""},
+		// d is hidden by c
+		{"/bin/vi", Binding{}, ErrNotExist.Error()},
+		{"/tmp/scratch", Binding{Root, "/tmp/scratch", true}, ""},
+		// b holds the file, but the unresponsive server precedes it
+		{"/u/ls", Binding{"dead", "/ls", true}, `server "dead": timed out`},
+		{"/ro/ls", Binding{"b", "/ls", true}, ""},
+	}
+	for _, test := range tests {
+		got, err := ns.Open(test.local, servers())
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.local, err, test.err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.local, got, test.want)
+		}
+	}
+
+	// A server bound but not supplied fails the open
+	if _, err := read(t, "/x --> gone:/\n").Open("/x/y", servers()); err == nil || !strings.Contains(err.Error(), `no server "gone"`) {
+		t.Errorf("open on a missing server: got %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ns := read(t, union)
+	tests := []struct {
+		local  string
+		server string // Expected to hold the file
+		err    string
+	}{
+		// The first writable binding, not the first binding
+		{"/bin/new", "c", ""},
+		// b is writable, but creation does not cascade past the failures of
+		// the servers before it
+		{"/u/new", "", `server "dead": timed out`},
+		{"/ro/new", "", `server "readonly": read-only file system`},
+		{"/tmp/new", Root, ""},
+		{"/", "", "cannot create /"},
+	}
+	for _, test := range tests {
+		ss := servers()
+		b, err := ns.Create(test.local, ss)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.local, err, test.err)
+			}
+			if exists, _ := ss["b"].Walk("/new"); exists {
+				t.Errorf("%s: creation cascaded to b", test.local)
+			}
+			continue
+		}
+		if err != nil || b.Server != test.server {
+			t.Errorf("%s: created on %q, %v; want %q", test.local, b.Server, err, test.server)
+			continue
+		}
+		if got, err := ns.Open(test.local, ss); err != nil || got != b {
+			t.Errorf("%s: created as %v, opened as %v, %v", test.local, b, got, err)
+		}
+	}
+
+	if _, err := read(t, "/x --> b:/\n").Create("/x/y", servers()); err == nil || !strings.Contains(err.Error(), "no writable binding") {
+		t.Errorf("create without a writable binding: got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ns := read(t, union)
+	tests := []struct {
+		local string
+		want  []string
+		err   string
+	}{
+		// In the order of the union, without duplicates or hidden names
+		{"/bin", []string{"ls", "cat", "lib", "sh"}, ""},
+		{"/bin/lib", []string{"libc"}, ""},
+		{"/u", nil, `server "dead": timed out`},
+		{"/tmp", []string{"scratch"}, ""},
+	}
+	for _, test := range tests {
+		got, err := ns.List(test.local, servers())
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.local, err, test.err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.local, got, test.want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	ns := read(t, union)
+	ss := servers()
+	if _, err := ns.Files(ss); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("files with an unresponsive server: got %v", err)
+	}
+	delete(ss, "dead")
+	ns = read(t, strings.Replace(union, "/u --> dead:/\twrite\n", "", 1))
+	got, err := ns.Files(ss)
+	want := []string{"/bin/cat", "/bin/lib/libc", "/bin/ls", "/bin/sh", "/ro/cat", "/ro/lib/libc", "/ro/ls", "/tmp/scratch", "/u/cat", "/u/lib/libc", "/u/ls"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+}
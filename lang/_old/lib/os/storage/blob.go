@@ -0,0 +1,169 @@
+// Content-addressed file storage, after the architecture of Camlistore.
+//
+// A store holds immutable blobs, each named by a ref: the hash of its
+// contents.  The contents of a file are split into chunks at boundaries
+// chosen by a rolling checksum, so that an edit changes only the chunks
+// around it, and each chunk is a blob.  A file schema blob lists the refs of
+// a file's chunks, and its ref is the root of the file's contents.
+//
+// Names are mutable, so they are not blobs themselves but claims: schema
+// blobs that bind a name to a content root at a version.  The claim of the
+// highest version names the current contents, and earlier contents remain
+// in the store.  Claims may be signed, in which case only those signed by
+// the storage's key are believed.
+//
+// The first byte of a blob gives its kind, chunk or schema, so that no file's
+// contents can be taken for a schema blob, such as a claim.
+//
+// A Storage serves the named files as a fileserver.FileSystem.
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Ref names a blob by the hash of its contents
+type Ref string
+
+const refPrefix = "sha256-"
+
+// RefOf returns the ref of a blob
+func RefOf(blob []byte) Ref {
+	sum := sha256.Sum256(blob)
+	return Ref(refPrefix + hex.EncodeToString(sum[:]))
+}
+
+// Valid reports whether the ref is well formed
+func (r Ref) Valid() bool {
+	h := strings.TrimPrefix(string(r), refPrefix)
+	if h == string(r) || len(h) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// A Store holds blobs by their refs
+type Store interface {
+	Get(r Ref) ([]byte, error)
+	Put(blob []byte) (Ref, error)
+	// Enumerate calls fn with the ref of each blob, in no particular order
+	Enumerate(fn func(Ref) error) error
+}
+
+var ErrNotFound = errors.New("storage: blob not found")
+
+// Kinds of blob
+const (
+	chunkBlob  byte = 'c'
+	schemaBlob byte = 's'
+)
+
+// tag returns the blob of a kind holding b
+func tag(kind byte, b []byte) []byte {
+	return append([]byte{kind}, b...)
+}
+
+// untag returns what a blob of a kind holds, or false if it is of another
+func untag(kind byte, blob []byte) ([]byte, bool) {
+	if len(blob) == 0 || blob[0] != kind {
+		return nil, false
+	}
+	return blob[1:], true
+}
+
+// A Dir store holds each blob in a file of a local directory, in
+// subdirectories named by the first bytes of the hashes
+type Dir struct {
+	path string
+}
+
+// OpenDir opens a directory as a store, creating it if it does not exist
+func OpenDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+	return &Dir{path}, nil
+}
+
+func (d *Dir) file(r Ref) string {
+	h := strings.TrimPrefix(string(r), refPrefix)
+	return filepath.Join(d.path, h[:2], string(r))
+}
+
+// Get returns a blob, having checked that it matches its ref
+func (d *Dir) Get(r Ref) ([]byte, error) {
+	if !r.Valid() {
+		return nil, fmt.Errorf("storage: invalid ref %q", r)
+	}
+	blob, err := os.ReadFile(d.file(r))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if RefOf(blob) != r {
+		return nil, fmt.Errorf("storage: blob %s is corrupt", r)
+	}
+	return blob, nil
+}
+
+// Put stores a blob, unless the store already holds it
+func (d *Dir) Put(blob []byte) (r Ref, err error) {
+	r = RefOf(blob)
+	name := d.file(r)
+	if _, err = os.Stat(name); err == nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return
+	}
+	// Write to a temporary file first, so that a blob is never partial
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return
+	}
+	if _, err = tmp.Write(blob); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return
+}
+
+func (d *Dir) Enumerate(fn func(Ref) error) error {
+	shards, err := os.ReadDir(d.path)
+	if err != nil {
+		return err
+	}
+	for _, s := range shards {
+		if !s.IsDir() {
+			continue
+		}
+		blobs, err := os.ReadDir(filepath.Join(d.path, s.Name()))
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			if r := Ref(b.Name()); r.Valid() {
+				if err := fn(r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
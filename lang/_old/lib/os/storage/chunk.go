@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Chunk boundaries are where the low bits of a rolling checksum over the
+// last windowSize bytes are all set, giving chunks of 8 KiB on average,
+// within the bounds of minChunk and maxChunk
+const (
+	windowSize = 64
+	charOffset = 31
+	splitBits  = 13
+	minChunk   = 1 << 10
+	maxChunk   = 1 << 16
+)
+
+// A rollsum is the rolling checksum of bup, which Camlistore also uses
+type rollsum struct {
+	s1, s2 uint32
+	window [windowSize]byte
+	i      int
+}
+
+func newRollsum() *rollsum {
+	return &rollsum{
+		s1: windowSize * charOffset,
+		s2: windowSize * (windowSize - 1) * charOffset,
+	}
+}
+
+func (r *rollsum) roll(c byte) {
+	drop := uint32(r.window[r.i])
+	r.s1 += uint32(c) - drop
+	r.s2 += r.s1 - windowSize*(drop+charOffset)
+	r.window[r.i] = c
+	r.i = (r.i + 1) % windowSize
+}
+
+func (r *rollsum) split() bool {
+	const mask = 1<<splitBits - 1
+	return r.s2&mask == mask
+}
+
+// chunks splits data at the boundaries of the rolling checksum
+func chunks(data []byte) (chunks [][]byte) {
+	r := newRollsum()
+	start := 0
+	for i, c := range data {
+		r.roll(c)
+		n := i + 1 - start
+		if n >= maxChunk || n >= minChunk && r.split() {
+			chunks = append(chunks, data[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(data) {
+		chunks = append(chunks, data[start:])
+	}
+	return
+}
+
+// A part of a file's contents
+type part struct {
+	Ref  Ref    `json:"ref"`
+	Size uint64 `json:"size"`
+}
+
+// The schema blob of a file's contents
+type fileSchema struct {
+	Type  string `json:"type"` // Always "file"
+	Parts []part `json:"parts"`
+}
+
+// WriteContents stores the chunks of data and their file schema, and
+// returns the content root
+func WriteContents(s Store, data []byte) (root Ref, err error) {
+	f := fileSchema{Type: "file", Parts: []part{}}
+	for _, c := range chunks(data) {
+		r, err := s.Put(tag(chunkBlob, c))
+		if err != nil {
+			return "", err
+		}
+		f.Parts = append(f.Parts, part{r, uint64(len(c))})
+	}
+	blob, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	return s.Put(tag(schemaBlob, blob))
+}
+
+// Contents are the contents of a file, read from its chunks as needed
+type Contents struct {
+	store Store
+	parts []part
+	ends  []uint64 // Offset of the end of each part
+	last  int      // Index of the part in blob
+	blob  []byte
+}
+
+// OpenContents returns the contents of a file by its content root
+func OpenContents(s Store, root Ref) (c *Contents, err error) {
+	blob, err := s.Get(root)
+	if err != nil {
+		return
+	}
+	var f fileSchema
+	blob, ok := untag(schemaBlob, blob)
+	if !ok || json.Unmarshal(blob, &f) != nil || f.Type != "file" {
+		return nil, fmt.Errorf("storage: %s is not a file schema", root)
+	}
+	c = &Contents{store: s, parts: f.Parts, last: -1}
+	var end uint64
+	for _, p := range f.Parts {
+		end += p.Size
+		c.ends = append(c.ends, end)
+	}
+	return
+}
+
+func (c *Contents) Size() uint64 {
+	if len(c.ends) == 0 {
+		return 0
+	}
+	return c.ends[len(c.ends)-1]
+}
+
+// ReadAt reads the contents at an offset.  It is not safe for concurrent
+// use.
+func (c *Contents) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("storage: negative offset")
+	}
+	pos := uint64(off)
+	for n < len(b) {
+		i := sort.Search(len(c.ends), func(i int) bool { return c.ends[i] > pos })
+		if i == len(c.ends) {
+			return n, io.EOF
+		}
+		if i != c.last {
+			blob, err := c.store.Get(c.parts[i].Ref)
+			if err != nil {
+				return n, err
+			}
+			blob, ok := untag(chunkBlob, blob)
+			if !ok {
+				return n, fmt.Errorf("storage: %s is not a chunk", c.parts[i].Ref)
+			}
+			if uint64(len(blob)) != c.parts[i].Size {
+				return n, fmt.Errorf("storage: chunk %s has the wrong size", c.parts[i].Ref)
+			}
+			c.last, c.blob = i, blob
+		}
+		start := c.ends[i] - c.parts[i].Size
+		k := copy(b[n:], c.blob[pos-start:])
+		n += k
+		pos += uint64(k)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+)
+
+// A Claim binds a name to a content root at a version.  A signed claim
+// holds its signer's public key, and a signature over the claim without it.
+type Claim struct {
+	Type      string            `json:"type"` // Always "claim"
+	Name      string            `json:"name"`
+	Version   uint64            `json:"version"`
+	Root      Ref               `json:"root"`
+	Signer    ed25519.PublicKey `json:"signer,omitempty"`
+	Signature []byte            `json:"signature,omitempty"`
+}
+
+// signed returns the bytes a claim's signature is over
+func (c Claim) signed() ([]byte, error) {
+	c.Signature = nil
+	return json.Marshal(c)
+}
+
+func (c *Claim) sign(key ed25519.PrivateKey) error {
+	c.Signer = key.Public().(ed25519.PublicKey)
+	b, err := c.signed()
+	if err != nil {
+		return err
+	}
+	c.Signature = ed25519.Sign(key, b)
+	return nil
+}
+
+// verify reports whether the claim is to be believed: whether it is signed
+// by the key, or unsigned if there is none
+func (c *Claim) verify(key ed25519.PrivateKey) bool {
+	if key == nil {
+		return c.Signer == nil
+	}
+	if !bytes.Equal(c.Signer, key.Public().(ed25519.PublicKey)) {
+		return false
+	}
+	b, err := c.signed()
+	return err == nil && ed25519.Verify(c.Signer, b, c.Signature)
+}
+
+// parseClaim returns the claim of a blob, or nil if it is not one
+func parseClaim(blob []byte) *Claim {
+	blob, ok := untag(schemaBlob, blob)
+	// Claims are small, so there is no need to parse larger blobs
+	if !ok || len(blob) > 4096 || !bytes.Contains(blob, []byte(`"claim"`)) {
+		return nil
+	}
+	c := new(Claim)
+	if json.Unmarshal(blob, c) != nil || c.Type != "claim" {
+		return nil
+	}
+	return c
+}
+
+// supersedes reports whether claim c replaces d for their name
+func (c *Claim) supersedes(d *Claim, cref, dref Ref) bool {
+	if d == nil || c.Version != d.Version {
+		return d == nil || c.Version > d.Version
+	}
+	// Claims of equal versions are ordered by their refs, so that every
+	// reader agrees
+	return cref > dref
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vvanpo/system/lang/lib/os/file"
+	"github.com/vvanpo/system/lang/lib/os/fileserver"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Storage holds named files in a store.  Each name is an absolute path,
+// and directories are implied by the names beneath them.
+type Storage struct {
+	store Store
+	key   ed25519.PrivateKey
+	mu    sync.Mutex
+	names map[string]current
+	open  map[string]*openFile
+}
+
+// The current claim of a name
+type current struct {
+	claim *Claim
+	ref   Ref
+}
+
+// A file open by at least one handle, whose contents are claimed once the
+// last handle closes if they were changed
+type openFile struct {
+	*file.File
+	name    string
+	handles int
+	mu      sync.Mutex
+	dirty   bool
+}
+
+type handle struct {
+	*openFile
+	s      *Storage
+	closed chan struct{}
+	once   sync.Once
+}
+
+var (
+	errNotExist = errors.New("file does not exist")
+	errExist    = errors.New("file exists")
+)
+
+// New returns the storage of a store, reading the claims it holds.  Claims
+// are signed by the key, unless it is nil.
+func New(store Store, key ed25519.PrivateKey) (s *Storage, err error) {
+	s = &Storage{
+		store: store,
+		key:   key,
+		names: make(map[string]current),
+		open:  make(map[string]*openFile),
+	}
+	err = store.Enumerate(func(r Ref) error {
+		blob, err := store.Get(r)
+		if err != nil {
+			return err
+		}
+		if c := parseClaim(blob); c != nil && c.verify(key) {
+			s.believe(c, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *Storage) believe(c *Claim, r Ref) {
+	name := path.Clean("/" + c.Name)
+	if cur := s.names[name]; c.supersedes(cur.claim, r, cur.ref) {
+		s.names[name] = current{c, r}
+	}
+}
+
+// Names returns the names of the files, sorted
+func (s *Storage) Names() (names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Resolve returns the current content root of a name
+func (s *Storage) Resolve(name string) (Ref, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.names[path.Clean("/"+name)]
+	if !ok {
+		return "", errNotExist
+	}
+	return cur.claim.Root, nil
+}
+
+// ReadFile returns the current contents of a name
+func (s *Storage) ReadFile(name string) ([]byte, error) {
+	root, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := OpenContents(s.store, root)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, c.Size())
+	if _, err := c.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile stores data and claims it as the contents of a name
+func (s *Storage) WriteFile(name string, data []byte) error {
+	root, err := WriteContents(s.store, data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.claim(path.Clean("/"+name), root)
+}
+
+// claim binds a name to a content root at the next version
+func (s *Storage) claim(name string, root Ref) error {
+	c := &Claim{Type: "claim", Name: name, Version: 1, Root: root}
+	if cur, ok := s.names[name]; ok {
+		c.Version = cur.claim.Version + 1
+	}
+	if s.key != nil {
+		if err := c.sign(s.key); err != nil {
+			return err
+		}
+	}
+	blob, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	r, err := s.store.Put(tag(schemaBlob, blob))
+	if err != nil {
+		return err
+	}
+	s.believe(c, r)
+	return nil
+}
+
+func (s *Storage) Walk(p string) (exists bool, err error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return true, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.names {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Storage) List(dir string) (names []string, err error) {
+	dir = path.Clean("/" + dir)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for name := range s.names {
+		rel := strings.TrimPrefix(name, dir)
+		if dir != "/" {
+			if rel == name || rel == "" || rel[0] != '/' {
+				continue
+			}
+			rel = rel[1:]
+		}
+		if i := strings.Index(rel, "/"); i >= 0 {
+			rel = rel[:i]
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Create claims an empty file
+func (s *Storage) Create(p string) error {
+	if exists, _ := s.Walk(p); exists {
+		return errExist
+	}
+	return s.WriteFile(p, nil)
+}
+
+// Open returns a handle of a file.  The handles of a name share its
+// contents, which are claimed once the last closes.
+func (s *Storage) Open(p string) (fileserver.File, error) {
+	name := path.Clean("/" + p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.open[name]
+	if !ok {
+		cur, ok := s.names[name]
+		if !ok {
+			return nil, errNotExist
+		}
+		c, err := OpenContents(s.store, cur.claim.Root)
+		if err != nil {
+			return nil, err
+		}
+		f = &openFile{File: file.Open(c, c.Size()), name: name}
+		s.open[name] = f
+	}
+	f.handles++
+	return &handle{openFile: f, s: s, closed: make(chan struct{})}, nil
+}
+
+func (h *handle) Write(offset uint64, data []byte) error {
+	h.changed()
+	return h.File.Write(offset, data)
+}
+
+func (h *handle) Insert(offset uint64, data []byte) error {
+	h.changed()
+	return h.File.Insert(offset, data)
+}
+
+func (h *handle) Remove(offset, length uint64) error {
+	h.changed()
+	return h.File.Remove(offset, length)
+}
+
+func (h *handle) Wait(length uint64) (uint64, error) {
+	return h.File.Wait(length, h.closed)
+}
+
+func (h *handle) changed() {
+	h.mu.Lock()
+	h.dirty = true
+	h.mu.Unlock()
+}
+
+// Close ends the waits of the handle, and claims the changed contents of
+// the file if it is the last open
+func (h *handle) Close() (err error) {
+	h.once.Do(func() {
+		close(h.closed)
+		s := h.s
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if h.handles--; h.handles > 0 {
+			return
+		}
+		delete(s.open, h.name)
+		if !h.dirty {
+			return
+		}
+		data, err1 := h.Bytes()
+		if err1 != nil {
+			err = fmt.Errorf("storage: %s: %v", h.name, err1)
+			return
+		}
+		root, err1 := WriteContents(s.store, data)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		err = s.claim(h.name, root)
+	})
+	return
+}
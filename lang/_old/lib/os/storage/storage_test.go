@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/system/lang/lib/os/fileserver"
+)
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func openDir(t *testing.T) *Dir {
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func count(d *Dir) (n int) {
+	d.Enumerate(func(Ref) error {
+		n++
+		return nil
+	})
+	return
+}
+
+func TestChunks(t *testing.T) {
+	data := random(1 << 20)
+	cs := chunks(data)
+	if !bytes.Equal(bytes.Join(cs, nil), data) {
+		t.Fatal("chunks do not join to the data")
+	}
+	for i, c := range cs {
+		if len(c) > maxChunk || len(c) < minChunk && i != len(cs)-1 {
+			t.Errorf("chunk %d of %d bytes", i, len(c))
+		}
+	}
+
+	// An insertion changes only the chunks around it
+	d := openDir(t)
+	if _, err := WriteContents(d, data); err != nil {
+		t.Fatal(err)
+	}
+	before := count(d)
+	edited := append(append(append([]byte{}, data[:1<<19]...), "inserted"...), data[1<<19:]...)
+	root, err := WriteContents(d, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// At most two new chunks, and a new file schema
+	if n := count(d) - before; n > 3 {
+		t.Errorf("%d new blobs of %d", n, before)
+	}
+	c, err := OpenContents(d, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, c.Size())
+	if _, err := c.ReadAt(got, 0); err != nil || !bytes.Equal(got, edited) {
+		t.Errorf("read back %d bytes, %v", len(got), err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	d := openDir(t)
+	_, key, _ := ed25519.GenerateKey(rand.New(rand.NewSource(2)))
+	s, err := New(d, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := random(100000)
+	if err := s.WriteFile("/a/data", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Through the file server, changes are claimed once the file closes
+	c := fileserver.Connect(s)
+	defer c.Close()
+	f, err := c.Open("/a/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Insert(0, []byte("head"))
+	f.Remove(10, 5)
+	if got, _ := s.ReadFile("/a/data"); !bytes.Equal(got, data) {
+		t.Error("changes claimed before the file closed")
+	}
+	f.Close()
+	want := append([]byte("head"), data...)
+	want = append(want[:10], want[15:]...)
+	if got, err := s.ReadFile("/a/data"); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes after the edit, %v", len(got), err)
+	}
+	if err := c.Create("/b/new"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := c.List("/"); err != nil || strings.Join(names, " ") != "a b" {
+		t.Errorf("list /: got %q, %v", names, err)
+	}
+
+	// The claims are read back from the store, and only with their key
+	s, err = New(d, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadFile("/a/data"); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes after reopening, %v", len(got), err)
+	}
+	if names := s.Names(); strings.Join(names, " ") != "/a/data /b/new" {
+		t.Errorf("names %q", names)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.New(rand.NewSource(3)))
+	for _, k := range []ed25519.PrivateKey{other, nil} {
+		s, err := New(d, k)
+		if err != nil || len(s.Names()) != 0 {
+			t.Errorf("believed %q, %v", s.Names(), err)
+		}
+	}
+}
+
+// A file whose contents are a claim is not taken for one, even unsigned
+func TestForgedClaim(t *testing.T) {
+	d := openDir(t)
+	s, err := New(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFile("/secret", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := WriteContents(d, []byte("pwned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := json.Marshal(Claim{Type: "claim", Name: "/secret", Version: 99, Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With and without the tag of a schema blob
+	for i, contents := range [][]byte{forged, tag(schemaBlob, forged)} {
+		c := fileserver.Connect(s)
+		if err := c.Create("/upload"); err != nil && i == 0 {
+			t.Fatal(err)
+		}
+		f, err := c.Open("/upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Write(0, contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	s, err = New(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadFile("/secret"); string(got) != "secret" || err != nil {
+		t.Errorf("read /secret as %q, %v", got, err)
+	}
+}